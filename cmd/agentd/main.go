@@ -1,25 +1,65 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/oarkflow/container/pkg/isolate/agent"
 )
 
 func main() {
-	unixPath := flag.String("unix", "", "Unix domain socket path to listen on")
+	// Must run first: when re-executed as an exec init helper this sets up
+	// the child's namespaces and never returns.
+	agent.RunExecInit()
+
+	unixPath := flag.String("unix", "", "Unix domain socket path to listen on; @name binds name in the abstract namespace (Linux only)")
 	vsockPort := flag.Uint("vsock-port", 0, "AF_VSOCK port to listen on (Linux guests)")
+	tcpAddr := flag.String("tcp", "", "TCP address to listen on, e.g. :7000 (use with -tls-cert outside trusted networks)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate served to TCP clients; enables TLS (requires -tcp and -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key for -tls-cert")
+	clientCA := flag.String("client-ca", "", "PEM CA bundle TCP clients' certificates must chain to; clients without one are rejected (requires -tls-cert)")
 	chunkSize := flag.Int("chunk", 32*1024, "Chunk size for stdout/stderr streaming")
 	maxBuffer := flag.Int("max-buffer", 4*1024*1024, "Maximum bytes to retain per stream in the final result")
 	rootDir := flag.String("root", "", "Root directory to restrict all operations to (for isolation)")
 	useChroot := flag.Bool("chroot", true, "Use chroot for OS-level isolation (requires root on Unix, enabled by default)")
 	noChroot := flag.Bool("no-chroot", false, "Disable chroot isolation (INSECURE - only for development)")
+	isolation := flag.String("isolation", "", "Isolation mode: none, chroot or namespaces (default: chroot when -chroot applies, else none)")
+	forcePath := flag.String("force-path", "", "Fixed PATH for executed commands; overrides any PATH sent by clients")
+	maxTransfers := flag.Int("max-transfers", 0, "Maximum concurrent file transfers (0 = unlimited)")
+	maxConcurrent := flag.Int("max-concurrent", 0, "Maximum connections served at once; more are refused as busy (0 = unlimited, 256 recommended)")
+	maxBuffered := flag.Int64("max-buffered-bytes", 0, "Total result buffer memory reserved across concurrent execs (0 = unlimited)")
+	logRetention := flag.Duration("exec-log-retention", 0, "Keep each exec's last -max-buffer bytes of output this long after it finishes for clients to replay (0 = off)")
+	maxArgs := flag.Int("max-args", 0, "Maximum exec argument count (0 = default, -1 = unlimited)")
+	maxArgBytes := flag.Int("max-arg-bytes", 0, "Maximum total exec argument size in bytes (0 = default, -1 = unlimited)")
+	allowLogs := flag.Bool("allow-log-subscribe", false, "Allow clients to tail the agent log over the transport")
+	logToken := flag.String("log-token", "", "Token log subscribers must present (requires -allow-log-subscribe)")
+	allowWebhooks := flag.Bool("allow-webhooks", false, "Allow execs to POST their result to a completion URL (needs outbound network)")
+	webhookSecret := flag.String("webhook-secret", "", "HMAC secret used to sign completion webhooks (requires -allow-webhooks)")
+	compression := flag.String("compression", "none", "Compress exec output for clients that accept it: none or gzip")
+	memoryLimit := flag.Int64("memory-limit", 0, "Memory limit in bytes for each exec, enforced with cgroups v2 (0 = unlimited, Linux only)")
+	cpuQuota := flag.Float64("cpu-quota", 0, "CPUs each exec may use, e.g. 0.5, enforced with cgroups v2 (0 = unlimited, Linux only)")
+	cgroupParent := flag.String("cgroup-parent", "", "Cgroup v2 directory exec cgroups are created under (default /sys/fs/cgroup/agentd)")
+	seccompProfile := flag.String("seccomp", "", "Seccomp profile applied to every exec: default, strict or the path of a Docker/OCI JSON profile (Linux only)")
+	egressNetwork := flag.String("egress-network", "", "IPv4 network the links of execs with egress rules are numbered from (default 10.254.0.0/16; Linux root only)")
+	envAllow := flag.String("env-allow", "", "Comma-separated environment keys execs may see, e.g. PATH,HOME,LANG_* (empty = all)")
+	envDeny := flag.String("env-deny", "", "Comma-separated environment keys removed from every exec, e.g. AWS_*,*_TOKEN")
+	readBuffer := flag.Int("read-buffer", 0, "Socket receive buffer size in bytes for accepted connections (0 = kernel default)")
+	writeBuffer := flag.Int("write-buffer", 0, "Socket send buffer size in bytes for accepted connections (0 = kernel default)")
+	idleTimeout := flag.Duration("idle-timeout", 0, "Exit after this long without a connection, client traffic or a running exec, e.g. 5m (0 = never)")
+	metricsAddr := flag.String("metrics", "", "HTTP address to serve Prometheus metrics on at /metrics, e.g. :9100 (empty = off)")
+	oneshot := flag.Bool("oneshot", false, "Serve exactly one connection, then exit and remove the socket")
 	flag.Parse()
 
 	// Override chroot if explicitly disabled
@@ -27,13 +67,24 @@ func main() {
 		*useChroot = false
 	}
 
-	if *unixPath == "" && *vsockPort == 0 {
-		fmt.Fprintln(os.Stderr, "agentd requires -unix or -vsock-port")
+	if *unixPath == "" && *vsockPort == 0 && *tcpAddr == "" {
+		fmt.Fprintln(os.Stderr, "agentd requires -unix, -vsock-port or -tcp")
 		os.Exit(1)
 	}
 
 	logger := log.New(os.Stdout, "[agentd] ", log.LstdFlags)
 
+	tlsConfig, err := serverTLSConfig(*tlsCert, *tlsKey, *clientCA)
+	if err != nil {
+		logger.Fatalf("tls: %v", err)
+	}
+	if tlsConfig != nil && *tcpAddr == "" {
+		logger.Fatalf("tls: -tls-cert requires -tcp")
+	}
+	if *tcpAddr != "" && tlsConfig == nil {
+		logger.Println("WARNING: -tcp without -tls-cert serves unauthenticated plaintext connections!")
+	}
+
 	// Warn about chroot requirements
 	if *useChroot && *rootDir == "" {
 		logger.Println("warning: -chroot specified but -root not set, chroot will not be used")
@@ -41,7 +92,7 @@ func main() {
 	}
 
 	// Warn if chroot is disabled
-	if !*useChroot && *rootDir != "" {
+	if !*useChroot && *rootDir != "" && agent.IsolationMode(*isolation) != agent.IsolationNamespaces {
 		logger.Println("WARNING: chroot isolation is DISABLED - this is INSECURE for untrusted code!")
 		logger.Println("WARNING: Scripts can escape the root directory restriction!")
 		logger.Println("WARNING: Only use --no-chroot for development with trusted code!")
@@ -53,24 +104,49 @@ func main() {
 		Logger:          logger,
 		RootDir:         *rootDir,
 		UseChrootIfRoot: *useChroot,
+		IsolationMode:   agent.IsolationMode(*isolation),
 		AllowInsecure:   !*useChroot, // Allow insecure mode when chroot is disabled
+		ForcePATH:       *forcePath,
+
+		MaxConcurrentTransfers: *maxTransfers,
+		MaxConcurrent:          *maxConcurrent,
+		MaxBufferedBytes:       *maxBuffered,
+		ExecLogRetention:       *logRetention,
+		IdleTimeout:            *idleTimeout,
+		MaxArgs:                *maxArgs,
+		MaxArgBytes:            *maxArgBytes,
+		AllowLogSubscribe:      *allowLogs,
+		LogSubscribeToken:      *logToken,
+		AllowWebhooks:          *allowWebhooks,
+		WebhookSecret:          *webhookSecret,
+		Compression:            agent.Compression(*compression),
+		MemoryLimitBytes:       *memoryLimit,
+		CPUQuota:               *cpuQuota,
+		CgroupParent:           *cgroupParent,
+		SeccompProfile:         *seccompProfile,
+		EgressNetwork:          *egressNetwork,
+		EnvAllowlist:           splitList(*envAllow),
+		EnvDenylist:            splitList(*envDeny),
+		TLSConfig:              tlsConfig,
 	})
 
 	listeners := make([]net.Listener, 0, 2)
 
+	abstract := strings.HasPrefix(*unixPath, "@")
 	if *unixPath != "" {
-		_ = os.Remove(*unixPath)
-		ln, err := net.Listen("unix", *unixPath)
+		var ln net.Listener
+		var err error
+		if abstract {
+			ln, err = agent.ListenAbstract(*unixPath)
+		} else {
+			_ = os.Remove(*unixPath)
+			ln, err = net.Listen("unix", *unixPath)
+		}
 		if err != nil {
 			logger.Fatalf("listen unix: %v", err)
 		}
-		listeners = append(listeners, ln)
+		listeners = append(listeners, agent.WithBufferSizes(ln, *readBuffer, *writeBuffer))
 		logger.Printf("listening on unix socket %s", *unixPath)
-		go func() {
-			if err := srv.Serve(ln); err != nil {
-				logger.Printf("unix listener error: %v", err)
-			}
-		}()
 	}
 
 	if *vsockPort != 0 {
@@ -78,25 +154,157 @@ func main() {
 		if err != nil {
 			logger.Fatalf("listen vsock: %v", err)
 		}
-		listeners = append(listeners, ln)
+		listeners = append(listeners, agent.WithBufferSizes(ln, *readBuffer, *writeBuffer))
 		logger.Printf("listening on vsock port %d", *vsockPort)
-		go func() {
-			if err := srv.Serve(ln); err != nil {
-				logger.Printf("vsock listener error: %v", err)
-			}
-		}()
+	}
+
+	if *tcpAddr != "" {
+		ln, err := agent.ListenTCP(*tcpAddr)
+		if err != nil {
+			logger.Fatalf("listen tcp: %v", err)
+		}
+		listeners = append(listeners, agent.WithBufferSizes(ln, *readBuffer, *writeBuffer))
+		switch {
+		case tlsConfig != nil && tlsConfig.ClientCAs != nil:
+			logger.Printf("listening on tcp %s with tls, requiring client certificates", ln.Addr())
+		case tlsConfig != nil:
+			logger.Printf("listening on tcp %s with tls", ln.Addr())
+		default:
+			logger.Printf("listening on tcp %s", ln.Addr())
+		}
+	}
+
+	if *metricsAddr != "" {
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			logger.Fatalf("listen metrics: %v", err)
+		}
+		go serveMetrics(srv, ln, logger)
+		logger.Printf("serving metrics on http://%s/metrics", ln.Addr())
+	}
+
+	done := make(chan struct{})
+	if *oneshot {
+		go serveOnce(srv, listeners, logger, done)
+	} else {
+		for _, ln := range listeners {
+			go func(ln net.Listener) {
+				if err := srv.Serve(ln); err != nil && !errors.Is(err, agent.ErrServerClosed) {
+					logger.Printf("%s listener error: %v", ln.Addr().Network(), err)
+				}
+			}(ln)
+		}
 	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
-	logger.Println("shutting down")
+	select {
+	case <-sigCh:
+		logger.Println("shutting down")
+	case <-done:
+		logger.Println("oneshot connection finished, exiting")
+	case <-srv.Done():
+	}
 
 	for _, ln := range listeners {
 		_ = ln.Close()
 	}
 
-	if *unixPath != "" {
+	if *unixPath != "" && !abstract {
 		_ = os.Remove(*unixPath)
 	}
 }
+
+// serveOnce accepts the first connection on any listener, stops accepting on
+// all of them, serves that connection to completion and then closes done.
+func serveOnce(srv *agent.Server, listeners []net.Listener, logger *log.Logger, done chan<- struct{}) {
+	defer close(done)
+
+	accepted := make(chan net.Conn, len(listeners))
+	var accepting sync.WaitGroup
+	for _, ln := range listeners {
+		accepting.Add(1)
+		go func(ln net.Listener) {
+			defer accepting.Done()
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}(ln)
+	}
+	// Every accept ends once the listeners are closed, and with them the
+	// refusal of late connections below.
+	go func() {
+		accepting.Wait()
+		close(accepted)
+	}()
+
+	conn := <-accepted
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+	// A connection that raced in on another listener is refused.
+	go func() {
+		for extra := range accepted {
+			_ = extra.Close()
+		}
+	}()
+
+	logger.Printf("serving oneshot connection from %s", conn.RemoteAddr())
+	srv.ServeConn(conn)
+}
+
+// serveMetrics serves srv's metrics over HTTP on ln until ln is closed.
+func serveMetrics(srv *agent.Server, ln net.Listener, logger *log.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", srv.MetricsHandler())
+	httpSrv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := httpSrv.Serve(ln); err != nil {
+		logger.Printf("metrics listener error: %v", err)
+	}
+}
+
+// serverTLSConfig builds the TLS config for TCP connections from the -tls-*
+// flags, or returns nil when TLS is off. With a client CA, clients must
+// present a certificate it signed.
+func serverTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("-client-ca requires -tls-cert and -tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
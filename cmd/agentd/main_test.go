@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain runs agentd itself when a test re-executes the test binary with
+// AGENTD_TEST_MAIN set, passing it the remaining arguments.
+func TestMain(m *testing.M) {
+	if os.Getenv("AGENTD_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestOneshotExitsAfterOneConnection(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	cmd := exec.Command(os.Args[0], "-oneshot", "-no-chroot", "-unix", sock)
+	cmd.Env = append(os.Environ(), "AGENTD_TEST_MAIN=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var err error
+		if conn, err = net.Dial("unix", sock); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("agentd never listened: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The connection is served, and agentd keeps running, until it closes.
+	select {
+	case err := <-exited:
+		t.Fatalf("agentd exited while serving its connection: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if late, err := net.Dial("unix", sock); err == nil {
+		late.Close()
+		t.Error("agentd accepted a second connection")
+	}
+	conn.Close()
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("agentd exited with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("agentd still running after its connection closed")
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -41,18 +42,28 @@ func run() int {
 	memory := flag.Int64("memory", 512*1024*1024, "Memory in bytes")
 	cpus := flag.Int("cpus", 2, "Number of vCPUs")
 	devMode := flag.Bool("dev", false, "Use loopback agent for local testing (executes on host)")
-	agentUnix := flag.String("agent-unix", "", "Path to a Unix socket (default: ~/.container/agent.sock)")
+	agentUnix := flag.String("agent-unix", "", "Path to a Unix socket, or @name for an abstract one on Linux (default: ~/.container/agent.sock)")
 	autoAgent := flag.Bool("auto-agent", true, "Automatically start/manage agent daemon")
 	noAgent := flag.Bool("no-agent", false, "Disable agent mode and use full VM (requires --image)")
-	agentVsockCID := flag.Uint("agent-vsock-cid", 3, "vsock CID for the guest (Linux only)")
-	agentVsockPort := flag.Uint("agent-vsock-port", 0, "vsock port for the guest agent (requires CID)")
+	agentVsockCID := flag.Uint("agent-vsock-cid", 0, "vsock CID for the guest (Linux only; 0 lets the runtime allocate one)")
+	agentVsockPort := flag.Uint("agent-vsock-port", 0, "vsock port for the guest agent (0 uses the runtime default)")
 	rootDir := flag.String("root", "", "Root directory for agent isolation (default: current directory)")
 	workdir := flag.String("workdir", "/workspace", "Guest working directory (used with --root)")
 	cmdFlag := flag.String("cmd", "", "Command to execute as a shell command (not recommended with isolated agent)")
+	noTTY := flag.Bool("no-tty", false, "Do not allocate a guest terminal even when stdin is one")
+	noStdin := flag.Bool("no-stdin", false, "Do not forward stdin to the command when it is not a terminal")
+	grace := flag.Duration("grace", 5*time.Second, "How long an interrupted guest command may take to exit before it is killed")
+	streamOutput := flag.Bool("stream", false, "Write the command's output as it is produced instead of once it exits")
+	output := flag.String("output", "text", "Output format: text, or json to print status, stats and the exec summary as one JSON document on stdout")
 	flag.Parse()
 
 	if *listRuntimes {
 		describeRuntimes()
+		socket := *agentUnix
+		if socket == "" {
+			socket = getDefaultSocketPath()
+		}
+		describeAgent(ctx, socket)
 		return 0
 	}
 
@@ -66,6 +77,12 @@ func run() int {
 		return 1
 	}
 
+	out, err := newReport(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
 	// Set default socket path if not provided (unless explicitly disabled)
 	if *agentUnix == "" && !*noAgent {
 		*agentUnix = getDefaultSocketPath()
@@ -87,7 +104,9 @@ func run() int {
 	// Start agent manager if auto-agent is enabled
 	var agentMgr *isolate.AgentManager
 	if *autoAgent && usingDirectAgent && *agentVsockPort == 0 {
-		agentMgr = isolate.NewAgentManager(*agentUnix, agentRootDir)
+		// isolatectl is also run from a checkout with go run, where the
+		// agent may not be built yet.
+		agentMgr = isolate.NewAgentManagerWithOptions(*agentUnix, agentRootDir, isolate.AgentManagerOptions{AllowGoRun: true})
 		if err := agentMgr.Start(ctx); err != nil {
 			fmt.Fprintf(os.Stderr, "warning: failed to start agent: %v\n", err)
 			fmt.Fprintln(os.Stderr, "continuing without auto-managed agent...")
@@ -97,9 +116,22 @@ func run() int {
 		}
 	}
 
+	// Interactive sessions get a terminal in the guest. The loopback agent
+	// used by dev mode cannot allocate one, and a terminal would write
+	// straight to stdout, which JSON output reserves for the document.
+	stdinIsTerminal := isTerminal(int(os.Stdin.Fd()))
+	useTTY := !*noTTY && !*devMode && !out.jsonOutput && stdinIsTerminal
+
+	// Piped or redirected input is forwarded to the command, which sees EOF
+	// when it ends; a terminal is only forwarded through a guest terminal.
+	var stdin io.Reader
+	if !useTTY && !stdinIsTerminal && !*noStdin {
+		stdin = os.Stdin
+	}
+
 	// If using direct agent mode, execute directly without creating a VM
 	if usingDirectAgent {
-		return runDirectAgent(ctx, *agentUnix, agentRootDir, *cmdFlag, flag.Args())
+		return runDirectAgent(ctx, *agentUnix, agentRootDir, *cmdFlag, flag.Args(), useTTY, *streamOutput, *grace, stdin, out)
 	}
 
 	manager, err := isolate.NewDefaultManager()
@@ -108,14 +140,17 @@ func run() int {
 		return 1
 	}
 
-	name := fmt.Sprintf("job-%d", time.Now().UnixNano())
+	name := manager.GenerateName("job")
 	metadata := map[string]string{}
 	if *agentUnix != "" {
-		metadata["agent.unix"] = *agentUnix
+		metadata[runtimectl.MetadataAgentUnix] = *agentUnix
+	}
+	// Unset vsock values are filled in by runtimes that allocate guest CIDs.
+	if *agentVsockCID != 0 {
+		metadata[runtimectl.MetadataAgentVsockCID] = fmt.Sprintf("%d", *agentVsockCID)
 	}
 	if *agentVsockPort != 0 {
-		metadata["agent.vsock.cid"] = fmt.Sprintf("%d", *agentVsockCID)
-		metadata["agent.vsock.port"] = fmt.Sprintf("%d", *agentVsockPort)
+		metadata[runtimectl.MetadataAgentVsockPort] = fmt.Sprintf("%d", *agentVsockPort)
 	}
 
 	// Resolve root directory to absolute path if provided
@@ -196,48 +231,60 @@ func run() int {
 	}
 
 	command := &isolate.Command{
-		Path: cmdPath,
-		Args: cmdArgs,
-		Env:  map[string]string{},
+		Path:  cmdPath,
+		Args:  cmdArgs,
+		Env:   map[string]string{},
+		Stdin: stdin,
 	}
 	if cfg.WorkingDir != "" {
 		command.WorkingDir = cfg.WorkingDir
 	}
 
-	result, err := container.Exec(ctx, command)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
-		return 1
-	}
-
-	if len(result.Stdout) > 0 {
-		if _, err := os.Stdout.Write(result.Stdout); err != nil {
-			fmt.Fprintf(os.Stderr, "write stdout: %v\n", err)
+	var exitCode int
+	if useTTY {
+		exitCode, err = runTTY(ctx, command, container.ExecStream, *grace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
+			return 1
 		}
-	}
-	if len(result.Stderr) > 0 {
-		if _, err := os.Stderr.Write(result.Stderr); err != nil {
-			fmt.Fprintf(os.Stderr, "write stderr: %v\n", err)
+	} else if *streamOutput {
+		summary, err := runStream(ctx, command, container.ExecStream, *grace, out.stdout())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
+			return 1
+		}
+		out.streamed(summary)
+		exitCode = summary.ExitCode
+	} else {
+		result, err := container.Exec(ctx, command)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
+			return 1
 		}
+		out.result(result)
+		exitCode = result.ExitCode
 	}
 
 	if status, err := container.Status(ctx); err == nil {
-		printStatus(status)
+		out.status(status)
 	} else {
 		fmt.Fprintf(os.Stderr, "failed to fetch status: %v\n", err)
 	}
 
 	if stats, err := container.Stats(ctx); err == nil {
-		printStats(stats)
+		out.stats(stats)
 	} else {
 		fmt.Fprintf(os.Stderr, "failed to fetch stats: %v\n", err)
 	}
 
-	return result.ExitCode
+	if err := out.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "write output: %v\n", err)
+	}
+	return exitCode
 }
 
 // runDirectAgent executes a command directly via the agent without creating a VM
-func runDirectAgent(ctx context.Context, socketPath, rootDir, cmdFlag string, positionalArgs []string) int {
+func runDirectAgent(ctx context.Context, socketPath, rootDir, cmdFlag string, positionalArgs []string, useTTY, streamOutput bool, grace time.Duration, stdin io.Reader, out *report) int {
 	// Connect to agent
 	client := isolate.NewAgentClient(socketPath)
 
@@ -264,9 +311,32 @@ func runDirectAgent(ctx context.Context, socketPath, rootDir, cmdFlag string, po
 		Path:       cmdPath,
 		Args:       cmdArgs,
 		Env:        map[string]string{},
+		Stdin:      stdin,
 		WorkingDir: rootDir,
 	}
 
+	if useTTY {
+		exitCode, err := runTTY(ctx, command, client.ExecStream, grace)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
+			return 1
+		}
+		return exitCode
+	}
+
+	if streamOutput {
+		summary, err := runStream(ctx, command, client.ExecStream, grace, out.stdout())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "exec failed: %v\n", err)
+			return 1
+		}
+		out.streamed(summary)
+		if err := out.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "write output: %v\n", err)
+		}
+		return summary.ExitCode
+	}
+
 	// Execute command
 	result, err := client.Exec(ctx, command)
 	if err != nil {
@@ -274,9 +344,18 @@ func runDirectAgent(ctx context.Context, socketPath, rootDir, cmdFlag string, po
 		return 1
 	}
 
-	// Write output
+	out.result(result)
+	if err := out.flush(); err != nil {
+		fmt.Fprintf(os.Stderr, "write output: %v\n", err)
+	}
+	return result.ExitCode
+}
+
+// writeResult copies the command's captured stdout to stdout and its stderr
+// to os.Stderr.
+func writeResult(result *isolate.Result, stdout io.Writer) {
 	if len(result.Stdout) > 0 {
-		if _, err := os.Stdout.Write(result.Stdout); err != nil {
+		if _, err := stdout.Write(result.Stdout); err != nil {
 			fmt.Fprintf(os.Stderr, "write stdout: %v\n", err)
 		}
 	}
@@ -285,8 +364,97 @@ func runDirectAgent(ctx context.Context, socketPath, rootDir, cmdFlag string, po
 			fmt.Fprintf(os.Stderr, "write stderr: %v\n", err)
 		}
 	}
+	printTruncation("stdout", result.StdoutTruncated, dropped(result.StdoutTotalBytes, len(result.Stdout)))
+	printTruncation("stderr", result.StderrTruncated, dropped(result.StderrTotalBytes, len(result.Stderr)))
+}
 
-	return result.ExitCode
+// printTruncation notes on os.Stderr that an output limit cut stream short.
+// Agents too old to count the output report no dropped bytes.
+func printTruncation(stream string, truncated bool, droppedBytes int64) {
+	switch {
+	case droppedBytes > 0:
+		fmt.Fprintf(os.Stderr, "[%s] (output truncated, %d bytes dropped)\n", stream, droppedBytes)
+	case truncated:
+		fmt.Fprintf(os.Stderr, "[%s] (output truncated)\n", stream)
+	}
+}
+
+// runTTY runs command on a guest terminal wired to this one, which is put in
+// raw mode for the duration, and returns the command's exit code.
+func runTTY(ctx context.Context, command *isolate.Command, start func(context.Context, *isolate.Command) (*isolate.Stream, error), grace time.Duration) (int, error) {
+	fd := int(os.Stdin.Fd())
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	command.Tty = true
+	command.Stdin = os.Stdin
+	command.TtySize = terminalSize(fd)
+	command.Resize = watchResize(ctx, fd)
+
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return 0, fmt.Errorf("set terminal raw mode: %w", err)
+	}
+	defer restore()
+
+	stream, err := start(ctx, command)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	defer forwardInterrupts(stream, grace)()
+
+	go func() {
+		for chunk := range stream.Stderr {
+			_, _ = os.Stderr.Write(chunk)
+		}
+	}()
+	for chunk := range stream.Stdout {
+		if _, err := os.Stdout.Write(chunk); err != nil {
+			return 0, fmt.Errorf("write stdout: %w", err)
+		}
+	}
+	result := <-stream.Done
+	if result == nil {
+		return 0, fmt.Errorf("agent connection lost")
+	}
+	return result.ExitCode, nil
+}
+
+// runStream runs command and writes its output to stdout and os.Stderr as it
+// arrives. It returns once the command has exited and both streams are
+// drained.
+func runStream(ctx context.Context, command *isolate.Command, start func(context.Context, *isolate.Command) (*isolate.Stream, error), grace time.Duration, stdout io.Writer) (*isolate.StreamSummary, error) {
+	stream, err := start(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	defer forwardInterrupts(stream, grace)()
+
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		for chunk := range stream.Stderr {
+			_, _ = os.Stderr.Write(chunk)
+		}
+	}()
+	var writeErr error
+	for chunk := range stream.Stdout {
+		// Keep draining after a failed write so the command is not blocked.
+		if writeErr == nil {
+			if _, err := stdout.Write(chunk); err != nil {
+				writeErr = fmt.Errorf("write stdout: %w", err)
+			}
+		}
+	}
+	<-stderrDone
+
+	summary := <-stream.Summary
+	if summary.Result == nil {
+		return nil, fmt.Errorf("agent connection lost")
+	}
+	return summary, writeErr
 }
 
 func describeRuntimes() {
@@ -303,6 +471,45 @@ func describeRuntimes() {
 	}
 }
 
+// describeAgent prints what the agent listening on socketPath reports about
+// itself, if one is reachable.
+func describeAgent(ctx context.Context, socketPath string) {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	client := isolate.NewAgentClient(socketPath)
+	defer client.Close()
+	info, err := client.Info(ctx)
+	if err != nil {
+		fmt.Printf("\nagent at %s: unavailable (%v)\n", socketPath, err)
+		return
+	}
+
+	isolation := "none"
+	switch {
+	case info.Namespaces:
+		isolation = "namespaces"
+	case info.Chroot:
+		isolation = "chroot"
+	}
+	fmt.Printf("\nagent at %s:\n", socketPath)
+	fmt.Printf("  version: %s (protocol %d)\n", info.Version, info.ProtocolVersion)
+	fmt.Printf("  platform: %s/%s\n", info.OS, info.Arch)
+	fmt.Printf("  isolation: %s\n", isolation)
+	if info.IsolationError != "" {
+		fmt.Printf("  not ready: %s\n", info.IsolationError)
+	}
+	fmt.Printf("  root: %s\n", valueOrDefault(info.RootDir, "unrestricted"))
+	fmt.Printf("  uptime: %s\n", info.Uptime.Truncate(time.Second))
+	if info.Connections > 0 {
+		limit := "unlimited"
+		if info.MaxConcurrent > 0 {
+			limit = fmt.Sprint(info.MaxConcurrent)
+		}
+		fmt.Printf("  connections: %d (limit %s)\n", info.Connections, limit)
+	}
+}
+
 func resolveCommand(cmdString string, positional []string) (string, []string) {
 	if cmdString != "" {
 		return shellCommandForHost(cmdString)
@@ -385,9 +592,16 @@ func printStats(stats *isolate.Stats) {
 	}
 
 	fmt.Fprintln(os.Stderr, "\n[resource metrics]")
-	fmt.Fprintf(os.Stderr, "  cpu: %.1f%%\n", stats.CPUPercent)
-	fmt.Fprintf(os.Stderr, "  memory: %s\n", formatBytes(stats.MemoryBytes))
+	estimated := ""
+	if stats.Estimated {
+		estimated = " (estimated)"
+	}
+	fmt.Fprintf(os.Stderr, "  cpu: %.1f%%%s\n", stats.CPUPercent, estimated)
+	fmt.Fprintf(os.Stderr, "  memory: %s%s\n", formatBytes(stats.MemoryBytes), estimated)
 	fmt.Fprintf(os.Stderr, "  disk: %s\n", formatBytes(stats.DiskBytes))
+	if stats.DiskReadBytes > 0 || stats.DiskWriteBytes > 0 {
+		fmt.Fprintf(os.Stderr, "  disk io: read=%s write=%s\n", formatBytes(stats.DiskReadBytes), formatBytes(stats.DiskWriteBytes))
+	}
 	fmt.Fprintf(os.Stderr, "  network rx: %s\n", formatBytes(stats.NetworkRxBytes))
 	fmt.Fprintf(os.Stderr, "  network tx: %s\n", formatBytes(stats.NetworkTxBytes))
 	if len(stats.Interfaces) > 0 {
@@ -403,15 +617,7 @@ func printStats(stats *isolate.Stats) {
 }
 
 func formatPortForward(pf runtimectl.PortForward) string {
-	proto := pf.Protocol
-	if proto == "" {
-		proto = runtimectl.PortProtocolTCP
-	}
-	hostIP := pf.HostIP
-	if hostIP == "" {
-		hostIP = "0.0.0.0"
-	}
-	desc := fmt.Sprintf("%s:%d -> %d/%s", hostIP, pf.HostPort, pf.GuestPort, proto)
+	desc := pf.String()
 	if pf.Description != "" {
 		desc = fmt.Sprintf("%s (%s)", desc, pf.Description)
 	}
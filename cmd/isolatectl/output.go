@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/oarkflow/container/pkg/isolate"
+)
+
+// report collects what isolatectl prints once the command has run. By
+// default that is the command's output followed by human readable status and
+// stats on stderr. With --output=json the status, stats and a summary of the
+// result are written to stdout as a single JSON document instead, and the
+// command's own output goes to stderr so it cannot corrupt the document.
+type report struct {
+	jsonOutput bool
+
+	Exec   *execReport     `json:"exec,omitempty"`
+	Status *isolate.Status `json:"status,omitempty"`
+	Stats  *isolate.Stats  `json:"stats,omitempty"`
+}
+
+type execReport struct {
+	ExitCode    int   `json:"exit_code"`
+	StdoutBytes int   `json:"stdout_bytes"`
+	StderrBytes int   `json:"stderr_bytes"`
+	DurationNS  int64 `json:"duration_ns"`
+	TimedOut    bool  `json:"timed_out,omitempty"`
+	// StdoutDropped and StderrDropped count output an output limit dropped.
+	StdoutDropped int64 `json:"stdout_dropped_bytes,omitempty"`
+	StderrDropped int64 `json:"stderr_dropped_bytes,omitempty"`
+}
+
+// newReport returns the report for an --output value.
+func newReport(format string) (*report, error) {
+	switch format {
+	case "", "text":
+		return &report{}, nil
+	case "json":
+		return &report{jsonOutput: true}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %q (want text or json)", format)
+}
+
+// stdout is where the command's stdout is written.
+func (r *report) stdout() io.Writer {
+	if r.jsonOutput {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// result writes the command's captured output and records its summary.
+func (r *report) result(result *isolate.Result) {
+	writeResult(result, r.stdout())
+	r.Exec = &execReport{
+		ExitCode:    result.ExitCode,
+		StdoutBytes: len(result.Stdout),
+		StderrBytes: len(result.Stderr),
+		DurationNS:  int64(result.Duration),
+		TimedOut:    result.TimedOut,
+
+		StdoutDropped: dropped(result.StdoutTotalBytes, len(result.Stdout)),
+		StderrDropped: dropped(result.StderrTotalBytes, len(result.Stderr)),
+	}
+}
+
+// dropped returns how many of total bytes written are missing from the kept
+// ones, or zero when the agent did not count them.
+func dropped(total int64, kept int) int64 {
+	return max(total-int64(kept), 0)
+}
+
+// streamed records the summary of a command whose output was streamed.
+func (r *report) streamed(summary *isolate.StreamSummary) {
+	r.Exec = &execReport{
+		ExitCode:    summary.ExitCode,
+		StdoutBytes: int(summary.StdoutBytes),
+		StderrBytes: int(summary.StderrBytes),
+		DurationNS:  int64(summary.Duration),
+		TimedOut:    summary.Result.TimedOut,
+	}
+}
+
+func (r *report) status(status *isolate.Status) {
+	if r.jsonOutput {
+		r.Status = status
+		return
+	}
+	printStatus(status)
+}
+
+func (r *report) stats(stats *isolate.Stats) {
+	if r.jsonOutput {
+		r.Stats = stats
+		return
+	}
+	printStats(stats)
+}
+
+// flush writes the JSON document; text output has already been printed.
+func (r *report) flush() error {
+	if !r.jsonOutput {
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate"
+)
+
+// forwardInterrupts relays SIGINT and SIGTERM received by isolatectl to the
+// guest command's process group. If the command has not exited grace after
+// the first one, or another one arrives, it is killed with SIGKILL. Streams
+// that cannot deliver signals are closed instead. The returned func stops
+// forwarding.
+func forwardInterrupts(stream *isolate.Stream, grace time.Duration) func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		var deadline <-chan time.Time
+		interrupted := false
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-sigs:
+				if interrupted {
+					kill(stream)
+					continue
+				}
+				interrupted = true
+				if err := stream.Signal(sig); err != nil {
+					fmt.Fprintf(os.Stderr, "\r\n[isolatectl] cannot signal guest command (%v); disconnecting\r\n", err)
+					stream.Close()
+					return
+				}
+				deadline = time.After(grace)
+			case <-deadline:
+				deadline = nil
+				fmt.Fprintf(os.Stderr, "\r\n[isolatectl] guest command still running after %v; killing it\r\n", grace)
+				kill(stream)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(done)
+	}
+}
+
+func kill(stream *isolate.Stream) {
+	if err := stream.Signal(syscall.SIGKILL); err != nil {
+		stream.Close()
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/oarkflow/container/pkg/isolate"
+)
+
+func isTerminal(fd int) bool { return false }
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
+
+func terminalSize(fd int) isolate.WindowSize { return isolate.WindowSize{} }
+
+func watchResize(ctx context.Context, fd int) <-chan isolate.WindowSize { return nil }
@@ -0,0 +1,78 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/oarkflow/container/pkg/isolate"
+)
+
+// isTerminal reports whether fd refers to a terminal.
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	return err == nil
+}
+
+// makeRaw switches the terminal to raw mode, so keystrokes such as ^C reach
+// the guest untouched, and returns a func restoring the previous mode. The
+// func may be called more than once.
+func makeRaw(fd int) (func(), error) {
+	old, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, err
+	}
+	raw := *old
+	raw.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	raw.Oflag &^= unix.OPOST
+	raw.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	raw.Cflag &^= unix.CSIZE | unix.PARENB
+	raw.Cflag |= unix.CS8
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { _ = unix.IoctlSetTermios(fd, ioctlSetTermios, old) })
+	}, nil
+}
+
+// terminalSize returns the size of the terminal at fd, or zero if unknown.
+func terminalSize(fd int) isolate.WindowSize {
+	ws, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ)
+	if err != nil {
+		return isolate.WindowSize{}
+	}
+	return isolate.WindowSize{Rows: ws.Row, Cols: ws.Col}
+}
+
+// watchResize reports the terminal's new size whenever it changes, until ctx
+// is done.
+func watchResize(ctx context.Context, fd int) <-chan isolate.WindowSize {
+	sizes := make(chan isolate.WindowSize, 1)
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, unix.SIGWINCH)
+	go func() {
+		defer signal.Stop(winch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-winch:
+			}
+			select {
+			case sizes <- terminalSize(fd):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sizes
+}
@@ -0,0 +1,277 @@
+package isolate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// SchedulingHints describe a container's expected resource profile and
+// placement constraints to the manager's admission logic. Every field is
+// optional; a config without hints is admitted on its CPUs and Memory alone.
+type SchedulingHints struct {
+	// BurstCPUs and BurstMemory are the peak vCPUs and bytes the workload is
+	// expected to use. Admission reserves the larger of these and the
+	// config's CPUs and Memory.
+	BurstCPUs   int
+	BurstMemory int64
+	// Affinity requires that a container whose Metadata holds every listed
+	// pair has already been admitted by the same manager.
+	Affinity map[string]string
+	// AntiAffinity refuses admission while a container whose Metadata holds
+	// every listed pair is admitted. The rule is symmetric: a later container
+	// matching these labels is refused as well.
+	AntiAffinity map[string]string
+	// Priority orders creations waiting for capacity, highest first.
+	Priority int
+}
+
+// Clone returns a deep copy of the hints.
+func (h *SchedulingHints) Clone() *SchedulingHints {
+	if h == nil {
+		return nil
+	}
+	out := *h
+	out.Affinity = cloneStringMap(h.Affinity)
+	out.AntiAffinity = cloneStringMap(h.AntiAffinity)
+	return &out
+}
+
+// Capacity bounds the resources a manager admits containers against. Zero
+// CPUs or Memory leaves that resource unbounded.
+type Capacity struct {
+	CPUs   int
+	Memory int64 // bytes
+	// Wait queues creations that do not fit until enough capacity is freed
+	// or their context ends, dispatching them by SchedulingHints.Priority.
+	// Without it they fail immediately with ErrInsufficientCapacity.
+	Wait bool
+}
+
+// admission reserves capacity for containers and enforces their affinity
+// rules. A reservation is held from admission until the container is deleted.
+type admission struct {
+	mu       sync.Mutex
+	capacity Capacity
+	cpus     int
+	memory   int64
+	admitted map[*reservation]struct{}
+	seq      uint64
+	queue    []*admissionWaiter
+}
+
+type reservation struct {
+	cpus         int
+	memory       int64
+	labels       map[string]string
+	antiAffinity map[string]string
+}
+
+type admissionWaiter struct {
+	res      *reservation
+	affinity map[string]string
+	priority int
+	seq      uint64
+	ready    chan struct{}
+	err      error
+}
+
+func newAdmission() *admission {
+	return &admission{admitted: make(map[*reservation]struct{})}
+}
+
+func (a *admission) setCapacity(c Capacity) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.capacity = c
+	a.dispatchLocked()
+}
+
+// admit reserves capacity for cfg, waiting for it when the capacity allows,
+// and returns the func that releases the reservation.
+func (a *admission) admit(ctx context.Context, cfg *Config) (func(), error) {
+	hints := cfg.Scheduling
+	if hints == nil {
+		hints = &SchedulingHints{}
+	}
+	w := &admissionWaiter{
+		res:      newReservation(cfg, hints),
+		affinity: cloneStringMap(hints.Affinity),
+		priority: hints.Priority,
+		ready:    make(chan struct{}),
+	}
+
+	a.mu.Lock()
+	if err := a.checkLocked(w); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	if !a.exceedsLocked(w.res) {
+		if len(a.queue) == 0 || !a.capacity.Wait {
+			a.reserveLocked(w.res)
+			a.mu.Unlock()
+			return a.releaseFunc(w.res), nil
+		}
+	} else if !a.capacity.Wait || !a.fitsEmptyLocked(w.res) {
+		a.mu.Unlock()
+		return nil, fmt.Errorf("%w: needs %d cpus and %d bytes", ErrInsufficientCapacity, w.res.cpus, w.res.memory)
+	}
+	a.seq++
+	w.seq = a.seq
+	a.queue = append(a.queue, w)
+	a.dispatchLocked()
+	a.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		if w.err != nil {
+			return nil, w.err
+		}
+		return a.releaseFunc(w.res), nil
+	case <-ctx.Done():
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Dispatched concurrently with cancellation; hand it back.
+			if w.err == nil {
+				a.unreserveLocked(w.res)
+			}
+		default:
+			a.removeLocked(w)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// reserve records the reservation of an existing container, such as one
+// reloaded from a state directory, without checking capacity or affinity.
+func (a *admission) reserve(cfg *Config) func() {
+	hints := cfg.Scheduling
+	if hints == nil {
+		hints = &SchedulingHints{}
+	}
+	res := newReservation(cfg, hints)
+	a.mu.Lock()
+	a.reserveLocked(res)
+	a.mu.Unlock()
+	return a.releaseFunc(res)
+}
+
+func newReservation(cfg *Config, hints *SchedulingHints) *reservation {
+	return &reservation{
+		cpus:         max(cfg.CPUs, hints.BurstCPUs),
+		memory:       max(cfg.Memory, hints.BurstMemory),
+		labels:       cloneStringMap(cfg.Metadata),
+		antiAffinity: cloneStringMap(hints.AntiAffinity),
+	}
+}
+
+func (a *admission) releaseFunc(res *reservation) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			a.unreserveLocked(res)
+		})
+	}
+}
+
+// checkLocked enforces the affinity rules of w against every admitted
+// container.
+func (a *admission) checkLocked(w *admissionWaiter) error {
+	affine := len(w.affinity) == 0
+	for other := range a.admitted {
+		if matchesLabels(other.labels, w.affinity) {
+			affine = true
+		}
+		if matchesLabels(other.labels, w.res.antiAffinity) || matchesLabels(w.res.labels, other.antiAffinity) {
+			return ErrAntiAffinity
+		}
+	}
+	if !affine {
+		return ErrAffinityUnsatisfied
+	}
+	return nil
+}
+
+// matchesLabels reports whether labels holds every pair of a non-empty
+// selector.
+func matchesLabels(labels, selector map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for k, v := range selector {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *admission) exceedsLocked(res *reservation) bool {
+	return (a.capacity.CPUs > 0 && a.cpus+res.cpus > a.capacity.CPUs) ||
+		(a.capacity.Memory > 0 && a.memory+res.memory > a.capacity.Memory)
+}
+
+// fitsEmptyLocked reports whether res could ever be admitted, i.e. whether
+// it fits the capacity with nothing else reserved.
+func (a *admission) fitsEmptyLocked(res *reservation) bool {
+	return (a.capacity.CPUs <= 0 || res.cpus <= a.capacity.CPUs) &&
+		(a.capacity.Memory <= 0 || res.memory <= a.capacity.Memory)
+}
+
+func (a *admission) reserveLocked(res *reservation) {
+	a.admitted[res] = struct{}{}
+	a.cpus += res.cpus
+	a.memory += res.memory
+}
+
+func (a *admission) unreserveLocked(res *reservation) {
+	if _, ok := a.admitted[res]; !ok {
+		return
+	}
+	delete(a.admitted, res)
+	a.cpus -= res.cpus
+	a.memory -= res.memory
+	a.dispatchLocked()
+}
+
+// dispatchLocked admits queued creations in priority order, breaking ties in
+// arrival order. It stops at the first one that does not fit, so a large
+// creation is not starved by smaller ones behind it. Waiters whose affinity
+// rules no longer hold are failed.
+func (a *admission) dispatchLocked() {
+	for len(a.queue) > 0 {
+		best := 0
+		for i := 1; i < len(a.queue); i++ {
+			q, b := a.queue[i], a.queue[best]
+			if q.priority > b.priority || (q.priority == b.priority && q.seq < b.seq) {
+				best = i
+			}
+		}
+		w := a.queue[best]
+		if err := a.checkLocked(w); err != nil {
+			w.err = err
+		} else if !a.fitsEmptyLocked(w.res) {
+			w.err = fmt.Errorf("%w: needs %d cpus and %d bytes", ErrInsufficientCapacity, w.res.cpus, w.res.memory)
+		} else if a.exceedsLocked(w.res) {
+			return
+		} else {
+			a.reserveLocked(w.res)
+		}
+		a.queue = append(a.queue[:best], a.queue[best+1:]...)
+		close(w.ready)
+	}
+}
+
+func (a *admission) removeLocked(w *admissionWaiter) {
+	for i, queued := range a.queue {
+		if queued == w {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			a.dispatchLocked()
+			return
+		}
+	}
+}
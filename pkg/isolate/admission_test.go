@@ -0,0 +1,156 @@
+package isolate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAdmissionCapacity(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m.SetCapacity(Capacity{CPUs: 4, Memory: 1 << 30})
+
+	if _, err := m.CreateContainer(ctx, &Config{Name: "a", CPUs: 2, Memory: 256 << 20}); err != nil {
+		t.Fatal(err)
+	}
+	// The burst, not the base size, is reserved.
+	if _, err := m.CreateContainer(ctx, &Config{Name: "b", CPUs: 1, Memory: 256 << 20, Scheduling: &SchedulingHints{BurstCPUs: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, cfg := range map[string]*Config{
+		"cpus":   {Name: "c", CPUs: 1, Memory: 1 << 20},
+		"memory": {Name: "c", CPUs: 1, Memory: 256 << 20, Scheduling: &SchedulingHints{BurstMemory: 768 << 20}},
+	} {
+		if _, err := m.CreateContainer(ctx, cfg); !errors.Is(err, ErrInsufficientCapacity) {
+			t.Errorf("CreateContainer over the %s capacity = %v, want %v", name, err, ErrInsufficientCapacity)
+		}
+	}
+
+	// Deleting a container, or a failed creation, frees its reservation.
+	if err := m.DeleteContainer(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateContainer(ctx, &Config{Name: "b", CPUs: 2, Memory: 1 << 20}); !errors.Is(err, ErrContainerExists) {
+		t.Errorf("CreateContainer with a taken name = %v, want %v", err, ErrContainerExists)
+	}
+	if _, err := m.CreateContainer(ctx, &Config{Name: "c", CPUs: 2, Memory: 1 << 20}); err != nil {
+		t.Errorf("CreateContainer after freeing capacity: %v", err)
+	}
+
+	// The zero capacity removes the bounds.
+	m.SetCapacity(Capacity{})
+	if _, err := m.CreateContainer(ctx, &Config{Name: "d", CPUs: 16, Memory: 8 << 30}); err != nil {
+		t.Errorf("CreateContainer without bounds: %v", err)
+	}
+}
+
+func TestAdmissionWaitsByPriority(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	m.SetCapacity(Capacity{CPUs: 2, Wait: true})
+	if _, err := m.CreateContainer(ctx, &Config{Name: "holder", CPUs: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A creation that could never fit fails without waiting.
+	if _, err := m.CreateContainer(ctx, &Config{Name: "huge", CPUs: 3}); !errors.Is(err, ErrInsufficientCapacity) {
+		t.Errorf("CreateContainer larger than the capacity = %v, want %v", err, ErrInsufficientCapacity)
+	}
+
+	admitted := make(chan string, 3)
+	create := func(ctx context.Context, name string, priority int) {
+		cfg := &Config{Name: name, CPUs: 2, Scheduling: &SchedulingHints{Priority: priority}}
+		if _, err := m.CreateContainer(ctx, cfg); err != nil {
+			admitted <- name + ": " + err.Error()
+			return
+		}
+		admitted <- name
+	}
+	waitQueued := func(n int) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			m.admission.mu.Lock()
+			queued := len(m.admission.queue)
+			m.admission.mu.Unlock()
+			if queued == n {
+				return
+			}
+		}
+		t.Fatalf("%d creations never queued", n)
+	}
+	cancelledCtx, cancelWaiter := context.WithCancel(ctx)
+	go create(ctx, "low", 0)
+	waitQueued(1)
+	go create(cancelledCtx, "cancelled", 10)
+	go create(ctx, "high", 5)
+	waitQueued(3)
+
+	// A cancelled waiter leaves the queue without being admitted.
+	cancelWaiter()
+	if got := <-admitted; got != "cancelled: "+context.Canceled.Error() {
+		t.Errorf("cancelled waiter = %q", got)
+	}
+	waitQueued(2)
+
+	for _, want := range []string{"high", "low"} {
+		var freed string
+		m.mu.RLock()
+		for name := range m.containers {
+			freed = name
+		}
+		m.mu.RUnlock()
+		if err := m.DeleteContainer(ctx, freed); err != nil {
+			t.Fatal(err)
+		}
+		if got := <-admitted; got != want {
+			t.Errorf("admitted %q, want %q", got, want)
+		}
+	}
+}
+
+func TestAdmissionAffinity(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := m.CreateContainer(ctx, &Config{Name: "cache", Scheduling: &SchedulingHints{Affinity: map[string]string{"app": "db"}}}); !errors.Is(err, ErrAffinityUnsatisfied) {
+		t.Errorf("CreateContainer without its affine container = %v, want %v", err, ErrAffinityUnsatisfied)
+	}
+	db := &Config{
+		Name:       "db-1",
+		Metadata:   map[string]string{"app": "db", "zone": "a"},
+		Scheduling: &SchedulingHints{AntiAffinity: map[string]string{"app": "db"}},
+	}
+	if _, err := m.CreateContainer(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateContainer(ctx, &Config{Name: "cache", Scheduling: &SchedulingHints{Affinity: map[string]string{"app": "db"}}}); err != nil {
+		t.Errorf("CreateContainer next to its affine container: %v", err)
+	}
+
+	// The first replica's rule refuses a second one even though the second
+	// declares no rule of its own, and the second's rule refuses it too.
+	for name, cfg := range map[string]*Config{
+		"existing rule": {Name: "db-2", Metadata: map[string]string{"app": "db"}},
+		"own rule":      {Name: "db-2", Metadata: map[string]string{"app": "web"}, Scheduling: &SchedulingHints{AntiAffinity: map[string]string{"zone": "a"}}},
+	} {
+		if _, err := m.CreateContainer(ctx, cfg); !errors.Is(err, ErrAntiAffinity) {
+			t.Errorf("%s: CreateContainer = %v, want %v", name, err, ErrAntiAffinity)
+		}
+	}
+	// Partial matches are no conflict.
+	if _, err := m.CreateContainer(ctx, &Config{Name: "web", Metadata: map[string]string{"app": "web", "zone": "a"}}); err != nil {
+		t.Errorf("CreateContainer with other labels: %v", err)
+	}
+
+	if err := m.DeleteContainer(ctx, "db-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.CreateContainer(ctx, &Config{Name: "db-2", Metadata: map[string]string{"app": "db"}}); err != nil {
+		t.Errorf("CreateContainer after the conflicting container was deleted: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// chunkWriter adapts a frame writer into an io.Writer that emits each write
+// as one or more chunk frames of the given type.
+type chunkWriter struct {
+	writer    *frameWriter
+	typ       frameType
+	chunkSize int
+	written   int64
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := len(p)
+		if w.chunkSize > 0 && n > w.chunkSize {
+			n = w.chunkSize
+		}
+		chunk := append([]byte(nil), p[:n]...)
+		if err := w.writer.send(w.typ, chunkPayload{Data: chunk}); err != nil {
+			return total, err
+		}
+		w.written += int64(n)
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+func (s *Server) handleArchive(writer *frameWriter, payload archiveRequestPayload) {
+	if payload.Path == "" {
+		_ = writer.send(frameTypeError, errorPayload{Message: "path is required"})
+		return
+	}
+	format := payload.Format
+	if format == "" {
+		format = ArchiveFormatTar
+	}
+	if format != ArchiveFormatTar && format != ArchiveFormatTarGzip {
+		_ = writer.send(frameTypeError, errorPayload{Message: fmt.Sprintf("unsupported archive format %q", format)})
+		return
+	}
+
+	srcDir, err := s.resolveRootedPath(payload.Path)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "security violation: " + err.Error()})
+		return
+	}
+	info, err := os.Stat(srcDir)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+		return
+	}
+	if !info.IsDir() {
+		_ = writer.send(frameTypeError, errorPayload{Message: fmt.Sprintf("%q is not a directory", payload.Path)})
+		return
+	}
+
+	sink := &chunkWriter{writer: writer, typ: frameTypeArchiveChunk, chunkSize: s.chunkSize}
+	buffered := bufio.NewWriterSize(sink, s.chunkSize)
+
+	var out io.Writer = buffered
+	var gz *gzip.Writer
+	if format == ArchiveFormatTarGzip {
+		gz = gzip.NewWriter(buffered)
+		out = gz
+	}
+
+	tw := tar.NewWriter(out)
+	archiveErr := s.writeArchive(tw, srcDir)
+	if err := tw.Close(); err != nil && archiveErr == nil {
+		archiveErr = err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil && archiveErr == nil {
+			archiveErr = err
+		}
+	}
+	if err := buffered.Flush(); err != nil && archiveErr == nil {
+		archiveErr = err
+	}
+
+	result := fileTransferResultPayload{Bytes: sink.written}
+	if archiveErr != nil {
+		result.Error = archiveErr.Error()
+	}
+	_ = writer.send(frameTypeArchiveResult, result)
+}
+
+// writeArchive walks srcDir and appends every entry to tw. Symlinks are stored
+// as links rather than followed, and any entry resolving outside rootDir is
+// rejected.
+func (s *Server) writeArchive(tw *tar.Writer, srcDir string) error {
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := s.checkEntryWithinRoot(path); err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			target := link
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(path), target)
+			}
+			if s.rootDir != "" {
+				if err := s.checkPathWithinRoot(target, "symlink target"); err != nil {
+					return err
+				}
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
+
+// resolveRootedPath maps a client supplied path onto the host filesystem,
+// resolving relative paths against rootDir and rejecting anything that escapes
+// it (including via symlinks).
+func (s *Server) resolveRootedPath(path string) (string, error) {
+	if s.rootDir == "" {
+		return filepath.Clean(path), nil
+	}
+	resolved := path
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(s.rootDir, resolved)
+	}
+	resolved = filepath.Clean(resolved)
+	if err := s.checkPathWithinRoot(resolved, "path"); err != nil {
+		return "", err
+	}
+	if err := s.checkEntryWithinRoot(resolved); err != nil {
+		return "", err
+	}
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		if err := s.checkRealPathWithinRoot(real, path); err != nil {
+			return "", err
+		}
+	}
+	return resolved, nil
+}
+
+// checkEntryWithinRoot resolves symlinks in the parent directories of path and
+// verifies the real location still lies inside rootDir.
+func (s *Server) checkEntryWithinRoot(path string) error {
+	if s.rootDir == "" || filepath.Clean(path) == s.rootDir {
+		return nil
+	}
+	realDir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return s.checkRealPathWithinRoot(filepath.Join(realDir, filepath.Base(path)), path)
+}
+
+// checkRealPathWithinRoot compares an already symlink-resolved path against
+// the resolved rootDir. display is used in the error message.
+func (s *Server) checkRealPathWithinRoot(real, display string) error {
+	realRoot, err := filepath.EvalSymlinks(s.rootDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("path %q is outside root %q", display, s.rootDir)
+	}
+	return nil
+}
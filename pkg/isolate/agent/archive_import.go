@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// chunkReader reads the data of chunk frames sent by the client until the
+// matching close frame, so uploads can be consumed as a plain io.Reader.
+type chunkReader struct {
+	dec       *json.Decoder
+	chunkType frameType
+	closeType frameType
+	buf       []byte
+	closed    bool
+	received  int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.closed {
+			return 0, io.EOF
+		}
+		frame, err := readFrame(r.dec)
+		if err != nil {
+			return 0, err
+		}
+		switch frame.Type {
+		case r.chunkType:
+			var chunk chunkPayload
+			if err := json.Unmarshal(frame.Payload, &chunk); err != nil {
+				return 0, err
+			}
+			r.buf = chunk.Data
+			r.received += int64(len(chunk.Data))
+		case r.closeType:
+			r.closed = true
+		default:
+			return 0, fmt.Errorf("unexpected frame %q during upload", frame.Type)
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (s *Server) handleArchiveImport(dec *json.Decoder, writer *frameWriter, payload archiveImportRequestPayload) {
+	if s.rootDir == "" {
+		_ = writer.send(frameTypeError, errorPayload{Message: "archive import requires an agent root directory"})
+		return
+	}
+	if payload.Format != "" && payload.Format != ArchiveFormatTar && payload.Format != ArchiveFormatTarGzip {
+		_ = writer.send(frameTypeError, errorPayload{Message: fmt.Sprintf("unsupported archive format %q", payload.Format)})
+		return
+	}
+
+	upload := &chunkReader{dec: dec, chunkType: frameTypeArchiveImportChunk, closeType: frameTypeArchiveImportClose}
+	importErr := s.extractArchive(upload, payload.Format)
+	// Consume the rest of the upload so the client is not left blocked on
+	// a write, and the result is read after its close frame.
+	if _, err := io.Copy(io.Discard, upload); err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+		return
+	}
+
+	result := fileTransferResultPayload{Bytes: upload.received}
+	if importErr != nil {
+		result.Error = importErr.Error()
+	}
+	_ = writer.send(frameTypeArchiveImportResult, result)
+}
+
+// extractArchive unpacks a tar stream into rootDir. An empty format detects
+// gzip compression from the stream itself. Entry names must be relative and
+// stay inside rootDir, as must the targets of links; device nodes and other
+// special files are skipped.
+func (s *Server) extractArchive(r io.Reader, format ArchiveFormat) error {
+	br := bufio.NewReader(r)
+	var src io.Reader = br
+	if format == "" {
+		if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+			format = ArchiveFormatTarGzip
+		}
+	}
+	if format == ArchiveFormatTarGzip {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	}
+
+	tr := tar.NewReader(src)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.extractEntry(tr, hdr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+func (s *Server) extractEntry(tr *tar.Reader, hdr *tar.Header) error {
+	name := filepath.Clean(filepath.FromSlash(hdr.Name))
+	if name == "." {
+		return nil
+	}
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("entry escapes the root directory")
+	}
+	target := filepath.Join(s.rootDir, name)
+	if err := s.checkEntryWithinRoot(target); err != nil {
+		return err
+	}
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	// Never write through whatever currently occupies the name; a symlink
+	// there could point anywhere.
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return err
+		}
+		return os.Chmod(target, mode)
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, tr); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		return os.Chmod(target, mode)
+	case tar.TypeSymlink:
+		link := hdr.Linkname
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(target), link)
+		}
+		if err := s.checkPathWithinRoot(link, "symlink target"); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, target)
+	case tar.TypeLink:
+		linkName := filepath.Clean(filepath.FromSlash(hdr.Linkname))
+		if !filepath.IsLocal(linkName) {
+			return fmt.Errorf("hard link target escapes the root directory")
+		}
+		source := filepath.Join(s.rootDir, linkName)
+		if err := s.checkEntryWithinRoot(source); err != nil {
+			return err
+		}
+		if info, err := os.Lstat(source); err != nil || !info.Mode().IsRegular() {
+			return fmt.Errorf("hard link target %q is not a regular file", hdr.Linkname)
+		}
+		return os.Link(source, target)
+	default:
+		s.logger.Printf("archive import: skipping %s (type %q)", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+}
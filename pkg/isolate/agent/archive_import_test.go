@@ -0,0 +1,127 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarEntry is one entry of a test archive; a non-empty link makes it a
+// symlink.
+type tarEntry struct {
+	name, body, link string
+	mode             int64
+}
+
+func buildTarGz(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Typeflag: tar.TypeReg, Size: int64(len(e.body))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestImportArchiveNestedDirectories(t *testing.T) {
+	root := t.TempDir()
+	_, client := startServer(t, ServerConfig{RootDir: root})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	archive := buildTarGz(t, []tarEntry{
+		{name: "app/", mode: 0o755},
+		{name: "app/bin/run.sh", body: "#!/bin/sh\n", mode: 0o755},
+		{name: "app/etc/conf/app.toml", body: "port = 80\n", mode: 0o640},
+		{name: "app/current", link: "bin/run.sh"},
+	})
+	if err := client.ImportArchive(ctx, archive); err != nil {
+		t.Fatalf("ImportArchive: %v", err)
+	}
+
+	for name, want := range map[string]struct {
+		body string
+		mode os.FileMode
+	}{
+		"app/bin/run.sh":        {"#!/bin/sh\n", 0o755},
+		"app/etc/conf/app.toml": {"port = 80\n", 0o640},
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		info, _ := os.Stat(path)
+		if string(data) != want.body || info.Mode().Perm() != want.mode {
+			t.Errorf("%s = %q, mode %v, want %q, mode %v", name, data, info.Mode().Perm(), want.body, want.mode)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(root, "app", "current")); err != nil || link != "bin/run.sh" {
+		t.Errorf("app/current links to %q, %v, want bin/run.sh", link, err)
+	}
+}
+
+func TestImportArchiveRejectsEscapes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		entry tarEntry
+	}{
+		{"parent directory", tarEntry{name: "../escaped", body: "x", mode: 0o644}},
+		{"nested parent directory", tarEntry{name: "app/../../escaped", body: "x", mode: 0o644}},
+		{"absolute path", tarEntry{name: "/escaped", body: "x", mode: 0o644}},
+		{"symlink outside", tarEntry{name: "app/escaped", link: "../../escaped"}},
+		{"absolute symlink", tarEntry{name: "app/escaped", link: "/etc/passwd"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "root")
+			if err := os.Mkdir(root, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			_, client := startServer(t, ServerConfig{RootDir: root})
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			archive := buildTarGz(t, []tarEntry{{name: "app/kept", body: "ok", mode: 0o644}, tc.entry})
+			if err := client.ImportArchive(ctx, archive); err == nil {
+				t.Fatal("ImportArchive accepted an entry escaping the root")
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escaped")); err == nil {
+				t.Error("the escaping entry was written outside the root")
+			}
+			if _, err := os.Lstat(filepath.Join(root, "app", "escaped")); err == nil {
+				t.Error("the escaping symlink was created")
+			}
+			// Entries before the bad one are kept.
+			if _, err := os.Stat(filepath.Join(root, "app", "kept")); err != nil {
+				t.Errorf("entry before the escape: %v", err)
+			}
+		})
+	}
+}
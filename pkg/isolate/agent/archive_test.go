@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTree creates files, mapping slash-separated paths to contents, under
+// dir.
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTar returns the contents of the regular files in a tar stream by
+// name, and the names of its directories.
+func readTar(t *testing.T, r io.Reader) (map[string]string, []string) {
+	t.Helper()
+	files := make(map[string]string)
+	var dirs []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, dirs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			dirs = append(dirs, hdr.Name)
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[hdr.Name] = string(data)
+		}
+	}
+}
+
+func TestCopyArchiveFromNestedDirectory(t *testing.T) {
+	root := t.TempDir()
+	want := map[string]string{
+		"out/report.txt":      "done\n",
+		"out/logs/build.log":  "ok\n",
+		"out/logs/deep/trace": strings.Repeat("trace line\n", 1000),
+	}
+	writeTree(t, root, want)
+	// A small chunk size makes the archive span many frames.
+	_, client := startServer(t, ServerConfig{RootDir: root, ChunkSize: 512})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, format := range []ArchiveFormat{ArchiveFormatTar, ArchiveFormatTarGzip} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := client.CopyArchiveFrom(ctx, "out", format, &buf); err != nil {
+				t.Fatalf("CopyArchiveFrom: %v", err)
+			}
+			var r io.Reader = &buf
+			if format == ArchiveFormatTarGzip {
+				gz, err := gzip.NewReader(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = gz
+			}
+			files, dirs := readTar(t, r)
+			if len(files) != len(want) {
+				t.Errorf("archive holds %d files, want %d", len(files), len(want))
+			}
+			for name, content := range want {
+				rel := name[len("out/"):]
+				if files[rel] != content {
+					t.Errorf("%s: got %d bytes, want %d", rel, len(files[rel]), len(content))
+				}
+			}
+			if got := len(dirs); got != 2 {
+				t.Errorf("archive holds directories %q, want logs/ and logs/deep/", dirs)
+			}
+		})
+	}
+}
+
+func TestCopyArchiveFromOutsideRoot(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	writeTree(t, outside, map[string]string{"secret": "x"})
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	_, client := startServer(t, ServerConfig{RootDir: root})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, dir := range []string{"../", outside, "escape"} {
+		if err := client.CopyArchiveFrom(ctx, dir, ArchiveFormatTar, io.Discard); err == nil {
+			t.Errorf("CopyArchiveFrom(%q) succeeded outside the root", dir)
+		}
+	}
+}
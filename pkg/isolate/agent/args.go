@@ -0,0 +1,44 @@
+package agent
+
+import "fmt"
+
+const (
+	// defaultMaxArgs is far above what real commands use while keeping a
+	// hostile request from allocating millions of argument strings.
+	defaultMaxArgs = 32 * 1024
+	// defaultMaxArgBytes matches the common Linux ARG_MAX of 2 MiB; execve
+	// would reject anything larger anyway.
+	defaultMaxArgBytes = 2 * 1024 * 1024
+)
+
+func argLimit(configured, def int) int {
+	switch {
+	case configured < 0:
+		return 0
+	case configured == 0:
+		return def
+	default:
+		return configured
+	}
+}
+
+// checkArgs enforces MaxArgs and MaxArgBytes. Limits of zero are disabled.
+func (s *Server) checkArgs(payload *execRequestPayload) error {
+	if s.maxArgs > 0 && len(payload.Args) > s.maxArgs {
+		return fmt.Errorf("%d arguments exceed the limit of %d", len(payload.Args), s.maxArgs)
+	}
+	if s.maxArgBytes <= 0 {
+		return nil
+	}
+	total := len(payload.Path) + 1
+	for _, arg := range payload.Args {
+		total += len(arg) + 1
+		if total > s.maxArgBytes {
+			return fmt.Errorf("arguments exceed the limit of %d bytes", s.maxArgBytes)
+		}
+	}
+	if total > s.maxArgBytes {
+		return fmt.Errorf("arguments exceed the limit of %d bytes", s.maxArgBytes)
+	}
+	return nil
+}
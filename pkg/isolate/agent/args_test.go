@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecArgLimits(t *testing.T) {
+	_, client := startServer(t, ServerConfig{MaxArgs: 3, MaxArgBytes: 64})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dir := t.TempDir()
+
+	// "/bin/echo" and its NUL take 10 of the 64 bytes.
+	for _, args := range [][]string{
+		{"a", "b", "c"},
+		{strings.Repeat("x", 53)},
+	} {
+		result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/echo", Args: args})
+		if err != nil || result.ExitCode != 0 {
+			t.Errorf("Exec with %d args at the limit = %+v, %v", len(args), result, err)
+		}
+	}
+	// Refused requests would create the marker if they ran; "/bin/sh",
+	// "-c" and "touch m" take 19 bytes.
+	for _, args := range [][]string{
+		{"-c", "touch m", "a", "b"},
+		{"-c", "touch m", strings.Repeat("x", 46)},
+		{"-c", "touch m", strings.Repeat("x", 20), strings.Repeat("x", 20)},
+	} {
+		_, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: args, WorkingDir: dir})
+		if !errors.Is(err, ErrArgsTooLarge) {
+			t.Errorf("Exec with %d args over the limit = %v, want %v", len(args), err, ErrArgsTooLarge)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "m")); !os.IsNotExist(err) {
+		t.Errorf("a refused command ran: %v", err)
+	}
+}
+
+func TestExecArgLimitDefaults(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	args := make([]string, defaultMaxArgs+1)
+	for i := range args {
+		args[i] = "x"
+	}
+
+	srv, client := startServer(t, ServerConfig{})
+	if srv.maxArgs != defaultMaxArgs || srv.maxArgBytes != defaultMaxArgBytes {
+		t.Errorf("limits = %d args, %d bytes; want %d, %d", srv.maxArgs, srv.maxArgBytes, defaultMaxArgs, defaultMaxArgBytes)
+	}
+	if _, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true", Args: args}); !errors.Is(err, ErrArgsTooLarge) {
+		t.Errorf("Exec with %d args = %v, want %v", len(args), err, ErrArgsTooLarge)
+	}
+
+	// A negative limit disables the check.
+	_, client = startServer(t, ServerConfig{MaxArgs: -1})
+	if result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true", Args: args}); err != nil || result.ExitCode != 0 {
+		t.Errorf("Exec with the limit disabled = %+v, %v", result, err)
+	}
+}
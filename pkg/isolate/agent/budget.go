@@ -0,0 +1,60 @@
+package agent
+
+import "sync"
+
+// bufferBudget accounts for the worst-case size of the result buffers held by
+// in-flight execs and retained detached jobs, so many concurrent execs cannot
+// together exceed a server-wide memory ceiling.
+type bufferBudget struct {
+	mu    sync.Mutex
+	limit int64 // zero means unlimited; usage is still tracked
+	used  int64
+}
+
+// reserve claims n bytes, reporting false when that would exceed the limit.
+func (b *bufferBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *bufferBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+}
+
+func (b *bufferBudget) usage() (used, limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used, b.limit
+}
+
+// outputReservation is the most the buffers built by newOutputBuffers with the
+// same arguments can hold.
+func outputReservation(ceiling, stdoutLimit, stderrLimit, combined int) int64 {
+	n := int64(clampLimit(stdoutLimit, ceiling)) + int64(clampLimit(stderrLimit, ceiling))
+	if combined > 0 && int64(combined) < n {
+		n = int64(combined)
+	}
+	return n
+}
+
+// ServerStats is a point-in-time snapshot of server resource usage.
+type ServerStats struct {
+	// ResultBufferBytes is the result buffer memory currently reserved by
+	// running execs and retained detached jobs.
+	ResultBufferBytes int64
+	// ResultBufferBudget is the configured MaxBufferedBytes (0 = unlimited).
+	ResultBufferBudget int64
+}
+
+// Stats reports current resource usage for metrics.
+func (s *Server) Stats() ServerStats {
+	used, limit := s.buffers.usage()
+	return ServerStats{ResultBufferBytes: used, ResultBufferBudget: limit}
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResultBufferBudget(t *testing.T) {
+	const (
+		bufLimit = 64 << 10
+		perExec  = 2 * bufLimit // stdout and stderr buffers
+		budget   = 4 * perExec
+		execs    = 12
+	)
+	srv, client := startServer(t, ServerConfig{MaxResultBuffer: bufLimit, MaxBufferedBytes: budget})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// Sample the reserved memory while the execs run.
+	stop := make(chan struct{})
+	peak := make(chan int64, 1)
+	go func() {
+		var max int64
+		defer func() { peak <- max }()
+		for {
+			if used := srv.Stats().ResultBufferBytes; used > max {
+				max = used
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	var (
+		wg                 sync.WaitGroup
+		mu                 sync.Mutex
+		succeeded, refused int
+	)
+	for range execs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each writes a megabyte to both streams, far beyond the buffers.
+			result, err := client.Exec(ctx, &CommandRequest{
+				Path: "/bin/sh",
+				Args: []string{"-c", "head -c 1048576 /dev/zero; head -c 1048576 /dev/zero >&2; sleep 0.5"},
+			})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, ErrBufferBudgetExceeded):
+				refused++
+			case err != nil:
+				t.Errorf("Exec: %v", err)
+			default:
+				succeeded++
+				if len(result.Stdout) > bufLimit || len(result.Stderr) > bufLimit {
+					t.Errorf("result holds %d/%d bytes, want at most %d each", len(result.Stdout), len(result.Stderr), bufLimit)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+
+	if max := <-peak; max > budget || max == 0 {
+		t.Errorf("peak reserved buffer memory = %d, want 1..%d", max, budget)
+	}
+	if succeeded == 0 || refused == 0 {
+		t.Errorf("%d execs ran and %d were refused, want some of each", succeeded, refused)
+	}
+	// The server releases an exec's reservation just after sending its
+	// result.
+	for deadline := time.Now().Add(5 * time.Second); srv.Stats().ResultBufferBytes != 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if stats := srv.Stats(); stats.ResultBufferBytes != 0 || stats.ResultBufferBudget != budget {
+		t.Errorf("stats after the execs = %+v, want 0 of %d in use", stats, budget)
+	}
+}
@@ -0,0 +1,68 @@
+package agent
+
+import "slices"
+
+// unsupportedFrameMessage is the error text sent for unknown requests.
+const unsupportedFrameMessage = "unsupported frame"
+
+// Capabilities describes what an agent handles, so callers can check for an
+// optional request before relying on it.
+type Capabilities struct {
+	ProtocolVersion int
+	// Requests lists the request frame types the agent handles, such as
+	// "which_request" or "log_subscribe" (see PROTOCOL.md).
+	Requests []string
+	// Features lists optional behaviour within those requests, such as
+	// FeatureChecksum.
+	Features []string
+}
+
+// Supports reports whether the agent handles the request frame type.
+func (c *Capabilities) Supports(request string) bool {
+	return c != nil && slices.Contains(c.Requests, request)
+}
+
+// HasFeature reports whether the agent offers the optional feature.
+func (c *Capabilities) HasFeature(feature string) bool {
+	return c != nil && slices.Contains(c.Features, feature)
+}
+
+type capabilitiesResultPayload struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Requests        []string `json:"requests"`
+	Features        []string `json:"features,omitempty"`
+}
+
+// supportedRequests lists the request frames handleConn serves with the
+// server's current configuration.
+func (s *Server) supportedRequests() []string {
+	requests := []string{
+		string(frameTypePing),
+		string(frameTypeHello),
+		string(frameTypeExecRequest),
+		string(frameTypePauseOutput),
+		string(frameTypeResumeOutput),
+		string(frameTypeSignal),
+		string(frameTypeFilePutRequest),
+		string(frameTypeFileGetRequest),
+		string(frameTypeArchiveRequest),
+		string(frameTypeArchiveImportRequest),
+		string(frameTypeAttachRequest),
+		string(frameTypeCheckSpaceRequest),
+		string(frameTypeWhichRequest),
+		string(frameTypeChownRequest),
+		string(frameTypeSignalJobRequest),
+		string(frameTypeCapabilitiesRequest),
+		string(frameTypeInfoRequest),
+	}
+	if canSampleProcesses {
+		requests = append(requests, string(frameTypeProcessStatsRequest))
+	}
+	if s.logRing != nil {
+		requests = append(requests, string(frameTypeLogSubscribe))
+	}
+	if s.retained != nil {
+		requests = append(requests, string(frameTypeLogsRequest))
+	}
+	return requests
+}
@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCapabilitiesReflectConfiguration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	optional := []string{string(frameTypeLogSubscribe), string(frameTypeLogsRequest)}
+
+	_, plain := startServer(t, ServerConfig{})
+	caps, err := plain.Capabilities(ctx)
+	if err != nil {
+		t.Fatalf("Capabilities: %v", err)
+	}
+	if !caps.Supports(string(frameTypeWhichRequest)) || caps.ProtocolVersion != ProtocolVersion {
+		t.Errorf("capabilities = %+v, want which_request at version %d", caps, ProtocolVersion)
+	}
+	for _, request := range optional {
+		if caps.Supports(request) {
+			t.Errorf("a server without the feature reports %s", request)
+		}
+	}
+	// Calling a request the agent reports unsupported fails with a typed
+	// error, as does one it has never heard of.
+	if _, err := plain.Logs(ctx, "exec-1", 0); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Logs = %v, want %v", err, ErrUnsupported)
+	}
+	if err := plain.call(ctx, "teleport_request", nil, "teleport_result", nil); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("unknown request = %v, want %v", err, ErrUnsupported)
+	}
+
+	_, full := startServer(t, ServerConfig{AllowLogSubscribe: true, ExecLogRetention: time.Minute})
+	if caps, err = full.Capabilities(ctx); err != nil {
+		t.Fatalf("Capabilities: %v", err)
+	}
+	for _, request := range optional {
+		if !caps.Supports(request) {
+			t.Errorf("a server with the feature does not report %s", request)
+		}
+	}
+}
+
+func TestNegotiateWithAgentPredatingCapabilities(t *testing.T) {
+	// The agent answers every request the way agents without hello or
+	// capabilities_request did.
+	sock := filepath.Join(t.TempDir(), "old.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dec, writer := json.NewDecoder(conn), newFrameWriter(conn)
+				for {
+					if _, err := readFrame(dec); err != nil {
+						return
+					}
+					_ = writer.send(frameTypeError, errorPayload{Message: unsupportedFrameMessage})
+				}
+			}()
+		}
+	}()
+	client := NewIPCClient(&UnixDialer{Path: sock}).(*IPCClient)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.Capabilities(ctx); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Capabilities = %v, want %v", err, ErrUnsupported)
+	}
+	caps, err := client.Negotiate(ctx)
+	if err != nil {
+		t.Fatalf("Negotiate: %v", err)
+	}
+	if caps.ProtocolVersion != 0 || len(caps.Requests) != 0 || caps.Supports(string(frameTypeWhichRequest)) {
+		t.Errorf("capabilities = %+v, want version 0 with nothing optional", caps)
+	}
+}
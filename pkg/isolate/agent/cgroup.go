@@ -0,0 +1,34 @@
+package agent
+
+import "fmt"
+
+// ExitReasonOOMKilled is the exit reason of a command the kernel killed for
+// exceeding the agent's memory limit.
+const ExitReasonOOMKilled = "oom_killed"
+
+// defaultCgroupParent is where exec cgroups are created when
+// ServerConfig.CgroupParent is empty.
+const defaultCgroupParent = "/sys/fs/cgroup/agentd"
+
+// cgroupCPUPeriod is the cpu.max period, in microseconds, CPUQuota is
+// expressed against.
+const cgroupCPUPeriod = 100000
+
+// execLimits are the resource ceilings applied to every exec.
+type execLimits struct {
+	parent   string
+	memory   int64
+	cpuQuota float64
+}
+
+func (l execLimits) enabled() bool {
+	return l.memory > 0 || l.cpuQuota > 0
+}
+
+// cpuMax renders the quota as a cpu.max value.
+func (l execLimits) cpuMax() string {
+	if l.cpuQuota <= 0 {
+		return "max"
+	}
+	return fmt.Sprintf("%d %d", max(int64(l.cpuQuota*cgroupCPUPeriod), 1000), cgroupCPUPeriod)
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var cgroupSeq atomic.Uint64
+
+// execCgroup is a transient cgroup v2 holding a single exec.
+type execCgroup struct {
+	path string
+	dir  *os.File
+}
+
+// newExecCgroup creates a cgroup under limits.parent with memory.max and
+// cpu.max applied, enabling the controllers on the parent as needed.
+func newExecCgroup(limits execLimits) (*execCgroup, error) {
+	parent := limits.parent
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return nil, err
+	}
+	var controllers []string
+	if limits.memory > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if limits.cpuQuota > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0); err != nil {
+		return nil, fmt.Errorf("enable controllers in %s: %w", parent, err)
+	}
+
+	path := filepath.Join(parent, fmt.Sprintf("exec-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.Mkdir(path, 0o755); err != nil {
+		return nil, err
+	}
+	g := &execCgroup{path: path}
+	if err := g.configure(limits); err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	g.dir = dir
+	return g, nil
+}
+
+func (g *execCgroup) configure(limits execLimits) error {
+	if limits.memory > 0 {
+		if err := g.write("memory.max", strconv.FormatInt(limits.memory, 10)); err != nil {
+			return err
+		}
+		// Without this the limit only moves the excess to swap. The file is
+		// absent when swap accounting is off.
+		if err := g.write("memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if limits.cpuQuota > 0 {
+		if err := g.write("cpu.max", limits.cpuMax()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *execCgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(g.path, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("set %s: %w", file, err)
+	}
+	return nil
+}
+
+// attach makes cmd start inside the cgroup, so the limits hold from its
+// first instruction.
+func (g *execCgroup) attach(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(g.dir.Fd())
+}
+
+// oomKilled reports whether the kernel killed a process in the cgroup for
+// exceeding memory.max.
+func (g *execCgroup) oomKilled() bool {
+	data, err := os.ReadFile(filepath.Join(g.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), " ")
+		if ok && key == "oom_kill" {
+			n, _ := strconv.Atoi(value)
+			return n > 0
+		}
+	}
+	return false
+}
+
+// remove kills anything the exec left running in the cgroup and deletes it.
+func (g *execCgroup) remove() error {
+	g.dir.Close()
+	if err := g.write("cgroup.kill", "1"); err != nil {
+		g.killProcs()
+	}
+	var err error
+	for range 20 {
+		if err = os.Remove(g.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+// killProcs is the fallback for kernels without cgroup.kill.
+func (g *execCgroup) killProcs() {
+	data, err := os.ReadFile(filepath.Join(g.path, "cgroup.procs"))
+	if err != nil {
+		return
+	}
+	for _, field := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(field); err == nil {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+}
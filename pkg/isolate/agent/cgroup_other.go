@@ -0,0 +1,21 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+)
+
+type execCgroup struct{}
+
+// newExecCgroup fails outside Linux, which has no cgroups.
+func newExecCgroup(limits execLimits) (*execCgroup, error) {
+	return nil, errors.New("resource limits need cgroups v2, which this platform lacks")
+}
+
+func (g *execCgroup) attach(cmd *exec.Cmd) {}
+
+func (g *execCgroup) oomKilled() bool { return false }
+
+func (g *execCgroup) remove() error { return nil }
@@ -0,0 +1,37 @@
+package agent
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+)
+
+// newChecksum returns the SHA-256 hash a verified transfer is checked with,
+// or nil when verification is off. The helpers below accept the nil hash.
+func newChecksum(enabled bool) hash.Hash {
+	if !enabled {
+		return nil
+	}
+	return sha256.New()
+}
+
+func checksumHex(h hash.Hash) string {
+	if h == nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+var zeroBlock [32 << 10]byte
+
+// hashZeros feeds n zero bytes, the contents of a hole, into h.
+func hashZeros(h hash.Hash, n int64) {
+	if h == nil {
+		return
+	}
+	for n > 0 {
+		k := min(n, int64(len(zeroBlock)))
+		h.Write(zeroBlock[:k])
+		n -= k
+	}
+}
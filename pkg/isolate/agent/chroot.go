@@ -60,14 +60,14 @@ func (ce *ChrootExecutor) PrepareCommand(cmd *exec.Cmd, workDir string) error {
 		cmd.Dir = "/"
 	}
 
-	// Set up credential to run as current user (required for chroot)
+	// Set up credential to run as current user (required for chroot),
+	// unless the exec already asked for another user.
 	// Note: chroot typically requires root privileges or specific capabilities
-	currentUID := uint32(os.Getuid())
-	currentGID := uint32(os.Getgid())
-
-	cmd.SysProcAttr.Credential = &syscall.Credential{
-		Uid: currentUID,
-		Gid: currentGID,
+	if cmd.SysProcAttr.Credential == nil {
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		}
 	}
 
 	return nil
@@ -4,4 +4,39 @@ import "errors"
 
 var (
 	ErrUnavailable = errors.New("guest agent unavailable")
+	// ErrTooManyTransfers is returned when the agent is already running its
+	// configured maximum of concurrent file transfers.
+	ErrTooManyTransfers = errors.New("too many concurrent file transfers")
+	// ErrCommandNotFound is returned by Which when no executable matches the
+	// requested name.
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrBufferBudgetExceeded is returned when starting an exec would push the
+	// agent's reserved result buffer memory past its MaxBufferedBytes.
+	ErrBufferBudgetExceeded = errors.New("result buffer budget exceeded")
+	// ErrPermissionDenied is returned when the agent lacks the privilege for
+	// an operation, such as changing ownership when it is not root.
+	ErrPermissionDenied = errors.New("agent lacks permission")
+	// ErrArgsTooLarge is returned when an exec exceeds the agent's MaxArgs or
+	// MaxArgBytes.
+	ErrArgsTooLarge = errors.New("exec arguments too large")
+	// ErrUnauthorized is returned when a request's credentials are rejected.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrUnsupported is returned when the agent does not handle a request,
+	// because it predates it or was started without the feature.
+	ErrUnsupported = errors.New("request not supported by agent")
+	// ErrChecksumMismatch is returned when a verified file transfer arrived
+	// with different contents than were sent.
+	ErrChecksumMismatch = errors.New("file checksum mismatch")
+	// ErrWorkingDirNotFound is returned when an exec's WorkingDir does not
+	// exist, or is not a directory, and was not to be created.
+	ErrWorkingDirNotFound = errors.New("working directory not found")
+	// ErrAgentBusy is returned when the agent is already serving its
+	// configured maximum of concurrent connections.
+	ErrAgentBusy = errors.New("agent busy")
 )
+
+// errWebhooksDisabled explains why execs with a CompletionURL are refused.
+var errWebhooksDisabled = errors.New("completion webhooks are disabled on this agent")
+
+// errTTYUnsupported is returned where pseudo-terminals cannot be allocated.
+var errTTYUnsupported = errors.New("tty allocation is not supported on this platform")
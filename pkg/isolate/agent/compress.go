@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Compression names an encoding for exec output on the wire. Gzip is the
+// only one implemented.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+)
+
+const (
+	// compressMinBytes is the smallest chunk worth compressing; below it
+	// the encoding overhead outweighs the saving.
+	compressMinBytes = 1 << 10
+	// maxDecompressedBytes bounds what a single compressed field may expand
+	// to, so a corrupt or hostile frame cannot exhaust memory.
+	maxDecompressedBytes = 64 << 20
+)
+
+// acceptedEncodings lists the output encodings IPCClient can decode; it is
+// sent with every exec.
+var acceptedEncodings = []string{string(CompressionGzip)}
+
+// outputEncoding picks the encoding for an exec's output: the server's
+// configured compression if the client accepts it. Detached jobs stay
+// uncompressed since a later attach may come from a client that does not.
+func (s *Server) outputEncoding(payload *execRequestPayload) string {
+	if s.compression == "" || payload.Detach || !slices.Contains(payload.AcceptEncoding, s.compression) {
+		return ""
+	}
+	return s.compression
+}
+
+// serverCompression validates the configured compression, returning the
+// encoding the server will use or "" for none.
+func serverCompression(c Compression) (string, error) {
+	switch c {
+	case "", CompressionNone:
+		return "", nil
+	case CompressionGzip:
+		return string(c), nil
+	default:
+		return "", fmt.Errorf("unknown compression %q", c)
+	}
+}
+
+// encodeOutput compresses data with enc when that makes it smaller, and
+// returns the bytes to send with the encoding actually applied.
+func encodeOutput(enc string, data []byte) ([]byte, string) {
+	if enc != string(CompressionGzip) || len(data) < compressMinBytes {
+		return data, ""
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		return data, ""
+	}
+	if err := gz.Close(); err != nil || buf.Len() >= len(data) {
+		return data, ""
+	}
+	return buf.Bytes(), enc
+}
+
+// decodeOutput reverses encodeOutput.
+func decodeOutput(enc string, data []byte) ([]byte, error) {
+	switch enc {
+	case "":
+		return data, nil
+	case string(CompressionGzip):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		out, err := io.ReadAll(io.LimitReader(gz, maxDecompressedBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > maxDecompressedBytes {
+			return nil, fmt.Errorf("compressed output expands beyond %d bytes", maxDecompressedBytes)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported output encoding %q", enc)
+	}
+}
+
+// decode returns the chunk's data, inflating it if it was compressed.
+func (p *chunkPayload) decode() ([]byte, error) {
+	return decodeOutput(p.Encoding, p.Data)
+}
+
+// decode inflates compressed stdout and stderr in place.
+func (p *execResultPayload) decode() error {
+	var err error
+	if p.Stdout, err = decodeOutput(p.StdoutEncoding, p.Stdout); err != nil {
+		return fmt.Errorf("stdout: %w", err)
+	}
+	if p.Stderr, err = decodeOutput(p.StderrEncoding, p.Stderr); err != nil {
+		return fmt.Errorf("stderr: %w", err)
+	}
+	p.StdoutEncoding, p.StderrEncoding = "", ""
+	return nil
+}
+
+// encode compresses large stdout and stderr in place.
+func (p *execResultPayload) encode(enc string) {
+	p.Stdout, p.StdoutEncoding = encodeOutput(enc, p.Stdout)
+	p.Stderr, p.StderrEncoding = encodeOutput(enc, p.Stderr)
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// busyLinger bounds how long the server reads from a connection it turned
+// away before closing it.
+const busyLinger = time.Second
+
+// connLimit counts the connections a server is serving and caps them at
+// ServerConfig.MaxConcurrent.
+type connLimit struct {
+	mu     sync.Mutex
+	limit  int // zero means unlimited; connections are still counted
+	active int
+}
+
+// acquire claims a slot, reporting false when every slot is taken.
+func (l *connLimit) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 0 && l.active >= l.limit {
+		return false
+	}
+	l.active++
+	return true
+}
+
+func (l *connLimit) release() {
+	l.mu.Lock()
+	l.active--
+	l.mu.Unlock()
+}
+
+func (l *connLimit) usage() (active, limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.active, l.limit
+}
+
+// refuseBusy answers a connection that arrived while MaxConcurrent were
+// being served with an agent_busy error. What the client already sent is
+// read first, for up to busyLinger, so a TCP connection is not reset with
+// the error frame still unread.
+func (s *Server) refuseBusy(conn net.Conn, writer *frameWriter) {
+	_, limit := s.conns.usage()
+	_ = writer.send(frameTypeError, errorPayload{
+		Message: fmt.Sprintf("limit of %d connections reached", limit),
+		Code:    errorCodeAgentBusy,
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(busyLinger))
+	_, _ = io.Copy(io.Discard, conn)
+}
+
+// busyError returns ErrAgentBusy when frame, read in place of the reply to
+// a hello, turned the connection away; nil otherwise.
+func busyError(frame *rawFrame) error {
+	if frame.Type != frameTypeError {
+		return nil
+	}
+	var payload errorPayload
+	if json.Unmarshal(frame.Payload, &payload) != nil || payload.Code != errorCodeAgentBusy {
+		return nil
+	}
+	return payload.err()
+}
@@ -0,0 +1,329 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Entry types of a tree upload; regular files leave the type empty.
+const (
+	filePutTypeDir     = "dir"
+	filePutTypeSymlink = "symlink"
+)
+
+// CopyProgress reports how far a CopyDirTo has got. Bytes and TotalBytes
+// count regular file contents only.
+type CopyProgress struct {
+	Path         string // slash-separated path of the current entry
+	Entries      int    // entries fully sent
+	TotalEntries int
+	Bytes        int64
+	TotalBytes   int64
+}
+
+type treeEntry struct {
+	rel  string
+	path string
+	info fs.FileInfo
+}
+
+// CopyDirTo uploads the directory tree at srcDir on the host to dst in the
+// guest over a single connection, preserving relative paths, permission
+// bits, empty directories and symlinks. Other special files are skipped.
+// progress, when non-nil, is called as file contents are sent and after
+// every entry. An agent with a root directory refuses symlinks that point
+// outside it; entries written before a failure are kept.
+func (c *IPCClient) CopyDirTo(ctx context.Context, srcDir, dst string, progress func(CopyProgress)) error {
+	if srcDir == "" {
+		return fmt.Errorf("source directory is required")
+	}
+	if dst == "" {
+		return fmt.Errorf("destination path is required")
+	}
+	entries, total, err := walkTree(srcDir)
+	if err != nil {
+		return err
+	}
+	if err := c.requireFeature(ctx, FeatureTreeUpload); err != nil {
+		return err
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	writer := newFrameWriter(conn)
+	dec := json.NewDecoder(conn)
+	closeOnContext(ctx, conn)
+
+	if err := writer.send(frameTypeFilePutRequest, filePutRequestPayload{Path: dst, Tree: true}); err != nil {
+		return err
+	}
+	state := CopyProgress{TotalEntries: len(entries), TotalBytes: total}
+	report := func() {
+		if progress != nil {
+			progress(state)
+		}
+	}
+	for _, entry := range entries {
+		state.Path = entry.rel
+		if err := c.sendTreeEntry(ctx, writer, entry, func(n int) {
+			state.Bytes += int64(n)
+			report()
+		}); err != nil {
+			return fmt.Errorf("%s: %w", entry.rel, err)
+		}
+		state.Entries++
+		report()
+	}
+	if err := writer.send(frameTypeFilePutClose, nil); err != nil {
+		return err
+	}
+
+	result, err := c.readFileTransferResult(ctx, dec, frameTypeFilePutResult)
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+// walkTree lists the directories, regular files and symlinks below root in
+// lexical order, so parents precede their children, and sums the file sizes.
+func walkTree(root string) ([]treeEntry, int64, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !info.IsDir() {
+		return nil, 0, fmt.Errorf("%s is not a directory", root)
+	}
+	var (
+		entries []treeEntry
+		total   int64
+	)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		mode := info.Mode()
+		if !mode.IsDir() && !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, treeEntry{rel: filepath.ToSlash(rel), path: path, info: info})
+		if mode.IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].rel < entries[j].rel })
+	return entries, total, nil
+}
+
+func (c *IPCClient) sendTreeEntry(ctx context.Context, writer *frameWriter, entry treeEntry, sent func(int)) error {
+	mode := entry.info.Mode()
+	payload := filePutRequestPayload{
+		Path: entry.rel,
+		Mode: uint32(mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)),
+	}
+	switch {
+	case mode.IsDir():
+		payload.Type = filePutTypeDir
+		return writer.send(frameTypeFilePutRequest, payload)
+	case mode&fs.ModeSymlink != 0:
+		link, err := os.Readlink(entry.path)
+		if err != nil {
+			return err
+		}
+		payload.Type = filePutTypeSymlink
+		payload.Linkname = link
+		return writer.send(frameTypeFilePutRequest, payload)
+	}
+
+	file, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := writer.send(frameTypeFilePutRequest, payload); err != nil {
+		return err
+	}
+	return c.sendChunks(ctx, writer, &countingReader{r: file, read: sent}, frameTypeFilePutChunk, frameTypeFilePutClose, nil)
+}
+
+// countingReader reports the size of every read to read.
+type countingReader struct {
+	r    io.Reader
+	read func(int)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.read(n)
+	}
+	return n, err
+}
+
+// handleFilePutTree receives the entries of a tree upload into payload.Path.
+// Each entry is a file_put_request with a relative path; regular files are
+// followed by their chunks and a file_put_close. A file_put_close between
+// entries ends the upload. After an entry fails, the rest of the upload is
+// read and discarded so the error is reported in the result.
+func (s *Server) handleFilePutTree(dec *json.Decoder, writer *frameWriter, payload filePutRequestPayload) {
+	base, err := s.resolveRootedPath(payload.Path)
+	if err == nil {
+		err = os.MkdirAll(base, 0o755)
+	}
+	var (
+		putErr  error
+		written int64
+		dirs    []filePutRequestPayload
+	)
+	if err != nil {
+		putErr = err
+	}
+	for {
+		frame, err := readFrame(dec)
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+		switch frame.Type {
+		case frameTypeFilePutRequest:
+			var entry filePutRequestPayload
+			if err := json.Unmarshal(frame.Payload, &entry); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			var upload *chunkReader
+			if entry.Type == "" {
+				upload = &chunkReader{dec: dec, chunkType: frameTypeFilePutChunk, closeType: frameTypeFilePutClose}
+			}
+			if putErr == nil {
+				if err := s.putTreeEntry(base, entry, upload); err != nil {
+					putErr = fmt.Errorf("%s: %w", entry.Path, err)
+				} else if entry.Type == filePutTypeDir {
+					dirs = append(dirs, entry)
+				}
+			}
+			if upload != nil {
+				if _, err := io.Copy(io.Discard, upload); err != nil {
+					_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+					return
+				}
+				written += upload.received
+			}
+		case frameTypeFilePutClose:
+			// Directory modes are applied last so read-only directories can
+			// still be filled, deepest first.
+			for i := len(dirs) - 1; i >= 0 && putErr == nil; i-- {
+				if err := os.Chmod(filepath.Join(base, filepath.FromSlash(dirs[i].Path)), treeEntryMode(dirs[i], 0o755)); err != nil {
+					putErr = err
+				}
+			}
+			result := fileTransferResultPayload{Bytes: written}
+			if putErr != nil {
+				result.Error = putErr.Error()
+			}
+			_ = writer.send(frameTypeFilePutResult, result)
+			return
+		default:
+			_ = writer.send(frameTypeError, errorPayload{Message: "unexpected frame during tree upload"})
+			return
+		}
+	}
+}
+
+// putTreeEntry creates one entry of a tree upload below base. Names must be
+// relative and stay inside base; with a root directory, symlink targets must
+// stay inside the root.
+func (s *Server) putTreeEntry(base string, entry filePutRequestPayload, upload io.Reader) error {
+	name := filepath.Clean(filepath.FromSlash(entry.Path))
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("entry escapes the destination directory")
+	}
+	target := filepath.Join(base, name)
+	if err := s.checkEntryWithinRoot(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	// Never write through whatever currently occupies the name; a symlink
+	// there could point anywhere.
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	switch entry.Type {
+	case filePutTypeDir:
+		return os.MkdirAll(target, 0o755)
+	case filePutTypeSymlink:
+		if entry.Linkname == "" {
+			return fmt.Errorf("symlink target is required")
+		}
+		if s.rootDir != "" {
+			link := entry.Linkname
+			if !filepath.IsAbs(link) {
+				link = filepath.Join(filepath.Dir(target), link)
+			}
+			if err := s.checkPathWithinRoot(link, "symlink target"); err != nil {
+				return err
+			}
+		}
+		return os.Symlink(entry.Linkname, target)
+	case "":
+		mode := treeEntryMode(entry, defaultFileMode)
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, upload); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+		// Set the mode explicitly; the umask applied at creation.
+		return os.Chmod(target, mode)
+	default:
+		return fmt.Errorf("unsupported entry type %q", entry.Type)
+	}
+}
+
+func treeEntryMode(entry filePutRequestPayload, fallback os.FileMode) os.FileMode {
+	mode := os.FileMode(entry.Mode) & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if mode == 0 {
+		return fallback
+	}
+	return mode
+}
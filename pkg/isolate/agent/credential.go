@@ -0,0 +1,182 @@
+package agent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// execUser is the account an exec runs as.
+type execUser struct {
+	UID    uint32   `json:"uid"`
+	GID    uint32   `json:"gid"`
+	Groups []uint32 `json:"groups,omitempty"` // supplementary groups
+}
+
+// resolveExecUser resolves spec, a user name or uid optionally followed by
+// ":group" with a group name or gid. root selects the account database of a
+// chroot; empty means the agent's own, read through os/user. A numeric
+// "uid:gid" needs no database entry; anything else must exist in it.
+func resolveExecUser(root, spec string) (*execUser, error) {
+	name, group, hasGroup := strings.Cut(spec, ":")
+	if name == "" || (hasGroup && group == "") {
+		return nil, fmt.Errorf("invalid user %q", spec)
+	}
+
+	uid, uidErr := parseID(name)
+	gid, gidErr := parseID(group)
+	if uidErr == nil && hasGroup && gidErr == nil {
+		return &execUser{UID: uid, GID: gid}, nil
+	}
+
+	var u *execUser
+	if root != "" {
+		entry, err := lookupPasswd(root, name)
+		if err != nil {
+			return nil, err
+		}
+		u = &execUser{UID: uint32(entry.UID), GID: uint32(entry.GID)}
+	} else {
+		var err error
+		if u, err = lookupSystemUser(name); err != nil {
+			return nil, err
+		}
+	}
+	if !hasGroup {
+		return u, nil
+	}
+	if gidErr != nil {
+		var err error
+		if gid, err = lookupGroupID(root, group); err != nil {
+			return nil, err
+		}
+	}
+	// An explicit group replaces the user's groups entirely.
+	u.GID = gid
+	u.Groups = nil
+	return u, nil
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// lookupSystemUser finds name, a user name or uid, in the agent's own
+// account database, with its supplementary groups.
+func lookupSystemUser(name string) (*execUser, error) {
+	var (
+		u   *user.User
+		err error
+	)
+	if _, numErr := parseID(name); numErr == nil {
+		u, err = user.LookupId(name)
+	} else {
+		u, err = user.Lookup(name)
+	}
+	var unknownName user.UnknownUserError
+	var unknownID user.UnknownUserIdError
+	if errors.As(err, &unknownName) || errors.As(err, &unknownID) {
+		return nil, fmt.Errorf("user %q not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("look up user %q: %w", name, err)
+	}
+	uid, err := parseID(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("user %q has non-numeric uid %q", name, u.Uid)
+	}
+	gid, err := parseID(u.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("user %q has non-numeric gid %q", name, u.Gid)
+	}
+	out := &execUser{UID: uid, GID: gid}
+	ids, _ := u.GroupIds()
+	for _, id := range ids {
+		if g, err := parseID(id); err == nil && g != gid {
+			out.Groups = append(out.Groups, g)
+		}
+	}
+	return out, nil
+}
+
+// lookupGroupID resolves a group name in the agent's account database, or
+// in the /etc/group of root when it is set.
+func lookupGroupID(root, name string) (uint32, error) {
+	if root == "" {
+		g, err := user.LookupGroup(name)
+		var unknown user.UnknownGroupError
+		if errors.As(err, &unknown) {
+			return 0, fmt.Errorf("group %q not found", name)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("look up group %q: %w", name, err)
+		}
+		return parseID(g.Gid)
+	}
+
+	f, err := os.Open(filepath.Join(root, "/etc/group"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// name:password:gid:members
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		return parseID(fields[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("group %q not found in group database", name)
+}
+
+// execCredential resolves the user an exec asked for, in the account
+// database of the root directory when commands are confined to it.
+func (s *Server) execCredential(spec string) (*execUser, error) {
+	root := ""
+	if s.rootIsolated() {
+		root = s.rootDir
+	}
+	return switchUser(root, spec)
+}
+
+// switchUser resolves spec for a command the agent starts. It returns nil
+// when the command should keep the agent's own credentials, and fails with
+// ErrPermissionDenied when an unprivileged agent is asked to switch to
+// someone else.
+func switchUser(root, spec string) (*execUser, error) {
+	u, err := resolveExecUser(root, spec)
+	if err != nil {
+		return nil, err
+	}
+	if os.Geteuid() == 0 {
+		return u, nil
+	}
+	if int(u.UID) == os.Getuid() && int(u.GID) == os.Getgid() {
+		return nil, nil
+	}
+	return nil, &userSwitchError{uid: os.Getuid(), spec: spec}
+}
+
+// userSwitchError reports an unprivileged agent asked to run a command as
+// another user. It matches ErrPermissionDenied.
+type userSwitchError struct {
+	uid  int
+	spec string
+}
+
+func (e *userSwitchError) Error() string {
+	return fmt.Sprintf("agent runs as uid %d and cannot run commands as %q", e.uid, e.spec)
+}
+
+func (e *userSwitchError) Unwrap() error { return ErrPermissionDenied }
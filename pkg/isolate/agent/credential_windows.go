@@ -0,0 +1,12 @@
+//go:build windows
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func setCredential(cmd *exec.Cmd, u *execUser) error {
+	return errors.New("running commands as another user is not supported on windows")
+}
@@ -0,0 +1,65 @@
+package agent
+
+import "os/exec"
+
+// refuseExec answers an exec that may not run with resp. A dry run is
+// answered with a result reporting it blocked for resp's reason instead, and
+// its connection may serve further requests.
+func (s *Server) refuseExec(frames frameSource, writer *frameWriter, payload *execRequestPayload, resp errorPayload, keepAlive bool) (reusable bool) {
+	if !payload.DryRun {
+		_ = writer.send(frameTypeError, resp)
+		return false
+	}
+	report := &dryRunPayload{
+		Path:       payload.Path,
+		Args:       payload.Args,
+		WorkingDir: payload.WorkingDir,
+		Blocked:    true,
+		Reason:     resp.Message,
+		Code:       resp.Code,
+	}
+	return s.reportDryRun(frames, writer, payload, report, keepAlive)
+}
+
+// dryRunReport describes command, prepared for payload with every check
+// passed, as it would have started.
+func (s *Server) dryRunReport(command *exec.Cmd, payload *execRequestPayload, cred *execUser) *dryRunPayload {
+	report := &dryRunPayload{
+		Path:       payload.Path,
+		Args:       payload.Args,
+		WorkingDir: command.Dir,
+		User:       cred,
+	}
+	if s.rootIsolated() {
+		report.Chroot = s.rootDir
+	}
+	return report
+}
+
+// reportDryRun answers a dry run with report in place of the command's
+// result.
+func (s *Server) reportDryRun(frames frameSource, writer *frameWriter, payload *execRequestPayload, report *dryRunPayload, keepAlive bool) (reusable bool) {
+	_ = writer.send(frameTypeResult, execResultPayload{DryRun: report})
+	return s.awaitResultAck(frames, writer, payload, keepAlive)
+}
+
+// report converts p for CommandResult; nil stays nil.
+func (p *dryRunPayload) report() *DryRunReport {
+	if p == nil {
+		return nil
+	}
+	r := &DryRunReport{
+		Path:       p.Path,
+		Args:       p.Args,
+		WorkingDir: p.WorkingDir,
+		Chroot:     p.Chroot,
+		Blocked:    p.Blocked,
+	}
+	if p.User != nil {
+		r.User = &ExecCredential{UID: p.User.UID, GID: p.User.GID, Groups: p.User.Groups}
+	}
+	if p.Blocked {
+		r.Err = errorPayload{Message: p.Reason, Code: p.Code}.err()
+	}
+	return r
+}
@@ -0,0 +1,203 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultEgressNetwork is where the links of egress-restricted execs are
+// numbered when ServerConfig.EgressNetwork is empty.
+const defaultEgressNetwork = "10.254.0.0/16"
+
+// errEgressUnsupported explains why the agent refuses exec requests carrying
+// egress_allow: without a network namespace of its own, the command would
+// run with the agent's unrestricted network.
+var errEgressUnsupported = errors.New("egress rules need a linux agent running as root with the exec init helper")
+
+// egressRule admits traffic to network, on port (TCP and UDP) when it is
+// non-zero or any protocol otherwise.
+type egressRule struct {
+	network *net.IPNet
+	port    uint16
+}
+
+// parseEgressRules parses EgressAllow entries: an IPv4 address, an IPv4
+// CIDR or a host name, each optionally followed by ":port". Host names are
+// resolved now, to every IPv4 address they have.
+func parseEgressRules(ctx context.Context, entries []string) ([]egressRule, error) {
+	var rules []egressRule
+	for _, entry := range entries {
+		parsed, err := parseEgressRule(ctx, entry)
+		if err != nil {
+			return nil, fmt.Errorf("egress rule %q: %w", entry, err)
+		}
+		rules = append(rules, parsed...)
+	}
+	return rules, nil
+}
+
+func parseEgressRule(ctx context.Context, entry string) ([]egressRule, error) {
+	dest, port := entry, uint16(0)
+	if i := strings.LastIndexByte(entry, ':'); i >= 0 {
+		if strings.Contains(entry[:i], ":") || strings.HasPrefix(entry, "[") {
+			return nil, errors.New("only IPv4 destinations are supported")
+		}
+		n, err := strconv.ParseUint(entry[i+1:], 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port %q", entry[i+1:])
+		}
+		dest, port = entry[:i], uint16(n)
+	}
+	if dest == "" {
+		return nil, errors.New("missing destination")
+	}
+	if _, network, err := net.ParseCIDR(dest); err == nil {
+		if network.IP.To4() == nil {
+			return nil, errors.New("only IPv4 destinations are supported")
+		}
+		return []egressRule{{network: network, port: port}}, nil
+	}
+	if ip := net.ParseIP(dest); ip != nil {
+		if ip.To4() == nil {
+			return nil, errors.New("only IPv4 destinations are supported")
+		}
+		return []egressRule{{network: hostNetwork(ip), port: port}}, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", dest)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]egressRule, len(ips))
+	for i, ip := range ips {
+		rules[i] = egressRule{network: hostNetwork(ip), port: port}
+	}
+	return rules, nil
+}
+
+// hostNetwork is the /32 holding just ip.
+func hostNetwork(ip net.IP) *net.IPNet {
+	return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+}
+
+// egressPool numbers the links of egress-restricted execs, handing each a
+// /30 of its network: the host end of the link takes the first address and
+// the command's end the second.
+type egressPool struct {
+	base uint32
+	size int // number of /30 blocks
+
+	mu   sync.Mutex
+	used map[int]bool
+}
+
+func newEgressPool(cidr string) (*egressPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := network.Mask.Size()
+	if bits != 32 {
+		return nil, errors.New("must be an IPv4 network")
+	}
+	if ones > 30 {
+		return nil, errors.New("must hold at least a /30")
+	}
+	return &egressPool{
+		base: binary.BigEndian.Uint32(network.IP.To4()),
+		size: 1 << (30 - ones),
+		used: make(map[int]bool),
+	}, nil
+}
+
+// allocate reserves a /30 for a new link, returning nil when all are in use.
+func (p *egressPool) allocate() *egressLink {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.size {
+		if !p.used[i] {
+			p.used[i] = true
+			return &egressLink{pool: p, index: i}
+		}
+	}
+	return nil
+}
+
+func (p *egressPool) free(index int) {
+	p.mu.Lock()
+	delete(p.used, index)
+	p.mu.Unlock()
+}
+
+// egressLink connects the network namespace of one egress-restricted exec
+// to the agent's: a veth pair whose host end filters what the command
+// sends, so the rules stay out of reach of the command itself.
+type egressLink struct {
+	pool  *egressPool
+	index int
+	rules []egressRule
+
+	// ready is handed to the exec init helper, which waits on it before
+	// configuring its end of the link; signal is the agent's end.
+	ready, signal *os.File
+	hostUp        bool // the veth pair and the filter exist on the host
+}
+
+// hostName and guestName are the interfaces' names in the agent's namespace.
+func (l *egressLink) hostName() string  { return fmt.Sprintf("egress%d", l.index) }
+func (l *egressLink) guestName() string { return fmt.Sprintf("egress%dp", l.index) }
+
+// tableName is the nftables table holding the link's filter.
+func (l *egressLink) tableName() string { return fmt.Sprintf("agentd_egress%d", l.index) }
+
+func (l *egressLink) address(n uint32) net.IP {
+	return binary.BigEndian.AppendUint32(nil, l.pool.base+uint32(l.index)*4+n)
+}
+
+// gateway is the host end's address and guest the command's.
+func (l *egressLink) gateway() net.IP { return l.address(1) }
+func (l *egressLink) guest() net.IP   { return l.address(2) }
+
+// prepareEgress reserves a link for an exec restricted to rules and passes
+// cmd the helper's end of the ready pipe. The host side is set up later, by
+// setUp, just before the command starts.
+func (s *Server) prepareEgress(cmd *exec.Cmd, rules []egressRule) (*egressLink, *execInitEgress, error) {
+	link := s.egress.allocate()
+	if link == nil {
+		return nil, nil, errors.New("egress: every link address is in use")
+	}
+	var err error
+	link.ready, link.signal, err = os.Pipe()
+	if err != nil {
+		link.release()
+		return nil, nil, fmt.Errorf("egress: %w", err)
+	}
+	link.rules = rules
+	cmd.ExtraFiles = append(cmd.ExtraFiles, link.ready)
+	return link, &execInitEgress{
+		Link:    link.guestName(),
+		Address: (&net.IPNet{IP: link.guest(), Mask: net.CIDRMask(30, 32)}).String(),
+		Gateway: link.gateway().String(),
+		ReadyFD: 2 + len(cmd.ExtraFiles),
+	}, nil
+}
+
+// release tears down whatever setUp created and frees the link's addresses.
+func (l *egressLink) release() {
+	if l.hostUp {
+		l.tearDown()
+	}
+	for _, f := range []*os.File{l.ready, l.signal} {
+		if f != nil {
+			_ = f.Close()
+		}
+	}
+	l.pool.free(l.index)
+}
@@ -0,0 +1,473 @@
+//go:build linux
+
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// nftables message types, attributes and values used by the egress filter
+// (linux/netfilter/nf_tables.h, linux/netfilter/nfnetlink.h).
+const (
+	nfnlSubsysNFTables = 10
+	nfnlMsgBatchBegin  = 0x10
+	nfnlMsgBatchEnd    = 0x11
+
+	nftMsgNewTable = 0
+	nftMsgDelTable = 2
+	nftMsgNewChain = 3
+	nftMsgNewRule  = 6
+
+	nfprotoInet = 1
+	nfprotoIPv4 = 2
+
+	nftaTableName       = 1
+	nftaChainTable      = 1
+	nftaChainName       = 3
+	nftaChainHook       = 4
+	nftaChainPolicy     = 5
+	nftaChainType       = 7
+	nftaHookHooknum     = 1
+	nftaHookPriority    = 2
+	nftaRuleTable       = 1
+	nftaRuleChain       = 2
+	nftaRuleExpressions = 4
+	nftaListElem        = 1
+	nftaExprName        = 1
+	nftaExprData        = 2
+	nftaDataValue       = 1
+	nftaDataVerdict     = 2
+	nftaVerdictCode     = 1
+	nftaVerdictChain    = 2
+
+	nfInetLocalIn     = 1
+	nfInetForward     = 2
+	nfInetPostRouting = 4
+	nfAccept          = 1
+	nftJump           = 0xfffffffd // -3
+	nftRegVerdict     = 0
+	nftReg1           = 1
+
+	nftaMetaDreg      = 1
+	nftaMetaKey       = 2
+	nftaPayloadDreg   = 1
+	nftaPayloadBase   = 2
+	nftaPayloadOffset = 3
+	nftaPayloadLen    = 4
+	nftaCtDreg        = 1
+	nftaCtKey         = 2
+	nftaBitwiseSreg   = 1
+	nftaBitwiseDreg   = 2
+	nftaBitwiseLen    = 3
+	nftaBitwiseMask   = 4
+	nftaBitwiseXor    = 5
+	nftaCmpSreg       = 1
+	nftaCmpOp         = 2
+	nftaCmpData       = 3
+	nftaImmediateDreg = 1
+	nftaImmediateData = 2
+	nftaRejectType    = 1
+	nftaRejectICMP    = 2
+
+	nftMetaIIFName = 6
+	nftMetaOIFName = 7
+	nftMetaNFProto = 15
+	nftMetaL4Proto = 16
+	nftCmpEq       = 0
+	nftCmpNeq      = 1
+	nftPayloadNet  = 1
+	nftPayloadTH   = 2
+	nftCtState     = 0
+
+	ctStateEstablished = 1 << 1
+	ctStateRelated     = 1 << 2
+
+	nftRejectICMPXUnreach         = 2
+	nftRejectICMPXAdminProhibited = 3
+
+	// natSourcePriority is the postrouting priority of source NAT.
+	natSourcePriority = 100
+)
+
+// egressAvailable reports whether execs can be given a network namespace
+// with filtered egress: the agent plumbs it from the host namespace, which
+// takes root, through the exec init helper.
+func egressAvailable() bool {
+	return os.Geteuid() == 0 && execInitEnabled.Load()
+}
+
+// setUp creates the link's veth pair in the agent's namespace, addresses
+// the host end and installs its filter. Both ends stay on the host until
+// attach moves the command's end.
+func (l *egressLink) setUp() error {
+	rt, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	defer rt.close()
+	nft, err := openNetlink(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	defer nft.close()
+
+	// A link or table left behind by an agent that crashed is in the way.
+	l.removeHostSide(rt, nft)
+	l.hostUp = true
+	if err := rt.addVethPair(l.hostName(), l.guestName()); err != nil {
+		return fmt.Errorf("egress: create link %s: %w", l.hostName(), err)
+	}
+	host, err := net.InterfaceByName(l.hostName())
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	if err := rt.addAddress(host.Index, &net.IPNet{IP: l.gateway(), Mask: net.CIDRMask(30, 32)}); err != nil {
+		return fmt.Errorf("egress: address %s: %w", l.hostName(), err)
+	}
+	if err := rt.setLinkUp(host.Index); err != nil {
+		return fmt.Errorf("egress: bring up %s: %w", l.hostName(), err)
+	}
+	routed := l.routed()
+	if err := l.filter(routed).commit(nft); err != nil {
+		return fmt.Errorf("egress: install filter: %w", err)
+	}
+	if routed {
+		if err := enableIPForwarding(); err != nil {
+			return fmt.Errorf("egress: %w", err)
+		}
+	}
+	return nil
+}
+
+// routed reports whether any destination lies beyond the agent's host and
+// so needs the command's traffic forwarded and masqueraded.
+func (l *egressLink) routed() bool {
+	addrs, _ := net.InterfaceAddrs()
+	for _, rule := range l.rules {
+		if ones, _ := rule.network.Mask.Size(); ones < 32 {
+			return true
+		}
+		local := false
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(rule.network.IP) {
+				local = true
+				break
+			}
+		}
+		if !local {
+			return true
+		}
+	}
+	return false
+}
+
+// filter builds the link's table. Whatever the command sends arrives on
+// the host end, where the input and forward hooks hand it to the egress
+// chain: replies and allowed destinations pass, the rest is rejected.
+func (l *egressLink) filter(routed bool) *nftBatch {
+	table, link := l.tableName(), l.hostName()
+	b := &nftBatch{}
+	m := b.add(nftMsgNewTable, syscall.NLM_F_CREATE)
+	m.attrString(nftaTableName, table)
+	b.addChain(table, "egress", 0, 0, "")
+	b.addChain(table, "input", nfInetLocalIn, 0, "filter")
+	b.addChain(table, "forward", nfInetForward, 0, "filter")
+
+	b.addRule(table, "egress", ctStateLoad(), nftBitwise(nativeUint32(ctStateEstablished|ctStateRelated)), nftCmp(nftCmpNeq, nativeUint32(0)), nftVerdict(nfAccept, ""))
+	for _, rule := range l.rules {
+		match := []nftExpr{nftMeta(nftMetaNFProto), nftCmp(nftCmpEq, []byte{nfprotoIPv4})}
+		if ones, _ := rule.network.Mask.Size(); ones > 0 {
+			match = append(match, nftPayload(nftPayloadNet, 16, 4))
+			if ones < 32 {
+				match = append(match, nftBitwise(rule.network.Mask))
+			}
+			match = append(match, nftCmp(nftCmpEq, rule.network.IP.To4()))
+		}
+		if rule.port == 0 {
+			b.addRule(table, "egress", append(match, nftVerdict(nfAccept, ""))...)
+			continue
+		}
+		for _, proto := range []byte{syscall.IPPROTO_TCP, syscall.IPPROTO_UDP} {
+			exprs := append(append([]nftExpr(nil), match...),
+				nftMeta(nftMetaL4Proto), nftCmp(nftCmpEq, []byte{proto}),
+				nftPayload(nftPayloadTH, 2, 2), nftCmp(nftCmpEq, []byte{byte(rule.port >> 8), byte(rule.port)}),
+				nftVerdict(nfAccept, ""))
+			b.addRule(table, "egress", exprs...)
+		}
+	}
+	b.addRule(table, "egress", nftReject())
+	for _, chain := range []string{"input", "forward"} {
+		b.addRule(table, chain, nftMeta(nftMetaIIFName), nftCmp(nftCmpEq, ifName(link)), nftVerdict(nftJump, "egress"))
+	}
+
+	if routed {
+		b.addChain(table, "postrouting", nfInetPostRouting, natSourcePriority, "nat")
+		b.addRule(table, "postrouting",
+			nftMeta(nftMetaNFProto), nftCmp(nftCmpEq, []byte{nfprotoIPv4}),
+			nftPayload(nftPayloadNet, 12, 4), nftCmp(nftCmpEq, l.guest()),
+			nftMeta(nftMetaOIFName), nftCmp(nftCmpNeq, ifName(link)),
+			nftExpr{name: "masq"})
+	}
+	return b
+}
+
+// attach moves the command's end of the link into the network namespace of
+// its helper, pid, and lets the helper configure it.
+func (l *egressLink) attach(pid int) error {
+	_ = l.ready.Close()
+	l.ready = nil
+	rt, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	defer rt.close()
+	guest, err := net.InterfaceByName(l.guestName())
+	if err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	if err := rt.moveLink(guest.Index, pid); err != nil {
+		return fmt.Errorf("egress: move %s: %w", l.guestName(), err)
+	}
+	if _, err := l.signal.Write([]byte{1}); err != nil {
+		return fmt.Errorf("egress: %w", err)
+	}
+	return nil
+}
+
+// tearDown removes the link's filter and veth pair, the command's end
+// included wherever it is.
+func (l *egressLink) tearDown() {
+	rt, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return
+	}
+	defer rt.close()
+	nft, err := openNetlink(syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return
+	}
+	defer nft.close()
+	l.removeHostSide(rt, nft)
+	l.hostUp = false
+}
+
+func (l *egressLink) removeHostSide(rt, nft *nlSocket) {
+	b := &nftBatch{}
+	b.add(nftMsgDelTable, 0).attrString(nftaTableName, l.tableName())
+	_ = b.commit(nft)
+	if host, err := net.InterfaceByName(l.hostName()); err == nil {
+		_ = rt.deleteLink(host.Index)
+	}
+}
+
+// enableIPForwarding lets the host route the traffic of egress links.
+func enableIPForwarding() error {
+	const path = "/proc/sys/net/ipv4/ip_forward"
+	if data, err := os.ReadFile(path); err == nil && len(data) > 0 && data[0] == '1' {
+		return nil
+	}
+	if err := os.WriteFile(path, []byte("1"), 0); err != nil {
+		return fmt.Errorf("enable ip forwarding: %w", err)
+	}
+	return nil
+}
+
+// setUpEgressLink runs in the exec init helper, in the command's new network
+// namespace. It waits for the agent to move the command's end of the link
+// in, then brings it up as eth0, with the loopback interface and a default
+// route through the host end.
+func setUpEgressLink(cfg *execInitEgress) error {
+	ready := os.NewFile(uintptr(cfg.ReadyFD), "egress-ready")
+	var b [1]byte
+	_, err := io.ReadFull(ready, b[:])
+	_ = ready.Close()
+	if err != nil {
+		return fmt.Errorf("egress link was not set up: %w", err)
+	}
+	ip, network, err := net.ParseCIDR(cfg.Address)
+	if err != nil {
+		return fmt.Errorf("egress address: %w", err)
+	}
+	network.IP = ip
+	gateway := net.ParseIP(cfg.Gateway)
+	if gateway == nil {
+		return fmt.Errorf("egress gateway %q is not an address", cfg.Gateway)
+	}
+
+	rt, err := openNetlink(syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer rt.close()
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return err
+	}
+	if err := rt.setLinkUp(lo.Index); err != nil {
+		return fmt.Errorf("bring up lo: %w", err)
+	}
+	link, err := net.InterfaceByName(cfg.Link)
+	if err != nil {
+		return err
+	}
+	if err := rt.renameLink(link.Index, "eth0"); err != nil {
+		return fmt.Errorf("rename %s: %w", cfg.Link, err)
+	}
+	if err := rt.addAddress(link.Index, network); err != nil {
+		return fmt.Errorf("address eth0: %w", err)
+	}
+	if err := rt.setLinkUp(link.Index); err != nil {
+		return fmt.Errorf("bring up eth0: %w", err)
+	}
+	if err := rt.addDefaultRoute(link.Index, gateway); err != nil {
+		return fmt.Errorf("default route: %w", err)
+	}
+	return nil
+}
+
+// nftBatch collects nftables messages for the inet family, which commit
+// applies atomically.
+type nftBatch struct {
+	msgs []*nlMessage
+}
+
+// nfGenMsg renders a struct nfgenmsg.
+func nfGenMsg(family uint8, resID uint16) []byte {
+	return []byte{family, 0, byte(resID >> 8), byte(resID)}
+}
+
+func (b *nftBatch) add(typ uint16, flags uint16) *nlMessage {
+	m := newNLMessage(nfnlSubsysNFTables<<8|typ, flags|syscall.NLM_F_ACK, nfGenMsg(nfprotoInet, 0))
+	b.msgs = append(b.msgs, m)
+	return m
+}
+
+// addChain adds a regular chain, or a base chain of type typ on hook when
+// typ is set.
+func (b *nftBatch) addChain(table, name string, hook uint32, priority int32, typ string) {
+	m := b.add(nftMsgNewChain, syscall.NLM_F_CREATE)
+	m.attrString(nftaChainTable, table)
+	m.attrString(nftaChainName, name)
+	if typ == "" {
+		return
+	}
+	m.nest(nlaFNested|nftaChainHook, func() {
+		m.attrBE32(nftaHookHooknum, hook)
+		m.attrBE32(nftaHookPriority, uint32(priority))
+	})
+	m.attrBE32(nftaChainPolicy, nfAccept)
+	m.attrString(nftaChainType, typ)
+}
+
+func (b *nftBatch) addRule(table, chain string, exprs ...nftExpr) {
+	m := b.add(nftMsgNewRule, syscall.NLM_F_CREATE|syscall.NLM_F_APPEND)
+	m.attrString(nftaRuleTable, table)
+	m.attrString(nftaRuleChain, chain)
+	m.nest(nlaFNested|nftaRuleExpressions, func() {
+		for _, e := range exprs {
+			m.nest(nlaFNested|nftaListElem, func() {
+				m.attrString(nftaExprName, e.name)
+				if e.data != nil {
+					m.nest(nlaFNested|nftaExprData, func() { e.data(m) })
+				}
+			})
+		}
+	})
+}
+
+func (b *nftBatch) commit(s *nlSocket) error {
+	header := nfGenMsg(syscall.AF_UNSPEC, nfnlSubsysNFTables)
+	msgs := append([]*nlMessage{newNLMessage(nfnlMsgBatchBegin, 0, header)}, b.msgs...)
+	return s.exec(append(msgs, newNLMessage(nfnlMsgBatchEnd, 0, header))...)
+}
+
+// nftExpr is one expression of a rule; every one that loads a value loads
+// it into register 1.
+type nftExpr struct {
+	name string
+	data func(m *nlMessage)
+}
+
+func nftMeta(key uint32) nftExpr {
+	return nftExpr{"meta", func(m *nlMessage) {
+		m.attrBE32(nftaMetaDreg, nftReg1)
+		m.attrBE32(nftaMetaKey, key)
+	}}
+}
+
+func nftPayload(base, offset, length uint32) nftExpr {
+	return nftExpr{"payload", func(m *nlMessage) {
+		m.attrBE32(nftaPayloadDreg, nftReg1)
+		m.attrBE32(nftaPayloadBase, base)
+		m.attrBE32(nftaPayloadOffset, offset)
+		m.attrBE32(nftaPayloadLen, length)
+	}}
+}
+
+func ctStateLoad() nftExpr {
+	return nftExpr{"ct", func(m *nlMessage) {
+		m.attrBE32(nftaCtDreg, nftReg1)
+		m.attrBE32(nftaCtKey, nftCtState)
+	}}
+}
+
+// nftBitwise masks register 1 with mask.
+func nftBitwise(mask []byte) nftExpr {
+	return nftExpr{"bitwise", func(m *nlMessage) {
+		m.attrBE32(nftaBitwiseSreg, nftReg1)
+		m.attrBE32(nftaBitwiseDreg, nftReg1)
+		m.attrBE32(nftaBitwiseLen, uint32(len(mask)))
+		m.nest(nlaFNested|nftaBitwiseMask, func() { m.attr(nftaDataValue, mask) })
+		m.nest(nlaFNested|nftaBitwiseXor, func() { m.attr(nftaDataValue, make([]byte, len(mask))) })
+	}}
+}
+
+func nftCmp(op uint32, data []byte) nftExpr {
+	return nftExpr{"cmp", func(m *nlMessage) {
+		m.attrBE32(nftaCmpSreg, nftReg1)
+		m.attrBE32(nftaCmpOp, op)
+		m.nest(nlaFNested|nftaCmpData, func() { m.attr(nftaDataValue, data) })
+	}}
+}
+
+// nftVerdict ends the rule with code, jumping to chain for nftJump.
+func nftVerdict(code uint32, chain string) nftExpr {
+	return nftExpr{"immediate", func(m *nlMessage) {
+		m.attrBE32(nftaImmediateDreg, nftRegVerdict)
+		m.nest(nlaFNested|nftaImmediateData, func() {
+			m.nest(nlaFNested|nftaDataVerdict, func() {
+				m.attrBE32(nftaVerdictCode, code)
+				if chain != "" {
+					m.attrString(nftaVerdictChain, chain)
+				}
+			})
+		})
+	}}
+}
+
+// nftReject refuses a packet with an administratively-prohibited ICMP
+// error, so connections fail at once instead of timing out.
+func nftReject() nftExpr {
+	return nftExpr{"reject", func(m *nlMessage) {
+		m.attrBE32(nftaRejectType, nftRejectICMPXUnreach)
+		m.attr(nftaRejectICMP, []byte{nftRejectICMPXAdminProhibited})
+	}}
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+// ifName renders an interface name as meta iifname and oifname compare it.
+func ifName(name string) []byte {
+	b := make([]byte, syscall.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// listenEgress accepts connections on the host end of an egress link and
+// returns what each one sends.
+func listenEgress(t *testing.T) (int, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			data, _ := io.ReadAll(conn)
+			conn.Close()
+			received <- string(data)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port, received
+}
+
+func TestExecEgressAllow(t *testing.T) {
+	if !egressAvailable() {
+		t.Skip("egress rules need root")
+	}
+	if _, err := os.Stat("/bin/bash"); err != nil {
+		t.Skip("needs bash for /dev/tcp")
+	}
+	// The first exec of a fresh server gets the first /30, whose host end
+	// the command can address without any routing on the host.
+	_, client := startServer(t, ServerConfig{EgressNetwork: "10.254.250.0/30"})
+	const gateway = "10.254.250.1"
+	allowedPort, allowed := listenEgress(t)
+	blockedPort, blocked := listenEgress(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	script := fmt.Sprintf(`echo allowed >/dev/tcp/%[1]s/%[2]d || exit 10
+echo blocked >/dev/tcp/%[1]s/%[3]d && exit 11
+exit 0`, gateway, allowedPort, blockedPort)
+	result, err := client.Exec(ctx, &CommandRequest{
+		Path:        "/bin/bash",
+		Args:        []string{"-c", script},
+		EgressAllow: []string{fmt.Sprintf("%s:%d", gateway, allowedPort)},
+	})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	switch result.ExitCode {
+	case 0:
+	case 10:
+		t.Fatalf("allowed destination unreachable: %s", result.Stderr)
+	case 11:
+		t.Fatal("blocked destination reachable")
+	default:
+		t.Fatalf("exit code %d: %s", result.ExitCode, result.Stderr)
+	}
+	select {
+	case got := <-allowed:
+		if got != "allowed\n" {
+			t.Errorf("allowed destination received %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("allowed destination received nothing")
+	}
+	select {
+	case got := <-blocked:
+		t.Errorf("blocked destination received %q", got)
+	default:
+	}
+
+	if _, err := net.InterfaceByName("egress0"); err == nil {
+		t.Error("the link outlived the exec")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package agent
+
+func egressAvailable() bool { return false }
+
+func (l *egressLink) setUp() error { return errEgressUnsupported }
+
+func (l *egressLink) attach(pid int) error { return errEgressUnsupported }
+
+func (l *egressLink) tearDown() {}
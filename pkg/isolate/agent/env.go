@@ -1,5 +1,13 @@
 package agent
 
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
 func mergeEnv(base, overrides map[string]string) map[string]string {
 	merged := make(map[string]string, len(base)+len(overrides))
 	for k, v := range base {
@@ -25,3 +33,77 @@ func envMapToList(env map[string]string) []string {
 func flattenEnv(base, overrides map[string]string) []string {
 	return envMapToList(mergeEnv(base, overrides))
 }
+
+// envSnapshot renders a child's environment as sorted KEY=VALUE pairs with
+// values passed through redactor. A nil env means the child inherited this
+// process's environment.
+func envSnapshot(env []string, redactor Redactor) []string {
+	if env == nil {
+		env = os.Environ()
+	}
+	out := make([]string, 0, len(env))
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		out = append(out, key+"="+redactor.RedactEnv(key, value))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// envFilter decides which variables reach a child's environment. Patterns
+// use path.Match syntax, so AWS_* matches every key that starts with AWS_.
+type envFilter struct {
+	allow []string
+	deny  []string
+}
+
+// newEnvFilter returns the filter for the allow and deny patterns, or nil
+// when both are empty.
+func newEnvFilter(allow, deny []string) (*envFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	for _, pattern := range append(append([]string(nil), allow...), deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("env pattern %q: %w", pattern, err)
+		}
+	}
+	return &envFilter{allow: allow, deny: deny}, nil
+}
+
+// allowed reports whether key matches an allow pattern, when there are any,
+// and no deny pattern.
+func (f *envFilter) allowed(key string) bool {
+	if len(f.allow) > 0 && !matchesAny(f.allow, key) {
+		return false
+	}
+	return !matchesAny(f.deny, key)
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// apply returns env without the variables f rejects. A nil env stands for
+// the agent's own environment, which the child would otherwise inherit; it
+// is filtered the same way. A nil filter returns env unchanged.
+func (f *envFilter) apply(env map[string]string) map[string]string {
+	if f == nil {
+		return env
+	}
+	if env == nil {
+		env = environMap()
+	}
+	out := make(map[string]string, len(env))
+	for k, v := range env {
+		if f.allowed(k) {
+			out[k] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReturnEnvMatchesChildEnvironment(t *testing.T) {
+	self, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, tc := range []struct {
+		name string
+		cfg  ServerConfig
+		req  CommandRequest
+		want []string // entries the returned env must hold
+	}{
+		{
+			name: "request env",
+			req:  CommandRequest{Env: map[string]string{"FOO": "bar", "API_TOKEN": "hunter2"}},
+			want: []string{"FOO=bar", "API_TOKEN=" + RedactedPlaceholder},
+		},
+		{
+			name: "filtered and seeded for a user",
+			cfg:  ServerConfig{EnvDenylist: []string{"SECRET_*"}},
+			req:  CommandRequest{Env: map[string]string{"FOO": "bar", "SECRET_KEY": "x"}, User: self.Username},
+			want: []string{"FOO=bar", "USER=" + self.Username, "LOGNAME=" + self.Username, "HOME=" + self.HomeDir},
+		},
+		{
+			name: "inherited and allowlisted",
+			cfg:  ServerConfig{EnvAllowlist: []string{"PATH", "HOME"}},
+			want: []string{"PATH=" + os.Getenv("PATH")},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, client := startServer(t, tc.cfg)
+			req := tc.req
+			req.Path, req.ReturnEnv, req.WorkingDir = "env", true, os.TempDir()
+			result, err := client.Exec(ctx, &req)
+			if err != nil || result.ExitCode != 0 {
+				t.Fatalf("Exec = %+v, %v", result, err)
+			}
+			// What the child saw, redacted as the agent redacts its report.
+			var observed []string
+			for _, kv := range strings.Split(strings.TrimSuffix(string(result.Stdout), "\n"), "\n") {
+				key, value, _ := strings.Cut(kv, "=")
+				observed = append(observed, key+"="+DefaultRedactor().RedactEnv(key, value))
+			}
+			slices.Sort(observed)
+			if !reflect.DeepEqual(result.Env, observed) {
+				t.Errorf("returned env = %q\nchild saw %q", result.Env, observed)
+			}
+			for _, kv := range tc.want {
+				if !slices.Contains(result.Env, kv) {
+					t.Errorf("returned env lacks %q", kv)
+				}
+			}
+			for _, kv := range result.Env {
+				if strings.HasPrefix(kv, "SECRET_") || strings.Contains(kv, "hunter2") {
+					t.Errorf("returned env holds %q", kv)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync/atomic"
+)
+
+// execInitArg marks a re-exec of the agent binary as an exec init helper.
+// Some per-exec isolation (such as setting the hostname of a fresh UTS
+// namespace) has to run inside the child after clone but before the target
+// is executed, which os/exec cannot express. The agent therefore starts
+// itself as a tiny init that performs the setup and then execs the target.
+const execInitArg = "__agent-exec-init"
+
+// execInitConfig is handed to the init helper on its command line.
+type execInitConfig struct {
+	Hostname string          `json:"hostname,omitempty"`
+	Mounts   []execInitMount `json:"mounts,omitempty"`
+	Tmpfs    []execInitTmpfs `json:"tmpfs,omitempty"`
+	Egress   *execInitEgress `json:"egress,omitempty"`
+	Seccomp  []bpfInsn       `json:"seccomp,omitempty"`
+	Root     string          `json:"root,omitempty"` // chroot applied by the helper
+	User     *execUser       `json:"user,omitempty"` // credentials the helper switches to
+	Dir      string          `json:"dir,omitempty"`  // working directory, inside Root if set
+	Path     string          `json:"path"`
+	Args     []string        `json:"args"`
+}
+
+// execInitMount is a read-only bind mount made by the helper before any
+// chroot, so both paths are on the agent's filesystem.
+type execInitMount struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// execInitTmpfs is a size-limited tmpfs mounted by the helper, like
+// execInitMount before any chroot.
+type execInitTmpfs struct {
+	Target    string `json:"target"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+// execInitEgress is the command's end of its egress link, which the agent
+// moves into the helper's network namespace once it has started. The helper
+// waits for a byte on ReadyFD before configuring it.
+type execInitEgress struct {
+	Link    string `json:"link"`
+	Address string `json:"address"` // CIDR
+	Gateway string `json:"gateway"`
+	ReadyFD int    `json:"ready_fd"`
+}
+
+var execInitEnabled atomic.Bool
+
+// RunExecInit must be called at the very start of main by binaries that embed
+// a Server and want per-exec namespace features such as Hostname. When the
+// process was started as an exec init helper it performs the requested setup
+// and replaces itself with the target command, never returning. Otherwise it
+// returns immediately and enables those features for servers in this process.
+// Servers in binaries that never call it ignore the features with a warning,
+// except a seccomp profile: without the helper, every exec is refused.
+func RunExecInit() {
+	if len(os.Args) < 3 || os.Args[1] != execInitArg {
+		execInitEnabled.Store(true)
+		return
+	}
+	var cfg execInitConfig
+	if err := json.Unmarshal([]byte(os.Args[2]), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "exec init: %v\n", err)
+		os.Exit(execErrorExitCode)
+	}
+	if err := runExecInit(&cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "exec init: %v\n", err)
+		os.Exit(execInitExitCode(err))
+	}
+}
+
+// execInitExitCode is the exit status of a helper that failed with err. A
+// target that could not be executed gets the status a shell gives it, as it
+// would had the agent started it directly.
+func execInitExitCode(err error) int {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) && pathErr.Op == "exec" {
+		if exitCode, _, ok := startFailure(err); ok {
+			return exitCode
+		}
+	}
+	return execErrorExitCode
+}
+
+// wrapWithExecInit rewrites cmd to start through the init helper. A chroot
+// already configured on cmd is moved into the helper, since the helper binary
+// is not reachable from inside the new root, and so are credentials, since
+// the setup needs the agent's privileges.
+func wrapWithExecInit(cmd *exec.Cmd, cfg execInitConfig) error {
+	if !execInitEnabled.Load() {
+		return fmt.Errorf("exec init helper not enabled (agent.RunExecInit was not called)")
+	}
+	if cmd.Err != nil {
+		// Let Start report the lookup failure as usual.
+		return nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("locate agent binary: %w", err)
+	}
+
+	cfg.Path = cmd.Path
+	cfg.Args = cmd.Args
+	cfg.Dir = cmd.Dir
+	if cmd.SysProcAttr != nil {
+		cfg.Root = moveChroot(cmd.SysProcAttr)
+		cfg.User = moveCredential(cmd.SysProcAttr)
+	}
+	if cfg.Root != "" {
+		cmd.Dir = ""
+	}
+
+	encoded, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	cmd.Path = self
+	cmd.Args = []string{self, execInitArg, string(encoded)}
+	return nil
+}
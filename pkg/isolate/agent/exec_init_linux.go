@@ -0,0 +1,206 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	capSysChroot         = 18
+	capSysAdmin          = 21
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+	linuxCapabilityV3    = 0x20080522
+)
+
+func runExecInit(cfg *execInitConfig) error {
+	// Capabilities and seccomp filters are per thread; keep the setup on
+	// the thread that execs the target.
+	runtime.LockOSThread()
+	if len(cfg.Mounts) > 0 || len(cfg.Tmpfs) > 0 {
+		// Keep the mounts below out of the parent namespace.
+		if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("make mounts private: %w", err)
+		}
+		for _, m := range cfg.Mounts {
+			if err := bindReadOnly(m.Source, m.Target); err != nil {
+				return err
+			}
+		}
+		for _, t := range cfg.Tmpfs {
+			data := fmt.Sprintf("size=%d,mode=1777", t.SizeBytes)
+			if err := syscall.Mount("tmpfs", t.Target, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, data); err != nil {
+				return fmt.Errorf("mount tmpfs on %s: %w", t.Target, err)
+			}
+		}
+	}
+	if cfg.Hostname != "" {
+		if err := syscall.Sethostname([]byte(cfg.Hostname)); err != nil {
+			return fmt.Errorf("sethostname: %w", err)
+		}
+	}
+	if cfg.Egress != nil {
+		if err := setUpEgressLink(cfg.Egress); err != nil {
+			return err
+		}
+	}
+	dir := cfg.Dir
+	if cfg.Root != "" {
+		if err := syscall.Chroot(cfg.Root); err != nil {
+			return fmt.Errorf("chroot: %w", err)
+		}
+		if dir == "" {
+			dir = "/"
+		}
+	}
+	if u := cfg.User; u != nil {
+		groups := make([]int, len(u.Groups))
+		for i, g := range u.Groups {
+			groups[i] = int(g)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("setgroups: %w", err)
+		}
+		if err := syscall.Setgid(int(u.GID)); err != nil {
+			return fmt.Errorf("setgid: %w", err)
+		}
+		if err := syscall.Setuid(int(u.UID)); err != nil {
+			return fmt.Errorf("setuid: %w", err)
+		}
+	}
+	if dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+	if err := dropInheritedCaps(); err != nil {
+		return err
+	}
+	if len(cfg.Seccomp) > 0 {
+		if err := installSeccomp(cfg.Seccomp); err != nil {
+			return err
+		}
+	}
+	err := syscall.Exec(cfg.Path, cfg.Args, os.Environ())
+	return &os.PathError{Op: "exec", Path: cfg.Path, Err: err}
+}
+
+// dropInheritedCaps clears the ambient and inheritable capabilities raised
+// for the setup above so the target does not inherit them.
+func dropInheritedCaps() error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("clear ambient capabilities: %w", errno)
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityV3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %w", errno)
+	}
+	if data[0].inheritable == 0 && data[1].inheritable == 0 {
+		return nil
+	}
+	data[0].inheritable, data[1].inheritable = 0, 0
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capset: %w", errno)
+	}
+	return nil
+}
+
+// bindReadOnly bind mounts source on target and remounts it read-only,
+// keeping the flags the kernel refuses to clear inside a user namespace.
+func bindReadOnly(source, target string) error {
+	if err := syscall.Mount(source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("bind %s on %s: %w", source, target, err)
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(target, &st); err != nil {
+		return fmt.Errorf("statfs %s: %w", target, err)
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	for _, f := range lockedMountFlags {
+		if int64(st.Flags)&f.statfs != 0 {
+			flags |= f.mount
+		}
+	}
+	if err := syscall.Mount("", target, "", flags, ""); err != nil {
+		return fmt.Errorf("remount %s read-only: %w", target, err)
+	}
+	return nil
+}
+
+// lockedMountFlags pairs the statfs(2) ST_* flags with the MS_* flags a
+// remount must repeat.
+var lockedMountFlags = []struct {
+	statfs int64
+	mount  uintptr
+}{
+	{0x2, syscall.MS_NOSUID},
+	{0x4, syscall.MS_NODEV},
+	{0x8, syscall.MS_NOEXEC},
+	{0x400, syscall.MS_NOATIME},
+	{0x800, syscall.MS_NODIRATIME},
+	{0x1000, syscall.MS_RELATIME},
+}
+
+// applyExecInit runs cmd through the init helper configured by cfg, in a new
+// UTS namespace when it sets a hostname, a new mount namespace when it has
+// mounts or tmpfs filesystems and a new network namespace when it restricts
+// egress. When the setup needs privilege,
+// unprivileged agents additionally create a user namespace that maps the
+// agent's own uid/gid, which grants just enough of it; a seccomp filter
+// alone needs none.
+func applyExecInit(cmd *exec.Cmd, cfg execInitConfig) error {
+	chroot := cmd.SysProcAttr != nil && cmd.SysProcAttr.Chroot != ""
+	if err := wrapWithExecInit(cmd, cfg); err != nil {
+		return err
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	if cfg.Hostname != "" {
+		attr.Cloneflags |= syscall.CLONE_NEWUTS
+	}
+	if len(cfg.Mounts) > 0 || len(cfg.Tmpfs) > 0 {
+		attr.Cloneflags |= syscall.CLONE_NEWNS
+	}
+	if cfg.Egress != nil {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if os.Geteuid() != 0 && (attr.Cloneflags&(syscall.CLONE_NEWUTS|syscall.CLONE_NEWNS) != 0 || chroot) {
+		uid, gid := os.Getuid(), os.Getgid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.AmbientCaps = append(attr.AmbientCaps, capSysAdmin)
+		if chroot {
+			// The helper applies the chroot moved into it.
+			attr.AmbientCaps = append(attr.AmbientCaps, capSysChroot)
+		}
+	}
+	return nil
+}
+
+func moveChroot(attr *syscall.SysProcAttr) string {
+	root := attr.Chroot
+	attr.Chroot = ""
+	return root
+}
+
+func moveCredential(attr *syscall.SysProcAttr) *execUser {
+	cred := attr.Credential
+	if cred == nil {
+		return nil
+	}
+	attr.Credential = nil
+	return &execUser{UID: cred.Uid, GID: cred.Gid, Groups: cred.Groups}
+}
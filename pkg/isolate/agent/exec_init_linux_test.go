@@ -0,0 +1,49 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecHostname(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root for a UTS namespace")
+	}
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", "hostname; cat /proc/sys/kernel/hostname"}, Hostname: "sandbox-1"})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got := strings.TrimSpace(string(result.Stdout)); got != "sandbox-1\nsandbox-1" || result.ExitCode != 0 {
+		t.Errorf("hostname in the exec = %q, exit %d: %s", got, result.ExitCode, result.Stderr)
+	}
+	if after, _ := os.Hostname(); after != host {
+		t.Errorf("the agent's hostname changed from %q to %q", host, after)
+	}
+
+	// Without Hostname the command shares the agent's.
+	result, err = client.Exec(ctx, &CommandRequest{Path: "/bin/cat", Args: []string{"/proc/sys/kernel/hostname"}})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got := strings.TrimSpace(string(result.Stdout)); got != host {
+		t.Errorf("hostname without Hostname = %q, want %q", got, host)
+	}
+
+	result, err = client.Exec(ctx, &CommandRequest{Path: "/bin/true", Hostname: strings.Repeat("x", 65)})
+	if err == nil && result.ExitCode == 0 {
+		t.Error("a hostname longer than 64 bytes was accepted")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+func runExecInit(cfg *execInitConfig) error {
+	return fmt.Errorf("exec init helper is only supported on linux")
+}
+
+func applyExecInit(cmd *exec.Cmd, cfg execInitConfig) error {
+	return fmt.Errorf("per-exec namespaces require linux")
+}
+
+func moveChroot(attr *syscall.SysProcAttr) string {
+	return ""
+}
+
+func moveCredential(attr *syscall.SysProcAttr) *execUser {
+	return nil
+}
@@ -0,0 +1,60 @@
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// fdSampleInterval is how often an exec's open descriptors are counted.
+const fdSampleInterval = 50 * time.Millisecond
+
+// fdSampler polls the number of descriptors a process has open and keeps the
+// highest count seen. Only the process itself is counted, not its children.
+type fdSampler struct {
+	pid  int
+	peak atomic.Int64
+	stop chan struct{}
+	done chan struct{}
+}
+
+func startFDSampler(pid int) *fdSampler {
+	f := &fdSampler{pid: pid, stop: make(chan struct{}), done: make(chan struct{})}
+	f.sample()
+	go f.run()
+	return f
+}
+
+func (f *fdSampler) run() {
+	defer close(f.done)
+	ticker := time.NewTicker(fdSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			f.sample()
+		}
+	}
+}
+
+func (f *fdSampler) sample() {
+	n, err := countOpenFiles(f.pid)
+	if err != nil {
+		return
+	}
+	for {
+		peak := f.peak.Load()
+		if int64(n) <= peak || f.peak.CompareAndSwap(peak, int64(n)) {
+			return
+		}
+	}
+}
+
+// finish stops sampling and returns the peak, or zero when no sample could
+// be taken.
+func (f *fdSampler) finish() int {
+	close(f.stop)
+	<-f.done
+	return int(f.peak.Load())
+}
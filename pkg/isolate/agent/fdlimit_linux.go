@@ -0,0 +1,26 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setOpenFilesLimit sets both the soft and hard RLIMIT_NOFILE of a running
+// process to n. Raising the hard limit needs CAP_SYS_RESOURCE.
+func setOpenFilesLimit(pid int, n uint64) error {
+	limit := unix.Rlimit{Cur: n, Max: n}
+	return unix.Prlimit(pid, unix.RLIMIT_NOFILE, &limit, nil)
+}
+
+// countOpenFiles counts the entries of /proc/<pid>/fd.
+func countOpenFiles(pid int) (int, error) {
+	entries, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
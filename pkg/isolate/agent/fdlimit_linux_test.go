@@ -0,0 +1,62 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecPeakOpenFiles(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The shell holds descriptors 3 to 9 open for longer than a sample
+	// interval, then closes them again before exiting.
+	script := `exec 3</dev/null 4</dev/null 5</dev/null 6</dev/null 7</dev/null 8</dev/null 9</dev/null
+sleep 0.3
+exec 3<&- 4<&- 5<&- 6<&- 7<&- 8<&- 9<&-
+sleep 0.1`
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", script}})
+	if err != nil || result.ExitCode != 0 {
+		t.Fatalf("Exec = %+v, %v", result, err)
+	}
+	if result.PeakOpenFiles < 10 {
+		t.Errorf("PeakOpenFiles = %d, want at least 10", result.PeakOpenFiles)
+	}
+
+	result, err = client.Exec(ctx, &CommandRequest{Path: "/bin/sleep", Args: []string{"0.2"}})
+	if err != nil || result.ExitCode != 0 {
+		t.Fatalf("Exec = %+v, %v", result, err)
+	}
+	if result.PeakOpenFiles == 0 || result.PeakOpenFiles >= 10 {
+		t.Errorf("PeakOpenFiles of sleep = %d, want a few", result.PeakOpenFiles)
+	}
+}
+
+func TestExecMaxOpenFiles(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The limit is applied just after the command starts, hence the sleep.
+	script := `sleep 0.2; ulimit -n; ulimit -Hn`
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", script}, MaxOpenFiles: 5})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got := string(result.Stdout); got != "5\n5\n" {
+		t.Errorf("stdout = %q, want both limits at 5", got)
+	}
+
+	result, err = client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", "ulimit -n"}})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if strings.TrimSpace(string(result.Stdout)) == "5" {
+		t.Error("the limit leaked into an exec that did not set one")
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package agent
+
+import "errors"
+
+var errFDLimitUnsupported = errors.New("per-exec descriptor limits and counts are only available on Linux")
+
+func setOpenFilesLimit(pid int, n uint64) error {
+	return errFDLimitUnsupported
+}
+
+func countOpenFiles(pid int) (int, error) {
+	return 0, errFDLimitUnsupported
+}
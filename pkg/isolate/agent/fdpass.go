@@ -0,0 +1,32 @@
+package agent
+
+import (
+	"net"
+	"os"
+)
+
+// maxPassedFiles bounds how many descriptors a single read accepts.
+const maxPassedFiles = 4
+
+// fileReceiver is implemented by connections that can receive descriptors
+// passed alongside frame data (SCM_RIGHTS on Unix sockets).
+type fileReceiver interface {
+	// takeFile returns the oldest received descriptor not yet claimed, or
+	// nil when none is queued.
+	takeFile() *os.File
+}
+
+// takePassedFile claims a descriptor sent with the current request.
+func takePassedFile(conn net.Conn) *os.File {
+	if r, ok := conn.(fileReceiver); ok {
+		return r.takeFile()
+	}
+	return nil
+}
+
+// discardWriteCloser stands in for the stdin pipe when the child's stdin is a
+// passed descriptor; stdin frames from the client are dropped.
+type discardWriteCloser struct{}
+
+func (discardWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (discardWriteCloser) Close() error                { return nil }
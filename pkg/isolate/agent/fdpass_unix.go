@@ -0,0 +1,118 @@
+//go:build !windows
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// rightsConn collects descriptors passed with SCM_RIGHTS while the frame
+// decoder reads from the connection.
+type rightsConn struct {
+	*net.UnixConn
+
+	mu    sync.Mutex
+	files []*os.File
+}
+
+// acceptPassedFiles wraps Unix socket connections so passed descriptors are
+// retained instead of discarded by plain reads. Other connections are
+// returned unchanged.
+func acceptPassedFiles(conn net.Conn) net.Conn {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn
+	}
+	return &rightsConn{UnixConn: uc}
+}
+
+func (c *rightsConn) Read(p []byte) (int, error) {
+	oob := make([]byte, syscall.CmsgSpace(maxPassedFiles*4))
+	n, oobn, _, _, err := c.UnixConn.ReadMsgUnix(p, oob)
+	if oobn > 0 {
+		c.collect(oob[:oobn])
+	}
+	if n < 0 {
+		// ReadMsgUnix reports -1 on errors such as an expired deadline,
+		// which io.Reader callers must never see.
+		n = 0
+	}
+	return n, err
+}
+
+func (c *rightsConn) collect(oob []byte) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for i := range msgs {
+		fds, err := syscall.ParseUnixRights(&msgs[i])
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			c.files = append(c.files, os.NewFile(uintptr(fd), "passed-fd"))
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *rightsConn) takeFile() *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.files) == 0 {
+		return nil
+	}
+	f := c.files[0]
+	c.files = c.files[1:]
+	return f
+}
+
+// Close also closes any descriptors that no request claimed.
+func (c *rightsConn) Close() error {
+	c.mu.Lock()
+	for _, f := range c.files {
+		_ = f.Close()
+	}
+	c.files = nil
+	c.mu.Unlock()
+	return c.UnixConn.Close()
+}
+
+// sendFrameWithFile writes a frame with f attached as SCM_RIGHTS, so the
+// agent receives the descriptor together with the request that uses it.
+func sendFrameWithFile(conn net.Conn, typ frameType, payload any, f *os.File) error {
+	if shaped, ok := conn.(*shapedConn); ok {
+		// The descriptor carries the command's stdio past the
+		// connection, so the request frame need not be metered.
+		conn = shaped.Conn
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("passing file descriptors requires a unix socket connection")
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	frame, err := json.Marshal(rawFrame{Type: typ, Payload: data})
+	if err != nil {
+		return err
+	}
+	frame = append(frame, '\n')
+	n, _, err := uc.WriteMsgUnix(frame, syscall.UnixRights(int(f.Fd())), nil)
+	if err != nil {
+		return err
+	}
+	if n < len(frame) {
+		_, err = uc.Write(frame[n:])
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socketPair returns both ends of a connected Unix stream socket pair: a
+// connection for the test and a file to pass to the command.
+func socketPair(t *testing.T) (*net.UnixConn, *os.File) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := os.NewFile(uintptr(fds[0]), "local")
+	defer local.Close()
+	conn, err := net.FileConn(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn.(*net.UnixConn), os.NewFile(uintptr(fds[1]), "remote")
+}
+
+func TestExecStdioEchoesThroughPassedSocket(t *testing.T) {
+	_, ipc := startServer(t, ServerConfig{})
+	for name, client := range map[string]Client{"ipc": ipc, "loopback": NewLoopbackClient(nil)} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			conn, remote := socketPair(t)
+
+			done := make(chan error, 1)
+			var result *CommandResult
+			go func() {
+				var err error
+				result, err = client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", `echo ready; cat; echo bye >&2`}, Stdio: remote})
+				done <- err
+			}()
+			const want = "ready\nhello through the socket\n"
+			if _, err := conn.Write([]byte("hello through the socket\n")); err != nil {
+				t.Fatal(err)
+			}
+			// Shutting down our end is the EOF that ends cat.
+			if err := conn.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			echoed := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != want {
+				t.Errorf("echo = %q, %v; want %q", echoed, err, want)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			remote.Close()
+			if n, err := conn.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+				t.Errorf("read after the command exited = %d, %v; want EOF", n, err)
+			}
+			// stdout went to the socket, not the result; stderr is captured.
+			if result.ExitCode != 0 || len(result.Stdout) != 0 || string(result.Stderr) != "bye\n" {
+				t.Errorf("result = exit %d, stdout %q, stderr %q", result.ExitCode, result.Stdout, result.Stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package agent
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+func acceptPassedFiles(conn net.Conn) net.Conn { return conn }
+
+func sendFrameWithFile(conn net.Conn, typ frameType, payload any, f *os.File) error {
+	return fmt.Errorf("passing file descriptors is not supported on windows")
+}
@@ -0,0 +1,30 @@
+package agent
+
+import "os"
+
+// execFIFOs holds the named pipes an exec's stdio is redirected to.
+type execFIFOs struct {
+	stdin   *os.File
+	stdout  *os.File
+	stderr  *os.File
+	created []string // FIFOs made for this exec; removed by cleanup
+}
+
+// closeFiles drops the agent's copies once the child holds its own, so the
+// other end sees EOF when the child exits.
+func (f *execFIFOs) closeFiles() {
+	for _, file := range []*os.File{f.stdin, f.stdout, f.stderr} {
+		if file != nil {
+			_ = file.Close()
+		}
+	}
+}
+
+// cleanup closes the files and removes FIFOs created on demand. Processes
+// that already opened them are unaffected.
+func (f *execFIFOs) cleanup() {
+	f.closeFiles()
+	for _, path := range f.created {
+		_ = os.Remove(path)
+	}
+}
@@ -0,0 +1,133 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// fifoReleaseInterval paces the retries that unblock abandoned FIFO opens.
+const fifoReleaseInterval = 50 * time.Millisecond
+
+// openFIFOs resolves, creates when missing, and opens the FIFOs named in the
+// request. Opening a FIFO blocks until the other end is opened too, typically
+// by a concurrent exec, so all ends are opened in parallel and the wait is
+// bounded by ctx.
+func (s *Server) openFIFOs(ctx context.Context, payload *execRequestPayload) (*execFIFOs, error) {
+	fifos := &execFIFOs{}
+	specs := []struct {
+		path string
+		flag int
+		dst  **os.File
+	}{
+		{payload.StdinFIFO, os.O_RDONLY, &fifos.stdin},
+		{payload.StdoutFIFO, os.O_WRONLY, &fifos.stdout},
+		{payload.StderrFIFO, os.O_WRONLY, &fifos.stderr},
+	}
+
+	type opened struct {
+		index int
+		file  *os.File
+		err   error
+	}
+	results := make(chan opened, len(specs))
+	pending := make(map[int]string)
+	for i, spec := range specs {
+		if spec.path == "" {
+			continue
+		}
+		path, err := s.resolveRootedPath(spec.path)
+		if err != nil {
+			fifos.cleanup()
+			return nil, fmt.Errorf("security violation: %w", err)
+		}
+		created, err := ensureFIFO(path)
+		if err != nil {
+			fifos.cleanup()
+			return nil, err
+		}
+		if created {
+			fifos.created = append(fifos.created, path)
+		}
+		pending[i] = path
+		go func(i int, path string, flag int) {
+			file, err := os.OpenFile(path, flag, 0)
+			results <- opened{index: i, file: file, err: err}
+		}(i, path, spec.flag)
+	}
+
+	var firstErr error
+	done := ctx.Done()
+	var retry <-chan time.Time
+	for len(pending) > 0 {
+		select {
+		case res := <-results:
+			delete(pending, res.index)
+			if res.err != nil {
+				if firstErr == nil {
+					firstErr = res.err
+				}
+				continue
+			}
+			*specs[res.index].dst = res.file
+		case <-done:
+			if firstErr == nil {
+				firstErr = fmt.Errorf("waiting for fifo peer: %w", ctx.Err())
+			}
+			done = nil
+			// An open that has not reached the kernel yet would miss a
+			// single release, so keep releasing until all have returned.
+			ticker := time.NewTicker(fifoReleaseInterval)
+			defer ticker.Stop()
+			retry = ticker.C
+			for i, path := range pending {
+				releaseFIFOOpen(path, specs[i].flag)
+			}
+		case <-retry:
+			for i, path := range pending {
+				releaseFIFOOpen(path, specs[i].flag)
+			}
+		}
+	}
+	if firstErr != nil {
+		fifos.cleanup()
+		return nil, firstErr
+	}
+	return fifos, nil
+}
+
+// ensureFIFO creates path as a FIFO unless it already is one.
+func ensureFIFO(path string) (bool, error) {
+	err := syscall.Mkfifo(path, 0o600)
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, syscall.EEXIST) {
+		return false, fmt.Errorf("create fifo %s: %w", path, err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&os.ModeNamedPipe == 0 {
+		return false, fmt.Errorf("%s exists and is not a fifo", path)
+	}
+	return false, nil
+}
+
+// releaseFIFOOpen briefly opens the opposite end of path so an open blocked
+// waiting for a peer returns.
+func releaseFIFOOpen(path string, flag int) {
+	other := os.O_WRONLY
+	if flag == os.O_WRONLY {
+		other = os.O_RDONLY
+	}
+	if file, err := os.OpenFile(path, other|syscall.O_NONBLOCK, 0); err == nil {
+		_ = file.Close()
+	}
+}
@@ -0,0 +1,85 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecFIFOPipeline(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// seq 1 1000 | grep 7 | wc -l, one exec per stage, started in any order.
+	stages := []*CommandRequest{
+		{Path: "wc", Args: []string{"-l"}, StdinFIFO: second, Timeout: 5 * time.Second},
+		{Path: "grep", Args: []string{"7"}, StdinFIFO: first, StdoutFIFO: second, Timeout: 5 * time.Second},
+		{Path: "seq", Args: []string{"1", "1000"}, StdoutFIFO: first, Timeout: 5 * time.Second},
+	}
+	type outcome struct {
+		result *CommandResult
+		err    error
+	}
+	outcomes := make([]chan outcome, len(stages))
+	for i, stage := range stages {
+		outcomes[i] = make(chan outcome, 1)
+		go func() {
+			result, err := client.Exec(ctx, stage)
+			outcomes[i] <- outcome{result, err}
+		}()
+	}
+	for i, stage := range stages {
+		o := <-outcomes[i]
+		if o.err != nil {
+			t.Fatalf("%s: %v", stage.Path, o.err)
+		}
+		if o.result.ExitCode != 0 {
+			t.Errorf("%s exited with %d: %s", stage.Path, o.result.ExitCode, o.result.Stderr)
+		}
+		// Redirected streams are not captured.
+		if i > 0 && len(o.result.Stdout) != 0 {
+			t.Errorf("%s stdout = %q, want it redirected", stage.Path, o.result.Stdout)
+		}
+		if i == 0 {
+			// 1000 numbers hold 271 with a 7 in them.
+			if got := strings.TrimSpace(string(o.result.Stdout)); got != "271" {
+				t.Errorf("pipeline output = %q, want 271", got)
+			}
+		}
+	}
+	for _, path := range []string{first, second} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestExecFIFOWithoutPeerTimesOut(t *testing.T) {
+	dir := t.TempDir()
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	result, err := client.Exec(ctx, &CommandRequest{Path: "cat", StdinFIFO: filepath.Join(dir, "lonely"), Timeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if result.ExitCode != execErrorExitCode || !strings.Contains(string(result.Stderr), "waiting for fifo peer") {
+		t.Errorf("result = exit %d, stderr %q; want the exec refused for want of a peer", result.ExitCode, result.Stderr)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Exec gave up after %v, want about its 200ms timeout", elapsed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lonely")); !os.IsNotExist(err) {
+		t.Errorf("the FIFO was not removed: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package agent
+
+import (
+	"context"
+	"fmt"
+)
+
+func (s *Server) openFIFOs(ctx context.Context, payload *execRequestPayload) (*execFIFOs, error) {
+	if payload.StdinFIFO != "" || payload.StdoutFIFO != "" || payload.StderrFIFO != "" {
+		return nil, fmt.Errorf("fifo redirection is not supported on windows")
+	}
+	return &execFIFOs{}, nil
+}
@@ -0,0 +1,150 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// outputGate holds back an exec's output while the client has paused it.
+// A blocked sink stops its pipe from being read, so once the pipe buffer is
+// full the command's own writes block until output resumes.
+type outputGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed while output flows
+	opened  bool          // set by open; later pauses are ignored
+}
+
+func newOutputGate() *outputGate {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &outputGate{resumed: resumed}
+}
+
+func (g *outputGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-g.resumed:
+		if !g.opened {
+			g.resumed = make(chan struct{})
+		}
+	default:
+	}
+}
+
+func (g *outputGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	select {
+	case <-g.resumed:
+	default:
+		close(g.resumed)
+	}
+}
+
+// open resumes output for good, once no further resume can arrive.
+func (g *outputGate) open() {
+	g.resume()
+	g.mu.Lock()
+	g.opened = true
+	g.mu.Unlock()
+}
+
+// wrap returns a sink that waits for the gate before passing chunks on. It
+// stops waiting when ctx ends, so a timed-out exec still finishes.
+func (g *outputGate) wrap(ctx context.Context, sink func([]byte)) func([]byte) {
+	return func(chunk []byte) {
+		g.mu.Lock()
+		resumed := g.resumed
+		g.mu.Unlock()
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+		}
+		sink(chunk)
+	}
+}
+
+// stdinWindow bounds the stdin an exec has sent but the agent has not yet
+// acknowledged with stdin_ack, so a fast reader cannot outrun a slow
+// command and pile its input up in the buffers between them. A nil window
+// never blocks.
+type stdinWindow struct {
+	size int64
+
+	mu      sync.Mutex
+	sent    int64
+	acked   int64
+	changed chan struct{} // closed and replaced whenever acked grows
+	closed  bool
+}
+
+func newStdinWindow(size int64) *stdinWindow {
+	return &stdinWindow{size: size, changed: make(chan struct{})}
+}
+
+// reserve waits until n more bytes fit in the window and counts them as
+// sent. A chunk larger than the whole window goes once nothing is in
+// flight. It reports false when ctx ends or the window is closed first.
+func (w *stdinWindow) reserve(ctx context.Context, n int) bool {
+	if w == nil {
+		return true
+	}
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return false
+		}
+		if w.sent == w.acked || w.sent-w.acked+int64(n) <= w.size {
+			w.sent += int64(n)
+			w.mu.Unlock()
+			return true
+		}
+		changed := w.changed
+		w.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// ack records that the agent has consumed total bytes of stdin.
+func (w *stdinWindow) ack(total int64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || total <= w.acked {
+		return
+	}
+	w.acked = total
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// ackFrame applies a stdin_ack frame's payload.
+func (w *stdinWindow) ackFrame(payload json.RawMessage) {
+	var ack stdinAckPayload
+	if err := json.Unmarshal(payload, &ack); err == nil {
+		w.ack(ack.Bytes)
+	}
+}
+
+// close releases a reserve that would wait for acknowledgements that can
+// no longer arrive, once the exec has finished or its connection is gone.
+func (w *stdinWindow) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.changed)
+	}
+}
@@ -0,0 +1,112 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPauseAndResumeOutput(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dir := t.TempDir()
+
+	// The sleep gives the pause time to arrive before any output; head then
+	// fills the pipe and blocks, so the marker is only written once output
+	// resumes.
+	const size = 1 << 20
+	stream, err := client.ExecStream(ctx, &CommandRequest{
+		Path:       "/bin/sh",
+		Args:       []string{"-c", "sleep 0.2; head -c 1048576 /dev/zero; touch done"},
+		WorkingDir: dir,
+	})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	if err := stream.PauseOutput(); err != nil {
+		t.Fatalf("PauseOutput: %v", err)
+	}
+
+	received := 0
+	paused := time.After(time.Second)
+drain:
+	for {
+		select {
+		case chunk := <-stream.Stdout:
+			received += len(chunk)
+		case <-paused:
+			break drain
+		}
+	}
+	if received >= size {
+		t.Errorf("received all %d bytes while paused", received)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "done")); !os.IsNotExist(err) {
+		t.Errorf("the command finished while its output was paused: %v", err)
+	}
+
+	if err := stream.ResumeOutput(); err != nil {
+		t.Fatalf("ResumeOutput: %v", err)
+	}
+	for chunk := range stream.Stdout {
+		received += len(chunk)
+	}
+	for range stream.Stderr {
+	}
+	result := <-stream.Done
+	if result == nil || result.ExitCode != 0 {
+		t.Fatalf("result = %+v", result)
+	}
+	if received != size {
+		t.Errorf("received %d bytes, want %d", received, size)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "done")); err != nil {
+		t.Errorf("the command did not finish after resuming: %v", err)
+	}
+}
+
+func TestPausedOutputResumesOnTimeout(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.ExecStream(ctx, &CommandRequest{
+		Path:    "/bin/sh",
+		Args:    []string{"-c", "sleep 0.2; head -c 1048576 /dev/zero"},
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	if err := stream.PauseOutput(); err != nil {
+		t.Fatalf("PauseOutput: %v", err)
+	}
+	// Never resumed: the exec still ends once it times out.
+	for range stream.Stdout {
+	}
+	for range stream.Stderr {
+	}
+	if result := <-stream.Done; result == nil || result.ExitCode == 0 {
+		t.Errorf("result = %+v, want the exec to time out", result)
+	}
+}
+
+func TestPauseOutputUnsupported(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := NewLoopbackClient(nil).ExecStream(ctx, &CommandRequest{Path: "/bin/true"})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	defer stream.Cancel()
+	if err := stream.PauseOutput(); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("PauseOutput on a loopback stream = %v, want %v", err, ErrUnsupported)
+	}
+	if err := stream.ResumeOutput(); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("ResumeOutput on a loopback stream = %v, want %v", err, ErrUnsupported)
+	}
+}
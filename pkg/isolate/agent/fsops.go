@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// spaceSafetyMarginDivisor reserves 1/50th (2%) of the filesystem on top of
+// the requested bytes so a CheckSpace pass leaves headroom for metadata and
+// concurrent writers.
+const spaceSafetyMarginDivisor = 50
+
+func (s *Server) handleCheckSpace(writer *frameWriter, payload checkSpaceRequestPayload) {
+	if payload.Path == "" {
+		_ = writer.send(frameTypeError, errorPayload{Message: "path is required"})
+		return
+	}
+	path, err := s.resolveRootedPath(payload.Path)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "security violation: " + err.Error()})
+		return
+	}
+	// Upload targets usually don't exist yet; measure the filesystem of the
+	// nearest existing ancestor instead.
+	path, err = nearestExistingPath(path)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+		return
+	}
+
+	usage, err := statFilesystem(path)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+		return
+	}
+
+	need := uint64(0)
+	if payload.NeedBytes > 0 {
+		need = uint64(payload.NeedBytes)
+	}
+	margin := usage.TotalBytes / spaceSafetyMarginDivisor
+	_ = writer.send(frameTypeCheckSpaceResult, checkSpaceResultPayload{
+		OK:    need+margin <= usage.AvailableBytes,
+		Usage: *usage,
+	})
+}
+
+func nearestExistingPath(path string) (string, error) {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", os.ErrNotExist
+		}
+		path = parent
+	}
+}
+
+func (s *Server) handleChown(writer *frameWriter, payload chownRequestPayload) {
+	if payload.Path == "" {
+		_ = writer.send(frameTypeError, errorPayload{Message: "path is required"})
+		return
+	}
+	path, err := s.resolveRootedPath(payload.Path)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "security violation: " + err.Error()})
+		return
+	}
+	if err := os.Chown(path, payload.UID, payload.GID); err != nil {
+		resp := errorPayload{Message: err.Error()}
+		if errors.Is(err, os.ErrPermission) {
+			resp.Code = errorCodePermissionDenied
+		}
+		_ = writer.send(frameTypeError, resp)
+		return
+	}
+	_ = writer.send(frameTypeChownResult, nil)
+}
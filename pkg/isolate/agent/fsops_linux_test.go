@@ -0,0 +1,51 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCheckSpaceOnSmallTmpfs(t *testing.T) {
+	dir := t.TempDir()
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", 0, "size=1m"); err != nil {
+		t.Skipf("mount tmpfs: %v", err)
+	}
+	t.Cleanup(func() { syscall.Unmount(dir, syscall.MNT_DETACH) })
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Upload targets need not exist yet.
+	target := filepath.Join(dir, "uploads", "file")
+
+	ok, usage, err := client.CheckSpace(ctx, target, 256<<10)
+	if err != nil {
+		t.Fatalf("CheckSpace: %v", err)
+	}
+	if !ok {
+		t.Errorf("256KiB does not fit an empty 1MiB filesystem: %+v", usage)
+	}
+	if usage.TotalBytes != 1<<20 {
+		t.Errorf("total = %d, want the tmpfs size %d", usage.TotalBytes, 1<<20)
+	}
+
+	if ok, usage, err = client.CheckSpace(ctx, target, 2<<20); err != nil || ok {
+		t.Errorf("CheckSpace(2MiB) on a 1MiB filesystem = %v, %+v, %v, want insufficient space", ok, usage, err)
+	}
+	// Only a safety margin short of the free space is refused too.
+	if ok, usage, err = client.CheckSpace(ctx, target, int64(usage.AvailableBytes)); err != nil || ok {
+		t.Errorf("CheckSpace(all free bytes) = %v, %+v, %v, want insufficient space", ok, usage, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "fill"), make([]byte, 768<<10), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if ok, usage, err = client.CheckSpace(ctx, target, 512<<10); err != nil || ok {
+		t.Errorf("CheckSpace(512KiB) with 768KiB used = %v, %+v, %v, want insufficient space", ok, usage, err)
+	}
+}
@@ -0,0 +1,136 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const nobodyUID = 65534
+
+// fileOwner returns the uid and gid owning path.
+func fileOwner(t *testing.T, path string) (uid, gid int) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := info.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
+
+func TestChownAsRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership needs root")
+	}
+	root := t.TempDir()
+	path := filepath.Join(root, "staged")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, client := startServer(t, ServerConfig{RootDir: root})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := client.Chown(ctx, path, nobodyUID, nobodyUID); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+	if uid, gid := fileOwner(t, path); uid != nobodyUID || gid != nobodyUID {
+		t.Errorf("owner = %d:%d, want %d:%d", uid, gid, nobodyUID, nobodyUID)
+	}
+	// -1 leaves that id unchanged; relative paths are taken from the root.
+	if err := client.Chown(ctx, "staged", -1, 0); err != nil {
+		t.Fatalf("Chown: %v", err)
+	}
+	if uid, gid := fileOwner(t, path); uid != nobodyUID || gid != 0 {
+		t.Errorf("owner = %d:%d, want %d:0", uid, gid, nobodyUID)
+	}
+	// Paths outside the root are refused, however they are spelled.
+	outside := filepath.Join(t.TempDir(), "outside")
+	if err := os.WriteFile(outside, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{outside, "../" + filepath.Base(filepath.Dir(outside)) + "/outside", "link"} {
+		if err := client.Chown(ctx, p, nobodyUID, nobodyUID); err == nil {
+			t.Errorf("Chown(%q) outside the root succeeded", p)
+		}
+	}
+	if uid, _ := fileOwner(t, outside); uid != 0 {
+		t.Errorf("owner of the file outside the root = %d, want 0", uid)
+	}
+}
+
+func TestChownWithoutPrivilege(t *testing.T) {
+	// Not t.TempDir, whose parent directory the nobody account cannot enter.
+	dir, err := os.MkdirTemp("", "chown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "staged")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var client *IPCClient
+	if os.Geteuid() != 0 {
+		_, client = startServer(t, ServerConfig{})
+	} else {
+		// Run the agent as nobody, owning the file but unable to give it away.
+		if err := os.Chmod(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(path, nobodyUID, nobodyUID); err != nil {
+			t.Fatal(err)
+		}
+		client = startUnprivilegedAgent(t, dir)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	uid, gid := fileOwner(t, path)
+	if err := client.Chown(ctx, path, 0, 0); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("Chown = %v, want %v", err, ErrPermissionDenied)
+	}
+	if u, g := fileOwner(t, path); u != uid || g != gid {
+		t.Errorf("owner = %d:%d, want it unchanged at %d:%d", u, g, uid, gid)
+	}
+}
+
+// startUnprivilegedAgent runs the test binary as an agent serving a socket in
+// dir under the nobody account.
+func startUnprivilegedAgent(t *testing.T, dir string) *IPCClient {
+	t.Helper()
+	sock := filepath.Join(dir, "agent.sock")
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "AGENT_TEST_SERVE="+sock, fmt.Sprintf("AGENT_TEST_UID=%d", nobodyUID))
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		// The socket file appears before the agent listens on it.
+		if conn, err := net.Dial("unix", sock); err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the unprivileged agent did not start")
+		}
+	}
+	return NewIPCClient(&UnixDialer{Path: sock}).(*IPCClient)
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// MinProtocolVersion is the oldest protocol revision this package still
+// speaks. Peers announcing an older version in their hello are refused.
+const MinProtocolVersion = 1
+
+// Optional features an agent may advertise in its hello, beyond the request
+// frames it handles.
+const (
+	// FeatureChecksum: file transfers honour "checksum" (see VerifyChecksum).
+	FeatureChecksum = "checksum"
+	// FeatureTreeUpload: file_put_request accepts "tree" (see CopyDirTo).
+	FeatureTreeUpload = "tree_upload"
+	// FeatureTTY: execs may run on a pseudo-terminal.
+	FeatureTTY = "tty"
+	// FeatureWebhooks: execs may name a completion_url.
+	FeatureWebhooks = "webhooks"
+	// FeatureGzipOutput: exec output may be gzip-compressed for clients that
+	// accept it.
+	FeatureGzipOutput = "gzip_output"
+	// FeatureKeepAlive: a connection may serve several requests.
+	FeatureKeepAlive = "keep_alive"
+	// FeatureMultiplex: a connection may carry several execs at once, their
+	// frames tagged with an exchange ID (see IPCClient.Multiplex).
+	FeatureMultiplex = "multiplex"
+	// FeatureStdinAck: execs may ask for stdin_ack frames, letting the
+	// client bound the stdin in flight (see IPCClient.StdinWindow).
+	FeatureStdinAck = "stdin_ack"
+	// FeatureDryRun: execs may ask for a dry run (see CommandRequest.DryRun).
+	FeatureDryRun = "dry_run"
+	// FeatureEgress: execs may restrict their network with egress_allow.
+	FeatureEgress = "egress"
+)
+
+// ErrIncompatibleProtocol is returned when the client and agent share no
+// protocol version.
+var ErrIncompatibleProtocol = errors.New("incompatible protocol version")
+
+type helloPayload struct {
+	ProtocolVersion    int      `json:"protocol_version"`
+	MinProtocolVersion int      `json:"min_protocol_version,omitempty"`
+	Requests           []string `json:"requests,omitempty"`
+	Features           []string `json:"features,omitempty"`
+	// KeepAlive asks the agent to serve further requests on the connection;
+	// the agent echoes it when it agrees.
+	KeepAlive bool `json:"keep_alive,omitempty"`
+	// Multiplex asks the agent to run the execs on the connection
+	// concurrently, routing frames by their ID; the agent echoes it when it
+	// agrees.
+	Multiplex bool `json:"multiplex,omitempty"`
+}
+
+// compatibleVersion returns the protocol version two peers should use, the
+// newer one being expected to speak down to the older.
+func compatibleVersion(peer helloPayload) (int, error) {
+	minPeer := peer.MinProtocolVersion
+	if minPeer == 0 {
+		minPeer = peer.ProtocolVersion
+	}
+	if peer.ProtocolVersion < MinProtocolVersion || minPeer > ProtocolVersion {
+		return 0, fmt.Errorf("peer speaks protocol %d-%d, this side %d-%d",
+			minPeer, peer.ProtocolVersion, MinProtocolVersion, ProtocolVersion)
+	}
+	return min(peer.ProtocolVersion, ProtocolVersion), nil
+}
+
+// supportedFeatures lists the optional features the server offers with its
+// current configuration.
+func (s *Server) supportedFeatures() []string {
+	features := []string{FeatureChecksum, FeatureTreeUpload, FeatureKeepAlive, FeatureMultiplex, FeatureStdinAck, FeatureDryRun}
+	if ttySupported {
+		features = append(features, FeatureTTY)
+	}
+	if s.webhooks != nil {
+		features = append(features, FeatureWebhooks)
+	}
+	if s.compression == string(CompressionGzip) {
+		features = append(features, FeatureGzipOutput)
+	}
+	if egressAvailable() {
+		features = append(features, FeatureEgress)
+	}
+	return features
+}
+
+// handleHello answers a client's hello with the negotiated version and what
+// the server supports, or refuses it with an incompatible_version error. It
+// reports whether the connection may continue.
+func (s *Server) handleHello(writer *frameWriter, payload helloPayload) bool {
+	version, err := compatibleVersion(payload)
+	if err != nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: err.Error(), Code: errorCodeIncompatibleVersion})
+		return false
+	}
+	_ = writer.send(frameTypeHello, helloPayload{
+		ProtocolVersion:    version,
+		MinProtocolVersion: MinProtocolVersion,
+		Requests:           s.supportedRequests(),
+		Features:           s.supportedFeatures(),
+		KeepAlive:          payload.KeepAlive,
+		Multiplex:          payload.Multiplex,
+	})
+	return true
+}
+
+// Capabilities asks the agent which requests it handles. Agents that predate
+// the capabilities request return ErrUnsupported.
+func (c *IPCClient) Capabilities(ctx context.Context) (*Capabilities, error) {
+	var result capabilitiesResultPayload
+	if err := c.call(ctx, frameTypeCapabilitiesRequest, nil, frameTypeCapabilitiesResult, &result); err != nil {
+		return nil, err
+	}
+	return &Capabilities{ProtocolVersion: result.ProtocolVersion, Requests: result.Requests, Features: result.Features}, nil
+}
+
+// Negotiate exchanges hellos with the agent on first use and caches the
+// result: the negotiated protocol version, the requests the agent handles
+// and the features it offers. Agents that predate the handshake are
+// described by their capabilities_result, or as version 0 with nothing
+// optional when they predate that too. Failed attempts are not cached.
+func (c *IPCClient) Negotiate(ctx context.Context) (*Capabilities, error) {
+	c.peerMu.Lock()
+	defer c.peerMu.Unlock()
+	if c.peer != nil {
+		return c.peer, nil
+	}
+
+	var reply helloPayload
+	hello := helloPayload{ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion}
+	err := c.call(ctx, frameTypeHello, hello, frameTypeHello, &reply)
+	var peer *Capabilities
+	switch {
+	case err == nil:
+		version, verr := compatibleVersion(reply)
+		if verr != nil {
+			return nil, fmt.Errorf("%w: %v", ErrIncompatibleProtocol, verr)
+		}
+		peer = &Capabilities{ProtocolVersion: version, Requests: reply.Requests, Features: reply.Features}
+	case errors.Is(err, ErrUnsupported):
+		peer, err = c.Capabilities(ctx)
+		if errors.Is(err, ErrUnsupported) {
+			peer, err = &Capabilities{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	c.peer = peer
+	return peer, nil
+}
+
+// requireFeature fails with ErrUnsupported unless the agent advertised
+// feature.
+func (c *IPCClient) requireFeature(ctx context.Context, feature string) error {
+	peer, err := c.Negotiate(ctx)
+	if err != nil {
+		return err
+	}
+	if !peer.HasFeature(feature) {
+		return fmt.Errorf("%w: agent does not offer %s", ErrUnsupported, feature)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestMain lets the test binary serve as its own exec init helper, as agentd
+// does, so servers in tests can use per-exec namespaces. With
+// AGENT_TEST_SERVE set it serves an agent on that Unix socket instead of
+// running the tests, for tests needing an agent in another process, as the
+// user AGENT_TEST_UID when that is set.
+func TestMain(m *testing.M) {
+	RunExecInit()
+	if sock := os.Getenv("AGENT_TEST_SERVE"); sock != "" {
+		if uid, err := strconv.Atoi(os.Getenv("AGENT_TEST_UID")); err == nil {
+			if syscall.Setgroups(nil) != nil || syscall.Setgid(uid) != nil || syscall.Setuid(uid) != nil {
+				os.Exit(1)
+			}
+		}
+		ln, err := net.Listen("unix", sock)
+		if err != nil {
+			os.Exit(1)
+		}
+		_ = NewServer(ServerConfig{}).Serve(ln)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// startServer serves a Server built from cfg on a Unix socket for the
+// duration of the test and returns a client dialing it.
+func startServer(t *testing.T, cfg ServerConfig) (*Server, *IPCClient) {
+	t.Helper()
+	srv := NewServer(cfg)
+	return srv, serve(t, srv)
+}
+
+// serve serves srv on a Unix socket for the duration of the test and
+// returns a client dialing it.
+func serve(t *testing.T, srv *Server) *IPCClient {
+	t.Helper()
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Shutdown)
+	return NewIPCClient(&UnixDialer{Path: sock}).(*IPCClient)
+}
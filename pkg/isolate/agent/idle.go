@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleTracker records when a server last had something to do: a connection
+// accepted, bytes read from or written to a client, or an exec finishing.
+// Running execs hold it busy however long they take.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64 // UnixNano of the last activity
+	busy    atomic.Int64 // running execs
+}
+
+// newIdleTracker returns a tracker for timeout, or nil when timeout is not
+// positive and the server never goes idle.
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	if t == nil {
+		return
+	}
+	t.last.Store(time.Now().UnixNano())
+}
+
+// hold keeps the tracker busy until the returned function is called.
+func (t *idleTracker) hold() func() {
+	if t == nil {
+		return func() {}
+	}
+	t.busy.Add(1)
+	return func() {
+		t.touch()
+		t.busy.Add(-1)
+	}
+}
+
+// expired reports whether nothing has held the tracker busy or touched it
+// for its timeout as of now.
+func (t *idleTracker) expired(now time.Time) bool {
+	if t.busy.Load() > 0 {
+		return false
+	}
+	return now.Sub(time.Unix(0, t.last.Load())) >= t.timeout
+}
+
+// watchIdle shuts the server down once its idle tracker expires, checking
+// often enough to overshoot the timeout by at most a tenth of it, or a
+// second. It returns when the server shuts down for any reason.
+func (s *Server) watchIdle() {
+	interval := min(max(s.idle.timeout/10, 10*time.Millisecond), time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case now := <-ticker.C:
+			if s.idle.expired(now) {
+				s.logger.Printf("idle for %s, shutting down", s.idle.timeout)
+				s.Shutdown()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"context"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// AgentInfo describes a running agent, for health and readiness checks that
+// need more than Ping.
+type AgentInfo struct {
+	// Version is the agent build's version; see ServerConfig.Version.
+	Version         string
+	ProtocolVersion int
+	OS              string
+	Arch            string
+	// Chroot and Namespaces report which isolation is active for execs.
+	Chroot     bool
+	Namespaces bool
+	// IsolationError is set when the configured isolation is unusable, in
+	// which case the agent refuses every exec.
+	IsolationError string
+	// RootDir is the absolute directory the agent confines operations to;
+	// empty when it is unrestricted.
+	RootDir string
+	Uptime  time.Duration
+	// Connections is how many connections the agent was serving, the one
+	// asking included, out of MaxConcurrent; zero is unlimited.
+	Connections   int
+	MaxConcurrent int
+}
+
+// Ready reports whether the agent can run commands.
+func (i *AgentInfo) Ready() bool {
+	return i != nil && i.IsolationError == ""
+}
+
+type infoPayload struct {
+	Version         string `json:"version,omitempty"`
+	ProtocolVersion int    `json:"protocol_version"`
+	OS              string `json:"os"`
+	Arch            string `json:"arch"`
+	Chroot          bool   `json:"chroot,omitempty"`
+	Namespaces      bool   `json:"namespaces,omitempty"`
+	IsolationError  string `json:"isolation_error,omitempty"`
+	RootDir         string `json:"root_dir,omitempty"`
+	UptimeMilli     int64  `json:"uptime_ms"`
+	Connections     int    `json:"connections,omitempty"`
+	MaxConcurrent   int    `json:"max_concurrent,omitempty"`
+}
+
+// buildVersion returns the main module's version from the build information,
+// "(devel)" for builds from a source tree.
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+func (s *Server) info() infoPayload {
+	payload := infoPayload{
+		Version:         s.version,
+		ProtocolVersion: ProtocolVersion,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		Chroot:          s.chrootExecutor != nil,
+		Namespaces:      s.nsExecutor != nil,
+		RootDir:         s.rootDir,
+		UptimeMilli:     time.Since(s.started).Milliseconds(),
+	}
+	payload.Connections, payload.MaxConcurrent = s.conns.usage()
+	if s.isolationErr != nil {
+		payload.IsolationError = s.isolationErr.Error()
+	}
+	return payload
+}
+
+// Info asks the agent for its version, platform, isolation and uptime.
+// Agents that predate the info request return ErrUnsupported.
+func (c *IPCClient) Info(ctx context.Context) (*AgentInfo, error) {
+	var result infoPayload
+	if err := c.call(ctx, frameTypeInfoRequest, nil, frameTypeInfo, &result); err != nil {
+		return nil, err
+	}
+	return &AgentInfo{
+		Version:         result.Version,
+		ProtocolVersion: result.ProtocolVersion,
+		OS:              result.OS,
+		Arch:            result.Arch,
+		Chroot:          result.Chroot,
+		Namespaces:      result.Namespaces,
+		IsolationError:  result.IsolationError,
+		RootDir:         result.RootDir,
+		Uptime:          time.Duration(result.UptimeMilli) * time.Millisecond,
+		Connections:     result.Connections,
+		MaxConcurrent:   result.MaxConcurrent,
+	}, nil
+}
@@ -6,8 +6,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -16,6 +20,8 @@ const (
 	maxResultBytes    = 4 * 1024 * 1024
 	execErrorExitCode = -1
 	defaultFileMode   = 0o644
+
+	defaultStdinWindow = 1 << 20
 )
 
 // Dialer dials a transport connection to the guest agent.
@@ -27,6 +33,57 @@ type Dialer interface {
 type IPCClient struct {
 	dialer    Dialer
 	chunkSize int
+
+	// VerifyChecksum makes CopyTo and CopyFrom check a SHA-256 digest of
+	// each file end to end. A mismatch fails the transfer with
+	// ErrChecksumMismatch, and an upload that arrived corrupted is removed;
+	// agents that cannot report a digest fail it with ErrUnsupported.
+	VerifyChecksum bool
+
+	// PoolSize, when positive, keeps up to that many idle connections open
+	// and reuses them for Ping, Exec, CopyTo, CopyFrom and the other simple
+	// requests, instead of dialing for each. Streams, detached execs and
+	// execs with stdin or passed descriptors always use their own
+	// connection. Close closes the idle connections.
+	PoolSize int
+
+	// Retry, when set, retries dials that fail because the agent is not
+	// listening yet, such as right after it was started.
+	Retry *RetryPolicy
+
+	// Multiplex runs Exec and ExecStream calls over one shared connection,
+	// concurrently, when the agent offers FeatureMultiplex; otherwise each
+	// keeps using a connection of its own. Detached execs, reconnecting
+	// streams and execs passing descriptors never share. Output a caller
+	// does not drain holds up the other execs on the connection.
+	Multiplex bool
+
+	// Bandwidth throttles the client's connections to the agent, all of
+	// them sharing the limit: output and downloads at the egress rate,
+	// stdin and uploads at the ingress rate. Set it before first use.
+	Bandwidth Bandwidth
+
+	// StdinWindow bounds how many bytes of an exec's stdin are sent ahead
+	// of the agent acknowledging them, when it offers FeatureStdinAck, so
+	// reading stdin keeps pace with the command consuming it. Zero means
+	// 1 MiB; negative sends stdin as fast as it is read, as it is to agents
+	// without the feature.
+	StdinWindow int
+
+	shapeOnce sync.Once
+	shape     *shaper
+
+	peerMu sync.Mutex
+	peer   *Capabilities // set once Negotiate succeeds
+
+	poolMu      sync.Mutex
+	idle        []*poolConn
+	closed      bool
+	noKeepAlive bool // the agent refused a keep-alive hello
+
+	muxMu sync.Mutex
+	mux   *muxConn
+	noMux bool // the agent refused a multiplex hello
 }
 
 // NewIPCClient builds a transport-backed client instance.
@@ -38,82 +95,168 @@ func NewIPCClient(d Dialer) Client {
 }
 
 func (c *IPCClient) Ping(ctx context.Context) error {
+	return c.roundTrip(ctx, frameTypePing, nil, func(pc *poolConn) error {
+		frame, err := readFrame(pc.dec)
+		if err != nil {
+			return err
+		}
+		if frame.Type != frameTypePong {
+			return fmt.Errorf("unexpected frame %s", frame.Type)
+		}
+		return nil
+	})
+}
+
+func (c *IPCClient) Exec(ctx context.Context, cmd *CommandRequest) (*CommandResult, error) {
+	if cmd.DryRun {
+		if err := c.requireFeature(ctx, FeatureDryRun); err != nil {
+			return nil, err
+		}
+	}
+	if mc, err := c.multiplexed(ctx, cmd); err != nil {
+		return nil, err
+	} else if mc != nil {
+		return c.execMultiplexed(ctx, mc, cmd)
+	}
+	if c.PoolSize > 0 && cmd.Stdin == nil && cmd.Stdio == nil && !cmd.Detach && cmd.Resize == nil {
+		return c.execPooled(ctx, cmd)
+	}
+	win, err := c.stdinWindow(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer win.close()
 	conn, err := c.dial(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer conn.Close()
 
 	writer := newFrameWriter(conn)
 	dec := json.NewDecoder(conn)
 
-	if err := writer.send(frameTypePing, nil); err != nil {
-		return err
+	closeOnContext(ctx, conn)
+
+	if err := c.sendExecRequest(ctx, conn, writer, cmd, win, false, cmd.Detach); err != nil {
+		return nil, err
 	}
 
-	frame, err := readFrame(dec)
+	return c.readExecResult(ctx, decoderFrames(dec), cmd, win)
+}
+
+// execPooled runs a command without input on a pooled connection,
+// acknowledging the result with exec_done so the agent takes the next
+// request.
+func (c *IPCClient) execPooled(ctx context.Context, cmd *CommandRequest) (*CommandResult, error) {
+	var result *CommandResult
+	err := c.roundTrip(ctx, frameTypeExecRequest, newExecRequest(cmd, false, false), func(pc *poolConn) error {
+		if err := pc.writer.send(frameTypeStdinClose, nil); err != nil {
+			return err
+		}
+		var err error
+		if result, err = c.readExecResult(ctx, decoderFrames(pc.dec), cmd, nil); err != nil {
+			return err
+		}
+		if !pc.keepAlive {
+			return nil
+		}
+		return pc.writer.send(frameTypeExecDone, nil)
+	})
 	if err != nil {
-		return err
-	}
-	if frame.Type != frameTypePong {
-		return fmt.Errorf("unexpected frame %s", frame.Type)
+		return nil, err
 	}
-	return nil
+	return result, nil
 }
 
-func (c *IPCClient) Exec(ctx context.Context, cmd *CommandRequest) (*CommandResult, error) {
+func (c *IPCClient) ExecStream(ctx context.Context, cmd *CommandRequest) (*CommandStream, error) {
+	if cmd.DryRun {
+		if err := c.requireFeature(ctx, FeatureDryRun); err != nil {
+			return nil, err
+		}
+	}
+	if mc, err := c.multiplexed(ctx, cmd); err != nil {
+		return nil, err
+	} else if mc != nil {
+		return c.execStreamMultiplexed(ctx, mc, cmd)
+	}
+	win, err := c.stdinWindow(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
 	conn, err := c.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+
+	streamCtx, cancel := context.WithCancel(ctx)
 
 	writer := newFrameWriter(conn)
 	dec := json.NewDecoder(conn)
 
-	closeOnContext(ctx, conn)
+	closeOnContext(streamCtx, conn)
 
-	if err := c.sendExecRequest(ctx, writer, cmd, false); err != nil {
+	detach := cmd.Detach || cmd.Reconnect != nil
+	if err := c.sendExecRequest(streamCtx, conn, writer, cmd, win, true, detach); err != nil {
+		cancel()
+		conn.Close()
 		return nil, err
 	}
 
-	return c.readExecResult(ctx, dec)
+	fwd := &streamForwarder{client: c, conn: conn, dec: dec, policy: cmd.Reconnect, control: writer, stdin: win}
+	if detach {
+		// The agent announces the job ID before any output so callers can
+		// re-attach even if the very first read fails.
+		frame, err := readFrame(dec)
+		if err != nil {
+			cancel()
+			conn.Close()
+			win.close()
+			return nil, err
+		}
+		if frame.Type == frameTypeJob {
+			var payload jobPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err == nil {
+				fwd.jobID = payload.ID
+			}
+		} else {
+			fwd.pending = frame
+		}
+	}
+
+	return fwd.start(streamCtx, cancel), nil
 }
 
-func (c *IPCClient) ExecStream(ctx context.Context, cmd *CommandRequest) (*CommandStream, error) {
+// Attach resumes the output stream of a detached job from the beginning of
+// its retained output. Stdin cannot be re-attached.
+func (c *IPCClient) Attach(ctx context.Context, jobID string) (*CommandStream, error) {
+	if jobID == "" {
+		return nil, fmt.Errorf("job id is required")
+	}
 	conn, err := c.dial(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	streamCtx, cancel := context.WithCancel(ctx)
-
-	writer := newFrameWriter(conn)
-	dec := json.NewDecoder(conn)
-
 	closeOnContext(streamCtx, conn)
 
-	if err := c.sendExecRequest(streamCtx, writer, cmd, true); err != nil {
+	if err := newFrameWriter(conn).send(frameTypeAttachRequest, attachRequestPayload{ID: jobID}); err != nil {
 		cancel()
 		conn.Close()
 		return nil, err
 	}
 
-	stdoutCh := make(chan []byte, 32)
-	stderrCh := make(chan []byte, 32)
-	doneCh := make(chan *CommandResult, 1)
-
-	go c.forwardStream(streamCtx, dec, stdoutCh, stderrCh, doneCh)
+	fwd := &streamForwarder{client: c, conn: conn, dec: json.NewDecoder(conn), jobID: jobID}
+	return fwd.start(streamCtx, cancel), nil
+}
 
-	return &CommandStream{
-		Stdout: stdoutCh,
-		Stderr: stderrCh,
-		Done:   doneCh,
-		Cancel: func() {
-			cancel()
-			conn.Close()
-		},
-	}, nil
+// SignalJob sends sig to the process of the detached exec jobID. Jobs that
+// have already finished are left alone.
+func (c *IPCClient) SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error {
+	if jobID == "" {
+		return fmt.Errorf("job id is required")
+	}
+	return c.call(ctx, frameTypeSignalJobRequest, signalJobRequestPayload{ID: jobID, Signal: int(sig)}, frameTypeSignalJobResult, nil)
 }
 
 func (c *IPCClient) CopyTo(ctx context.Context, reader io.Reader, dst string) error {
@@ -124,6 +267,53 @@ func (c *IPCClient) CopyTo(ctx context.Context, reader io.Reader, dst string) er
 		return fmt.Errorf("destination path is required")
 	}
 
+	if c.VerifyChecksum {
+		if err := c.requireFeature(ctx, FeatureChecksum); err != nil {
+			return err
+		}
+	}
+	req := filePutRequestPayload{Path: dst, Mode: defaultFileMode, Sparse: true, Checksum: c.VerifyChecksum}
+	return c.roundTrip(ctx, frameTypeFilePutRequest, req, func(pc *poolConn) error {
+		sum := newChecksum(c.VerifyChecksum)
+		if err := c.sendChunks(ctx, pc.writer, reader, frameTypeFilePutChunk, frameTypeFilePutClose, sum); err != nil {
+			return err
+		}
+
+		result, err := c.readFileTransferResult(ctx, pc.dec, frameTypeFilePutResult)
+		if err != nil {
+			return err
+		}
+		if result.Error != "" {
+			return errors.New(result.Error)
+		}
+		return verifyChecksum(sum, result.SHA256)
+	})
+}
+
+// verifyChecksum compares the digest of what this side sent or received
+// with the one the agent reported. A nil sum skips the check.
+func verifyChecksum(sum hash.Hash, reported string) error {
+	if sum == nil {
+		return nil
+	}
+	if reported == "" {
+		return fmt.Errorf("%w: agent did not report a checksum", ErrUnsupported)
+	}
+	if local := checksumHex(sum); local != reported {
+		return fmt.Errorf("%w: sha256 %s here, %s on the agent", ErrChecksumMismatch, local, reported)
+	}
+	return nil
+}
+
+// ImportArchive streams a tar archive, optionally gzip-compressed, from
+// reader to the agent, which extracts it into its root directory. Entries
+// that would land outside the root, including links pointing outside it,
+// fail the import; entries extracted before the failure are kept.
+func (c *IPCClient) ImportArchive(ctx context.Context, reader io.Reader) error {
+	if reader == nil {
+		return fmt.Errorf("reader is required")
+	}
+
 	conn, err := c.dial(ctx)
 	if err != nil {
 		return err
@@ -134,10 +324,27 @@ func (c *IPCClient) CopyTo(ctx context.Context, reader io.Reader, dst string) er
 	dec := json.NewDecoder(conn)
 	closeOnContext(ctx, conn)
 
-	if err := writer.send(frameTypeFilePutRequest, filePutRequestPayload{Path: dst, Mode: defaultFileMode}); err != nil {
+	if err := writer.send(frameTypeArchiveImportRequest, archiveImportRequestPayload{}); err != nil {
+		return err
+	}
+	if err := c.sendChunks(ctx, writer, reader, frameTypeArchiveImportChunk, frameTypeArchiveImportClose, nil); err != nil {
 		return err
 	}
 
+	result, err := c.readFileTransferResult(ctx, dec, frameTypeArchiveImportResult)
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
+// sendChunks uploads everything read from reader as chunk frames of the
+// given type, followed by a close frame. A non-nil sum hashes the data and
+// its digest is sent with the close frame.
+func (c *IPCClient) sendChunks(ctx context.Context, writer *frameWriter, reader io.Reader, chunkType, closeType frameType, sum hash.Hash) error {
 	buf := make([]byte, c.chunkSize)
 	for {
 		select {
@@ -149,7 +356,10 @@ func (c *IPCClient) CopyTo(ctx context.Context, reader io.Reader, dst string) er
 		n, readErr := reader.Read(buf)
 		if n > 0 {
 			chunk := append([]byte(nil), buf[:n]...)
-			if err := writer.send(frameTypeFilePutChunk, chunkPayload{Data: chunk}); err != nil {
+			if sum != nil {
+				sum.Write(chunk)
+			}
+			if err := writer.send(chunkType, chunkPayload{Data: chunk}); err != nil {
 				return err
 			}
 		}
@@ -160,19 +370,10 @@ func (c *IPCClient) CopyTo(ctx context.Context, reader io.Reader, dst string) er
 			return readErr
 		}
 	}
-
-	if err := writer.send(frameTypeFilePutClose, nil); err != nil {
-		return err
-	}
-
-	result, err := c.readFileTransferResult(ctx, dec, frameTypeFilePutResult)
-	if err != nil {
-		return err
-	}
-	if result.Error != "" {
-		return errors.New(result.Error)
+	if sum != nil {
+		return writer.send(closeType, fileClosePayload{SHA256: checksumHex(sum)})
 	}
-	return nil
+	return writer.send(closeType, nil)
 }
 
 func (c *IPCClient) CopyFrom(ctx context.Context, src string, writer io.Writer) error {
@@ -182,6 +383,31 @@ func (c *IPCClient) CopyFrom(ctx context.Context, src string, writer io.Writer)
 	if src == "" {
 		return fmt.Errorf("source path is required")
 	}
+	if c.VerifyChecksum {
+		if err := c.requireFeature(ctx, FeatureChecksum); err != nil {
+			return err
+		}
+	}
+
+	req := fileGetRequestPayload{Path: src, Sparse: true, Checksum: c.VerifyChecksum}
+	return c.roundTrip(ctx, frameTypeFileGetRequest, req, func(pc *poolConn) error {
+		return c.receiveChunks(ctx, pc.dec, frameTypeFileGetChunk, frameTypeFileGetResult, writer, newChecksum(c.VerifyChecksum))
+	})
+}
+
+// CopyArchiveFrom streams a tar (optionally gzip-compressed) archive of a guest
+// directory into writer. The archive is produced on the fly by the agent, so
+// nothing is materialized on the guest disk.
+func (c *IPCClient) CopyArchiveFrom(ctx context.Context, srcDir string, format ArchiveFormat, writer io.Writer) error {
+	if writer == nil {
+		return fmt.Errorf("writer is required")
+	}
+	if srcDir == "" {
+		return fmt.Errorf("source directory is required")
+	}
+	if format == "" {
+		format = ArchiveFormatTar
+	}
 
 	conn, err := c.dial(ctx)
 	if err != nil {
@@ -193,10 +419,17 @@ func (c *IPCClient) CopyFrom(ctx context.Context, src string, writer io.Writer)
 	dec := json.NewDecoder(conn)
 	closeOnContext(ctx, conn)
 
-	if err := frameWriter.send(frameTypeFileGetRequest, fileGetRequestPayload{Path: src}); err != nil {
+	if err := frameWriter.send(frameTypeArchiveRequest, archiveRequestPayload{Path: srcDir, Format: format}); err != nil {
 		return err
 	}
 
+	return c.receiveChunks(ctx, dec, frameTypeArchiveChunk, frameTypeArchiveResult, writer, nil)
+}
+
+// receiveChunks copies chunk frames into dst until the terminating result
+// frame arrives, recreating any holes announced along the way.
+func (c *IPCClient) receiveChunks(ctx context.Context, dec *json.Decoder, chunkType, resultType frameType, dst io.Writer, sum hash.Hash) error {
+	writer := newHoleWriter(dst)
 	for {
 		frame, err := readFrame(dec)
 		if err != nil {
@@ -204,32 +437,47 @@ func (c *IPCClient) CopyFrom(ctx context.Context, src string, writer io.Writer)
 		}
 
 		switch frame.Type {
-		case frameTypeFileGetChunk:
+		case chunkType:
 			var payload chunkPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
 				return err
 			}
 			if len(payload.Data) > 0 {
+				if sum != nil {
+					sum.Write(payload.Data)
+				}
 				if _, err := writer.Write(payload.Data); err != nil {
 					return err
 				}
 			}
-		case frameTypeFileGetResult:
+		case frameTypeFileGetHole:
+			var payload holePayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return err
+			}
+			if err := writer.hole(payload.Length); err != nil {
+				return err
+			}
+			hashZeros(sum, payload.Length)
+		case resultType:
 			var payload fileTransferResultPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
 				return err
 			}
+			if err := writer.finish(); err != nil {
+				return err
+			}
 			if payload.Error != "" {
 				return errors.New(payload.Error)
 			}
-			return nil
+			return verifyChecksum(sum, payload.SHA256)
 		case frameTypeError:
 			var payload errorPayload
 			_ = json.Unmarshal(frame.Payload, &payload)
 			if payload.Message == "" {
 				payload.Message = "file transfer error"
 			}
-			return errors.New(payload.Message)
+			return payload.err()
 		default:
 			return fmt.Errorf("unexpected frame %s", frame.Type)
 		}
@@ -242,44 +490,130 @@ func (c *IPCClient) CopyFrom(ctx context.Context, src string, writer io.Writer)
 	}
 }
 
-func (c *IPCClient) Close() error { return nil }
+// CheckSpace reports whether the filesystem backing path has room for
+// needBytes plus a safety margin, along with its current usage.
+func (c *IPCClient) CheckSpace(ctx context.Context, path string, needBytes int64) (bool, *DiskUsage, error) {
+	if path == "" {
+		return false, nil, fmt.Errorf("path is required")
+	}
+	var result checkSpaceResultPayload
+	req := checkSpaceRequestPayload{Path: path, NeedBytes: needBytes}
+	if err := c.call(ctx, frameTypeCheckSpaceRequest, req, frameTypeCheckSpaceResult, &result); err != nil {
+		return false, nil, err
+	}
+	return result.OK, &result.Usage, nil
+}
+
+// Which resolves name against the guest PATH (or the agent's ForcePATH) and
+// returns the absolute path the agent would execute. Missing commands yield
+// an error wrapping ErrCommandNotFound.
+func (c *IPCClient) Which(ctx context.Context, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("command name is required")
+	}
+	var result whichResultPayload
+	if err := c.call(ctx, frameTypeWhichRequest, whichRequestPayload{Name: name}, frameTypeWhichResult, &result); err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// Chown changes the owner of path in the guest. A uid or gid of -1 leaves
+// that value unchanged. It fails with ErrPermissionDenied when the agent is
+// not privileged to change ownership.
+func (c *IPCClient) Chown(ctx context.Context, path string, uid, gid int) error {
+	if path == "" {
+		return fmt.Errorf("path is required")
+	}
+	req := chownRequestPayload{Path: path, UID: uid, GID: gid}
+	return c.call(ctx, frameTypeChownRequest, req, frameTypeChownResult, nil)
+}
+
+// call performs a single request/response exchange, decoding the expected
+// response frame into out.
+func (c *IPCClient) call(ctx context.Context, reqType frameType, req any, respType frameType, out any) error {
+	return c.roundTrip(ctx, reqType, req, func(pc *poolConn) error {
+		frame, err := readFrame(pc.dec)
+		if err != nil {
+			return err
+		}
+		switch frame.Type {
+		case respType:
+			if out == nil {
+				return nil
+			}
+			return json.Unmarshal(frame.Payload, out)
+		case frameTypeError:
+			var payload errorPayload
+			_ = json.Unmarshal(frame.Payload, &payload)
+			return payload.err()
+		default:
+			return fmt.Errorf("unexpected frame %s", frame.Type)
+		}
+	})
+}
+
+// decoderFrames returns a func reading frames from dec, for readExecResult.
+func decoderFrames(dec *json.Decoder) func() (*rawFrame, error) {
+	return func() (*rawFrame, error) { return readFrame(dec) }
+}
 
-func (c *IPCClient) readExecResult(ctx context.Context, dec *json.Decoder) (*CommandResult, error) {
-	stdoutBuf := newLimitedBuffer(maxResultBytes)
-	stderrBuf := newLimitedBuffer(maxResultBytes)
+// readExecResult collects an exec's output and result from the frames next
+// returns.
+func (c *IPCClient) readExecResult(ctx context.Context, next func() (*rawFrame, error), cmd *CommandRequest, win *stdinWindow) (*CommandResult, error) {
+	stdoutBuf, stderrBuf := newOutputBuffers(maxResultBytes, cmd.MaxStdoutBytes, cmd.MaxStderrBytes, cmd.MaxOutputBytes)
 
 	for {
-		frame, err := readFrame(dec)
+		frame, err := next()
 		if err != nil {
 			return nil, err
 		}
 
 		switch frame.Type {
-		case frameTypeStdout:
+		case frameTypeStdout, frameTypeStderr:
 			var payload chunkPayload
-			if err := json.Unmarshal(frame.Payload, &payload); err == nil {
-				stdoutBuf.Write(payload.Data)
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				continue
 			}
-		case frameTypeStderr:
-			var payload chunkPayload
-			if err := json.Unmarshal(frame.Payload, &payload); err == nil {
-				stderrBuf.Write(payload.Data)
+			data, err := payload.decode()
+			if err != nil {
+				return nil, err
+			}
+			if frame.Type == frameTypeStdout {
+				stdoutBuf.Write(data)
+			} else {
+				stderrBuf.Write(data)
 			}
+		case frameTypeStdinAck:
+			win.ackFrame(frame.Payload)
 		case frameTypeResult:
 			var payload execResultPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
 				return nil, err
 			}
+			if err := payload.decode(); err != nil {
+				return nil, err
+			}
 			if len(payload.Stdout) == 0 {
 				payload.Stdout = stdoutBuf.Bytes()
 			}
 			if len(payload.Stderr) == 0 {
 				payload.Stderr = stderrBuf.Bytes()
 			}
+			payload.StdoutTrunc = payload.StdoutTrunc || stdoutBuf.Truncated()
+			payload.StderrTrunc = payload.StderrTrunc || stderrBuf.Truncated()
+			// Agents predating the totals leave them zero; streamed output
+			// was counted here as it arrived.
+			payload.StdoutTotalBytes = max(payload.StdoutTotalBytes, stdoutBuf.Total())
+			payload.StderrTotalBytes = max(payload.StderrTotalBytes, stderrBuf.Total())
 			return payload.toCommandResult(), nil
 		case frameTypeError:
 			var payload errorPayload
 			_ = json.Unmarshal(frame.Payload, &payload)
+			if payload.Code != "" {
+				// Coded errors are agent-side refusals, not command failures.
+				return nil, payload.err()
+			}
 			return &CommandResult{ExitCode: execErrorExitCode, Stderr: []byte(payload.Message)}, nil
 		}
 
@@ -291,14 +625,84 @@ func (c *IPCClient) readExecResult(ctx context.Context, dec *json.Decoder) (*Com
 	}
 }
 
-func (c *IPCClient) forwardStream(ctx context.Context, dec *json.Decoder, stdoutCh, stderrCh chan<- []byte, doneCh chan<- *CommandResult) {
+// streamForwarder pumps frames from the agent into a CommandStream's
+// channels. For detached jobs with a ReconnectPolicy it transparently re-dials
+// and re-attaches after a transport failure, resuming from the byte offsets
+// already delivered.
+type streamForwarder struct {
+	client  *IPCClient
+	jobID   string
+	policy  *ReconnectPolicy
+	pending *rawFrame
+	control *frameWriter // writes to the exec's original connection
+	mux     *muxStream   // the exchange, for execs on a multiplexed connection
+	stdin   *stdinWindow // released when the exec's original connection is done
+
+	mu   sync.Mutex
+	conn net.Conn
+	dec  *json.Decoder
+
+	stdoutOffset int64
+	stderrOffset int64
+	missed       missedOutput
+}
+
+func (f *streamForwarder) start(ctx context.Context, cancel context.CancelFunc) *CommandStream {
+	stdoutCh := make(chan []byte, 32)
+	stderrCh := make(chan []byte, 32)
+	doneCh := make(chan *CommandResult, 1)
+
+	go f.run(ctx, stdoutCh, stderrCh, doneCh)
+
+	return &CommandStream{
+		JobID:  f.jobID,
+		Stdout: stdoutCh,
+		Stderr: stderrCh,
+		Done:   doneCh,
+		Cancel: func() {
+			cancel()
+			f.closeConn()
+		},
+		control: f.control,
+		missed:  &f.missed,
+	}
+}
+
+func (f *streamForwarder) closeConn() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+}
+
+func (f *streamForwarder) next(ctx context.Context) (*rawFrame, error) {
+	if f.pending != nil {
+		frame := f.pending
+		f.pending = nil
+		return frame, nil
+	}
+	if f.mux != nil {
+		return f.mux.next(ctx)
+	}
+	return readFrame(f.dec)
+}
+
+func (f *streamForwarder) run(ctx context.Context, stdoutCh, stderrCh chan<- []byte, doneCh chan<- *CommandResult) {
 	defer close(stdoutCh)
 	defer close(stderrCh)
 	defer close(doneCh)
+	defer f.stdin.close()
+	if f.mux != nil {
+		defer f.mux.close()
+	}
 
 	for {
-		frame, err := readFrame(dec)
+		frame, err := f.next(ctx)
 		if err != nil {
+			if f.reconnect(ctx, err) {
+				continue
+			}
 			doneCh <- &CommandResult{ExitCode: execErrorExitCode, Stderr: []byte(err.Error())}
 			return
 		}
@@ -307,8 +711,15 @@ func (c *IPCClient) forwardStream(ctx context.Context, dec *json.Decoder, stdout
 		case frameTypeStdout:
 			var payload chunkPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err == nil {
+				data, err := payload.decode()
+				if err != nil {
+					doneCh <- &CommandResult{ExitCode: execErrorExitCode, Stderr: []byte(err.Error())}
+					return
+				}
+				skipTo(&f.stdoutOffset, payload.Offset, &f.missed.stdout)
 				select {
-				case stdoutCh <- payload.Data:
+				case stdoutCh <- data:
+					f.stdoutOffset += int64(len(data))
 				case <-ctx.Done():
 					return
 				}
@@ -316,17 +727,33 @@ func (c *IPCClient) forwardStream(ctx context.Context, dec *json.Decoder, stdout
 		case frameTypeStderr:
 			var payload chunkPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err == nil {
+				data, err := payload.decode()
+				if err != nil {
+					doneCh <- &CommandResult{ExitCode: execErrorExitCode, Stderr: []byte(err.Error())}
+					return
+				}
+				skipTo(&f.stderrOffset, payload.Offset, &f.missed.stderr)
 				select {
-				case stderrCh <- payload.Data:
+				case stderrCh <- data:
+					f.stderrOffset += int64(len(data))
 				case <-ctx.Done():
 					return
 				}
 			}
+		case frameTypeStdinAck:
+			f.stdin.ackFrame(frame.Payload)
 		case frameTypeResult:
 			var payload execResultPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
 				doneCh <- &CommandResult{ExitCode: execErrorExitCode, Stderr: []byte(err.Error())}
+			} else if err := payload.decode(); err != nil {
+				doneCh <- &CommandResult{ExitCode: execErrorExitCode, Stderr: []byte(err.Error())}
 			} else {
+				if f.jobID != "" {
+					// Output past the last chunk that was never sent.
+					skipTo(&f.stdoutOffset, payload.StdoutTotalBytes, &f.missed.stdout)
+					skipTo(&f.stderrOffset, payload.StderrTotalBytes, &f.missed.stderr)
+				}
 				doneCh <- payload.toCommandResult()
 			}
 			return
@@ -346,7 +773,101 @@ func (c *IPCClient) forwardStream(ctx context.Context, dec *json.Decoder, stdout
 	}
 }
 
-func (c *IPCClient) sendExecRequest(ctx context.Context, writer *frameWriter, cmd *CommandRequest, stream bool) error {
+// skipTo advances *delivered to offset, the position of the next output the
+// agent sends, counting any bytes it skipped in missed. Agents that do not
+// send offsets leave offset zero and nothing is counted.
+func skipTo(delivered *int64, offset int64, missed *atomic.Int64) {
+	if offset > *delivered {
+		missed.Add(offset - *delivered)
+		*delivered = offset
+	}
+}
+
+// reconnect re-dials the agent and re-attaches to the detached job. It
+// reports false when reconnection is not configured or every attempt failed.
+func (f *streamForwarder) reconnect(ctx context.Context, cause error) bool {
+	if f.jobID == "" || f.policy == nil || ctx.Err() != nil {
+		return false
+	}
+	f.closeConn()
+	// Stdin went with the original connection; attaching cannot resume it.
+	f.stdin.close()
+
+	for attempt := 1; attempt <= f.policy.MaxAttempts; attempt++ {
+		if f.policy.OnReconnect != nil {
+			f.policy.OnReconnect(attempt, cause)
+		}
+		if f.policy.Delay > 0 {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-time.After(f.policy.Delay):
+			}
+		}
+
+		conn, err := f.client.dial(ctx)
+		if err != nil {
+			cause = err
+			continue
+		}
+		req := attachRequestPayload{ID: f.jobID, StdoutOffset: f.stdoutOffset, StderrOffset: f.stderrOffset}
+		if err := newFrameWriter(conn).send(frameTypeAttachRequest, req); err != nil {
+			conn.Close()
+			cause = err
+			continue
+		}
+
+		f.mu.Lock()
+		f.conn = conn
+		f.dec = json.NewDecoder(conn)
+		f.mu.Unlock()
+		closeOnContext(ctx, conn)
+		return true
+	}
+	return false
+}
+
+func (c *IPCClient) sendExecRequest(ctx context.Context, conn net.Conn, writer *frameWriter, cmd *CommandRequest, win *stdinWindow, stream, detach bool) error {
+	req := newExecRequest(cmd, stream, detach)
+	req.StdinAck = win != nil
+	if cmd.Stdio != nil {
+		if err := sendFrameWithFile(conn, frameTypeExecRequest, req, cmd.Stdio); err != nil {
+			return err
+		}
+	} else if err := writer.send(frameTypeExecRequest, req); err != nil {
+		return err
+	}
+
+	go c.pipeStdin(ctx, writer, cmd.Stdin, win)
+	if cmd.Tty && cmd.Resize != nil {
+		go pipeResize(ctx, writer, cmd.Resize)
+	}
+	return nil
+}
+
+// stdinWindow returns the window cmd's stdin is sent within, or nil when
+// it has no stdin, StdinWindow turns flow control off, or the agent does
+// not acknowledge stdin. It negotiates before the exec dials, so agents
+// limiting their connections are not asked for a second one.
+func (c *IPCClient) stdinWindow(ctx context.Context, cmd *CommandRequest) (*stdinWindow, error) {
+	if cmd.Stdin == nil || c.StdinWindow < 0 {
+		return nil, nil
+	}
+	peer, err := c.Negotiate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !peer.HasFeature(FeatureStdinAck) {
+		return nil, nil
+	}
+	size := c.StdinWindow
+	if size == 0 {
+		size = defaultStdinWindow
+	}
+	return newStdinWindow(int64(size)), nil
+}
+
+func newExecRequest(cmd *CommandRequest, stream, detach bool) execRequestPayload {
 	req := execRequestPayload{
 		Path:       cmd.Path,
 		Args:       append([]string(nil), cmd.Args...),
@@ -354,20 +875,57 @@ func (c *IPCClient) sendExecRequest(ctx context.Context, writer *frameWriter, cm
 		WorkingDir: cmd.WorkingDir,
 		Stream:     stream,
 		User:       cmd.User,
+		Detach:     detach,
+		MaxStdout:  cmd.MaxStdoutBytes,
+		MaxStderr:  cmd.MaxStderrBytes,
+		MaxOutput:  cmd.MaxOutputBytes,
+		Hostname:   cmd.Hostname,
+		StdioFD:    cmd.Stdio != nil,
+
+		OOMScoreAdj:   cmd.OOMScoreAdj,
+		MaxOpenFiles:  cmd.MaxOpenFiles,
+		StdinFIFO:     cmd.StdinFIFO,
+		StdoutFIFO:    cmd.StdoutFIFO,
+		StderrFIFO:    cmd.StderrFIFO,
+		ReturnEnv:     cmd.ReturnEnv,
+		EgressAllow:   cmd.EgressAllow,
+		CompletionURL: cmd.CompletionURL,
+		Tty:           cmd.Tty,
+		CreateWorkDir: cmd.CreateWorkingDir,
+
+		AcceptEncoding: acceptedEncodings,
+		DryRun:         cmd.DryRun,
+	}
+	if cmd.Tty && cmd.TtySize != (WindowSize{}) {
+		req.TtySize = &windowSizePayload{Rows: cmd.TtySize.Rows, Cols: cmd.TtySize.Cols}
+	}
+	for _, m := range cmd.Mounts {
+		req.Mounts = append(req.Mounts, mountPayload{Source: m.Source, Target: m.Target})
 	}
+	for _, t := range cmd.Tmpfs {
+		req.Tmpfs = append(req.Tmpfs, tmpfsPayload{Path: t.Path, SizeBytes: t.SizeBytes})
+	}
+	req.StdoutLog = logFileRequest(cmd.StdoutLog)
+	req.StderrLog = logFileRequest(cmd.StderrLog)
 	if cmd.Timeout > 0 {
 		req.TimeoutMilli = cmd.Timeout.Milliseconds()
 	}
+	return req
+}
 
-	if err := writer.send(frameTypeExecRequest, req); err != nil {
-		return err
+func logFileRequest(log *LogFile) *logFilePayload {
+	if log == nil {
+		return nil
+	}
+	return &logFilePayload{
+		Path:        log.Path,
+		MaxBytes:    log.MaxBytes,
+		MaxAgeMilli: log.MaxAge.Milliseconds(),
+		Keep:        log.Keep,
 	}
-
-	go c.pipeStdin(ctx, writer, cmd.Stdin)
-	return nil
 }
 
-func (c *IPCClient) pipeStdin(ctx context.Context, writer *frameWriter, reader io.Reader) {
+func (c *IPCClient) pipeStdin(ctx context.Context, writer *frameWriter, reader io.Reader, win *stdinWindow) {
 	if reader == nil {
 		_ = writer.send(frameTypeStdinClose, nil)
 		return
@@ -384,6 +942,10 @@ func (c *IPCClient) pipeStdin(ctx context.Context, writer *frameWriter, reader i
 
 		n, err := reader.Read(buf)
 		if n > 0 {
+			if !win.reserve(ctx, n) {
+				_ = writer.send(frameTypeStdinClose, nil)
+				return
+			}
 			chunk := append([]byte(nil), buf[:n]...)
 			if sendErr := writer.send(frameTypeStdinChunk, stdinPayload{Data: chunk}); sendErr != nil {
 				return
@@ -400,8 +962,31 @@ func (c *IPCClient) pipeStdin(ctx context.Context, writer *frameWriter, reader i
 	}
 }
 
+// pipeResize forwards terminal size changes until ctx ends, sizes stops, or
+// the connection is gone.
+func pipeResize(ctx context.Context, writer *frameWriter, sizes <-chan WindowSize) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case size, ok := <-sizes:
+			if !ok {
+				return
+			}
+			if err := writer.send(frameTypeResize, windowSizePayload{Rows: size.Rows, Cols: size.Cols}); err != nil {
+				return
+			}
+		}
+	}
+}
+
 func (c *IPCClient) dial(ctx context.Context) (net.Conn, error) {
-	return c.dialer.Dial(ctx)
+	conn, err := dialRetry(ctx, c.dialer, c.Retry)
+	if err != nil {
+		return nil, err
+	}
+	c.shapeOnce.Do(func() { c.shape = newShaper(c.Bandwidth) })
+	return c.shape.conn(conn), nil
 }
 
 func closeOnContext(ctx context.Context, conn net.Conn) {
@@ -430,7 +1015,7 @@ func (c *IPCClient) readFileTransferResult(ctx context.Context, dec *json.Decode
 			if payload.Message == "" {
 				payload.Message = "file transfer error"
 			}
-			return nil, errors.New(payload.Message)
+			return nil, payload.err()
 		default:
 			return nil, fmt.Errorf("unexpected frame %s", frame.Type)
 		}
@@ -441,32 +1026,82 @@ func newLimitedBuffer(limit int) *limitedBuffer {
 	return &limitedBuffer{limit: limit}
 }
 
-type limitedBuffer struct {
-	buf   bytes.Buffer
-	limit int
+// newOutputBuffers returns the stdout and stderr collectors for one exec.
+// Per-stream limits are clamped to ceiling; a positive combined limit is
+// shared between the two buffers.
+func newOutputBuffers(ceiling, stdoutLimit, stderrLimit, combined int) (*limitedBuffer, *limitedBuffer) {
+	stdout := newLimitedBuffer(clampLimit(stdoutLimit, ceiling))
+	stderr := newLimitedBuffer(clampLimit(stderrLimit, ceiling))
+	if combined > 0 {
+		budget := &outputBudget{remaining: combined}
+		stdout.shared = budget
+		stderr.shared = budget
+	}
+	return stdout, stderr
 }
 
-func (b *limitedBuffer) Write(p []byte) (int, error) {
-	if b.limit <= 0 {
-		return 0, nil
+func clampLimit(limit, ceiling int) int {
+	if limit <= 0 || limit > ceiling {
+		return ceiling
 	}
+	return limit
+}
 
-	remaining := b.limit - b.buf.Len()
-	if remaining <= 0 {
-		return len(p), nil
-	}
+// outputBudget is a byte allowance shared by the stdout and stderr buffers of
+// a single exec.
+type outputBudget struct {
+	mu        sync.Mutex
+	remaining int
+}
 
-	if len(p) > remaining {
-		p = p[:remaining]
+func (b *outputBudget) take(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > b.remaining {
+		n = b.remaining
 	}
+	b.remaining -= n
+	return n
+}
 
-	return b.buf.Write(p)
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	shared    *outputBudget
+	truncated bool
+	total     int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	b.total += int64(n)
+	if remaining := b.limit - b.buf.Len(); len(p) > remaining {
+		p = p[:max(remaining, 0)]
+	}
+	if b.shared != nil {
+		p = p[:b.shared.take(len(p))]
+	}
+	if len(p) < n {
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
 }
 
 func (b *limitedBuffer) Bytes() []byte {
 	return b.buf.Bytes()
 }
 
+// Truncated reports whether any written data was dropped.
+func (b *limitedBuffer) Truncated() bool {
+	return b.truncated
+}
+
+// Total returns the number of bytes written, including any that were dropped.
+func (b *limitedBuffer) Total() int64 {
+	return b.total
+}
+
 func (p execResultPayload) toCommandResult() *CommandResult {
 	return &CommandResult{
 		ExitCode:   p.ExitCode,
@@ -475,5 +1110,22 @@ func (p execResultPayload) toCommandResult() *CommandResult {
 		Duration:   time.Duration(p.DurationMilli) * time.Millisecond,
 		StartedAt:  p.StartedAt,
 		FinishedAt: p.FinishedAt,
+
+		StdoutTruncated: p.StdoutTrunc,
+		StderrTruncated: p.StderrTrunc,
+		Env:             p.Env,
+		PeakOpenFiles:   p.PeakOpenFiles,
+		ExitReason:      p.ExitReason,
+		TimedOut:        p.TimedOut,
+		UserTime:        time.Duration(p.UserTimeMicro) * time.Microsecond,
+		SysTime:         time.Duration(p.SysTimeMicro) * time.Microsecond,
+		MaxRSSBytes:     p.MaxRSSBytes,
+		BlockedSyscall:  p.BlockedSyscall,
+		ExecID:          p.ExecID,
+
+		StdoutTotalBytes: p.StdoutTotalBytes,
+		StderrTotalBytes: p.StderrTotalBytes,
+
+		DryRun: p.DryRun.report(),
 	}
 }
@@ -0,0 +1,200 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutputBuffersLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name                     string
+		stdoutLimit, stderrLimit int
+		combined                 int
+		wantStdout, wantStderr   int
+		truncStdout, truncStderr bool
+	}{
+		{name: "defaults", wantStdout: 100, wantStderr: 100},
+		{name: "stdout only", stdoutLimit: 10, wantStdout: 10, wantStderr: 100, truncStdout: true},
+		{name: "stderr only", stderrLimit: 5, wantStdout: 100, wantStderr: 5, truncStderr: true},
+		{name: "asymmetric", stdoutLimit: 60, stderrLimit: 3, wantStdout: 60, wantStderr: 3, truncStdout: true, truncStderr: true},
+		{name: "combined", combined: 150, wantStdout: 100, wantStderr: 50, truncStderr: true},
+		{name: "combined under stream limits", stdoutLimit: 30, combined: 40, wantStdout: 30, wantStderr: 10, truncStdout: true, truncStderr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, stderr := newOutputBuffers(200, tc.stdoutLimit, tc.stderrLimit, tc.combined)
+			// Each stream is written 100 bytes, stdout first, so it gets
+			// the combined allowance first.
+			for _, w := range []*limitedBuffer{stdout, stderr} {
+				for range 10 {
+					if n, err := w.Write([]byte("0123456789")); n != 10 || err != nil {
+						t.Fatalf("Write = %d, %v, want 10, nil", n, err)
+					}
+				}
+			}
+			if got := len(stdout.Bytes()); got != tc.wantStdout {
+				t.Errorf("stdout kept %d bytes, want %d", got, tc.wantStdout)
+			}
+			if got := len(stderr.Bytes()); got != tc.wantStderr {
+				t.Errorf("stderr kept %d bytes, want %d", got, tc.wantStderr)
+			}
+			if stdout.Truncated() != tc.truncStdout || stderr.Truncated() != tc.truncStderr {
+				t.Errorf("truncated = %v, %v, want %v, %v", stdout.Truncated(), stderr.Truncated(), tc.truncStdout, tc.truncStderr)
+			}
+		})
+	}
+
+	if stdout, _ := newOutputBuffers(200, 1<<30, 0, 0); stdout.limit != 200 {
+		t.Errorf("limit above the ceiling = %d, want it clamped to 200", stdout.limit)
+	}
+}
+
+func TestExecOutputLimits(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := client.Exec(ctx, &CommandRequest{
+		Path:           "/bin/sh",
+		Args:           []string{"-c", "printf '%0100d' 0; printf '%0100d' 0 >&2"},
+		MaxStdoutBytes: 64,
+		MaxStderrBytes: 8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Stdout) != 64 || len(result.Stderr) != 8 {
+		t.Errorf("kept %d bytes of stdout and %d of stderr, want 64 and 8", len(result.Stdout), len(result.Stderr))
+	}
+	if !result.StdoutTruncated || !result.StderrTruncated {
+		t.Errorf("truncated = %v, %v, want true, true", result.StdoutTruncated, result.StderrTruncated)
+	}
+
+	result, err = client.Exec(ctx, &CommandRequest{
+		Path:           "/bin/sh",
+		Args:           []string{"-c", "printf ok"},
+		MaxStdoutBytes: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Stdout) != "ok" || result.StdoutTruncated {
+		t.Errorf("stdout = %q, truncated %v, want \"ok\", false", result.Stdout, result.StdoutTruncated)
+	}
+	if len(result.Stderr) != 0 || result.StderrTruncated {
+		t.Errorf("stderr = %q, truncated %v, want empty", result.Stderr, result.StderrTruncated)
+	}
+}
+
+// cuttableDialer dials a Unix socket and can sever every connection it has
+// made so far, as a transport failure would.
+type cuttableDialer struct {
+	UnixDialer
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (d *cuttableDialer) Dial(ctx context.Context) (net.Conn, error) {
+	conn, err := d.UnixDialer.Dial(ctx)
+	if err == nil {
+		d.mu.Lock()
+		d.conns = append(d.conns, conn)
+		d.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (d *cuttableDialer) cut() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.conns = nil
+}
+
+func TestExecStreamReconnectResumesOutput(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(ServerConfig{})
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Shutdown)
+	dialer := &cuttableDialer{UnixDialer: UnixDialer{Path: sock}}
+	client := NewIPCClient(dialer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var mu sync.Mutex
+	var attempts int
+	stream, err := client.ExecStream(ctx, &CommandRequest{
+		Path: "/bin/sh",
+		Args: []string{"-c", "for i in $(seq 1 40); do echo out$i; echo err$i >&2; sleep 0.01; done"},
+		Reconnect: &ReconnectPolicy{
+			MaxAttempts: 5,
+			Delay:       50 * time.Millisecond,
+			OnReconnect: func(int, error) {
+				mu.Lock()
+				attempts++
+				mu.Unlock()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+
+	var stdout, stderr strings.Builder
+	outCh, errCh := stream.Stdout, stream.Stderr
+	for outCh != nil || errCh != nil {
+		select {
+		case data, ok := <-outCh:
+			if !ok {
+				outCh = nil
+				continue
+			}
+			if stdout.Len() == 0 {
+				// Sever the transport as soon as output is flowing.
+				dialer.cut()
+			}
+			stdout.Write(data)
+		case data, ok := <-errCh:
+			if !ok {
+				errCh = nil
+				continue
+			}
+			stderr.Write(data)
+		}
+	}
+	result := <-stream.Done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts == 0 {
+		t.Fatal("the stream never reconnected")
+	}
+	if result == nil || result.ExitCode != 0 {
+		t.Fatalf("result = %+v, want exit code 0", result)
+	}
+	var wantOut, wantErr strings.Builder
+	for i := 1; i <= 40; i++ {
+		fmt.Fprintf(&wantOut, "out%d\n", i)
+		fmt.Fprintf(&wantErr, "err%d\n", i)
+	}
+	if stdout.String() != wantOut.String() {
+		t.Errorf("stdout after reconnecting = %q, want %q", stdout.String(), wantOut.String())
+	}
+	if stderr.String() != wantErr.String() {
+		t.Errorf("stderr after reconnecting = %q, want %q", stderr.String(), wantErr.String())
+	}
+	if out, errs := stream.Missed(); out != 0 || errs != 0 {
+		t.Errorf("missed %d bytes of stdout and %d of stderr", out, errs)
+	}
+}
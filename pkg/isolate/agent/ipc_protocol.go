@@ -2,6 +2,8 @@ package agent
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"sync"
 	"time"
@@ -10,37 +12,125 @@ import (
 type frameType string
 
 const (
-	frameTypeExecRequest    frameType = "exec_request"
-	frameTypeStdout         frameType = "stdout"
-	frameTypeStderr         frameType = "stderr"
-	frameTypeResult         frameType = "result"
-	frameTypeError          frameType = "error"
-	frameTypeStdinChunk     frameType = "stdin_chunk"
-	frameTypeStdinClose     frameType = "stdin_close"
-	frameTypePing           frameType = "ping"
-	frameTypePong           frameType = "pong"
-	frameTypeFilePutRequest frameType = "file_put_request"
-	frameTypeFilePutChunk   frameType = "file_put_chunk"
-	frameTypeFilePutClose   frameType = "file_put_close"
-	frameTypeFilePutResult  frameType = "file_put_result"
-	frameTypeFileGetRequest frameType = "file_get_request"
-	frameTypeFileGetChunk   frameType = "file_get_chunk"
-	frameTypeFileGetResult  frameType = "file_get_result"
+	frameTypeExecRequest          frameType = "exec_request"
+	frameTypeStdout               frameType = "stdout"
+	frameTypeStderr               frameType = "stderr"
+	frameTypeResult               frameType = "result"
+	frameTypeError                frameType = "error"
+	frameTypeStdinChunk           frameType = "stdin_chunk"
+	frameTypeStdinClose           frameType = "stdin_close"
+	frameTypeStdinAck             frameType = "stdin_ack"
+	frameTypeResize               frameType = "resize"
+	frameTypePauseOutput          frameType = "pause_output"
+	frameTypeResumeOutput         frameType = "resume_output"
+	frameTypeSignal               frameType = "signal"
+	frameTypePing                 frameType = "ping"
+	frameTypePong                 frameType = "pong"
+	frameTypeFilePutRequest       frameType = "file_put_request"
+	frameTypeFilePutChunk         frameType = "file_put_chunk"
+	frameTypeFilePutClose         frameType = "file_put_close"
+	frameTypeFilePutResult        frameType = "file_put_result"
+	frameTypeFileGetRequest       frameType = "file_get_request"
+	frameTypeFileGetChunk         frameType = "file_get_chunk"
+	frameTypeFileGetHole          frameType = "file_get_hole"
+	frameTypeFileGetResult        frameType = "file_get_result"
+	frameTypeArchiveRequest       frameType = "archive_request"
+	frameTypeArchiveChunk         frameType = "archive_chunk"
+	frameTypeArchiveResult        frameType = "archive_result"
+	frameTypeArchiveImportRequest frameType = "archive_import_request"
+	frameTypeArchiveImportChunk   frameType = "archive_import_chunk"
+	frameTypeArchiveImportClose   frameType = "archive_import_close"
+	frameTypeArchiveImportResult  frameType = "archive_import_result"
+	frameTypeJob                  frameType = "job"
+	frameTypeAttachRequest        frameType = "attach_request"
+	frameTypeCheckSpaceRequest    frameType = "check_space_request"
+	frameTypeCheckSpaceResult     frameType = "check_space_result"
+	frameTypeWhichRequest         frameType = "which_request"
+	frameTypeWhichResult          frameType = "which_result"
+	frameTypeChownRequest         frameType = "chown_request"
+	frameTypeChownResult          frameType = "chown_result"
+	frameTypeLogSubscribe         frameType = "log_subscribe"
+	frameTypeLogSubscribed        frameType = "log_subscribed"
+	frameTypeLogLine              frameType = "log_line"
+	frameTypeLogUnsubscribe       frameType = "log_unsubscribe"
+	frameTypeLogEnd               frameType = "log_end"
+	frameTypeCapabilitiesRequest  frameType = "capabilities_request"
+	frameTypeCapabilitiesResult   frameType = "capabilities_result"
+	frameTypeSignalJobRequest     frameType = "signal_job_request"
+	frameTypeSignalJobResult      frameType = "signal_job_result"
+	frameTypeHello                frameType = "hello"
+	frameTypeInfoRequest          frameType = "info_request"
+	frameTypeInfo                 frameType = "info"
+	frameTypeProcessStatsRequest  frameType = "process_stats_request"
+	frameTypeProcessStats         frameType = "process_stats"
+	frameTypeLogsRequest          frameType = "logs_request"
+	frameTypeLogs                 frameType = "logs"
+	frameTypeExecDone             frameType = "exec_done"
 )
 
 type rawFrame struct {
-	Type    frameType       `json:"type"`
+	Type frameType `json:"type"`
+	// ID names the exchange a frame belongs to on a multiplexed connection.
+	ID      string          `json:"id,omitempty"`
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 type execRequestPayload struct {
-	Path         string            `json:"path"`
-	Args         []string          `json:"args"`
-	Env          map[string]string `json:"env,omitempty"`
-	WorkingDir   string            `json:"working_dir,omitempty"`
-	TimeoutMilli int64             `json:"timeout_ms,omitempty"`
-	Stream       bool              `json:"stream"`
-	User         string            `json:"user,omitempty"`
+	Path          string             `json:"path"`
+	Args          []string           `json:"args"`
+	Env           map[string]string  `json:"env,omitempty"`
+	WorkingDir    string             `json:"working_dir,omitempty"`
+	CreateWorkDir bool               `json:"create_working_dir,omitempty"`
+	TimeoutMilli  int64              `json:"timeout_ms,omitempty"`
+	Stream        bool               `json:"stream"`
+	User          string             `json:"user,omitempty"`
+	Detach        bool               `json:"detach,omitempty"`
+	MaxStdout     int                `json:"max_stdout_bytes,omitempty"`
+	MaxStderr     int                `json:"max_stderr_bytes,omitempty"`
+	MaxOutput     int                `json:"max_output_bytes,omitempty"`
+	Hostname      string             `json:"hostname,omitempty"`
+	OOMScoreAdj   int                `json:"oom_score_adj,omitempty"`
+	MaxOpenFiles  uint64             `json:"max_open_files,omitempty"`
+	StdinFIFO     string             `json:"stdin_fifo,omitempty"`
+	StdoutFIFO    string             `json:"stdout_fifo,omitempty"`
+	StderrFIFO    string             `json:"stderr_fifo,omitempty"`
+	Mounts        []mountPayload     `json:"mounts,omitempty"`
+	Tmpfs         []tmpfsPayload     `json:"tmpfs,omitempty"`
+	StdoutLog     *logFilePayload    `json:"stdout_log,omitempty"`
+	StderrLog     *logFilePayload    `json:"stderr_log,omitempty"`
+	ReturnEnv     bool               `json:"return_env,omitempty"`
+	EgressAllow   []string           `json:"egress_allow,omitempty"`
+	CompletionURL string             `json:"completion_url,omitempty"`
+	Tty           bool               `json:"tty,omitempty"`
+	TtySize       *windowSizePayload `json:"tty_size,omitempty"`
+	// AcceptEncoding lists the output compressions the client can decode.
+	AcceptEncoding []string `json:"accept_encoding,omitempty"`
+	// StdioFD marks a request sent with a descriptor attached (SCM_RIGHTS)
+	// that becomes the child's stdin and stdout.
+	StdioFD bool `json:"stdio_fd,omitempty"`
+	// StdinAck asks the agent to acknowledge stdin with stdin_ack frames,
+	// for clients that bound how much they send ahead.
+	StdinAck bool `json:"stdin_ack,omitempty"`
+	// DryRun asks the agent to check the exec as it would before starting
+	// it and answer with a result carrying dry_run, without running it.
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+type mountPayload struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+type tmpfsPayload struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+}
+
+type logFilePayload struct {
+	Path        string `json:"path"`
+	MaxBytes    int64  `json:"max_bytes,omitempty"`
+	MaxAgeMilli int64  `json:"max_age_ms,omitempty"`
+	Keep        int    `json:"keep,omitempty"`
 }
 
 type execResultPayload struct {
@@ -51,32 +141,238 @@ type execResultPayload struct {
 	StartedAt     time.Time `json:"started_at"`
 	FinishedAt    time.Time `json:"finished_at"`
 	ErrorMessage  string    `json:"error,omitempty"`
+	StdoutTrunc   bool      `json:"stdout_truncated,omitempty"`
+	StderrTrunc   bool      `json:"stderr_truncated,omitempty"`
+	Env           []string  `json:"env,omitempty"`
+	PeakOpenFiles int       `json:"peak_open_files,omitempty"`
+	ExitReason    string    `json:"exit_reason,omitempty"`
+	TimedOut      bool      `json:"timed_out,omitempty"`
+	UserTimeMicro int64     `json:"user_time_us,omitempty"`
+	SysTimeMicro  int64     `json:"sys_time_us,omitempty"`
+	MaxRSSBytes   uint64    `json:"max_rss_bytes,omitempty"`
+	// StdoutEncoding and StderrEncoding are set when the agent compressed
+	// the corresponding field.
+	StdoutEncoding string `json:"stdout_encoding,omitempty"`
+	StderrEncoding string `json:"stderr_encoding,omitempty"`
+	// BlockedSyscall names the system call a seccomp filter killed the
+	// command for, when the agent could tell.
+	BlockedSyscall string `json:"blocked_syscall,omitempty"`
+	// ExecID names the exec's retained output for logs_request; empty when
+	// the agent keeps none.
+	ExecID string `json:"exec_id,omitempty"`
+	// StdoutTotalBytes and StderrTotalBytes count all the output the
+	// command wrote, including what the truncated buffers dropped.
+	StdoutTotalBytes int64 `json:"stdout_total_bytes,omitempty"`
+	StderrTotalBytes int64 `json:"stderr_total_bytes,omitempty"`
+	// DryRun is the report answering a dry-run exec, which did not run.
+	DryRun *dryRunPayload `json:"dry_run,omitempty"`
+}
+
+// dryRunPayload reports what a dry-run exec would have done: the command as
+// it would start, from the working directory it would see inside Chroot, as
+// User when the request switched users, or that the agent would refuse it.
+type dryRunPayload struct {
+	Path       string    `json:"path"`
+	Args       []string  `json:"args,omitempty"`
+	WorkingDir string    `json:"working_dir,omitempty"`
+	Chroot     string    `json:"chroot,omitempty"`
+	User       *execUser `json:"user,omitempty"`
+	Blocked    bool      `json:"blocked,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Code       string    `json:"code,omitempty"`
+}
+
+type logsRequestPayload struct {
+	ID        string `json:"id"`
+	TailBytes int    `json:"tail_bytes,omitempty"`
+}
+
+type logsPayload struct {
+	Data []byte `json:"data,omitempty"`
+}
+
+type signalJobRequestPayload struct {
+	ID     string `json:"id"`
+	Signal int    `json:"signal"`
+}
+
+type jobPayload struct {
+	ID string `json:"id"`
+}
+
+type attachRequestPayload struct {
+	ID           string `json:"id"`
+	StdoutOffset int64  `json:"stdout_offset"`
+	StderrOffset int64  `json:"stderr_offset"`
 }
 
 type chunkPayload struct {
 	Data []byte `json:"data"`
+	// Encoding is set when the agent compressed Data, e.g. "gzip".
+	Encoding string `json:"encoding,omitempty"`
+	// Offset is where Data starts in its stream. Detached jobs set it, so
+	// a client attaching past output the agent no longer retains can tell
+	// how much it missed.
+	Offset int64 `json:"offset,omitempty"`
 }
 
 type stdinPayload struct {
 	Data []byte `json:"data"`
 }
 
+// stdinAckPayload counts the stdin bytes an exec has consumed so far.
+type stdinAckPayload struct {
+	Bytes int64 `json:"bytes"`
+}
+
+// windowSizePayload is a terminal size, sent as an exec's tty_size and in
+// resize frames.
+type windowSizePayload struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// signalPayload carries a signal number for a running exec.
+type signalPayload struct {
+	Signal int `json:"signal"`
+}
+
 type filePutRequestPayload struct {
-	Path string `json:"path"`
-	Mode uint32 `json:"mode,omitempty"`
+	Path   string `json:"path"`
+	Mode   uint32 `json:"mode,omitempty"`
+	Sparse bool   `json:"sparse,omitempty"` // leave all-zero chunks as holes
+	// Checksum asks the agent to hash the upload with SHA-256, check it
+	// against the digest in file_put_close and report it in the result.
+	Checksum bool `json:"checksum,omitempty"`
+	// Tree makes Path a directory that the entries following the request
+	// are written into.
+	Tree bool `json:"tree,omitempty"`
+	// Type and Linkname describe an entry of a tree upload; an empty Type is
+	// a regular file.
+	Type     string `json:"type,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
 }
 
 type fileGetRequestPayload struct {
+	Path     string `json:"path"`
+	Sparse   bool   `json:"sparse,omitempty"`   // client understands file_get_hole
+	Checksum bool   `json:"checksum,omitempty"` // report the SHA-256 of what was sent
+}
+
+// fileClosePayload ends an upload. SHA256 is the hex digest of everything
+// the client sent, for uploads that asked for a checksum.
+type fileClosePayload struct {
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// holePayload stands in for Length zero bytes of a sparse file.
+type holePayload struct {
+	Length int64 `json:"length"`
+}
+
+type archiveRequestPayload struct {
+	Path   string        `json:"path"`
+	Format ArchiveFormat `json:"format,omitempty"`
+}
+
+// archiveImportRequestPayload opens an upload of a tar stream to extract into
+// the agent's root; an empty Format lets the agent detect gzip compression.
+type archiveImportRequestPayload struct {
+	Format ArchiveFormat `json:"format,omitempty"`
+}
+
+type checkSpaceRequestPayload struct {
+	Path      string `json:"path"`
+	NeedBytes int64  `json:"need_bytes"`
+}
+
+type checkSpaceResultPayload struct {
+	OK    bool      `json:"ok"`
+	Usage DiskUsage `json:"usage"`
+}
+
+type whichRequestPayload struct {
+	Name string `json:"name"`
+}
+
+type whichResultPayload struct {
 	Path string `json:"path"`
 }
 
+type chownRequestPayload struct {
+	Path string `json:"path"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+}
+
+type logSubscribePayload struct {
+	Token string `json:"token,omitempty"`
+}
+
+type logLinePayload struct {
+	Line string `json:"line"`
+}
+
 type fileTransferResultPayload struct {
-	Bytes int64  `json:"bytes"`
-	Error string `json:"error,omitempty"`
+	Bytes  int64  `json:"bytes"`
+	Error  string `json:"error,omitempty"`
+	SHA256 string `json:"sha256,omitempty"` // hex digest, when a checksum was requested
 }
 
 type errorPayload struct {
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// Error codes let clients map well-known failures back to sentinel errors.
+const (
+	errorCodeTooManyTransfers = "too_many_transfers"
+	errorCodeCommandNotFound  = "command_not_found"
+	// errorCodeBufferBudgetExceeded rejects an exec before it starts.
+	errorCodeBufferBudgetExceeded = "buffer_budget_exceeded"
+	errorCodePermissionDenied     = "permission_denied"
+	errorCodeArgsTooLarge         = "args_too_large"
+	errorCodeUnauthorized         = "unauthorized"
+	errorCodeUnsupported          = "unsupported"
+	errorCodeChecksumMismatch     = "checksum_mismatch"
+	errorCodeIncompatibleVersion  = "incompatible_version"
+	errorCodeWorkingDirNotFound   = "working_dir_not_found"
+	errorCodeAgentBusy            = "agent_busy"
+)
+
+func (p errorPayload) err() error {
+	switch p.Code {
+	case errorCodeTooManyTransfers:
+		return fmt.Errorf("%w: %s", ErrTooManyTransfers, p.Message)
+	case errorCodeBufferBudgetExceeded:
+		return fmt.Errorf("%w: %s", ErrBufferBudgetExceeded, p.Message)
+	case errorCodeUnauthorized:
+		return fmt.Errorf("%w: %s", ErrUnauthorized, p.Message)
+	case errorCodeArgsTooLarge:
+		return fmt.Errorf("%w: %s", ErrArgsTooLarge, p.Message)
+	case errorCodePermissionDenied:
+		return fmt.Errorf("%w: %s", ErrPermissionDenied, p.Message)
+	case errorCodeCommandNotFound:
+		return fmt.Errorf("%w: %s", ErrCommandNotFound, p.Message)
+	case errorCodeUnsupported:
+		return fmt.Errorf("%w: %s", ErrUnsupported, p.Message)
+	case errorCodeIncompatibleVersion:
+		return fmt.Errorf("%w: %s", ErrIncompatibleProtocol, p.Message)
+	case errorCodeChecksumMismatch:
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, p.Message)
+	case errorCodeWorkingDirNotFound:
+		return fmt.Errorf("%w: %s", ErrWorkingDirNotFound, p.Message)
+	case errorCodeAgentBusy:
+		return fmt.Errorf("%w: %s", ErrAgentBusy, p.Message)
+	case "":
+		if p.Message == unsupportedFrameMessage {
+			// Agents predating error codes reject unknown requests this way.
+			return fmt.Errorf("%w: %s", ErrUnsupported, p.Message)
+		}
+		return errors.New(p.Message)
+	default:
+		return errors.New(p.Message)
+	}
 }
 
 type pongPayload struct {
@@ -85,17 +381,26 @@ type pongPayload struct {
 
 type frameWriter struct {
 	enc *json.Encoder
-	mu  sync.Mutex
+	mu  *sync.Mutex
+	id  string // tags every frame, on multiplexed connections
+
+	metrics *serverMetrics // counts the error frames a server sends; nil on clients
 }
 
 func newFrameWriter(w io.Writer) *frameWriter {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false)
-	return &frameWriter{enc: enc}
+	return &frameWriter{enc: enc, mu: new(sync.Mutex)}
+}
+
+// withID returns a writer on the same connection that tags its frames with
+// the exchange ID id.
+func (w *frameWriter) withID(id string) *frameWriter {
+	return &frameWriter{enc: w.enc, mu: w.mu, id: id, metrics: w.metrics}
 }
 
 func (w *frameWriter) send(typ frameType, payload any) error {
-	frame := rawFrame{Type: typ}
+	frame := rawFrame{Type: typ, ID: w.id}
 	if payload != nil {
 		data, err := json.Marshal(payload)
 		if err != nil {
@@ -104,6 +409,10 @@ func (w *frameWriter) send(typ frameType, payload any) error {
 		frame.Payload = data
 	}
 
+	if p, ok := payload.(errorPayload); ok && w.metrics != nil {
+		w.metrics.countError(p.Code)
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	return w.enc.Encode(&frame)
@@ -2,7 +2,9 @@ package agent
 
 import (
 	"bufio"
+	"cmp"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +16,8 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -25,6 +29,104 @@ type ServerConfig struct {
 	RootDir         string // If set, restricts all operations to this directory
 	UseChrootIfRoot bool   // If true and running as root, use chroot for isolation
 	AllowInsecure   bool   // If true, allow interpreter execution without chroot (INSECURE - dev only)
+	ForcePATH       string // If set, overrides the child's PATH and resolves bare command names against it
+	// IsolationMode selects how commands are isolated. Empty keeps the
+	// behavior chosen by UseChrootIfRoot. With IsolationNamespaces, an agent
+	// whose host does not allow the namespaces logs why and refuses every
+	// exec rather than running commands unisolated.
+	IsolationMode IsolationMode
+	// MaxConcurrentTransfers caps simultaneous file and archive transfers;
+	// excess requests are rejected with ErrTooManyTransfers. Zero is unlimited.
+	MaxConcurrentTransfers int
+	// MaxConcurrent caps the connections served at once, counting idle
+	// connections clients keep open for reuse. Connections beyond it are
+	// answered with an error, ErrAgentBusy to the client, and closed rather
+	// than queued. Zero is unlimited.
+	MaxConcurrent int
+	// Redactor masks command paths, arguments and environment values before
+	// they are logged. Nil uses DefaultRedactor.
+	Redactor Redactor
+	// MaxBufferedBytes caps the memory reserved for stdout/stderr result
+	// buffers across all in-flight execs and retained detached jobs. Each
+	// exec reserves the most its buffers can hold; execs that would exceed
+	// the cap are rejected with ErrBufferBudgetExceeded. Zero is unlimited.
+	MaxBufferedBytes int64
+	// MaxArgs and MaxArgBytes bound an exec's argument count and the total
+	// size of its path and arguments (each counted with its terminating
+	// NUL). Oversized requests are rejected with ErrArgsTooLarge before
+	// anything is spawned. Zero uses defaults in line with Linux's ARG_MAX;
+	// a negative value disables the check.
+	MaxArgs     int
+	MaxArgBytes int
+	// AllowLogSubscribe lets clients tail the agent's own log over the
+	// transport. When LogSubscribeToken is set, subscribers must present it.
+	AllowLogSubscribe bool
+	LogSubscribeToken string
+	// AllowWebhooks lets execs name a CompletionURL the agent POSTs their
+	// result summary to, which needs outbound network access from the
+	// agent. Deliveries are signed with WebhookSecret when it is set.
+	AllowWebhooks bool
+	WebhookSecret string
+	// Compression gzips exec output chunks and large result buffers for
+	// clients that accept it. Chunks under 1 KiB, and detached jobs, are
+	// sent as is. Zero or CompressionNone disables it; any value other
+	// than CompressionGzip is logged and ignored.
+	Compression Compression
+	// MemoryLimitBytes and CPUQuota, when positive, run every exec in its
+	// own cgroup v2 under CgroupParent (default /sys/fs/cgroup/agentd) with
+	// memory.max and cpu.max set; CPUQuota counts CPUs, so 1.5 allows one
+	// and a half. Execs fail when the cgroup cannot be set up, and a command
+	// killed for exceeding the memory limit reports ExitReasonOOMKilled.
+	// Linux only.
+	MemoryLimitBytes int64
+	CPUQuota         float64
+	CgroupParent     string
+	// SeccompProfile restricts the system calls of every exec: either
+	// SeccompProfileDefault, SeccompProfileStrict or the path of a
+	// Docker/OCI JSON profile. Argument filters in a profile are not
+	// evaluated; rules that depend on them are dropped when they allow a
+	// call and applied unconditionally otherwise. A command killed by the
+	// filter reports ExitReasonSeccomp. An agent whose profile cannot be
+	// loaded refuses every exec. Ignored with a warning off Linux.
+	SeccompProfile string
+	// EgressNetwork is the IPv4 network, default 10.254.0.0/16, the agent
+	// numbers the links of execs with EgressAllow from, one /30 each. Such
+	// an exec runs in its own network namespace joined to the agent's by a
+	// veth pair, whose host end filters what the command sends. Linux
+	// agents running as root only; an invalid network makes the agent
+	// refuse every exec.
+	EgressNetwork string
+	// Version is the agent version Info reports. Empty uses the main
+	// module's version from the binary's build information.
+	Version string
+	// EnvAllowlist and EnvDenylist filter every exec's environment,
+	// whatever the client sends, so secrets in the agent's own environment
+	// or injected by a client do not reach commands. Patterns use
+	// path.Match syntax: AWS_* matches every key starting with AWS_. When
+	// EnvAllowlist is non-empty only the keys it matches pass through;
+	// EnvDenylist then removes the keys it matches. Commands that would
+	// inherit the agent's environment get it filtered too, as do the login
+	// variables set for User; only the PATH set by ForcePATH is exempt. An
+	// invalid pattern makes the agent refuse every exec.
+	EnvAllowlist []string
+	EnvDenylist  []string
+	// TLSConfig, when set, runs TLS on connections accepted from TCP
+	// listeners such as ListenTCP; Unix socket and vsock connections are
+	// unaffected. Set ClientAuth to tls.RequireAndVerifyClientCert with
+	// ClientCAs to admit only clients holding a certificate from those CAs:
+	// a failed handshake closes the connection before any frame is read.
+	TLSConfig *tls.Config
+	// ExecLogRetention keeps the output of every exec, stdout and stderr
+	// interleaved, for this long after it finishes so clients can replay it
+	// with Logs. Each exec keeps its last MaxResultBuffer bytes, reserved
+	// from MaxBufferedBytes; an exec the budget has no room for is run
+	// without keeping its output. Zero keeps nothing.
+	ExecLogRetention time.Duration
+	// IdleTimeout shuts the server down, as Shutdown does, once it has
+	// accepted no connection, exchanged no bytes with a client and run no
+	// exec for this long. A running exec keeps it up however long it takes.
+	// Zero never shuts down.
+	IdleTimeout time.Duration
 }
 
 // Server executes guest commands upon requests from the host.
@@ -34,8 +136,41 @@ type Server struct {
 	logger          *log.Logger
 	rootDir         string          // If set, restricts all operations to this directory
 	chrootExecutor  *ChrootExecutor // Used for OS-level isolation when available
+	nsExecutor      *NamespaceExecutor
+	isolationErr    error // set when the configured isolation is unusable
 	useChrootIfRoot bool
 	allowInsecure   bool // Allow interpreter execution without chroot (INSECURE)
+	forcePATH       string
+	transfers       chan struct{} // semaphore; nil when transfers are unlimited
+	conns           *connLimit
+	redactor        Redactor
+	buffers         *bufferBudget
+	maxArgs         int
+	maxArgBytes     int
+	logRing         *logRing // nil unless log subscription is allowed
+	logToken        string
+	webhooks        *webhookSender // nil unless webhooks are allowed
+	compression     string         // output encoding; "" for none
+	limits          execLimits
+	seccomp         []bpfInsn // compiled filter; nil for none
+	egress          *egressPool
+	envFilter       *envFilter  // nil when the environment is not filtered
+	tlsConfig       *tls.Config // for TCP connections; nil for plain TCP
+	version         string
+	started         time.Time
+	processes       *processTracker // running execs, for ProcessStats
+	metrics         *serverMetrics
+
+	jobsMu sync.Mutex
+	jobs   map[string]*detachedJob
+
+	retained *retainedOutputs // nil unless ExecLogRetention is set
+
+	idle         *idleTracker // nil unless IdleTimeout is set
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+	listenersMu  sync.Mutex
+	listeners    map[net.Listener]struct{} // served by Serve, closed by Shutdown
 }
 
 // NewServer constructs a new agent server with sane defaults.
@@ -52,6 +187,18 @@ func NewServer(cfg ServerConfig) *Server {
 	if logger == nil {
 		logger = log.New(io.Discard, "", 0)
 	}
+	var ring *logRing
+	if cfg.AllowLogSubscribe {
+		ring = newLogRing()
+		logger = teeLogger(logger, ring)
+	}
+	mode := cfg.IsolationMode
+	if mode == "" {
+		mode = IsolationNone
+		if cfg.UseChrootIfRoot {
+			mode = IsolationChroot
+		}
+	}
 	rootDir := ""
 	var chrootExec *ChrootExecutor
 	if cfg.RootDir != "" {
@@ -63,7 +210,7 @@ func NewServer(cfg ServerConfig) *Server {
 			logger.Printf("restricting operations to: %s", rootDir)
 
 			// Try to set up chroot if requested
-			if cfg.UseChrootIfRoot {
+			if mode == IsolationChroot {
 				chrootExec, err = NewChrootExecutor(rootDir)
 				if err != nil {
 					logger.Printf("ERROR: chroot setup failed: %v", err)
@@ -81,22 +228,118 @@ func NewServer(cfg ServerConfig) *Server {
 			}
 		}
 	}
-	return &Server{
+	var (
+		nsExec       *NamespaceExecutor
+		isolationErr error
+	)
+	switch mode {
+	case IsolationNone, IsolationChroot:
+	case IsolationNamespaces:
+		nsExec, isolationErr = NewNamespaceExecutor(rootDir)
+		if isolationErr == nil {
+			logger.Printf("✓ namespace isolation enabled")
+		}
+	default:
+		isolationErr = fmt.Errorf("unknown isolation mode %q", mode)
+	}
+	seccomp, err := loadSeccompFilter(cfg.SeccompProfile)
+	switch {
+	case errors.Is(err, errSeccompUnsupported):
+		logger.Printf("WARNING: ignoring seccomp profile %q: %v", cfg.SeccompProfile, err)
+	case err != nil:
+		if isolationErr == nil {
+			isolationErr = fmt.Errorf("seccomp profile %q: %w", cfg.SeccompProfile, err)
+		}
+	case seccomp != nil:
+		logger.Printf("✓ seccomp profile %q enabled", cfg.SeccompProfile)
+	}
+	envFilter, err := newEnvFilter(cfg.EnvAllowlist, cfg.EnvDenylist)
+	if err != nil && isolationErr == nil {
+		isolationErr = err
+	}
+	egress, err := newEgressPool(cmp.Or(cfg.EgressNetwork, defaultEgressNetwork))
+	if err != nil && isolationErr == nil {
+		isolationErr = fmt.Errorf("egress network %q: %w", cfg.EgressNetwork, err)
+	}
+	if isolationErr != nil {
+		logger.Printf("ERROR: %v - every exec will be refused", isolationErr)
+	}
+	redactor := cfg.Redactor
+	if redactor == nil {
+		redactor = DefaultRedactor()
+	}
+	var webhooks *webhookSender
+	if cfg.AllowWebhooks {
+		webhooks = newWebhookSender(cfg.WebhookSecret, logger, redactor)
+	}
+	compression, err := serverCompression(cfg.Compression)
+	if err != nil {
+		logger.Printf("WARNING: %v; sending exec output uncompressed", err)
+	}
+	var transfers chan struct{}
+	if cfg.MaxConcurrentTransfers > 0 {
+		transfers = make(chan struct{}, cfg.MaxConcurrentTransfers)
+	}
+	buffers := &bufferBudget{limit: max(cfg.MaxBufferedBytes, 0)}
+	s := &Server{
 		chunkSize:       chunk,
 		bufLimit:        limit,
 		logger:          logger,
 		rootDir:         rootDir,
 		chrootExecutor:  chrootExec,
+		nsExecutor:      nsExec,
+		isolationErr:    isolationErr,
 		useChrootIfRoot: cfg.UseChrootIfRoot,
 		allowInsecure:   cfg.AllowInsecure,
+		forcePATH:       cfg.ForcePATH,
+		transfers:       transfers,
+		conns:           &connLimit{limit: max(cfg.MaxConcurrent, 0)},
+		redactor:        redactor,
+		buffers:         buffers,
+		retained:        newRetainedOutputs(cfg.ExecLogRetention, limit, buffers),
+		maxArgs:         argLimit(cfg.MaxArgs, defaultMaxArgs),
+		maxArgBytes:     argLimit(cfg.MaxArgBytes, defaultMaxArgBytes),
+		logRing:         ring,
+		logToken:        cfg.LogSubscribeToken,
+		webhooks:        webhooks,
+		compression:     compression,
+		seccomp:         seccomp,
+		egress:          egress,
+		envFilter:       envFilter,
+		tlsConfig:       cfg.TLSConfig,
+		version:         cmp.Or(cfg.Version, buildVersion()),
+		started:         time.Now(),
+		processes:       newProcessTracker(),
+		metrics:         newServerMetrics(),
+		limits: execLimits{
+			parent:   cmp.Or(cfg.CgroupParent, defaultCgroupParent),
+			memory:   cfg.MemoryLimitBytes,
+			cpuQuota: cfg.CPUQuota,
+		},
+		jobs:      make(map[string]*detachedJob),
+		idle:      newIdleTracker(cfg.IdleTimeout),
+		shutdown:  make(chan struct{}),
+		listeners: make(map[net.Listener]struct{}),
+	}
+	if s.idle != nil {
+		go s.watchIdle()
 	}
+	return s
 }
 
 // Serve accepts incoming connections and handles them concurrently.
 func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		_ = l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.closed() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				s.logger.Printf("accept error: %v", err)
 				continue
@@ -113,10 +356,28 @@ func (s *Server) ServeConn(conn net.Conn) {
 }
 
 func (s *Server) handleConn(conn net.Conn) {
+	secured, err := s.secureConn(conn)
+	if err != nil {
+		s.logger.Printf("rejecting connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn = acceptPassedFiles(secured)
 	defer conn.Close()
+	s.idle.touch()
 
-	dec := json.NewDecoder(bufio.NewReader(conn))
-	writer := newFrameWriter(conn)
+	writer := newFrameWriter(&countingWriter{w: conn, wrote: s.connBytes(&s.metrics.bytesSent)})
+	writer.metrics = s.metrics
+	if !s.conns.acquire() {
+		s.refuseBusy(conn, writer)
+		return
+	}
+	defer s.conns.release()
+
+	dec := json.NewDecoder(bufio.NewReader(&countingReader{r: conn, read: s.connBytes(&s.metrics.bytesReceived)}))
+	// A connection serves one request unless the client asked, in its
+	// hello, to keep it open for more.
+	keepAlive := false
 
 	for {
 		frame, err := readFrame(dec)
@@ -136,50 +397,215 @@ func (s *Server) handleConn(conn net.Conn) {
 				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 				return
 			}
-			s.runExec(conn, dec, writer, payload)
-			return
+			if !s.runExec(conn, connFrames{conn: conn, dec: dec}, writer, payload, keepAlive) {
+				return
+			}
 		case frameTypeFilePutRequest:
 			var payload filePutRequestPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
 				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 				return
 			}
+			release, ok := s.acquireTransfer(writer)
+			if !ok {
+				return
+			}
 			s.handleFilePut(dec, writer, payload)
-			return
+			release()
+			if !keepAlive {
+				return
+			}
 		case frameTypeFileGetRequest:
 			var payload fileGetRequestPayload
 			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
 				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 				return
 			}
+			release, ok := s.acquireTransfer(writer)
+			if !ok {
+				return
+			}
 			s.handleFileGet(writer, payload)
+			release()
+			if !keepAlive {
+				return
+			}
+		case frameTypeArchiveRequest:
+			var payload archiveRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			release, ok := s.acquireTransfer(writer)
+			if !ok {
+				return
+			}
+			s.handleArchive(writer, payload)
+			release()
+			if !keepAlive {
+				return
+			}
+		case frameTypeArchiveImportRequest:
+			var payload archiveImportRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			release, ok := s.acquireTransfer(writer)
+			if !ok {
+				return
+			}
+			s.handleArchiveImport(dec, writer, payload)
+			release()
+			if !keepAlive {
+				return
+			}
+		case frameTypeAttachRequest:
+			var payload attachRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleAttach(dec, writer, payload)
+			return
+		case frameTypeCheckSpaceRequest:
+			var payload checkSpaceRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleCheckSpace(writer, payload)
+			if !keepAlive {
+				return
+			}
+		case frameTypeWhichRequest:
+			var payload whichRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleWhich(writer, payload)
+			if !keepAlive {
+				return
+			}
+		case frameTypeChownRequest:
+			var payload chownRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleChown(writer, payload)
+			if !keepAlive {
+				return
+			}
+		case frameTypeLogSubscribe:
+			var payload logSubscribePayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleLogSubscribe(dec, writer, payload)
 			return
+		case frameTypeSignalJobRequest:
+			var payload signalJobRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleSignalJob(writer, payload)
+			if !keepAlive {
+				return
+			}
+		case frameTypeCapabilitiesRequest:
+			_ = writer.send(frameTypeCapabilitiesResult, capabilitiesResultPayload{
+				ProtocolVersion: ProtocolVersion,
+				Requests:        s.supportedRequests(),
+				Features:        s.supportedFeatures(),
+			})
+		case frameTypeInfoRequest:
+			_ = writer.send(frameTypeInfo, s.info())
+		case frameTypeLogsRequest:
+			var payload logsRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			s.handleLogs(writer, payload)
+			if !keepAlive {
+				return
+			}
+		case frameTypeProcessStatsRequest:
+			if !canSampleProcesses {
+				_ = writer.send(frameTypeError, errorPayload{Message: errUnsupportedSampling.Error(), Code: errorCodeUnsupported})
+				return
+			}
+			_ = writer.send(frameTypeProcessStats, s.processStats())
+		case frameTypeHello:
+			var payload helloPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+				return
+			}
+			if !s.handleHello(writer, payload) {
+				return
+			}
+			if payload.Multiplex {
+				s.serveMultiplexed(conn, dec, writer)
+				return
+			}
+			keepAlive = keepAlive || payload.KeepAlive
 		default:
-			_ = writer.send(frameTypeError, errorPayload{Message: "unsupported frame"})
+			_ = writer.send(frameTypeError, errorPayload{Message: unsupportedFrameMessage, Code: errorCodeUnsupported})
 			return
 		}
 	}
 }
 
-func (s *Server) runExec(conn net.Conn, dec *json.Decoder, writer *frameWriter, payload execRequestPayload) {
+// runExec runs one exec request to completion, reading the client's stdin
+// and control frames from frames. On a keep-alive connection it waits for the
+// client's exec_done after the result and reports whether the connection is
+// ready for another request.
+func (s *Server) runExec(conn net.Conn, frames frameSource, writer *frameWriter, payload execRequestPayload, keepAlive bool) (reusable bool) {
+	s.logger.Printf("exec %s", s.describeExec(&payload))
+
+	if s.isolationErr != nil {
+		return s.refuseExec(frames, writer, &payload, errorPayload{Message: s.isolationErr.Error()}, keepAlive)
+	}
+	if err := s.checkArgs(&payload); err != nil {
+		return s.refuseExec(frames, writer, &payload, errorPayload{Message: err.Error(), Code: errorCodeArgsTooLarge}, keepAlive)
+	}
+	if len(payload.EgressAllow) > 0 && !egressAvailable() {
+		return s.refuseExec(frames, writer, &payload, errorPayload{Message: errEgressUnsupported.Error(), Code: errorCodeUnsupported}, keepAlive)
+	}
+	if payload.CompletionURL != "" {
+		if s.webhooks == nil {
+			return s.refuseExec(frames, writer, &payload, errorPayload{Message: errWebhooksDisabled.Error(), Code: errorCodeUnsupported}, keepAlive)
+		}
+		if err := checkCompletionURL(payload.CompletionURL); err != nil {
+			return s.refuseExec(frames, writer, &payload, errorPayload{Message: err.Error()}, keepAlive)
+		}
+	}
+	if payload.Tty && (payload.StdioFD || payload.StdinFIFO != "" || payload.StdoutFIFO != "" || payload.StderrFIFO != "" ||
+		payload.StdoutLog != nil || payload.StderrLog != nil) {
+		return s.refuseExec(frames, writer, &payload, errorPayload{Message: "tty cannot be combined with a stdio descriptor, fifos or log files"}, keepAlive)
+	}
+
 	// Validate paths if rootDir is set (note: this only validates arguments, not script contents)
 	if s.rootDir != "" {
-		if s.chrootExecutor == nil {
+		if !s.rootIsolated() {
 			// Without chroot, we only have weak path validation
 			if err := s.validatePaths(&payload); err != nil {
-				_ = writer.send(frameTypeError, errorPayload{Message: "security violation: " + err.Error()})
-				return
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: "security violation: " + err.Error()}, keepAlive)
 			}
 
 			// Block interpreters without chroot unless explicitly allowed
 			if s.isInterpreter(payload.Path) && !s.allowInsecure {
-				s.logger.Printf("ERROR: refusing to execute interpreter %q without chroot isolation", payload.Path)
-				_ = writer.send(frameTypeError, errorPayload{
+				s.logger.Printf("ERROR: refusing to execute interpreter %q without chroot isolation", s.redactor.RedactString(payload.Path))
+				return s.refuseExec(frames, writer, &payload, errorPayload{
 					Message: fmt.Sprintf("security error: cannot execute interpreter %q without chroot isolation - scripts can escape root directory. Start agent with 'sudo' for secure mode", payload.Path),
-				})
-				return
+				}, keepAlive)
 			} else if s.isInterpreter(payload.Path) && s.allowInsecure {
-				s.logger.Printf("WARNING: executing interpreter %q in INSECURE mode - scripts can escape root directory!", payload.Path)
+				s.logger.Printf("WARNING: executing interpreter %q in INSECURE mode - scripts can escape root directory!", s.redactor.RedactString(payload.Path))
 			}
 		}
 	}
@@ -191,65 +617,389 @@ func (s *Server) runExec(conn net.Conn, dec *json.Decoder, writer *frameWriter,
 		defer cancel()
 	}
 
+	env := payload.Env
+	if payload.User != "" {
+		env = s.userEnv(payload.User, env)
+	}
+	env = s.envFilter.apply(env)
+	if s.forcePATH != "" {
+		// Resolve against the fixed PATH so a client-supplied PATH (or a
+		// binary planted in the working directory) cannot hijack the lookup.
+		lookupRoot := ""
+		if s.rootIsolated() {
+			lookupRoot = s.rootDir
+		}
+		resolved, err := lookPathIn(payload.Path, s.forcePATH, lookupRoot)
+		if err != nil {
+			return s.startFailed(frames, writer, &payload, err, keepAlive)
+		}
+		payload.Path = resolved
+		env = mergeEnv(env, map[string]string{"PATH": s.forcePATH})
+	}
+
 	command := exec.CommandContext(execCtx, payload.Path, payload.Args...)
 	command.Dir = payload.WorkingDir
-	command.Env = flattenEnv(nil, payload.Env)
+	command.Env = flattenEnv(nil, env)
+	if command.Env == nil && s.envFilter != nil {
+		// An empty filtered environment must not fall back to inheriting
+		// the agent's.
+		command.Env = []string{}
+	}
+	var cred *execUser
+	if payload.User != "" {
+		var err error
+		cred, err = s.execCredential(payload.User)
+		if err == nil && cred != nil {
+			err = setCredential(command, cred)
+		}
+		if err != nil {
+			resp := errorPayload{Message: err.Error()}
+			if errors.Is(err, ErrPermissionDenied) {
+				resp.Code = errorCodePermissionDenied
+			}
+			return s.refuseExec(frames, writer, &payload, resp, keepAlive)
+		}
+	}
 
 	// Apply chroot isolation if available
 	if s.chrootExecutor != nil {
 		if err := s.chrootExecutor.PrepareCommand(command, payload.WorkingDir); err != nil {
-			_ = writer.send(frameTypeError, errorPayload{Message: "chroot setup failed: " + err.Error()})
-			return
+			return s.refuseExec(frames, writer, &payload, errorPayload{Message: "chroot setup failed: " + err.Error()}, keepAlive)
+		}
+	}
+	if s.nsExecutor != nil {
+		if err := s.nsExecutor.PrepareCommand(command, payload.WorkingDir); err != nil {
+			return s.refuseExec(frames, writer, &payload, errorPayload{Message: "namespace setup failed: " + err.Error()}, keepAlive)
+		}
+	}
+	if err := s.prepareWorkingDir(command, &payload, cred); err != nil {
+		resp := errorPayload{Message: err.Error()}
+		if errors.Is(err, ErrWorkingDirNotFound) {
+			resp.Code = errorCodeWorkingDirNotFound
 		}
+		return s.refuseExec(frames, writer, &payload, resp, keepAlive)
 	}
 
-	stdinPipe, err := command.StdinPipe()
-	if err != nil {
-		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+	var egress *egressLink
+	if payload.Hostname != "" || len(payload.Mounts) > 0 || len(payload.Tmpfs) > 0 || len(payload.EgressAllow) > 0 || s.seccomp != nil {
+		initCfg := execInitConfig{Hostname: payload.Hostname, Seccomp: s.seccomp}
+		if len(payload.Mounts) > 0 {
+			mounts, err := s.resolveExecMounts(payload.Mounts)
+			if err != nil {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: err.Error()}, keepAlive)
+			}
+			initCfg.Mounts = mounts
+		}
+		if len(payload.Tmpfs) > 0 {
+			tmpfs, err := s.resolveExecTmpfs(payload.Tmpfs)
+			if err != nil {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: err.Error()}, keepAlive)
+			}
+			initCfg.Tmpfs = tmpfs
+		}
+		if len(payload.EgressAllow) > 0 {
+			rules, err := parseEgressRules(execCtx, payload.EgressAllow)
+			if err != nil {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: err.Error()}, keepAlive)
+			}
+			egress, initCfg.Egress, err = s.prepareEgress(command, rules)
+			if err != nil {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: err.Error()}, keepAlive)
+			}
+			defer egress.release()
+		}
+		if err := applyExecInit(command, initCfg); err != nil {
+			if s.seccomp != nil {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: "seccomp: " + err.Error()}, keepAlive)
+			}
+			if egress != nil {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: "egress: " + err.Error()}, keepAlive)
+			}
+			if len(initCfg.Mounts) > 0 || len(initCfg.Tmpfs) > 0 {
+				return s.refuseExec(frames, writer, &payload, errorPayload{Message: "exec mounts: " + err.Error()}, keepAlive)
+			}
+			s.logger.Printf("WARNING: ignoring hostname %q: %v", payload.Hostname, err)
+		}
+	}
+
+	if payload.DryRun {
+		return s.reportDryRun(frames, writer, &payload, s.dryRunReport(command, &payload, cred), keepAlive)
+	}
+
+	reserved := outputReservation(s.bufLimit, payload.MaxStdout, payload.MaxStderr, payload.MaxOutput)
+	if !s.buffers.reserve(reserved) {
+		used, limit := s.buffers.usage()
+		_ = writer.send(frameTypeError, errorPayload{
+			Message: fmt.Sprintf("exec needs %d bytes of result buffer, %d of %d in use", reserved, used, limit),
+			Code:    errorCodeBufferBudgetExceeded,
+		})
 		return
 	}
-	stdoutPipe, err := command.StdoutPipe()
+	releaseBuffers := func() { s.buffers.release(reserved) }
+	defer func() {
+		if releaseBuffers != nil {
+			releaseBuffers()
+		}
+	}()
+
+	logs, err := s.openExecLogs(&payload)
 	if err != nil {
 		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 		return
 	}
-	stderrPipe, err := command.StderrPipe()
+	defer logs.close()
+
+	fifos, err := s.openFIFOs(execCtx, &payload)
 	if err != nil {
 		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 		return
 	}
+	defer fifos.cleanup()
+
+	var stdio *os.File
+	if payload.StdioFD {
+		stdio = takePassedFile(conn)
+		if stdio == nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: "stdio descriptor was not received"})
+			return
+		}
+		defer stdio.Close()
+	}
+
+	var ttyMaster, ttySlave *os.File
+	if payload.Tty {
+		ttyMaster, ttySlave, err = openPTY()
+		if err != nil {
+			msg := errorPayload{Message: "allocate tty: " + err.Error()}
+			if errors.Is(err, errTTYUnsupported) {
+				msg.Code = errorCodeUnsupported
+			}
+			_ = writer.send(frameTypeError, msg)
+			return
+		}
+		defer ttyMaster.Close()
+		defer ttySlave.Close()
+		if err := setWindowSize(ttyMaster, payload.TtySize.windowSize()); err != nil {
+			s.logger.Printf("WARNING: ignoring tty size: %v", err)
+		}
+		attachTTY(command, ttySlave)
+	}
+
+	var (
+		stdinPipe  io.WriteCloser = discardWriteCloser{}
+		stdoutPipe io.ReadCloser
+		stderrPipe io.ReadCloser
+	)
+	switch {
+	case ttyMaster != nil:
+		stdinPipe = ttyInput{master: ttyMaster}
+	case stdio != nil:
+		command.Stdin = stdio
+	case fifos.stdin != nil:
+		command.Stdin = fifos.stdin
+	default:
+		stdinPipe, err = command.StdinPipe()
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+	}
+	switch {
+	case ttyMaster != nil:
+		// Output of both streams arrives merged on the master.
+		stdoutPipe = ttyMaster
+	case stdio != nil:
+		command.Stdout = stdio
+	case fifos.stdout != nil:
+		command.Stdout = fifos.stdout
+	case logs.stdout != nil:
+		command.Stdout = logs.stdout
+	default:
+		stdoutPipe, err = command.StdoutPipe()
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+	}
+	switch {
+	case ttyMaster != nil:
+	case fifos.stderr != nil:
+		command.Stderr = fifos.stderr
+	case logs.stderr != nil:
+		command.Stderr = logs.stderr
+	default:
+		stderrPipe, err = command.StderrPipe()
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+	}
+
+	// A timeout kills everything the command started, not just the command.
+	killGroupOnCancel(command)
+
+	var cgroup *execCgroup
+	if s.limits.enabled() {
+		cgroup, err = newExecCgroup(s.limits)
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: "resource limits: " + err.Error()})
+			return
+		}
+		cgroup.attach(command)
+		defer func() {
+			if cgroup != nil {
+				s.removeCgroup(cgroup)
+			}
+		}()
+	}
+
+	if egress != nil {
+		if err := egress.setUp(); err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+	}
 
 	if err := command.Start(); err != nil {
-		_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
-		return
+		if s.nsExecutor != nil {
+			err = s.nsExecutor.startError(err)
+		}
+		return s.startFailed(frames, writer, &payload, err, keepAlive)
 	}
+	if egress != nil {
+		if err := egress.attach(command.Process.Pid); err != nil {
+			_ = command.Process.Kill()
+			_ = command.Wait()
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+	}
+	if payload.OOMScoreAdj != 0 {
+		if err := setOOMScoreAdj(command.Process.Pid, payload.OOMScoreAdj); err != nil {
+			s.logger.Printf("WARNING: ignoring oom_score_adj %d: %v", payload.OOMScoreAdj, err)
+		}
+	}
+	if payload.MaxOpenFiles != 0 {
+		if err := setOpenFilesLimit(command.Process.Pid, payload.MaxOpenFiles); err != nil {
+			s.logger.Printf("WARNING: ignoring max_open_files %d: %v", payload.MaxOpenFiles, err)
+		}
+	}
+	fds := startFDSampler(command.Process.Pid)
+	s.processes.add(command.Process.Pid)
+	defer s.processes.remove(command.Process.Pid)
+	defer s.idle.hold()()
+	if stdio != nil {
+		// The child holds its own copy; drop ours so the peer sees EOF as
+		// soon as the child exits.
+		_ = stdio.Close()
+	}
+	if ttySlave != nil {
+		// Likewise, reads from the master fail once the child and its
+		// descendants have all closed the slave.
+		_ = ttySlave.Close()
+	}
+	fifos.closeFiles()
 
 	startTime := time.Now()
+	s.metrics.execs.Add(1)
 
-	stdoutBuf := newLimitedBuffer(s.bufLimit)
-	stderrBuf := newLimitedBuffer(s.bufLimit)
+	stdoutBuf, stderrBuf := newOutputBuffers(s.bufLimit, payload.MaxStdout, payload.MaxStderr, payload.MaxOutput)
 
-	wg := sync.WaitGroup{}
-	wg.Add(2)
+	var job *detachedJob
+	if payload.Detach {
+		// The job owns the reservation from here until it is forgotten.
+		job = s.registerJob(writer, command.Process, stdoutBuf, stderrBuf, releaseBuffers)
+		releaseBuffers = nil
+		_ = writer.send(frameTypeJob, jobPayload{ID: job.id})
+	}
+	execID := newJobID()
+	if job != nil {
+		execID = job.id
+	}
+	retained := s.retained.start(execID)
+	defer s.retained.finish(retained)
 
-	go s.streamPipe(stdoutPipe, stdoutBuf, writer, payload.Stream, frameTypeStdout, &wg)
-	go s.streamPipe(stderrPipe, stderrBuf, writer, payload.Stream, frameTypeStderr, &wg)
+	encoding := s.outputEncoding(&payload)
+	gate := newOutputGate()
+	wg := sync.WaitGroup{}
+	if stdoutPipe != nil {
+		wg.Add(1)
+		go s.streamPipe(stdoutPipe, gate.wrap(execCtx, s.outputSink(writer, job, retained, stdoutBuf, payload.Stream, encoding, frameTypeStdout)), &wg)
+	}
+	if stderrPipe != nil {
+		wg.Add(1)
+		go s.streamPipe(stderrPipe, gate.wrap(execCtx, s.outputSink(writer, job, retained, stderrBuf, payload.Stream, encoding, frameTypeStderr)), &wg)
+	}
 
-	stdinDone := make(chan struct{})
-	go s.consumeStdin(dec, writer, stdinPipe, stdinDone)
+	stdinDone := make(chan bool, 1)
+	var resize func(WindowSize)
+	if ttyMaster != nil {
+		resize = func(size WindowSize) {
+			if err := setWindowSize(ttyMaster, size); err != nil {
+				s.logger.Printf("WARNING: ignoring tty resize: %v", err)
+			}
+		}
+	}
+	var exited atomic.Bool
+	signal := func(sig syscall.Signal) {
+		// Once the command is reaped its process group ID may be reused;
+		// a signal racing with the reap is the only window left.
+		if exited.Load() {
+			return
+		}
+		if err := signalGroup(command.Process, sig); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			s.logger.Printf("WARNING: signal %d: %v", sig, err)
+		}
+	}
+	go s.consumeStdin(frames, writer, stdinPipe, payload.StdinAck, gate, resize, signal, stdinDone)
 
+	// Drain stdout/stderr before Wait: Wait closes the pipes and would
+	// discard output the readers have not consumed yet.
+	wg.Wait()
 	err = command.Wait()
+	exited.Store(true)
+	s.metrics.observeExec(time.Since(startTime))
+	timedOut := err != nil && errors.Is(execCtx.Err(), context.DeadlineExceeded)
+	peakFDs := fds.finish()
+	exitReason := ""
+	if cgroup != nil {
+		if cgroup.oomKilled() {
+			exitReason = ExitReasonOOMKilled
+		}
+		s.removeCgroup(cgroup)
+		cgroup = nil
+	}
+	blocked := ""
+	if s.seccomp != nil && seccompKilled(command.ProcessState) {
+		exitReason = ExitReasonSeccomp
+		blocked = blockedSyscall(command.Process.Pid)
+		if blocked != "" {
+			s.logger.Printf("exec %s killed by the seccomp filter for calling %s", s.redactor.RedactString(payload.Path), blocked)
+		} else {
+			s.logger.Printf("exec %s killed by the seccomp filter for a blocked system call", s.redactor.RedactString(payload.Path))
+		}
+	}
 
-	_ = conn.SetReadDeadline(time.Now())
-	<-stdinDone
-	wg.Wait()
+	// Detached jobs and passed descriptors outlive the exchange, so their
+	// connections are never reused.
+	awaitDone := keepAlive && job == nil && !payload.StdioFD
+	if !awaitDone {
+		frames.interrupt()
+		<-stdinDone
+	}
 
 	exitCode := 0
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
 		} else {
-			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			s.notifyCompletion(&payload, job, &CompletionSummary{
+				ExitCode:   -1,
+				Error:      err.Error(),
+				StartedAt:  startTime,
+				FinishedAt: time.Now(),
+			}, stdoutBuf, stderrBuf)
+			s.finishExec(writer, job, nil, err.Error())
 			return
 		}
 	}
@@ -261,21 +1011,116 @@ func (s *Server) runExec(conn net.Conn, dec *json.Decoder, writer *frameWriter,
 		DurationMilli: time.Since(startTime).Milliseconds(),
 		StartedAt:     startTime,
 		FinishedAt:    time.Now(),
+		StdoutTrunc:   stdoutBuf.Truncated(),
+		StderrTrunc:   stderrBuf.Truncated(),
+		PeakOpenFiles: peakFDs,
+		ExitReason:    exitReason,
+		TimedOut:      timedOut,
+	}
+	result.BlockedSyscall = blocked
+	result.StdoutTotalBytes, result.StderrTotalBytes = stdoutBuf.Total(), stderrBuf.Total()
+	if retained != nil {
+		result.ExecID = retained.id
+	}
+	if state := command.ProcessState; state != nil {
+		result.UserTimeMicro = state.UserTime().Microseconds()
+		result.SysTimeMicro = state.SystemTime().Microseconds()
+		result.MaxRSSBytes = maxRSSBytes(state)
+	}
+	if payload.ReturnEnv {
+		result.Env = envSnapshot(command.Env, s.redactor)
+	}
+	s.notifyCompletion(&payload, job, &CompletionSummary{
+		ExitCode:   result.ExitCode,
+		StartedAt:  result.StartedAt,
+		FinishedAt: result.FinishedAt,
+	}, stdoutBuf, stderrBuf)
+	result.encode(encoding)
+	s.finishExec(writer, job, &result, "")
+	if awaitDone {
+		reusable = awaitExecDone(frames, stdinDone)
+	}
+	return reusable
+}
+
+// rootIsolated reports whether commands are confined to the root directory
+// by the kernel rather than by path validation alone.
+func (s *Server) rootIsolated() bool {
+	return s.chrootExecutor != nil || (s.nsExecutor != nil && s.nsExecutor.rootDir != "")
+}
+
+func (s *Server) removeCgroup(cgroup *execCgroup) {
+	if err := cgroup.remove(); err != nil {
+		s.logger.Printf("WARNING: remove exec cgroup: %v", err)
+	}
+}
+
+// awaitExecDone waits for the client to acknowledge an exec's result with
+// exec_done, giving up after execDoneTimeout.
+func awaitExecDone(frames frameSource, stdinDone <-chan bool) bool {
+	timer := time.NewTimer(execDoneTimeout)
+	defer timer.Stop()
+	select {
+	case done := <-stdinDone:
+		return done
+	case <-timer.C:
+		frames.interrupt()
+		<-stdinDone
+		return false
+	}
+}
+
+// outputSink returns the callback streamPipe feeds each chunk into. Detached
+// jobs route output through the job so it survives the original connection.
+// Streamed chunks are compressed with encoding, when set and worthwhile.
+// Every chunk is also kept in retained, when the exec's output is.
+func (s *Server) outputSink(writer *frameWriter, job *detachedJob, retained *retainedOutput, collector *limitedBuffer, stream bool, encoding string, typ frameType) func([]byte) {
+	if job != nil {
+		return func(chunk []byte) {
+			if retained != nil {
+				retained.write(chunk)
+			}
+			job.publish(typ, chunk, stream)
+		}
+	}
+	return func(chunk []byte) {
+		if retained != nil {
+			retained.write(chunk)
+		}
+		collector.Write(chunk)
+		if stream {
+			data, enc := encodeOutput(encoding, chunk)
+			_ = writer.send(typ, chunkPayload{Data: data, Encoding: enc})
+		}
+	}
+}
+
+// finishExec delivers the terminal result (or error) frame. For detached jobs
+// the result is parked for a later re-attach when no client is listening.
+func (s *Server) finishExec(writer *frameWriter, job *detachedJob, result *execResultPayload, errMessage string) {
+	if job == nil {
+		if result == nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: errMessage})
+			return
+		}
+		_ = writer.send(frameTypeResult, result)
+		return
+	}
+	if job.finish(result, errMessage) {
+		s.forgetJob(job.id)
+		return
 	}
-	_ = writer.send(frameTypeResult, result)
+	id := job.id
+	time.AfterFunc(detachedJobRetention, func() { s.forgetJob(id) })
 }
 
-func (s *Server) streamPipe(reader io.Reader, collector *limitedBuffer, writer *frameWriter, stream bool, typ frameType, wg *sync.WaitGroup) {
+func (s *Server) streamPipe(reader io.Reader, sink func([]byte), wg *sync.WaitGroup) {
 	defer wg.Done()
 	buf := make([]byte, s.chunkSize)
 	for {
 		n, err := reader.Read(buf)
 		if n > 0 {
-			chunk := append([]byte(nil), buf[:n]...)
-			collector.Write(chunk)
-			if stream {
-				_ = writer.send(typ, chunkPayload{Data: chunk})
-			}
+			sink(append([]byte(nil), buf[:n]...))
 		}
 		if err != nil {
 			return
@@ -283,38 +1128,97 @@ func (s *Server) streamPipe(reader io.Reader, collector *limitedBuffer, writer *
 	}
 }
 
-func (s *Server) consumeStdin(dec *json.Decoder, writer *frameWriter, stdin io.WriteCloser, done chan<- struct{}) {
+// consumeStdin handles the frames a client sends while its exec runs. Stdin
+// closes at stdin_close, but control frames are read until the connection
+// fails, runExec interrupts the read, or the client sends exec_done, which is
+// reported on done. With ack set every stdin chunk is acknowledged once
+// written, or dropped because stdin is closed, so the client's window never
+// stalls.
+func (s *Server) consumeStdin(frames frameSource, writer *frameWriter, stdin io.WriteCloser, ack bool, gate *outputGate, resize func(WindowSize), signal func(syscall.Signal), done chan<- bool) {
+	stdinOpen := true
+	execDone := false
+	var consumed int64
 	defer func() {
-		stdin.Close()
-		close(done)
+		if stdinOpen {
+			stdin.Close()
+		}
+		// Nobody is left to resume paused output.
+		gate.open()
+		done <- execDone
 	}()
 
 	for {
-		frame, err := readFrame(dec)
+		frame, err := frames.next()
 		if err != nil {
 			return
 		}
 		switch frame.Type {
 		case frameTypeStdinChunk:
 			var payload stdinPayload
-			if err := json.Unmarshal(frame.Payload, &payload); err == nil {
+			if err := json.Unmarshal(frame.Payload, &payload); err == nil && stdinOpen {
 				_, _ = stdin.Write(payload.Data)
 			}
+			if ack {
+				consumed += int64(len(payload.Data))
+				_ = writer.send(frameTypeStdinAck, stdinAckPayload{Bytes: consumed})
+			}
 		case frameTypeStdinClose:
-			return
+			if stdinOpen {
+				stdin.Close()
+				stdinOpen = false
+			}
+		case frameTypePauseOutput:
+			gate.pause()
+		case frameTypeResumeOutput:
+			gate.resume()
+		case frameTypeResize:
+			var payload windowSizePayload
+			if err := json.Unmarshal(frame.Payload, &payload); err == nil && resize != nil {
+				resize(payload.windowSize())
+			}
+		case frameTypeSignal:
+			var payload signalPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err == nil && payload.Signal > 0 {
+				signal(syscall.Signal(payload.Signal))
+			}
 		case frameTypePing:
 			_ = writer.send(frameTypePong, pongPayload{Timestamp: time.Now()})
+		case frameTypeExecDone:
+			execDone = true
+			return
 		default:
 			return
 		}
 	}
 }
 
+// acquireTransfer reserves a transfer slot, answering with an error frame and
+// reporting false when every slot is taken.
+func (s *Server) acquireTransfer(writer *frameWriter) (func(), bool) {
+	if s.transfers == nil {
+		return func() {}, true
+	}
+	select {
+	case s.transfers <- struct{}{}:
+		return func() { <-s.transfers }, true
+	default:
+		_ = writer.send(frameTypeError, errorPayload{
+			Message: fmt.Sprintf("limit of %d reached", cap(s.transfers)),
+			Code:    errorCodeTooManyTransfers,
+		})
+		return nil, false
+	}
+}
+
 func (s *Server) handleFilePut(dec *json.Decoder, writer *frameWriter, payload filePutRequestPayload) {
 	if payload.Path == "" {
 		_ = writer.send(frameTypeError, errorPayload{Message: "path is required"})
 		return
 	}
+	if payload.Tree {
+		s.handleFilePutTree(dec, writer, payload)
+		return
+	}
 	mode := os.FileMode(payload.Mode)
 	if mode == 0 {
 		mode = defaultFileMode
@@ -332,7 +1236,16 @@ func (s *Server) handleFilePut(dec *json.Decoder, writer *frameWriter, payload f
 	}
 	defer file.Close()
 
+	sparse := false
+	if payload.Sparse {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			sparse = true
+		}
+	}
+
+	sum := newChecksum(payload.Checksum)
 	var written int64
+	trailingHole := false
 	for {
 		frame, err := readFrame(dec)
 		if err != nil {
@@ -346,16 +1259,47 @@ func (s *Server) handleFilePut(dec *json.Decoder, writer *frameWriter, payload f
 				_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 				return
 			}
-			if len(chunk.Data) > 0 {
+			if sum != nil {
+				sum.Write(chunk.Data)
+			}
+			if sparse && len(chunk.Data) > 0 && isZero(chunk.Data) {
+				if _, err := file.Seek(int64(len(chunk.Data)), io.SeekCurrent); err != nil {
+					_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+					return
+				}
+				written += int64(len(chunk.Data))
+				trailingHole = true
+			} else if len(chunk.Data) > 0 {
 				n, err := file.Write(chunk.Data)
 				if err != nil {
 					_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
 					return
 				}
 				written += int64(n)
+				trailingHole = false
 			}
 		case frameTypeFilePutClose:
-			_ = writer.send(frameTypeFilePutResult, fileTransferResultPayload{Bytes: written})
+			if trailingHole {
+				if err := file.Truncate(written); err != nil {
+					_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+					return
+				}
+			}
+			digest := checksumHex(sum)
+			var closing fileClosePayload
+			if len(frame.Payload) > 0 {
+				_ = json.Unmarshal(frame.Payload, &closing)
+			}
+			if digest != "" && closing.SHA256 != "" && closing.SHA256 != digest {
+				// Don't leave a corrupt file behind under the expected name.
+				_ = os.Remove(payload.Path)
+				_ = writer.send(frameTypeError, errorPayload{
+					Message: fmt.Sprintf("%s: received sha256 %s, client sent %s", payload.Path, digest, closing.SHA256),
+					Code:    errorCodeChecksumMismatch,
+				})
+				return
+			}
+			_ = writer.send(frameTypeFilePutResult, fileTransferResultPayload{Bytes: written, SHA256: digest})
 			return
 		default:
 			_ = writer.send(frameTypeError, errorPayload{Message: "unexpected frame during file upload"})
@@ -376,6 +1320,11 @@ func (s *Server) handleFileGet(writer *frameWriter, payload fileGetRequestPayloa
 	}
 	defer file.Close()
 
+	sum := newChecksum(payload.Checksum)
+	if payload.Sparse && s.sendSparseFile(writer, file, sum) {
+		return
+	}
+
 	buf := make([]byte, s.chunkSize)
 	var sent int64
 	for {
@@ -383,12 +1332,15 @@ func (s *Server) handleFileGet(writer *frameWriter, payload fileGetRequestPayloa
 		if n > 0 {
 			chunk := append([]byte(nil), buf[:n]...)
 			sent += int64(len(chunk))
+			if sum != nil {
+				sum.Write(chunk)
+			}
 			if err := writer.send(frameTypeFileGetChunk, chunkPayload{Data: chunk}); err != nil {
 				return
 			}
 		}
 		if errors.Is(readErr, io.EOF) {
-			_ = writer.send(frameTypeFileGetResult, fileTransferResultPayload{Bytes: sent})
+			_ = writer.send(frameTypeFileGetResult, fileTransferResultPayload{Bytes: sent, SHA256: checksumHex(sum)})
 			return
 		}
 		if readErr != nil {
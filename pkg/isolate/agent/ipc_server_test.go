@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrentTransfers(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	const limit = 2
+	srv, client := startServer(t, ServerConfig{MaxConcurrentTransfers: limit})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Uploads from pipes hold their slots until the pipes are closed.
+	pipes := make([]*io.PipeWriter, limit)
+	results := make(chan error, limit)
+	for i := range pipes {
+		r, w := io.Pipe()
+		pipes[i] = w
+		go func() { results <- client.CopyTo(ctx, r, filepath.Join(dir, "held", string(rune('a'+i)))) }()
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(srv.transfers) < limit; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d transfers in progress, want %d", len(srv.transfers), limit)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := client.CopyFrom(ctx, src, io.Discard); !errors.Is(err, ErrTooManyTransfers) {
+		t.Errorf("CopyFrom over the limit = %v, want %v", err, ErrTooManyTransfers)
+	}
+	if err := client.CopyTo(ctx, bytes.NewReader([]byte("x")), filepath.Join(dir, "extra")); !errors.Is(err, ErrTooManyTransfers) {
+		t.Errorf("CopyTo over the limit = %v, want %v", err, ErrTooManyTransfers)
+	}
+	// Execs are not transfers.
+	if _, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true"}); err != nil {
+		t.Errorf("Exec during transfers: %v", err)
+	}
+
+	for _, w := range pipes {
+		w.Write([]byte("hello"))
+		w.Close()
+	}
+	for range limit {
+		if err := <-results; err != nil {
+			t.Errorf("held transfer: %v", err)
+		}
+	}
+	var buf bytes.Buffer
+	if err := client.CopyFrom(ctx, src, &buf); err != nil || buf.String() != "data" {
+		t.Errorf("CopyFrom after the transfers ended = %q, %v", buf.String(), err)
+	}
+}
+
+func TestForcePATHIgnoresPlantedBinaries(t *testing.T) {
+	const forced = "/usr/bin:/bin"
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ls"), []byte("#!/bin/sh\necho planted\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, client := startServer(t, ServerConfig{ForcePATH: forced})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hostile := map[string]string{"PATH": ".:" + dir}
+
+	result, err := client.Exec(ctx, &CommandRequest{Path: "ls", WorkingDir: dir, Env: hostile})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got := string(result.Stdout); result.ExitCode != 0 || got != "ls\n" {
+		t.Errorf("ls = %q, exit %d; want the system ls listing the planted one", got, result.ExitCode)
+	}
+
+	result, err = client.Exec(ctx, &CommandRequest{Path: "sh", Args: []string{"-c", "echo $PATH"}, WorkingDir: dir, Env: hostile})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got := string(result.Stdout); got != forced+"\n" {
+		t.Errorf("child PATH = %q, want %q", got, forced)
+	}
+}
@@ -0,0 +1,233 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// detachedJobRetention bounds how long a finished detached job is kept around
+// for a late re-attach to collect its result.
+const detachedJobRetention = 5 * time.Minute
+
+// detachedJob tracks an exec that outlives the connection that started it.
+// Output is retained (up to the result buffer limit) so a client re-attaching
+// after a transport failure can resume from the offsets it already received.
+type detachedJob struct {
+	id string
+
+	mu          sync.Mutex
+	stdout      *limitedBuffer
+	stderr      *limitedBuffer
+	stdoutTotal int64
+	stderrTotal int64
+	writer      *frameWriter
+	result      *execResultPayload
+	errMessage  string
+	done        chan struct{}
+	release     func() // returns the job's result buffer reservation
+	process     *os.Process
+}
+
+func newJobID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (s *Server) registerJob(writer *frameWriter, process *os.Process, stdout, stderr *limitedBuffer, release func()) *detachedJob {
+	job := &detachedJob{
+		id:      newJobID(),
+		stdout:  stdout,
+		stderr:  stderr,
+		writer:  writer,
+		done:    make(chan struct{}),
+		release: release,
+		process: process,
+	}
+	s.jobsMu.Lock()
+	s.jobs[job.id] = job
+	s.jobsMu.Unlock()
+	return job
+}
+
+func (s *Server) lookupJob(id string) *detachedJob {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	return s.jobs[id]
+}
+
+func (s *Server) forgetJob(id string) {
+	s.jobsMu.Lock()
+	job := s.jobs[id]
+	delete(s.jobs, id)
+	s.jobsMu.Unlock()
+	if job != nil && job.release != nil {
+		job.release()
+	}
+}
+
+// publish records a chunk of output and forwards it to the attached client,
+// if any. A failed send detaches the client; the job keeps running.
+func (j *detachedJob) publish(typ frameType, chunk []byte, stream bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var offset int64
+	if typ == frameTypeStdout {
+		j.stdout.Write(chunk)
+		offset = j.stdoutTotal
+		j.stdoutTotal += int64(len(chunk))
+	} else {
+		j.stderr.Write(chunk)
+		offset = j.stderrTotal
+		j.stderrTotal += int64(len(chunk))
+	}
+	if stream && j.writer != nil {
+		if err := j.writer.send(typ, chunkPayload{Data: chunk, Offset: offset}); err != nil {
+			j.writer = nil
+		}
+	}
+}
+
+// finish stores the terminal frame and delivers it to the attached client.
+// It reports whether a client received it.
+func (j *detachedJob) finish(result *execResultPayload, errMessage string) bool {
+	j.mu.Lock()
+	defer func() {
+		j.mu.Unlock()
+		close(j.done)
+	}()
+	j.result = result
+	j.errMessage = errMessage
+	if j.writer == nil {
+		return false
+	}
+	return j.sendTerminalLocked(j.writer) == nil
+}
+
+func (j *detachedJob) sendTerminalLocked(writer *frameWriter) error {
+	if j.result != nil {
+		return writer.send(frameTypeResult, j.result)
+	}
+	return writer.send(frameTypeError, errorPayload{Message: j.errMessage})
+}
+
+// attach replays retained output past the given offsets to writer, in
+// chunks of at most chunkSize bytes, and makes it the job's live
+// destination. It reports whether the job had already finished, in which
+// case the terminal frame has been sent as well.
+func (j *detachedJob) attach(writer *frameWriter, stdoutOffset, stderrOffset int64, chunkSize int) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := replayRetained(writer, frameTypeStdout, j.stdout.Bytes(), stdoutOffset, chunkSize); err != nil {
+		return false, err
+	}
+	if err := replayRetained(writer, frameTypeStderr, j.stderr.Bytes(), stderrOffset, chunkSize); err != nil {
+		return false, err
+	}
+	select {
+	case <-j.done:
+		return true, j.sendTerminalLocked(writer)
+	default:
+	}
+	j.writer = writer
+	return false, nil
+}
+
+func (j *detachedJob) detach(writer *frameWriter) {
+	j.mu.Lock()
+	if j.writer == writer {
+		j.writer = nil
+	}
+	j.mu.Unlock()
+}
+
+// replayRetained sends retained[offset:] as chunks of at most chunkSize
+// bytes, each carrying its offset. Retained output is the head of the
+// stream, so output past it is skipped, and the next chunk the client
+// receives, replayed or live, starts further on than it asked for.
+func replayRetained(writer *frameWriter, typ frameType, retained []byte, offset int64, chunkSize int) error {
+	if offset < 0 {
+		offset = 0
+	}
+	for ; offset < int64(len(retained)); offset += int64(chunkSize) {
+		end := min(offset+int64(chunkSize), int64(len(retained)))
+		chunk := append([]byte(nil), retained[offset:end]...)
+		if err := writer.send(typ, chunkPayload{Data: chunk, Offset: offset}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleAttach(dec *json.Decoder, writer *frameWriter, payload attachRequestPayload) {
+	job := s.lookupJob(payload.ID)
+	if job == nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "unknown job " + payload.ID})
+		return
+	}
+
+	finished, err := job.attach(writer, payload.StdoutOffset, payload.StderrOffset, s.chunkSize)
+	if err != nil {
+		job.detach(writer)
+		return
+	}
+	if finished {
+		s.forgetJob(job.id)
+		return
+	}
+
+	// Watch the connection so a second transport failure detaches cleanly
+	// instead of pinning the handler until the job exits.
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		for {
+			frame, err := readFrame(dec)
+			if err != nil {
+				return
+			}
+			if frame.Type == frameTypePing {
+				_ = writer.send(frameTypePong, pongPayload{Timestamp: time.Now()})
+			}
+		}
+	}()
+
+	select {
+	case <-job.done:
+		s.forgetJob(job.id)
+	case <-disconnected:
+		job.detach(writer)
+	}
+}
+
+// handleSignalJob delivers a signal to a detached job's process. Signalling
+// a job that has already finished is not an error.
+func (s *Server) handleSignalJob(writer *frameWriter, payload signalJobRequestPayload) {
+	if payload.Signal <= 0 {
+		_ = writer.send(frameTypeError, errorPayload{Message: "signal is required"})
+		return
+	}
+	job := s.lookupJob(payload.ID)
+	if job == nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "unknown job " + payload.ID})
+		return
+	}
+	select {
+	case <-job.done:
+	default:
+		err := job.process.Signal(syscall.Signal(payload.Signal))
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+	}
+	_ = writer.send(frameTypeSignalJobResult, nil)
+}
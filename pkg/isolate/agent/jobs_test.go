@@ -0,0 +1,98 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestAttachReportsOutputPastRetainedBuffer(t *testing.T) {
+	_, client := startServer(t, ServerConfig{ChunkSize: 100, MaxResultBuffer: 1000})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.ExecStream(ctx, &CommandRequest{
+		Path:   "/bin/sh",
+		Args:   []string{"-c", "sleep 0.2; head -c 5000 /dev/zero"},
+		Detach: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.JobID == "" {
+		t.Fatal("detached exec has no job ID")
+	}
+	// Drop the connection before the job writes anything.
+	stream.Cancel()
+	time.Sleep(500 * time.Millisecond)
+
+	attached, err := client.Attach(ctx, stream.JobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks, received int
+	for chunk := range attached.Stdout {
+		if len(chunk) > 100 {
+			t.Errorf("replayed chunk of %d bytes, want at most the chunk size 100", len(chunk))
+		}
+		chunks++
+		received += len(chunk)
+	}
+	result := <-attached.Done
+	if result == nil || result.ExitCode != 0 {
+		t.Fatalf("result = %+v", result)
+	}
+	if received != 1000 || chunks != 10 {
+		t.Errorf("replayed %d bytes in %d chunks, want 1000 in 10", received, chunks)
+	}
+	if stdout, stderr := attached.Missed(); stdout != 4000 || stderr != 0 {
+		t.Errorf("Missed() = %d, %d, want 4000, 0", stdout, stderr)
+	}
+}
+
+func TestReplayRetainedFromOffset(t *testing.T) {
+	retained := []byte("0123456789")
+	for _, tc := range []struct {
+		offset int64
+		want   []string
+	}{
+		{0, []string{"0123", "4567", "89"}},
+		{5, []string{"5678", "9"}},
+		{10, nil},
+		{12, nil},
+	} {
+		var buf bytes.Buffer
+		if err := replayRetained(newFrameWriter(&buf), frameTypeStdout, retained, tc.offset, 4); err != nil {
+			t.Fatal(err)
+		}
+		var frames []chunkPayload
+		dec := json.NewDecoder(&buf)
+		for {
+			frame, err := readFrame(dec)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var payload chunkPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, payload)
+		}
+		if len(frames) != len(tc.want) {
+			t.Fatalf("offset %d: %d chunks, want %d", tc.offset, len(frames), len(tc.want))
+		}
+		offset := tc.offset
+		for i, frame := range frames {
+			if string(frame.Data) != tc.want[i] || frame.Offset != offset {
+				t.Errorf("offset %d: chunk %d = %q at %d, want %q at %d", tc.offset, i, frame.Data, frame.Offset, tc.want[i], offset)
+			}
+			offset += int64(len(frame.Data))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// logRingLines is how many recent agent log lines a new subscriber replays.
+const logRingLines = 1000
+
+// logSubscriberBuffer bounds the lines queued for a slow subscriber; lines
+// beyond it are dropped rather than stalling the agent's logging.
+const logSubscriberBuffer = 256
+
+// logRing keeps the agent's recent log lines and fans new ones out to
+// subscribers.
+type logRing struct {
+	mu      sync.Mutex
+	lines   []string
+	next    int
+	full    bool
+	partial []byte
+	subs    map[chan string]struct{}
+}
+
+func newLogRing() *logRing {
+	return &logRing{
+		lines: make([]string, logRingLines),
+		subs:  make(map[chan string]struct{}),
+	}
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := append(r.partial, p...)
+	for {
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			break
+		}
+		r.addLocked(string(data[:idx]))
+		data = data[idx+1:]
+	}
+	r.partial = append([]byte(nil), data...)
+	return len(p), nil
+}
+
+func (r *logRing) addLocked(line string) {
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+	for ch := range r.subs {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// subscribe returns the buffered lines and a channel receiving later ones.
+func (r *logRing) subscribe() ([]string, chan string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var recent []string
+	if r.full {
+		recent = append(recent, r.lines[r.next:]...)
+	}
+	recent = append(recent, r.lines[:r.next]...)
+	ch := make(chan string, logSubscriberBuffer)
+	r.subs[ch] = struct{}{}
+	return recent, ch
+}
+
+func (r *logRing) unsubscribe(ch chan string) {
+	r.mu.Lock()
+	delete(r.subs, ch)
+	r.mu.Unlock()
+}
+
+// teeLogger returns a logger writing to both base and ring with base's
+// prefix and flags, leaving the caller's logger untouched.
+func teeLogger(base *log.Logger, ring *logRing) *log.Logger {
+	return log.New(io.MultiWriter(base.Writer(), ring), base.Prefix(), base.Flags())
+}
+
+// handleLogSubscribe streams the log ring to the client until it sends
+// log_unsubscribe or disconnects.
+func (s *Server) handleLogSubscribe(dec *json.Decoder, writer *frameWriter, payload logSubscribePayload) {
+	if s.logRing == nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "log subscription is disabled", Code: errorCodeUnsupported})
+		return
+	}
+	if s.logToken != "" && subtle.ConstantTimeCompare([]byte(payload.Token), []byte(s.logToken)) != 1 {
+		_ = writer.send(frameTypeError, errorPayload{Message: "invalid log subscription token", Code: errorCodeUnauthorized})
+		return
+	}
+
+	recent, lines := s.logRing.subscribe()
+	defer s.logRing.unsubscribe(lines)
+
+	if err := writer.send(frameTypeLogSubscribed, nil); err != nil {
+		return
+	}
+
+	for _, line := range recent {
+		if err := writer.send(frameTypeLogLine, logLinePayload{Line: line}); err != nil {
+			return
+		}
+	}
+
+	stop := make(chan bool, 1) // true when the client asked to stop
+	go func() {
+		for {
+			frame, err := readFrame(dec)
+			if err != nil {
+				stop <- false
+				return
+			}
+			switch frame.Type {
+			case frameTypeLogUnsubscribe:
+				stop <- true
+				return
+			case frameTypePing:
+				_ = writer.send(frameTypePong, pongPayload{Timestamp: time.Now()})
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			if err := writer.send(frameTypeLogLine, logLinePayload{Line: line}); err != nil {
+				return
+			}
+		case requested := <-stop:
+			if requested {
+				_ = writer.send(frameTypeLogEnd, nil)
+			}
+			return
+		}
+	}
+}
+
+// SubscribeLogs streams the agent's recent and ongoing log lines. The agent
+// must be started with AllowLogSubscribe, and token must match its
+// LogSubscribeToken when one is set. The channel is closed once ctx is
+// cancelled (which unsubscribes) or the connection ends.
+func (c *IPCClient) SubscribeLogs(ctx context.Context, token string) (<-chan string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	writer := newFrameWriter(conn)
+	dec := json.NewDecoder(conn)
+
+	if err := writer.send(frameTypeLogSubscribe, logSubscribePayload{Token: token}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ack, err := readFrame(dec)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch ack.Type {
+	case frameTypeLogSubscribed:
+	case frameTypeError:
+		var payload errorPayload
+		_ = json.Unmarshal(ack.Payload, &payload)
+		conn.Close()
+		return nil, payload.err()
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unexpected frame %s", ack.Type)
+	}
+
+	out := make(chan string, logSubscriberBuffer)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = writer.send(frameTypeLogUnsubscribe, nil)
+			// Give the agent a moment to acknowledge before tearing down.
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				conn.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(out)
+		defer conn.Close()
+		defer close(done)
+		for {
+			frame, err := readFrame(dec)
+			if err != nil || frame.Type != frameTypeLogLine {
+				return
+			}
+			var payload logLinePayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				continue
+			}
+			select {
+			case out <- payload.Line:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return out, nil
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// nextLogLine reads lines until one contains want.
+func nextLogLine(t *testing.T, lines <-chan string, want string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				t.Fatalf("log stream ended before a line containing %q", want)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no log line containing %q", want)
+		}
+	}
+}
+
+func TestSubscribeLogs(t *testing.T) {
+	srv, client := startServer(t, ServerConfig{AllowLogSubscribe: true, LogSubscribeToken: "s3cret"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.SubscribeLogs(ctx, "wrong"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("SubscribeLogs with a wrong token = %v, want %v", err, ErrUnauthorized)
+	}
+
+	// Lines logged before subscribing are replayed.
+	if _, err := client.Exec(ctx, &CommandRequest{Path: "/bin/echo", Args: []string{"before"}}); err != nil {
+		t.Fatal(err)
+	}
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	lines, err := client.SubscribeLogs(subCtx, "s3cret")
+	if err != nil {
+		t.Fatalf("SubscribeLogs: %v", err)
+	}
+	nextLogLine(t, lines, "exec /bin/echo before")
+
+	if _, err := client.Exec(ctx, &CommandRequest{Path: "/bin/echo", Args: []string{"after"}}); err != nil {
+		t.Fatal(err)
+	}
+	nextLogLine(t, lines, "exec /bin/echo after")
+
+	// Unsubscribing ends the stream and removes the subscriber.
+	unsubscribe()
+	for range lines {
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		srv.logRing.mu.Lock()
+		subs := len(srv.logRing.subs)
+		srv.logRing.mu.Unlock()
+		if subs == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d subscribers left after unsubscribing", subs)
+		}
+	}
+}
+
+func TestSubscribeLogsDisabled(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := client.SubscribeLogs(ctx, ""); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("SubscribeLogs = %v, want %v", err, ErrUnsupported)
+	}
+}
@@ -0,0 +1,103 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// lookPathIn resolves a bare command name against pathList rather than the
+// agent's own PATH. When root is set the directories are interpreted inside
+// root (as the command would see them after chroot) and the returned path is
+// relative to that root. Relative PATH entries are ignored so the current
+// working directory can never shadow a system binary.
+func lookPathIn(name, pathList, root string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("command path is required")
+	}
+	if strings.ContainsAny(name, `/\`) {
+		return name, nil
+	}
+	for _, dir := range filepath.SplitList(pathList) {
+		if dir == "" || !filepath.IsAbs(dir) {
+			continue
+		}
+		candidate := filepath.Join(dir, name)
+		hostPath := candidate
+		if root != "" {
+			hostPath = filepath.Join(root, candidate)
+		}
+		if isExecutableFile(hostPath) {
+			return candidate, nil
+		}
+	}
+	return "", &commandNotFoundError{name: name, pathList: pathList}
+}
+
+func isExecutableFile(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	return info.Mode().Perm()&0o111 != 0
+}
+
+// handleWhich resolves a command name the way runExec would: against
+// ForcePATH when configured, otherwise the agent's own PATH. With chroot
+// isolation the lookup happens inside rootDir, the answer is the path as seen
+// from inside the root, and symlinks must not lead outside of it.
+func (s *Server) handleWhich(writer *frameWriter, payload whichRequestPayload) {
+	if payload.Name == "" {
+		_ = writer.send(frameTypeError, errorPayload{Message: "command name is required"})
+		return
+	}
+	pathList := s.forcePATH
+	if pathList == "" {
+		pathList = os.Getenv("PATH")
+	}
+	root := ""
+	if s.rootIsolated() {
+		root = s.rootDir
+	}
+
+	resolved := payload.Name
+	if strings.ContainsAny(resolved, `/\`) {
+		if !filepath.IsAbs(resolved) {
+			_ = writer.send(frameTypeError, errorPayload{Message: fmt.Sprintf("command %q must be a bare name or an absolute path", resolved)})
+			return
+		}
+		resolved = filepath.Clean(resolved)
+		if !isExecutableFile(filepath.Join(root, resolved)) {
+			_ = writer.send(frameTypeError, errorPayload{
+				Message: fmt.Sprintf("command %q not found", payload.Name),
+				Code:    errorCodeCommandNotFound,
+			})
+			return
+		}
+	} else {
+		var err error
+		resolved, err = lookPathIn(resolved, pathList, root)
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error(), Code: errorCodeCommandNotFound})
+			return
+		}
+	}
+
+	if root != "" {
+		real, err := filepath.EvalSymlinks(filepath.Join(root, resolved))
+		if err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+			return
+		}
+		if err := s.checkRealPathWithinRoot(real, resolved); err != nil {
+			_ = writer.send(frameTypeError, errorPayload{Message: "security violation: " + err.Error()})
+			return
+		}
+	}
+	_ = writer.send(frameTypeWhichResult, whichResultPayload{Path: resolved})
+}
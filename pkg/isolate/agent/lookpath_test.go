@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeExecutable writes a shell script to path, creating its directory.
+func writeExecutable(t *testing.T, path string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWhich(t *testing.T) {
+	bin := t.TempDir()
+	writeExecutable(t, filepath.Join(bin, "tool"), 0o755)
+	writeExecutable(t, filepath.Join(bin, "data"), 0o644)
+	_, client := startServer(t, ServerConfig{ForcePATH: bin})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for name, want := range map[string]string{
+		"tool":                          filepath.Join(bin, "tool"),
+		filepath.Join(bin, "tool"):      filepath.Join(bin, "tool"),
+		filepath.Join(bin, ".", "tool"): filepath.Join(bin, "tool"),
+	} {
+		if got, err := client.Which(ctx, name); err != nil || got != want {
+			t.Errorf("Which(%q) = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	// Commands outside ForcePATH, and files that are not executable, are
+	// not found.
+	for _, name := range []string{"sh", "missing", "data", filepath.Join(bin, "missing"), filepath.Join(bin, "data")} {
+		if got, err := client.Which(ctx, name); !errors.Is(err, ErrCommandNotFound) {
+			t.Errorf("Which(%q) = %q, %v; want %v", name, got, err, ErrCommandNotFound)
+		}
+	}
+	if _, err := client.Which(ctx, "bin/tool"); err == nil || errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Which of a relative path = %v, want a request error", err)
+	}
+}
+
+func TestWhichWithinRoot(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot isolation needs root")
+	}
+	root := t.TempDir()
+	writeExecutable(t, filepath.Join(root, "bin", "tool"), 0o755)
+	if err := os.Symlink("/bin/sh", filepath.Join(root, "bin", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	_, client := startServer(t, ServerConfig{RootDir: root, UseChrootIfRoot: true, ForcePATH: "/bin"})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The answer is the path as seen from inside the root.
+	if got, err := client.Which(ctx, "tool"); err != nil || got != "/bin/tool" {
+		t.Errorf("Which(tool) = %q, %v; want /bin/tool", got, err)
+	}
+	if got, err := client.Which(ctx, "ls"); !errors.Is(err, ErrCommandNotFound) {
+		t.Errorf("Which(ls) = %q, %v; want %v", got, err, ErrCommandNotFound)
+	}
+	if got, err := client.Which(ctx, "escape"); err == nil {
+		t.Errorf("Which of a symlink leaving the root = %q, want an error", got)
+	}
+}
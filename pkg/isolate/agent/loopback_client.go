@@ -5,10 +5,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -17,6 +20,21 @@ import (
 // used in production but provides a convenient feedback loop.
 type LoopbackClient struct {
 	baseEnv map[string]string
+
+	created time.Time
+
+	mu   sync.Mutex
+	jobs map[string]*os.Process // running detached streams, for SignalJob
+
+	processes *processTracker // running commands, for ProcessStats
+
+	// Bandwidth throttles commands' output at the egress rate and their
+	// stdin at the ingress rate, all commands sharing the limit. Set it
+	// before first use.
+	Bandwidth Bandwidth
+
+	shapeOnce sync.Once
+	shape     *shaper
 }
 
 // NewLoopbackClient constructs a loopback agent.
@@ -25,7 +43,7 @@ func NewLoopbackClient(baseEnv map[string]string) Client {
 	for k, v := range baseEnv {
 		env[k] = v
 	}
-	return &LoopbackClient{baseEnv: env}
+	return &LoopbackClient{baseEnv: env, created: time.Now(), jobs: make(map[string]*os.Process), processes: newProcessTracker()}
 }
 
 func (l *LoopbackClient) Ping(ctx context.Context) error { return nil }
@@ -33,24 +51,55 @@ func (l *LoopbackClient) Ping(ctx context.Context) error { return nil }
 func (l *LoopbackClient) Exec(ctx context.Context, cmd *CommandRequest) (*CommandResult, error) {
 	start := time.Now()
 
+	if len(cmd.EgressAllow) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, errEgressUnsupported)
+	}
+	if cmd.CompletionURL != "" {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, errWebhooksDisabled)
+	}
+	if cmd.Tty {
+		return nil, fmt.Errorf("%w: the loopback agent does not allocate ttys", ErrUnsupported)
+	}
+	if cmd.DryRun {
+		return nil, fmt.Errorf("%w: the loopback agent has no dry run", ErrUnsupported)
+	}
+
 	// Validate working directory to prevent path traversal
 	if cmd.WorkingDir != "" {
 		if err := validateWorkingDir(cmd); err != nil {
 			return nil, fmt.Errorf("security violation: %w", err)
 		}
+		if err := ensureWorkingDir(cmd.WorkingDir, cmd.WorkingDir, cmd.CreateWorkingDir, nil); err != nil {
+			return nil, err
+		}
 	}
 
 	command := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
 	command.Env = flattenEnv(l.baseEnv, cmd.Env)
 	command.Dir = cmd.WorkingDir
+	if err := runAsUser(command, cmd.User); err != nil {
+		return nil, err
+	}
+	var env []string
+	if cmd.ReturnEnv {
+		env = envSnapshot(command.Env, DefaultRedactor())
+	}
 
+	shape := l.shaper()
 	if cmd.Stdin != nil {
-		command.Stdin = cmd.Stdin
+		command.Stdin = limitReader(cmd.Stdin, shape.ingress)
 	}
 
-	stdout, err := command.StdoutPipe()
-	if err != nil {
-		return nil, err
+	var stdout io.Reader = strings.NewReader("")
+	if cmd.Stdio != nil {
+		command.Stdin = cmd.Stdio
+		command.Stdout = cmd.Stdio
+	} else {
+		pipe, err := command.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout = pipe
 	}
 	stderr, err := command.StderrPipe()
 	if err != nil {
@@ -58,14 +107,19 @@ func (l *LoopbackClient) Exec(ctx context.Context, cmd *CommandRequest) (*Comman
 	}
 
 	if err := command.Start(); err != nil {
+		if result := startFailureResult(err); result != nil {
+			return result.toCommandResult(), nil
+		}
 		return nil, err
 	}
+	l.processes.add(command.Process.Pid)
+	defer l.processes.remove(command.Process.Pid)
 
-	stdoutBytes, err := io.ReadAll(stdout)
+	stdoutBytes, err := io.ReadAll(limitReader(stdout, shape.egress))
 	if err != nil {
 		return nil, err
 	}
-	stderrBytes, err := io.ReadAll(stderr)
+	stderrBytes, err := io.ReadAll(limitReader(stderr, shape.egress))
 	if err != nil {
 		return nil, err
 	}
@@ -79,6 +133,10 @@ func (l *LoopbackClient) Exec(ctx context.Context, cmd *CommandRequest) (*Comman
 				Duration:   time.Since(start),
 				StartedAt:  start,
 				FinishedAt: time.Now(),
+				Env:        env,
+
+				StdoutTotalBytes: int64(len(stdoutBytes)),
+				StderrTotalBytes: int64(len(stderrBytes)),
 			}, nil
 		}
 		return nil, err
@@ -91,50 +149,102 @@ func (l *LoopbackClient) Exec(ctx context.Context, cmd *CommandRequest) (*Comman
 		Duration:   time.Since(start),
 		StartedAt:  start,
 		FinishedAt: time.Now(),
+		Env:        env,
+
+		StdoutTotalBytes: int64(len(stdoutBytes)),
+		StderrTotalBytes: int64(len(stderrBytes)),
 	}, nil
 }
 
 func (l *LoopbackClient) ExecStream(ctx context.Context, cmd *CommandRequest) (*CommandStream, error) {
+	if len(cmd.EgressAllow) > 0 {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, errEgressUnsupported)
+	}
+	if cmd.CompletionURL != "" {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, errWebhooksDisabled)
+	}
+	if cmd.Tty {
+		return nil, fmt.Errorf("%w: the loopback agent does not allocate ttys", ErrUnsupported)
+	}
+	if cmd.DryRun {
+		return nil, fmt.Errorf("%w: the loopback agent has no dry run", ErrUnsupported)
+	}
 	// Validate working directory to prevent path traversal
 	if cmd.WorkingDir != "" {
 		if err := validateWorkingDir(cmd); err != nil {
 			return nil, fmt.Errorf("security violation: %w", err)
 		}
+		if err := ensureWorkingDir(cmd.WorkingDir, cmd.WorkingDir, cmd.CreateWorkingDir, nil); err != nil {
+			return nil, err
+		}
 	}
 
 	command := exec.CommandContext(ctx, cmd.Path, cmd.Args...)
 	command.Env = flattenEnv(l.baseEnv, cmd.Env)
 	command.Dir = cmd.WorkingDir
-	command.Stdin = cmd.Stdin
-
-	stdoutPipe, err := command.StdoutPipe()
-	if err != nil {
+	if err := runAsUser(command, cmd.User); err != nil {
 		return nil, err
 	}
+	shape := l.shaper()
+	command.Stdin = limitReader(cmd.Stdin, shape.ingress)
+	var env []string
+	if cmd.ReturnEnv {
+		env = envSnapshot(command.Env, DefaultRedactor())
+	}
+
+	var stdoutPipe io.Reader = strings.NewReader("")
+	if cmd.Stdio != nil {
+		command.Stdin = cmd.Stdio
+		command.Stdout = cmd.Stdio
+	} else {
+		pipe, err := command.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdoutPipe = pipe
+	}
 	stderrPipe, err := command.StderrPipe()
 	if err != nil {
 		return nil, err
 	}
 
 	if err := command.Start(); err != nil {
+		if result := startFailureResult(err); result != nil {
+			return finishedStream(result.toCommandResult()), nil
+		}
 		return nil, err
 	}
+	l.processes.add(command.Process.Pid)
 
 	stdoutCh := make(chan []byte, 1)
 	stderrCh := make(chan []byte, 1)
 	doneCh := make(chan *CommandResult, 1)
 
+	var jobID string
+	if cmd.Detach {
+		jobID = newJobID()
+		l.mu.Lock()
+		l.jobs[jobID] = command.Process
+		l.mu.Unlock()
+	}
+
 	ctx, cancel := context.WithCancel(ctx)
 
 	wg := sync.WaitGroup{}
 	wg.Add(2)
 
-	go streamPipe(ctx, &wg, stdoutPipe, stdoutCh)
-	go streamPipe(ctx, &wg, stderrPipe, stderrCh)
+	go streamPipe(ctx, &wg, limitReader(stdoutPipe, shape.egress), stdoutCh)
+	go streamPipe(ctx, &wg, limitReader(stderrPipe, shape.egress), stderrCh)
 
 	go func() {
 		wg.Wait()
 		err := command.Wait()
+		l.processes.remove(command.Process.Pid)
+		if jobID != "" {
+			l.mu.Lock()
+			delete(l.jobs, jobID)
+			l.mu.Unlock()
+		}
 		exitCode := 0
 		if err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
@@ -146,6 +256,7 @@ func (l *LoopbackClient) ExecStream(ctx context.Context, cmd *CommandRequest) (*
 			Duration:   0,
 			StartedAt:  time.Now(),
 			FinishedAt: time.Now(),
+			Env:        env,
 		}
 		close(doneCh)
 	}()
@@ -155,19 +266,129 @@ func (l *LoopbackClient) ExecStream(ctx context.Context, cmd *CommandRequest) (*
 		Stderr: stderrCh,
 		Done:   doneCh,
 		Cancel: cancel,
+		JobID:  jobID,
 	}, nil
 }
 
+// finishedStream is the stream of a command that ended before producing
+// any output, such as one that could not be started.
+func finishedStream(result *CommandResult) *CommandStream {
+	stdoutCh := make(chan []byte)
+	stderrCh := make(chan []byte)
+	doneCh := make(chan *CommandResult, 1)
+	close(stdoutCh)
+	close(stderrCh)
+	doneCh <- result
+	close(doneCh)
+	return &CommandStream{Stdout: stdoutCh, Stderr: stderrCh, Done: doneCh, Cancel: func() {}}
+}
+
 func (l *LoopbackClient) CopyTo(ctx context.Context, reader io.Reader, dst string) error {
 	return ErrUnavailable
 }
 
+func (l *LoopbackClient) CopyDirTo(ctx context.Context, srcDir, dst string, progress func(CopyProgress)) error {
+	return ErrUnavailable
+}
+
 func (l *LoopbackClient) CopyFrom(ctx context.Context, src string, writer io.Writer) error {
 	return ErrUnavailable
 }
 
+func (l *LoopbackClient) CopyArchiveFrom(ctx context.Context, srcDir string, format ArchiveFormat, writer io.Writer) error {
+	return ErrUnavailable
+}
+
+func (l *LoopbackClient) ImportArchive(ctx context.Context, reader io.Reader) error {
+	return ErrUnavailable
+}
+
+func (l *LoopbackClient) Attach(ctx context.Context, jobID string) (*CommandStream, error) {
+	return nil, ErrUnavailable
+}
+
+func (l *LoopbackClient) CheckSpace(ctx context.Context, path string, needBytes int64) (bool, *DiskUsage, error) {
+	return false, nil, ErrUnavailable
+}
+
+// Which resolves name against the host PATH, since loopback commands run on
+// the host.
+func (l *LoopbackClient) Which(ctx context.Context, name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrCommandNotFound, err)
+	}
+	return filepath.Abs(path)
+}
+
+func (l *LoopbackClient) Chown(ctx context.Context, path string, uid, gid int) error {
+	return ErrUnavailable
+}
+
+func (l *LoopbackClient) Logs(ctx context.Context, execID string, tailBytes int) ([]byte, error) {
+	return nil, ErrUnavailable
+}
+
+func (l *LoopbackClient) SubscribeLogs(ctx context.Context, token string) (<-chan string, error) {
+	return nil, ErrUnavailable
+}
+
+// SignalJob signals a detached stream started by this client. Streams that
+// have finished are no longer known.
+func (l *LoopbackClient) SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error {
+	l.mu.Lock()
+	process := l.jobs[jobID]
+	l.mu.Unlock()
+	if process == nil {
+		return fmt.Errorf("unknown job %s", jobID)
+	}
+	return process.Signal(sig)
+}
+
+// Capabilities reports the requests the loopback client implements.
+func (l *LoopbackClient) Capabilities(ctx context.Context) (*Capabilities, error) {
+	requests := []string{
+		string(frameTypePing),
+		string(frameTypeExecRequest),
+		string(frameTypeWhichRequest),
+		string(frameTypeSignalJobRequest),
+		string(frameTypeCapabilitiesRequest),
+		string(frameTypeInfoRequest),
+	}
+	if canSampleProcesses {
+		requests = append(requests, string(frameTypeProcessStatsRequest))
+	}
+	return &Capabilities{ProtocolVersion: ProtocolVersion, Requests: requests}, nil
+}
+
+// Info describes the loopback agent: the host, without isolation or a root
+// directory, up since the client was created.
+func (l *LoopbackClient) Info(ctx context.Context) (*AgentInfo, error) {
+	return &AgentInfo{
+		Version:         buildVersion(),
+		ProtocolVersion: ProtocolVersion,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		Uptime:          time.Since(l.created),
+	}, nil
+}
+
+// ProcessStats samples the commands the loopback agent is running on the
+// host.
+func (l *LoopbackClient) ProcessStats(ctx context.Context) (*ProcessStats, error) {
+	if !canSampleProcesses {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, errUnsupportedSampling)
+	}
+	return l.processes.sample(), nil
+}
+
 func (l *LoopbackClient) Close() error { return nil }
 
+func (l *LoopbackClient) shaper() *shaper {
+	l.shapeOnce.Do(func() { l.shape = newShaper(l.Bandwidth) })
+	return l.shape
+}
+
 func streamPipe(ctx context.Context, wg *sync.WaitGroup, pipe io.Reader, out chan<- []byte) {
 	defer wg.Done()
 	reader := bufio.NewReader(pipe)
@@ -225,3 +446,17 @@ func validateWorkingDir(cmd *CommandRequest) error {
 
 	return nil
 }
+
+// runAsUser makes command run as spec, a user name or uid optionally
+// followed by ":group", as the agent does. An empty spec keeps this
+// process's credentials.
+func runAsUser(command *exec.Cmd, spec string) error {
+	if spec == "" {
+		return nil
+	}
+	u, err := switchUser("", spec)
+	if err != nil || u == nil {
+		return err
+	}
+	return setCredential(command, u)
+}
@@ -0,0 +1,180 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// execDurationBounds are the upper bounds, in seconds, of the exec duration
+// histogram's buckets.
+var execDurationBounds = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// serverMetrics holds a server's counters. Updates are a few atomic adds, so
+// they are kept whether or not anything collects them.
+type serverMetrics struct {
+	execs         atomic.Uint64
+	execBuckets   []atomic.Uint64 // per bound of execDurationBounds, not cumulative
+	execNanos     atomic.Int64
+	bytesReceived atomic.Uint64
+	bytesSent     atomic.Uint64
+
+	errorsMu sync.Mutex
+	errors   map[string]uint64 // error frames sent, by code
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		execBuckets: make([]atomic.Uint64, len(execDurationBounds)+1),
+		errors:      make(map[string]uint64),
+	}
+}
+
+// observeExec records an exec that ran for d.
+func (m *serverMetrics) observeExec(d time.Duration) {
+	m.execNanos.Add(int64(d))
+	idx, _ := slices.BinarySearch(execDurationBounds, d.Seconds())
+	m.execBuckets[idx].Add(1)
+}
+
+// countError counts an error frame with code; errors without one are counted
+// as "other".
+func (m *serverMetrics) countError(code string) {
+	if code == "" {
+		code = "other"
+	}
+	m.errorsMu.Lock()
+	m.errors[code]++
+	m.errorsMu.Unlock()
+}
+
+// countingWriter reports the size of every write to wrote, as
+// countingReader does for reads.
+type countingWriter struct {
+	w     io.Writer
+	wrote func(int)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.wrote(n)
+	}
+	return n, err
+}
+
+// connBytes returns the countingReader or countingWriter callback that adds
+// a connection's bytes to counter. Traffic either way also keeps the server
+// from going idle.
+func (s *Server) connBytes(counter *atomic.Uint64) func(int) {
+	return func(n int) {
+		counter.Add(uint64(n))
+		s.idle.touch()
+	}
+}
+
+// Metrics is a snapshot of a server's counters since it was created.
+type Metrics struct {
+	// ExecsTotal counts the commands started; ExecDuration only those that
+	// have exited.
+	ExecsTotal   uint64
+	ExecDuration Histogram
+	// BytesReceived and BytesSent count the protocol bytes read from and
+	// written to clients, file transfers and exec I/O included.
+	BytesReceived     uint64
+	BytesSent         uint64
+	ActiveConnections int
+	// Errors counts the error frames sent to clients by error code, such as
+	// "agent_busy" or "unsupported"; errors without a code count as "other".
+	Errors map[string]uint64
+}
+
+// Histogram is a cumulative histogram of durations in seconds.
+type Histogram struct {
+	Bounds []float64 // upper bound of each bucket
+	Counts []uint64  // observations at or below each bound
+	Count  uint64
+	Sum    float64
+}
+
+// Collect returns the server's current metrics.
+func (s *Server) Collect() Metrics {
+	m := s.metrics
+	active, _ := s.conns.usage()
+	out := Metrics{
+		ExecsTotal:        m.execs.Load(),
+		BytesReceived:     m.bytesReceived.Load(),
+		BytesSent:         m.bytesSent.Load(),
+		ActiveConnections: active,
+		ExecDuration: Histogram{
+			Bounds: slices.Clone(execDurationBounds),
+			Counts: make([]uint64, len(execDurationBounds)),
+			Sum:    time.Duration(m.execNanos.Load()).Seconds(),
+		},
+	}
+	var cumulative uint64
+	for i := range execDurationBounds {
+		cumulative += m.execBuckets[i].Load()
+		out.ExecDuration.Counts[i] = cumulative
+	}
+	out.ExecDuration.Count = cumulative + m.execBuckets[len(execDurationBounds)].Load()
+	m.errorsMu.Lock()
+	out.Errors = make(map[string]uint64, len(m.errors))
+	for code, n := range m.errors {
+		out.Errors[code] = n
+	}
+	m.errorsMu.Unlock()
+	return out
+}
+
+// WritePrometheus writes m in the Prometheus text exposition format.
+func (m Metrics) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("agentd_execs_total", "counter", "Commands started.")
+	fmt.Fprintf(bw, "agentd_execs_total %d\n", m.ExecsTotal)
+
+	metric("agentd_exec_duration_seconds", "histogram", "Time from starting a command to its exit.")
+	for i, bound := range m.ExecDuration.Bounds {
+		fmt.Fprintf(bw, "agentd_exec_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), m.ExecDuration.Counts[i])
+	}
+	fmt.Fprintf(bw, "agentd_exec_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.ExecDuration.Count)
+	fmt.Fprintf(bw, "agentd_exec_duration_seconds_sum %s\n", strconv.FormatFloat(m.ExecDuration.Sum, 'g', -1, 64))
+	fmt.Fprintf(bw, "agentd_exec_duration_seconds_count %d\n", m.ExecDuration.Count)
+
+	metric("agentd_received_bytes_total", "counter", "Protocol bytes read from clients.")
+	fmt.Fprintf(bw, "agentd_received_bytes_total %d\n", m.BytesReceived)
+	metric("agentd_sent_bytes_total", "counter", "Protocol bytes written to clients.")
+	fmt.Fprintf(bw, "agentd_sent_bytes_total %d\n", m.BytesSent)
+
+	metric("agentd_active_connections", "gauge", "Connections being served.")
+	fmt.Fprintf(bw, "agentd_active_connections %d\n", m.ActiveConnections)
+
+	metric("agentd_errors_total", "counter", "Error frames sent to clients, by error code.")
+	codes := make([]string, 0, len(m.Errors))
+	for code := range m.Errors {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Fprintf(bw, "agentd_errors_total{code=%q} %d\n", code, m.Errors[code])
+	}
+	return bw.Flush()
+}
+
+// MetricsHandler serves the server's metrics to Prometheus scrapes.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = s.Collect().WritePrometheus(w)
+	})
+}
@@ -0,0 +1,84 @@
+//go:build ignore
+
+// mkseccomp generates the syscall name tables seccomp profiles are compiled
+// against, one per supported architecture, from the syscall numbers in
+// golang.org/x/sys/unix. Run it with "go generate" after upgrading x/sys.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var arches = []struct {
+	goarch    string
+	auditArch string
+}{
+	{"amd64", "AUDIT_ARCH_X86_64"},
+	{"arm64", "AUDIT_ARCH_AARCH64"},
+}
+
+var sysnum = regexp.MustCompile(`^\s*SYS_(\w+)\s*=\s*\d+`)
+
+// renames maps x/sys constant names to the kernel names profiles use.
+var renames = map[string]string{
+	"fstatat": "newfstatat", // arm64
+}
+
+func main() {
+	out, err := exec.Command("go", "list", "-m", "-f", "{{.Dir}}", "golang.org/x/sys").Output()
+	if err != nil {
+		log.Fatalf("locate golang.org/x/sys: %v", err)
+	}
+	dir := filepath.Join(strings.TrimSpace(string(out)), "unix")
+	for _, a := range arches {
+		if err := generate(dir, a.goarch, a.auditArch); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func generate(dir, goarch, auditArch string) error {
+	f, err := os.Open(filepath.Join(dir, "zsysnum_linux_"+goarch+".go"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by \"go run mkseccomp.go\"; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "//go:build linux && %s\n\npackage agent\n\n", goarch)
+	fmt.Fprintf(&buf, "import \"golang.org/x/sys/unix\"\n\n")
+	fmt.Fprintf(&buf, "const seccompAuditArch = unix.%s\n\n", auditArch)
+	fmt.Fprintf(&buf, "var seccompSyscalls = map[string]uint32{\n")
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := sysnum.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		name := strings.ToLower(m[1])
+		if renamed, ok := renames[name]; ok {
+			name = renamed
+		}
+		fmt.Fprintf(&buf, "\t%q: unix.SYS_%s,\n", name, m[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile("seccomp_sysnum_linux_"+goarch+".go", src, 0o644)
+}
@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// resolveExecMounts validates per-exec bind mounts and maps their targets
+// onto the agent's filesystem. Sources must exist; targets are interpreted
+// inside the chroot when one is used, confined to it, and must already exist
+// with the same kind as their source.
+func (s *Server) resolveExecMounts(mounts []mountPayload) ([]execInitMount, error) {
+	resolved := make([]execInitMount, 0, len(mounts))
+	for _, m := range mounts {
+		if !filepath.IsAbs(m.Source) || !filepath.IsAbs(m.Target) {
+			return nil, fmt.Errorf("mount %q on %q: paths must be absolute", m.Source, m.Target)
+		}
+		source := filepath.Clean(m.Source)
+		sourceInfo, err := os.Stat(source)
+		if err != nil {
+			return nil, fmt.Errorf("mount source: %w", err)
+		}
+		target := filepath.Clean(m.Target)
+		if s.rootIsolated() {
+			if target, err = s.resolveRootedPath(filepath.Join(s.rootDir, target)); err != nil {
+				return nil, fmt.Errorf("mount target: %w", err)
+			}
+		}
+		targetInfo, err := os.Stat(target)
+		if err != nil {
+			return nil, fmt.Errorf("mount target: %w", err)
+		}
+		if sourceInfo.IsDir() != targetInfo.IsDir() {
+			return nil, fmt.Errorf("mount %q on %q: source and target must both be files or both be directories", m.Source, m.Target)
+		}
+		resolved = append(resolved, execInitMount{Source: source, Target: target})
+	}
+	return resolved, nil
+}
+
+// resolveExecTmpfs validates per-exec tmpfs mounts and maps their paths onto
+// the agent's filesystem like resolveExecMounts does for targets. Every
+// mount needs a positive size, and paths must be existing directories
+// within the agent's root.
+func (s *Server) resolveExecTmpfs(tmpfs []tmpfsPayload) ([]execInitTmpfs, error) {
+	resolved := make([]execInitTmpfs, 0, len(tmpfs))
+	for _, t := range tmpfs {
+		if !filepath.IsAbs(t.Path) {
+			return nil, fmt.Errorf("tmpfs %q: path must be absolute", t.Path)
+		}
+		if t.SizeBytes <= 0 {
+			return nil, fmt.Errorf("tmpfs %q: size must be positive", t.Path)
+		}
+		target := filepath.Clean(t.Path)
+		if s.rootIsolated() {
+			target = filepath.Join(s.rootDir, target)
+		}
+		target, err := s.resolveRootedPath(target)
+		if err != nil {
+			return nil, fmt.Errorf("tmpfs path: %w", err)
+		}
+		info, err := os.Stat(target)
+		if err != nil {
+			return nil, fmt.Errorf("tmpfs path: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("tmpfs %q: path is not a directory", t.Path)
+		}
+		resolved = append(resolved, execInitTmpfs{Target: target, SizeBytes: t.SizeBytes})
+	}
+	return resolved, nil
+}
@@ -0,0 +1,118 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecReadOnlyMounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root for a mount namespace")
+	}
+	host, sandbox := t.TempDir(), t.TempDir()
+	for path, content := range map[string]string{
+		filepath.Join(host, "app.conf"):        "from the host",
+		filepath.Join(host, "data", "x"):       "host data",
+		filepath.Join(sandbox, "app.conf"):     "placeholder",
+		filepath.Join(sandbox, "data", "keep"): "sandbox data",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mounts := []Mount{
+		{Source: filepath.Join(host, "app.conf"), Target: filepath.Join(sandbox, "app.conf")},
+		{Source: filepath.Join(host, "data"), Target: filepath.Join(sandbox, "data")},
+	}
+
+	script := `cat app.conf; echo; cat data/x; echo; ls data
+echo changed >app.conf && echo wrote app.conf
+touch data/new && echo wrote data/new
+exit 0`
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", script}, WorkingDir: sandbox, Mounts: mounts})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if got, want := string(result.Stdout), "from the host\nhost data\nx\n"; got != want {
+		t.Errorf("stdout = %q, want %q (stderr %q)", got, want, result.Stderr)
+	}
+
+	// The mounts were the command's alone and nothing was written through.
+	for path, want := range map[string]string{
+		filepath.Join(host, "app.conf"):        "from the host",
+		filepath.Join(sandbox, "app.conf"):     "placeholder",
+		filepath.Join(sandbox, "data", "keep"): "sandbox data",
+	} {
+		if got, err := os.ReadFile(path); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", path, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(host, "data", "new")); !os.IsNotExist(err) {
+		t.Errorf("the command wrote through the mount: %v", err)
+	}
+
+	for name, bad := range map[string]Mount{
+		"relative source": {Source: "app.conf", Target: filepath.Join(sandbox, "app.conf")},
+		"missing target":  {Source: filepath.Join(host, "app.conf"), Target: filepath.Join(sandbox, "missing")},
+		"file on a dir":   {Source: filepath.Join(host, "app.conf"), Target: filepath.Join(sandbox, "data")},
+		"missing source":  {Source: filepath.Join(host, "missing"), Target: filepath.Join(sandbox, "app.conf")},
+	} {
+		result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true", Mounts: []Mount{bad}})
+		if err == nil && result.ExitCode == 0 {
+			t.Errorf("%s: the mount was accepted", name)
+		}
+	}
+}
+
+func TestExecTmpfsSizeCap(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root for a mount namespace")
+	}
+	dir := t.TempDir()
+	scratch := filepath.Join(dir, "scratch")
+	if err := os.Mkdir(scratch, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tmpfs := []TmpfsMount{{Path: scratch, SizeBytes: 1 << 20}}
+
+	script := `head -c 524288 /dev/zero >small && echo wrote small
+head -c 2097152 /dev/zero >big && echo wrote big
+du -k big | cut -f1
+exit 0`
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: []string{"-c", script}, WorkingDir: scratch, Tmpfs: tmpfs})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	// The second write stops at the 1 MiB cap, less what the first used.
+	if got, want := string(result.Stdout), "wrote small\n512\n"; got != want {
+		t.Errorf("stdout = %q, want %q (stderr %q)", got, want, result.Stderr)
+	}
+	if entries, err := os.ReadDir(scratch); err != nil || len(entries) != 0 {
+		t.Errorf("the tmpfs contents outlived the command: %v, %v", entries, err)
+	}
+
+	for name, bad := range map[string]TmpfsMount{
+		"zero size":     {Path: scratch},
+		"relative path": {Path: "scratch", SizeBytes: 1 << 20},
+		"missing path":  {Path: filepath.Join(dir, "missing"), SizeBytes: 1 << 20},
+	} {
+		result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true", Tmpfs: []TmpfsMount{bad}})
+		if err == nil && result.ExitCode == 0 {
+			t.Errorf("%s: the tmpfs was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// muxQueueSize is how many frames of one exchange a multiplexed connection
+// buffers before its reader waits for the exchange to catch up.
+const muxQueueSize = 32
+
+// errMuxClosed is returned by the frame source of an exchange that was
+// interrupted or whose connection is gone.
+var errMuxClosed = errors.New("multiplexed exchange closed")
+
+// frameSource yields the frames a client sends during one exchange.
+// interrupt makes a pending or later next fail, so another goroutine can
+// stop the reader.
+type frameSource interface {
+	next() (*rawFrame, error)
+	interrupt()
+}
+
+// connFrames reads frames straight from a connection that serves one
+// exchange at a time.
+type connFrames struct {
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+func (f connFrames) next() (*rawFrame, error) { return readFrame(f.dec) }
+
+func (f connFrames) interrupt() { _ = f.conn.SetReadDeadline(time.Now()) }
+
+// muxFrames holds the frames routed to one exchange of a multiplexed
+// connection.
+type muxFrames struct {
+	frames chan *rawFrame
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newMuxFrames() *muxFrames {
+	return &muxFrames{frames: make(chan *rawFrame, muxQueueSize), stop: make(chan struct{})}
+}
+
+func (f *muxFrames) next() (*rawFrame, error) {
+	select {
+	case frame := <-f.frames:
+		return frame, nil
+	case <-f.stop:
+		return nil, errMuxClosed
+	}
+}
+
+func (f *muxFrames) interrupt() { f.once.Do(func() { close(f.stop) }) }
+
+// deliver queues frame for the exchange, dropping it once the exchange
+// stopped reading.
+func (f *muxFrames) deliver(frame *rawFrame) {
+	select {
+	case f.frames <- frame:
+	case <-f.stop:
+	}
+}
+
+// execInputFrames are the frames a client sends while its exec runs. On a
+// multiplexed connection they may still arrive after the exec finished, and
+// are dropped then.
+var execInputFrames = map[frameType]bool{
+	frameTypeStdinChunk:   true,
+	frameTypeStdinClose:   true,
+	frameTypePauseOutput:  true,
+	frameTypeResumeOutput: true,
+	frameTypeResize:       true,
+	frameTypeSignal:       true,
+	frameTypeExecDone:     true,
+}
+
+// serveMultiplexed serves a connection whose client asked for multiplex in
+// its hello. Every frame carries the ID of its exchange: each exec_request
+// with a new ID runs concurrently with the others, and the frames sent for
+// it afterwards are routed to it by ID. Besides execs only ping is served.
+// A client that stalls one exec's stdin holds up the frames of the others.
+func (s *Server) serveMultiplexed(conn net.Conn, dec *json.Decoder, writer *frameWriter) {
+	var (
+		mu     sync.Mutex
+		routes = make(map[string]*muxFrames)
+		wg     sync.WaitGroup
+	)
+	defer func() {
+		// Commands keep running to completion, as they do when a
+		// single-exec connection drops, but their stdin closes.
+		mu.Lock()
+		for _, route := range routes {
+			route.interrupt()
+		}
+		mu.Unlock()
+		wg.Wait()
+	}()
+
+	for {
+		frame, err := readFrame(dec)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.Printf("frame error: %v", err)
+			}
+			return
+		}
+		if frame.ID == "" {
+			_ = writer.send(frameTypeError, errorPayload{Message: "multiplexed frame has no id"})
+			return
+		}
+
+		mu.Lock()
+		route := routes[frame.ID]
+		mu.Unlock()
+		if route != nil {
+			route.deliver(frame)
+			continue
+		}
+
+		reply := writer.withID(frame.ID)
+		switch frame.Type {
+		case frameTypePing:
+			_ = reply.send(frameTypePong, pongPayload{Timestamp: time.Now()})
+		case frameTypeExecRequest:
+			var payload execRequestPayload
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				_ = reply.send(frameTypeError, errorPayload{Message: err.Error()})
+				continue
+			}
+			if payload.Detach || payload.StdioFD {
+				_ = reply.send(frameTypeError, errorPayload{
+					Message: "detached execs and passed descriptors need a connection of their own",
+					Code:    errorCodeUnsupported,
+				})
+				continue
+			}
+			route = newMuxFrames()
+			mu.Lock()
+			routes[frame.ID] = route
+			mu.Unlock()
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				s.runExec(conn, route, reply, payload, false)
+				// Execs refused before they read any frames leave the
+				// route open; stop it so deliver cannot block on it.
+				route.interrupt()
+				mu.Lock()
+				delete(routes, id)
+				mu.Unlock()
+			}(frame.ID)
+		default:
+			if execInputFrames[frame.Type] {
+				continue
+			}
+			_ = reply.send(frameTypeError, errorPayload{Message: unsupportedFrameMessage, Code: errorCodeUnsupported})
+		}
+	}
+}
+
+// muxConn is the client side of a multiplexed connection. A reader
+// goroutine routes incoming frames to the exchange named by their ID.
+type muxConn struct {
+	conn   net.Conn
+	writer *frameWriter
+
+	mu      sync.Mutex
+	streams map[string]*muxStream
+	nextID  uint64
+	err     error // why the reader stopped
+}
+
+// muxStream receives the frames of one exchange on a muxConn.
+type muxStream struct {
+	mc     *muxConn
+	id     string
+	frames chan *rawFrame
+	done   chan struct{} // closed by close or when the connection fails
+	once   sync.Once
+}
+
+// multiplexed returns the client's shared multiplexed connection for cmd,
+// dialing it on first use. It returns nil when multiplexing is off, cmd
+// needs a connection of its own, or the agent does not multiplex.
+func (c *IPCClient) multiplexed(ctx context.Context, cmd *CommandRequest) (*muxConn, error) {
+	if !c.Multiplex || cmd.Detach || cmd.Reconnect != nil || cmd.Stdio != nil {
+		return nil, nil
+	}
+	c.muxMu.Lock()
+	defer c.muxMu.Unlock()
+	if c.noMux {
+		return nil, nil
+	}
+	if c.mux != nil && !c.mux.failed() {
+		return c.mux, nil
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	dec := json.NewDecoder(conn)
+	writer := newFrameWriter(conn)
+	hello := helloPayload{ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion, Multiplex: true}
+	if err := writer.send(frameTypeHello, hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	frame, err := readFrame(dec)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := busyError(frame); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply helloPayload
+	if frame.Type != frameTypeHello || json.Unmarshal(frame.Payload, &reply) != nil || !reply.Multiplex {
+		// The agent predates multiplexing; give every exec its own
+		// connection from now on.
+		conn.Close()
+		c.noMux = true
+		return nil, nil
+	}
+
+	c.mux = &muxConn{conn: conn, writer: writer, streams: make(map[string]*muxStream)}
+	go c.mux.read(dec)
+	return c.mux, nil
+}
+
+// read routes frames to their exchanges until the connection fails. Frames
+// for exchanges that were already closed are dropped.
+func (mc *muxConn) read(dec *json.Decoder) {
+	for {
+		frame, err := readFrame(dec)
+		if err != nil {
+			mc.fail(err)
+			return
+		}
+		mc.mu.Lock()
+		stream := mc.streams[frame.ID]
+		mc.mu.Unlock()
+		if stream == nil {
+			continue
+		}
+		select {
+		case stream.frames <- frame:
+		case <-stream.done:
+		}
+	}
+}
+
+// fail closes the connection and ends every open exchange with err.
+func (mc *muxConn) fail(err error) {
+	mc.conn.Close()
+	mc.mu.Lock()
+	if mc.err == nil {
+		mc.err = err
+	}
+	streams := mc.streams
+	mc.streams = nil
+	mc.mu.Unlock()
+	for _, stream := range streams {
+		stream.once.Do(func() { close(stream.done) })
+	}
+}
+
+func (mc *muxConn) failed() bool {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	return mc.err != nil
+}
+
+// open starts an exchange, returning its stream and a writer that tags
+// frames with its ID.
+func (mc *muxConn) open() (*muxStream, *frameWriter, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if mc.err != nil {
+		return nil, nil, fmt.Errorf("multiplexed connection: %w", mc.err)
+	}
+	mc.nextID++
+	id := strconv.FormatUint(mc.nextID, 10)
+	stream := &muxStream{mc: mc, id: id, frames: make(chan *rawFrame, muxQueueSize), done: make(chan struct{})}
+	mc.streams[id] = stream
+	return stream, mc.writer.withID(id), nil
+}
+
+// next returns the exchange's next frame. Frames that arrived before the
+// connection failed are still returned.
+func (s *muxStream) next(ctx context.Context) (*rawFrame, error) {
+	select {
+	case frame := <-s.frames:
+		return frame, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.done:
+		select {
+		case frame := <-s.frames:
+			return frame, nil
+		default:
+		}
+		s.mc.mu.Lock()
+		err := s.mc.err
+		s.mc.mu.Unlock()
+		if err == nil {
+			err = errMuxClosed
+		}
+		return nil, err
+	}
+}
+
+// close ends the exchange; the agent's later frames for it are dropped.
+func (s *muxStream) close() {
+	s.mc.mu.Lock()
+	if s.mc.streams != nil {
+		delete(s.mc.streams, s.id)
+	}
+	s.mc.mu.Unlock()
+	s.once.Do(func() { close(s.done) })
+}
+
+// execMultiplexed runs cmd as one exchange on mc.
+func (c *IPCClient) execMultiplexed(ctx context.Context, mc *muxConn, cmd *CommandRequest) (*CommandResult, error) {
+	win, err := c.stdinWindow(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer win.close()
+	stream, writer, err := mc.open()
+	if err != nil {
+		return nil, err
+	}
+	defer stream.close()
+	if err := c.sendExecRequest(ctx, nil, writer, cmd, win, false, false); err != nil {
+		return nil, err
+	}
+	return c.readExecResult(ctx, func() (*rawFrame, error) { return stream.next(ctx) }, cmd, win)
+}
+
+// execStreamMultiplexed streams cmd as one exchange on mc.
+func (c *IPCClient) execStreamMultiplexed(ctx context.Context, mc *muxConn, cmd *CommandRequest) (*CommandStream, error) {
+	win, err := c.stdinWindow(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	stream, writer, err := mc.open()
+	if err != nil {
+		return nil, err
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	if err := c.sendExecRequest(streamCtx, nil, writer, cmd, win, true, false); err != nil {
+		cancel()
+		stream.close()
+		return nil, err
+	}
+	fwd := &streamForwarder{client: c, mux: stream, control: writer, stdin: win}
+	return fwd.start(streamCtx, cancel), nil
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// IsolationMode selects how the agent isolates the commands it runs.
+type IsolationMode string
+
+const (
+	// IsolationNone runs commands directly, relying on path validation
+	// when a root directory is set.
+	IsolationNone IsolationMode = "none"
+	// IsolationChroot confines commands to the root directory with
+	// chroot(2). The agent must run as root.
+	IsolationChroot IsolationMode = "chroot"
+	// IsolationNamespaces runs each command in new mount, PID, UTS and IPC
+	// namespaces, confined to the root directory when one is set.
+	// Unprivileged agents add a user namespace mapping their own uid and
+	// gid. Linux only.
+	IsolationNamespaces IsolationMode = "namespaces"
+)
+
+// ErrNamespacesUnavailable is returned when namespace isolation cannot be
+// used on the host, typically because unprivileged user namespaces are
+// disabled.
+var ErrNamespacesUnavailable = errors.New("namespace isolation unavailable")
+
+// NamespaceExecutor prepares commands to run in fresh namespaces, so they
+// cannot signal the agent's other processes and their mounts and hostname
+// changes stay private. The command is PID 1 of its namespace; /proc is not
+// remounted, so it still lists the agent's processes unless the root
+// directory provides its own.
+type NamespaceExecutor struct {
+	rootDir string
+}
+
+// NewNamespaceExecutor checks that the host allows the namespaces the agent
+// needs. A non-empty rootDir additionally confines commands to it.
+func NewNamespaceExecutor(rootDir string) (*NamespaceExecutor, error) {
+	if rootDir != "" {
+		abs, err := filepath.Abs(rootDir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid root directory: %w", err)
+		}
+		if _, err := os.Stat(abs); err != nil {
+			return nil, fmt.Errorf("root directory does not exist: %w", err)
+		}
+		rootDir = abs
+	}
+	if err := checkNamespaces(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNamespacesUnavailable, err)
+	}
+	return &NamespaceExecutor{rootDir: rootDir}, nil
+}
+
+// PrepareCommand sets cmd up to start in new namespaces, and inside the root
+// directory when there is one, with workDir translated to a path below it.
+func (ne *NamespaceExecutor) PrepareCommand(cmd *exec.Cmd, workDir string) error {
+	if err := ne.prepare(cmd); err != nil {
+		return err
+	}
+	if ne.rootDir == "" {
+		return nil
+	}
+	cmd.SysProcAttr.Chroot = ne.rootDir
+	cmd.Dir = "/"
+	if workDir != "" {
+		if rel, err := filepath.Rel(ne.rootDir, workDir); err == nil && filepath.IsLocal(rel) {
+			cmd.Dir = "/" + filepath.ToSlash(rel)
+		}
+	}
+	return nil
+}
+
+// startError explains a failure to start a command in new namespaces.
+func (ne *NamespaceExecutor) startError(err error) error {
+	if errors.Is(err, os.ErrPermission) || errors.Is(err, errNamespaceLimit) {
+		return fmt.Errorf("%w: %v (are unprivileged user namespaces disabled on this host?)", ErrNamespacesUnavailable, err)
+	}
+	return err
+}
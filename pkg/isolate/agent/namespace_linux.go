@@ -0,0 +1,57 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// errNamespaceLimit is what clone(2) fails with when the user namespace
+// limit is zero.
+var errNamespaceLimit = syscall.ENOSPC
+
+const namespaceCloneFlags = syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+
+// checkNamespaces reports host settings that rule out the user namespace an
+// unprivileged agent needs. Root needs none.
+func checkNamespaces() error {
+	if os.Geteuid() == 0 {
+		return nil
+	}
+	if readSysctl("kernel/unprivileged_userns_clone") == "0" {
+		return fmt.Errorf("kernel.unprivileged_userns_clone is 0")
+	}
+	if readSysctl("user/max_user_namespaces") == "0" {
+		return fmt.Errorf("user.max_user_namespaces is 0")
+	}
+	return nil
+}
+
+func readSysctl(name string) string {
+	data, err := os.ReadFile("/proc/sys/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (ne *NamespaceExecutor) prepare(cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+	// The command is init of its PID namespace, so anything it leaves
+	// running is killed when it exits.
+	attr.Cloneflags |= namespaceCloneFlags
+	if os.Geteuid() != 0 {
+		uid, gid := os.Getuid(), os.Getgid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errNamespaceLimit = errors.New("namespace limit reached")
+
+func checkNamespaces() error {
+	return errors.New("namespaces require linux")
+}
+
+func (ne *NamespaceExecutor) prepare(cmd *exec.Cmd) error {
+	return errors.New("namespaces require linux")
+}
@@ -0,0 +1,217 @@
+//go:build linux
+
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Just enough netlink to plumb the links of egress-restricted execs:
+// rtnetlink for links, addresses and routes, and nfnetlink for the
+// nftables filter on the host end.
+
+const (
+	nlaFNested        = 0x8000
+	iflaInfoKind      = 1
+	iflaInfoData      = 2
+	vethInfoPeer      = 1
+	netlinkAckTimeout = 5 * time.Second
+)
+
+// nlMessage builds a netlink message: the header, a family specific header
+// and attributes, nested ones included.
+type nlMessage struct {
+	buf []byte
+}
+
+func newNLMessage(typ, flags uint16, header []byte) *nlMessage {
+	m := &nlMessage{buf: make([]byte, syscall.NLMSG_HDRLEN, 256)}
+	binary.NativeEndian.PutUint16(m.buf[4:], typ)
+	binary.NativeEndian.PutUint16(m.buf[6:], flags|syscall.NLM_F_REQUEST)
+	m.raw(header)
+	return m
+}
+
+// raw appends data as is, padded to the netlink alignment.
+func (m *nlMessage) raw(data []byte) {
+	m.buf = append(m.buf, data...)
+	for len(m.buf)%syscall.NLMSG_ALIGNTO != 0 {
+		m.buf = append(m.buf, 0)
+	}
+}
+
+func (m *nlMessage) attr(typ uint16, data []byte) {
+	m.buf = binary.NativeEndian.AppendUint16(m.buf, uint16(syscall.SizeofRtAttr+len(data)))
+	m.buf = binary.NativeEndian.AppendUint16(m.buf, typ)
+	m.raw(data)
+}
+
+func (m *nlMessage) attrString(typ uint16, s string) { m.attr(typ, append([]byte(s), 0)) }
+
+func (m *nlMessage) attrUint32(typ uint16, v uint32) {
+	m.attr(typ, binary.NativeEndian.AppendUint32(nil, v))
+}
+
+// attrBE32 appends a big-endian value, as nftables expects most integers.
+func (m *nlMessage) attrBE32(typ uint16, v uint32) {
+	m.attr(typ, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// nest appends attribute typ holding whatever fill appends.
+func (m *nlMessage) nest(typ uint16, fill func()) {
+	start := len(m.buf)
+	m.attr(typ, nil)
+	fill()
+	binary.NativeEndian.PutUint16(m.buf[start:], uint16(len(m.buf)-start))
+}
+
+func (m *nlMessage) flags() uint16 { return binary.NativeEndian.Uint16(m.buf[6:]) }
+
+func (m *nlMessage) bytes(seq uint32) []byte {
+	binary.NativeEndian.PutUint32(m.buf[0:], uint32(len(m.buf)))
+	binary.NativeEndian.PutUint32(m.buf[8:], seq)
+	return m.buf
+}
+
+// nlSocket is a netlink socket of one protocol, bound in the calling
+// thread's network namespace.
+type nlSocket struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlink(protocol int) (*nlSocket, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	// Never wait forever for an acknowledgement the kernel will not send.
+	timeout := syscall.NsecToTimeval(netlinkAckTimeout.Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+	return &nlSocket{fd: fd}, nil
+}
+
+func (s *nlSocket) close() { _ = syscall.Close(s.fd) }
+
+// exec sends msgs in a single write and waits until the kernel has
+// acknowledged each one flagged NLM_F_ACK, returning the first error it
+// reports instead.
+func (s *nlSocket) exec(msgs ...*nlMessage) error {
+	var buf []byte
+	pending := make(map[uint32]bool)
+	for _, m := range msgs {
+		s.seq++
+		buf = append(buf, m.bytes(s.seq)...)
+		if m.flags()&syscall.NLM_F_ACK != 0 {
+			pending[s.seq] = true
+		}
+	}
+	if err := syscall.Sendto(s.fd, buf, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return err
+	}
+	reply := make([]byte, 64<<10)
+	for len(pending) > 0 {
+		n, _, err := syscall.Recvfrom(s.fd, reply, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(reply[:n])
+		if err != nil {
+			return err
+		}
+		for _, r := range replies {
+			if r.Header.Type != syscall.NLMSG_ERROR || len(r.Data) < 4 {
+				continue
+			}
+			if errno := -int32(binary.NativeEndian.Uint32(r.Data)); errno != 0 {
+				return syscall.Errno(errno)
+			}
+			delete(pending, r.Header.Seq)
+		}
+	}
+	return nil
+}
+
+// ifInfo renders a struct ifinfomsg.
+func ifInfo(index int, flags, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(b[4:], uint32(index))
+	binary.NativeEndian.PutUint32(b[8:], flags)
+	binary.NativeEndian.PutUint32(b[12:], change)
+	return b
+}
+
+// addVethPair creates the veth pair name and peer in the socket's namespace.
+func (s *nlSocket) addVethPair(name, peer string) error {
+	m := newNLMessage(syscall.RTM_NEWLINK, syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifInfo(0, 0, 0))
+	m.attrString(syscall.IFLA_IFNAME, name)
+	m.nest(syscall.IFLA_LINKINFO, func() {
+		m.attrString(iflaInfoKind, "veth")
+		m.nest(iflaInfoData, func() {
+			m.nest(vethInfoPeer, func() {
+				m.raw(ifInfo(0, 0, 0))
+				m.attrString(syscall.IFLA_IFNAME, peer)
+			})
+		})
+	})
+	return s.exec(m)
+}
+
+func (s *nlSocket) deleteLink(index int) error {
+	return s.exec(newNLMessage(syscall.RTM_DELLINK, syscall.NLM_F_ACK, ifInfo(index, 0, 0)))
+}
+
+func (s *nlSocket) setLinkUp(index int) error {
+	return s.exec(newNLMessage(syscall.RTM_NEWLINK, syscall.NLM_F_ACK, ifInfo(index, syscall.IFF_UP, syscall.IFF_UP)))
+}
+
+func (s *nlSocket) renameLink(index int, name string) error {
+	m := newNLMessage(syscall.RTM_NEWLINK, syscall.NLM_F_ACK, ifInfo(index, 0, 0))
+	m.attrString(syscall.IFLA_IFNAME, name)
+	return s.exec(m)
+}
+
+// moveLink moves a link into the network namespace of process pid.
+func (s *nlSocket) moveLink(index, pid int) error {
+	m := newNLMessage(syscall.RTM_NEWLINK, syscall.NLM_F_ACK, ifInfo(index, 0, 0))
+	m.attrUint32(syscall.IFLA_NET_NS_PID, uint32(pid))
+	return s.exec(m)
+}
+
+// addAddress assigns the IPv4 address and prefix of addr to a link.
+func (s *nlSocket) addAddress(index int, addr *net.IPNet) error {
+	ones, _ := addr.Mask.Size()
+	header := make([]byte, syscall.SizeofIfAddrmsg)
+	header[0] = syscall.AF_INET
+	header[1] = byte(ones)
+	binary.NativeEndian.PutUint32(header[4:], uint32(index))
+	m := newNLMessage(syscall.RTM_NEWADDR, syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, header)
+	m.attr(syscall.IFA_LOCAL, addr.IP.To4())
+	m.attr(syscall.IFA_ADDRESS, addr.IP.To4())
+	return s.exec(m)
+}
+
+// addDefaultRoute routes everything not on a link through gateway.
+func (s *nlSocket) addDefaultRoute(index int, gateway net.IP) error {
+	header := make([]byte, syscall.SizeofRtMsg)
+	header[0] = syscall.AF_INET
+	header[4] = syscall.RT_TABLE_MAIN
+	header[5] = syscall.RTPROT_BOOT
+	header[6] = syscall.RT_SCOPE_UNIVERSE
+	header[7] = syscall.RTN_UNICAST
+	m := newNLMessage(syscall.RTM_NEWROUTE, syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, header)
+	m.attr(syscall.RTA_GATEWAY, gateway.To4())
+	m.attrUint32(syscall.RTA_OIF, uint32(index))
+	return s.exec(m)
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"context"
 	"io"
+	"syscall"
 )
 
 // NopClient satisfies the Client interface while returning ErrUnavailable for
@@ -31,8 +32,60 @@ func (n *NopClient) CopyTo(ctx context.Context, reader io.Reader, dst string) er
 	return ErrUnavailable
 }
 
+func (n *NopClient) CopyDirTo(ctx context.Context, srcDir, dst string, progress func(CopyProgress)) error {
+	return ErrUnavailable
+}
+
 func (n *NopClient) CopyFrom(ctx context.Context, src string, writer io.Writer) error {
 	return ErrUnavailable
 }
 
+func (n *NopClient) CopyArchiveFrom(ctx context.Context, srcDir string, format ArchiveFormat, writer io.Writer) error {
+	return ErrUnavailable
+}
+
+func (n *NopClient) ImportArchive(ctx context.Context, reader io.Reader) error {
+	return ErrUnavailable
+}
+
+func (n *NopClient) Attach(ctx context.Context, jobID string) (*CommandStream, error) {
+	return nil, ErrUnavailable
+}
+
+func (n *NopClient) CheckSpace(ctx context.Context, path string, needBytes int64) (bool, *DiskUsage, error) {
+	return false, nil, ErrUnavailable
+}
+
+func (n *NopClient) Which(ctx context.Context, name string) (string, error) {
+	return "", ErrUnavailable
+}
+
+func (n *NopClient) Chown(ctx context.Context, path string, uid, gid int) error {
+	return ErrUnavailable
+}
+
+func (n *NopClient) SubscribeLogs(ctx context.Context, token string) (<-chan string, error) {
+	return nil, ErrUnavailable
+}
+
+func (n *NopClient) Capabilities(ctx context.Context) (*Capabilities, error) {
+	return nil, ErrUnavailable
+}
+
+func (n *NopClient) Info(ctx context.Context) (*AgentInfo, error) {
+	return nil, ErrUnavailable
+}
+
+func (n *NopClient) ProcessStats(ctx context.Context) (*ProcessStats, error) {
+	return nil, ErrUnavailable
+}
+
+func (n *NopClient) Logs(ctx context.Context, execID string, tailBytes int) ([]byte, error) {
+	return nil, ErrUnavailable
+}
+
+func (n *NopClient) SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error {
+	return ErrUnavailable
+}
+
 func (n *NopClient) Close() error { return nil }
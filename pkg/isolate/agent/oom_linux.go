@@ -0,0 +1,23 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+const (
+	minOOMScoreAdj = -1000
+	maxOOMScoreAdj = 1000
+)
+
+// setOOMScoreAdj writes adj, clamped to the kernel's range, to the process's
+// oom_score_adj. Lowering the value below the agent's own needs
+// CAP_SYS_RESOURCE.
+func setOOMScoreAdj(pid, adj int) error {
+	adj = min(max(adj, minOOMScoreAdj), maxOOMScoreAdj)
+	path := fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	return os.WriteFile(path, []byte(strconv.Itoa(adj)), 0)
+}
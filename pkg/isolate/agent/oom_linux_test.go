@@ -0,0 +1,62 @@
+//go:build linux
+
+package agent
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecOOMScoreAdj(t *testing.T) {
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	inherited := ownOOMScoreAdj(t)
+	// Lowering the score needs CAP_SYS_RESOURCE; without it the request is
+	// ignored and the command keeps the agent's value.
+	lowered := inherited
+	if exec.Command("/bin/sh", "-c", "echo -1 >/proc/self/oom_score_adj").Run() == nil {
+		lowered = -1000
+	}
+	tests := []struct{ adj, want int }{
+		{500, 500},
+		{5000, 1000}, // clamped
+		{-5000, lowered},
+	}
+	for _, tt := range tests {
+		// The value is written right after the command starts, so read it
+		// from a later child, which inherits it.
+		result, err := client.Exec(ctx, &CommandRequest{
+			Path:        "/bin/sh",
+			Args:        []string{"-c", "sleep 0.2; cat /proc/self/oom_score_adj"},
+			OOMScoreAdj: tt.adj,
+		})
+		if err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+		got, err := strconv.Atoi(strings.TrimSpace(string(result.Stdout)))
+		if err != nil || result.ExitCode != 0 || got != tt.want {
+			t.Errorf("OOMScoreAdj %d: oom_score_adj = %q, want %d", tt.adj, result.Stdout, tt.want)
+		}
+	}
+}
+
+// ownOOMScoreAdj is the test process's oom_score_adj, which execs inherit.
+func ownOOMScoreAdj(t *testing.T) int {
+	t.Helper()
+	data, err := os.ReadFile("/proc/self/oom_score_adj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adj, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return adj
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package agent
+
+// setOOMScoreAdj is a no-op outside Linux, which has no oom_score_adj.
+func setOOMScoreAdj(pid, adj int) error {
+	return nil
+}
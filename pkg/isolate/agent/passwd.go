@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// passwdEntry is the subset of an /etc/passwd record used to build a login
+// environment.
+type passwdEntry struct {
+	Name  string
+	UID   int
+	GID   int
+	Home  string
+	Shell string
+}
+
+// lookupPasswd finds the passwd record for spec, which may be a user name or
+// a numeric uid, optionally followed by ":group". root selects the passwd file
+// of a chroot; empty means the agent's own /etc/passwd.
+func lookupPasswd(root, spec string) (*passwdEntry, error) {
+	name, _, _ := strings.Cut(spec, ":")
+	if name == "" {
+		return nil, fmt.Errorf("invalid user %q", spec)
+	}
+	uid, numErr := strconv.Atoi(name)
+
+	f, err := os.Open(filepath.Join(root, "/etc/passwd"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:uid:gid:gecos:home:shell
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 {
+			continue
+		}
+		entryUID, err := strconv.Atoi(fields[2])
+		if err != nil {
+			continue
+		}
+		if fields[0] != name && (numErr != nil || entryUID != uid) {
+			continue
+		}
+		entryGID, _ := strconv.Atoi(fields[3])
+		return &passwdEntry{
+			Name:  fields[0],
+			UID:   entryUID,
+			GID:   entryGID,
+			Home:  fields[5],
+			Shell: fields[6],
+		}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("user %q not found in passwd database", name)
+}
+
+// loginEnv returns the variables login(1) would set for the user.
+func (e *passwdEntry) loginEnv() map[string]string {
+	shell := e.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	env := map[string]string{
+		"USER":    e.Name,
+		"LOGNAME": e.Name,
+		"SHELL":   shell,
+	}
+	if e.Home != "" {
+		env["HOME"] = e.Home
+	}
+	return env
+}
+
+// userEnv seeds HOME, SHELL, USER and LOGNAME from the passwd entry of user
+// underneath env, so values sent by the client still win. An empty env means
+// the child inherits the agent's environment, so the seeded values are layered
+// over that instead. Lookup failures are logged and leave env unchanged.
+func (s *Server) userEnv(user string, env map[string]string) map[string]string {
+	root := ""
+	if s.rootIsolated() {
+		root = s.rootDir
+	}
+	entry, err := lookupPasswd(root, user)
+	if err != nil {
+		s.logger.Printf("WARNING: no login environment for user %q: %v", user, err)
+		return env
+	}
+	base := entry.loginEnv()
+	if len(env) == 0 {
+		base = mergeEnv(environMap(), base)
+	}
+	return mergeEnv(base, env)
+}
+
+func environMap() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
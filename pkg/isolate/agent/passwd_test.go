@@ -0,0 +1,73 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLookupPasswd(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	passwd := "# comment\n\nroot:x:0:0:root:/root:/bin/bash\nbroken:x:1\napp:x:1000:1001:App:/home/app:\n"
+	if err := os.WriteFile(filepath.Join(root, "etc", "passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := passwdEntry{Name: "app", UID: 1000, GID: 1001, Home: "/home/app"}
+	for _, spec := range []string{"app", "1000", "app:wheel", "1000:1000"} {
+		entry, err := lookupPasswd(root, spec)
+		if err != nil || *entry != want {
+			t.Errorf("lookupPasswd(%q) = %+v, %v; want %+v", spec, entry, err, want)
+		}
+	}
+	for _, spec := range []string{"broken", "nobody", "1", ":wheel"} {
+		if entry, err := lookupPasswd(root, spec); err == nil {
+			t.Errorf("lookupPasswd(%q) = %+v, want an error", spec, entry)
+		}
+	}
+}
+
+func TestExecUserLoginEnv(t *testing.T) {
+	// Only root can switch to another account; others run as themselves.
+	name := "daemon"
+	if os.Geteuid() != 0 {
+		current, err := user.Current()
+		if err != nil {
+			t.Skip(err)
+		}
+		name = current.Username
+	}
+	account, err := user.Lookup(name)
+	if err != nil {
+		t.Skipf("no %s account: %v", name, err)
+	}
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	script := []string{"-c", `echo "$HOME|$USER|$LOGNAME"`}
+
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: script, User: name, WorkingDir: "/"})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	want := account.HomeDir + "|" + name + "|" + name
+	if got := strings.TrimSpace(string(result.Stdout)); got != want {
+		t.Errorf("login env = %q, want %q (stderr %q)", got, want, result.Stderr)
+	}
+
+	// Variables sent with the request win over the passwd entry.
+	result, err = client.Exec(ctx, &CommandRequest{Path: "/bin/sh", Args: script, User: name, WorkingDir: "/", Env: map[string]string{"HOME": "/custom"}})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	want = "/custom|" + name + "|" + name
+	if got := strings.TrimSpace(string(result.Stdout)); got != want {
+		t.Errorf("login env with HOME set = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// execDoneTimeout bounds how long the agent waits for a keep-alive client to
+// acknowledge an exec result before closing the connection.
+const execDoneTimeout = 10 * time.Second
+
+// poolConn is a connection with the framing state that must survive between
+// requests on it.
+type poolConn struct {
+	net.Conn
+	dec       *json.Decoder
+	writer    *frameWriter
+	keepAlive bool // the agent agreed to serve more requests
+	reused    bool // taken from the idle pool
+}
+
+func newPoolConn(conn net.Conn) *poolConn {
+	return &poolConn{Conn: conn, dec: json.NewDecoder(conn), writer: newFrameWriter(conn)}
+}
+
+// acquire returns a connection for one request: an idle pooled connection
+// that is still alive, or a new one. With pooling enabled, new connections
+// open with a keep-alive hello; agents that refuse it are remembered and
+// served one-shot connections.
+func (c *IPCClient) acquire(ctx context.Context) (*poolConn, error) {
+	if c.PoolSize <= 0 {
+		conn, err := c.dial(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return newPoolConn(conn), nil
+	}
+	for {
+		pc := c.popIdle()
+		if pc == nil {
+			break
+		}
+		if connAlive(pc.Conn) {
+			pc.reused = true
+			return pc, nil
+		}
+		pc.Close()
+	}
+	return c.dialKeepAlive(ctx)
+}
+
+func (c *IPCClient) dialKeepAlive(ctx context.Context) (*poolConn, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pc := newPoolConn(conn)
+	c.poolMu.Lock()
+	refused := c.noKeepAlive
+	c.poolMu.Unlock()
+	if refused {
+		return pc, nil
+	}
+
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+	hello := helloPayload{ProtocolVersion: ProtocolVersion, MinProtocolVersion: MinProtocolVersion, KeepAlive: true}
+	if err := pc.writer.send(frameTypeHello, hello); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	frame, err := readFrame(pc.dec)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if err := busyError(frame); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	var reply helloPayload
+	if frame.Type == frameTypeHello && json.Unmarshal(frame.Payload, &reply) == nil && reply.KeepAlive {
+		pc.keepAlive = true
+		return pc, nil
+	}
+	// The agent predates keep-alive, or refused the hello and closed the
+	// connection; fall back to one-shot connections from now on.
+	c.poolMu.Lock()
+	c.noKeepAlive = true
+	c.poolMu.Unlock()
+	if frame.Type == frameTypeHello {
+		return pc, nil
+	}
+	pc.Close()
+	conn, err = c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newPoolConn(conn), nil
+}
+
+func (c *IPCClient) popIdle() *poolConn {
+	c.poolMu.Lock()
+	defer c.poolMu.Unlock()
+	n := len(c.idle)
+	if n == 0 {
+		return nil
+	}
+	pc := c.idle[n-1]
+	c.idle = c.idle[:n-1]
+	return pc
+}
+
+// release returns pc to the idle pool when its request completed cleanly and
+// there is room, and closes it otherwise.
+func (c *IPCClient) release(pc *poolConn, ok bool) {
+	if ok && pc.keepAlive {
+		c.poolMu.Lock()
+		if !c.closed && len(c.idle) < c.PoolSize {
+			c.idle = append(c.idle, pc)
+			c.poolMu.Unlock()
+			return
+		}
+		c.poolMu.Unlock()
+	}
+	pc.Close()
+}
+
+// roundTrip sends req on a connection from acquire and lets handle finish
+// the exchange. A pooled connection that fails to take the request is
+// replaced by a new one, since the agent cannot have seen it. The
+// connection goes back to the pool only if handle succeeds.
+func (c *IPCClient) roundTrip(ctx context.Context, reqType frameType, req any, handle func(*poolConn) error) error {
+	pc, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	if err := pc.writer.send(reqType, req); err != nil {
+		pc.Close()
+		if !pc.reused {
+			return err
+		}
+		if pc, err = c.dialKeepAlive(ctx); err != nil {
+			return err
+		}
+		if err := pc.writer.send(reqType, req); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	err = handle(pc)
+	// stop fails once the context has closed the connection.
+	c.release(pc, stop() && err == nil)
+	return err
+}
+
+// connAlive reports whether an idle connection is still open: the agent
+// sends nothing between requests, so a read that does not time out means
+// the connection was closed or is out of step.
+func connAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now()); err != nil {
+		return false
+	}
+	var buf [1]byte
+	_, err := conn.Read(buf[:])
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// Close closes the idle pooled connections and the multiplexed connection.
+// Requests still in flight on pooled connections finish normally, but their
+// connections are closed rather than pooled; execs in flight on the
+// multiplexed connection fail.
+func (c *IPCClient) Close() error {
+	c.poolMu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.closed = true
+	c.poolMu.Unlock()
+	for _, pc := range idle {
+		pc.Close()
+	}
+	c.muxMu.Lock()
+	if c.mux != nil {
+		c.mux.fail(net.ErrClosed)
+		c.mux = nil
+	}
+	c.muxMu.Unlock()
+	return nil
+}
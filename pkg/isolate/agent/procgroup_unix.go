@@ -0,0 +1,33 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// killGroupOnCancel starts cmd in a process group of its own and makes the
+// cancellation of its context SIGKILL the whole group, so children it forked
+// do not outlive it. A command that starts a session already leads a group.
+func killGroupOnCancel(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !cmd.SysProcAttr.Setsid {
+		cmd.SysProcAttr.Setpgid = true
+	}
+	cmd.Cancel = func() error { return signalGroup(cmd.Process, syscall.SIGKILL) }
+}
+
+// signalGroup sends sig to the process group p leads, reporting
+// os.ErrProcessDone once the group is gone.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	err := syscall.Kill(-p.Pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
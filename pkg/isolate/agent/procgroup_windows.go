@@ -0,0 +1,18 @@
+//go:build windows
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// killGroupOnCancel keeps the default cancellation, which kills only the
+// command itself.
+func killGroupOnCancel(cmd *exec.Cmd) {}
+
+// signalGroup signals just p; Windows can only kill it.
+func signalGroup(p *os.Process, sig syscall.Signal) error {
+	return p.Signal(sig)
+}
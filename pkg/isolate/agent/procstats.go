@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ProcessStats aggregates the resource use of the commands an agent is
+// running, each counted with its descendants.
+type ProcessStats struct {
+	// Processes is the number of running execs sampled.
+	Processes int
+	// CPUPercent is the CPU the execs used since the previous sample, or
+	// since they started; 100 is one fully used CPU.
+	CPUPercent float64
+	RSSBytes   uint64
+	// ReadBytes and WriteBytes are the bytes the running execs made storage
+	// read and write. They stay zero where the platform does not count them.
+	ReadBytes  uint64
+	WriteBytes uint64
+}
+
+type processStatsPayload struct {
+	Processes  int     `json:"processes"`
+	CPUPercent float64 `json:"cpu_percent"`
+	RSSBytes   uint64  `json:"rss_bytes"`
+	ReadBytes  uint64  `json:"read_bytes,omitempty"`
+	WriteBytes uint64  `json:"write_bytes,omitempty"`
+}
+
+// errUnsupportedSampling is returned where the agent knows no way to
+// measure its processes.
+var errUnsupportedSampling = errors.New("process sampling is not supported on this platform")
+
+// procSample is what sampleProcess reads for a process and its descendants.
+type procSample struct {
+	cpu        time.Duration
+	rss        uint64
+	readBytes  uint64
+	writeBytes uint64
+}
+
+// processTracker keeps the pids of running execs so their resource use can
+// be sampled, along with the CPU time each had used at its previous sample.
+type processTracker struct {
+	mu    sync.Mutex
+	procs map[int]*trackedProcess
+}
+
+type trackedProcess struct {
+	sampledAt time.Time
+	cpu       time.Duration
+}
+
+func newProcessTracker() *processTracker {
+	return &processTracker{procs: make(map[int]*trackedProcess)}
+}
+
+func (t *processTracker) add(pid int) {
+	t.mu.Lock()
+	t.procs[pid] = &trackedProcess{sampledAt: time.Now()}
+	t.mu.Unlock()
+}
+
+func (t *processTracker) remove(pid int) {
+	t.mu.Lock()
+	delete(t.procs, pid)
+	t.mu.Unlock()
+}
+
+// sample measures every tracked process. Processes that exit while being
+// sampled are left out.
+func (t *processTracker) sample() *ProcessStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := &ProcessStats{}
+	now := time.Now()
+	for pid, proc := range t.procs {
+		s, err := sampleProcess(pid)
+		if err != nil {
+			continue
+		}
+		stats.Processes++
+		stats.RSSBytes += s.rss
+		stats.ReadBytes += s.readBytes
+		stats.WriteBytes += s.writeBytes
+		// Descendants that exit before they are waited for take their CPU
+		// time with them, so the total can drop.
+		if elapsed := now.Sub(proc.sampledAt); elapsed > 0 && s.cpu > proc.cpu {
+			stats.CPUPercent += 100 * (s.cpu - proc.cpu).Seconds() / elapsed.Seconds()
+		}
+		proc.sampledAt, proc.cpu = now, s.cpu
+	}
+	return stats
+}
+
+func (s *Server) processStats() processStatsPayload {
+	stats := s.processes.sample()
+	return processStatsPayload{
+		Processes:  stats.Processes,
+		CPUPercent: stats.CPUPercent,
+		RSSBytes:   stats.RSSBytes,
+		ReadBytes:  stats.ReadBytes,
+		WriteBytes: stats.WriteBytes,
+	}
+}
+
+// ProcessStats samples the CPU, memory and I/O of the commands the agent is
+// running. Agents that cannot sample their processes, or predate the
+// request, return ErrUnsupported.
+func (c *IPCClient) ProcessStats(ctx context.Context) (*ProcessStats, error) {
+	var result processStatsPayload
+	if err := c.call(ctx, frameTypeProcessStatsRequest, nil, frameTypeProcessStats, &result); err != nil {
+		return nil, err
+	}
+	return &ProcessStats{
+		Processes:  result.Processes,
+		CPUPercent: result.CPUPercent,
+		RSSBytes:   result.RSSBytes,
+		ReadBytes:  result.ReadBytes,
+		WriteBytes: result.WriteBytes,
+	}, nil
+}
@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// canSampleProcesses reports whether sampleProcess works on this platform.
+const canSampleProcesses = true
+
+// sampleProcess reads the CPU time and resident memory of pid and its live
+// descendants from ps(1), which reports no I/O. CPU time includes the
+// descendants that have already been waited for.
+func sampleProcess(pid int) (procSample, error) {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,ppid=,rss=,time=").Output()
+	if err != nil {
+		return procSample{}, fmt.Errorf("ps: %w", err)
+	}
+	type psEntry struct {
+		ppid int
+		s    procSample
+	}
+	entries := make(map[int]psEntry)
+	children := make(map[int][]int)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			continue
+		}
+		p, err1 := strconv.Atoi(fields[0])
+		ppid, err2 := strconv.Atoi(fields[1])
+		rss, err3 := strconv.ParseUint(fields[2], 10, 64)
+		cpu, err4 := parsePSTime(fields[3])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+			continue
+		}
+		entries[p] = psEntry{ppid: ppid, s: procSample{cpu: cpu, rss: rss * 1024}}
+		children[ppid] = append(children[ppid], p)
+	}
+	if _, ok := entries[pid]; !ok {
+		return procSample{}, fmt.Errorf("process %d not found", pid)
+	}
+
+	var total procSample
+	pending := []int{pid}
+	for len(pending) > 0 {
+		p := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		total.cpu += entries[p].s.cpu
+		total.rss += entries[p].s.rss
+		pending = append(pending, children[p]...)
+	}
+	return total, nil
+}
+
+// parsePSTime parses the [[dd-]hh:]mm:ss.cc CPU time ps prints.
+func parsePSTime(s string) (time.Duration, error) {
+	var days int
+	if d, rest, found := strings.Cut(s, "-"); found {
+		n, err := strconv.Atoi(d)
+		if err != nil {
+			return 0, err
+		}
+		days, s = n, rest
+	}
+	parts := strings.Split(s, ":")
+	secs, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil {
+		return 0, err
+	}
+	total := time.Duration(days) * 24 * time.Hour
+	unit := time.Minute
+	for i := len(parts) - 2; i >= 0; i-- {
+		n, err := strconv.Atoi(parts[i])
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(n) * unit
+		unit *= 60
+	}
+	return total + time.Duration(secs*float64(time.Second)), nil
+}
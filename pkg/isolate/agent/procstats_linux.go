@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// canSampleProcesses reports whether sampleProcess works on this platform.
+const canSampleProcesses = true
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat.
+const clockTicks = 100
+
+// sampleProcess reads the CPU time, resident memory and storage I/O of pid
+// and its live descendants from /proc. CPU time includes the descendants
+// that have already been waited for.
+func sampleProcess(pid int) (procSample, error) {
+	var total procSample
+	pending := []int{pid}
+	for len(pending) > 0 {
+		p := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		s, err := readProcSample(p)
+		if err != nil {
+			if p == pid {
+				return procSample{}, err
+			}
+			continue // exited since its parent listed it
+		}
+		total.cpu += s.cpu
+		total.rss += s.rss
+		total.readBytes += s.readBytes
+		total.writeBytes += s.writeBytes
+		pending = append(pending, procChildren(p)...)
+	}
+	return total, nil
+}
+
+func readProcSample(pid int) (procSample, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return procSample{}, err
+	}
+	// The command name may contain spaces; fields resume after its ')',
+	// with the state as the first. utime, stime, cutime and cstime follow
+	// at fields 14 to 17 of the whole line.
+	idx := bytes.LastIndexByte(data, ')')
+	if idx < 0 {
+		return procSample{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[idx+1:]))
+	if len(fields) < 15 {
+		return procSample{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	var ticks uint64
+	for _, f := range fields[11:15] {
+		n, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return procSample{}, fmt.Errorf("malformed /proc/%d/stat", pid)
+		}
+		ticks += n
+	}
+	s := procSample{cpu: time.Duration(ticks) * time.Second / clockTicks}
+
+	if kb, ok := procField(fmt.Sprintf("/proc/%d/status", pid), "VmRSS:"); ok {
+		s.rss = kb * 1024
+	}
+	// /proc/<pid>/io needs ptrace access to the process, which an agent
+	// running as another user may lack; report no I/O then.
+	io := fmt.Sprintf("/proc/%d/io", pid)
+	s.readBytes, _ = procField(io, "read_bytes:")
+	s.writeBytes, _ = procField(io, "write_bytes:")
+	return s, nil
+}
+
+// procField returns the number following key in a "key: value" file under
+// /proc.
+func procField(path, key string) (uint64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		rest, found := strings.CutPrefix(scanner.Text(), key)
+		if !found {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(fields[0], 10, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// procChildren lists the children of pid's threads. It needs a kernel with
+// CONFIG_PROC_CHILDREN; without it descendants are not sampled.
+func procChildren(pid int) []int {
+	tasks, err := os.ReadDir(fmt.Sprintf("/proc/%d/task", pid))
+	if err != nil {
+		return nil
+	}
+	var children []int
+	for _, task := range tasks {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/task/%s/children", pid, task.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range strings.Fields(string(data)) {
+			if child, err := strconv.Atoi(f); err == nil {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package agent
+
+// canSampleProcesses reports whether sampleProcess works on this platform.
+const canSampleProcesses = false
+
+func sampleProcess(pid int) (procSample, error) {
+	return procSample{}, errUnsupportedSampling
+}
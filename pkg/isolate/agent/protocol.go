@@ -2,7 +2,11 @@ package agent
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -16,7 +20,146 @@ type CommandRequest struct {
 	Stderr     io.Writer
 	Timeout    time.Duration
 	WorkingDir string
-	User       string
+	// CreateWorkingDir creates WorkingDir, and any missing parents, when it
+	// does not exist. Otherwise a missing WorkingDir fails the exec with
+	// ErrWorkingDirNotFound.
+	CreateWorkingDir bool
+	// User runs the command as another account: a user name or uid,
+	// optionally followed by ":group" with a group name or gid. Only an
+	// agent running as root can switch users; others fail the exec with
+	// ErrPermissionDenied unless User is their own account.
+	User string
+	// Detach keeps the command running on the agent if the connection that
+	// started it is lost, so the stream can be resumed with Attach.
+	Detach bool
+	// Reconnect enables automatic re-attach after a transport failure. It
+	// implies Detach; execs that are not detached cannot be resumed.
+	Reconnect *ReconnectPolicy
+	// MaxStdoutBytes and MaxStderrBytes cap how much of each stream is kept
+	// in the result; MaxOutputBytes caps both combined. Zero uses the agent
+	// default, and limits above the agent's own buffer cap are clamped to it.
+	MaxStdoutBytes int
+	MaxStderrBytes int
+	MaxOutputBytes int
+	// Hostname runs the command in its own UTS namespace with this hostname
+	// (Linux only; ignored with a warning elsewhere).
+	Hostname string
+	// OOMScoreAdj is written to the command's /proc/<pid>/oom_score_adj
+	// right after it starts, clamped to -1000..1000. Zero keeps the
+	// inherited value; ignored outside Linux.
+	OOMScoreAdj int
+	// MaxOpenFiles sets the command's soft and hard RLIMIT_NOFILE right
+	// after it starts. Zero keeps the inherited limit; ignored with a
+	// warning outside Linux.
+	MaxOpenFiles uint64
+	// StdinFIFO, StdoutFIFO and StderrFIFO redirect the command's streams to
+	// named pipes on the agent, within its root. Missing FIFOs are created
+	// and removed again when the command finishes. Opening a FIFO waits for
+	// its other end, usually another exec, for at most Timeout. Redirected
+	// streams are not relayed or captured. Unix agents only.
+	StdinFIFO  string
+	StdoutFIFO string
+	StderrFIFO string
+	// Mounts are bind mounted read-only into a private mount namespace for
+	// the duration of the command (Linux agents only). Sources are agent
+	// paths outside any chroot; targets are paths as the command sees them,
+	// must already exist and must match their source's kind (file or
+	// directory).
+	Mounts []Mount
+	// Tmpfs mounts a fresh, size-limited tmpfs at each Path in the same
+	// private mount namespace (Linux agents only). Paths are as the command
+	// sees them, must be existing directories within the agent's root, and
+	// the filesystems disappear when the command exits.
+	Tmpfs []TmpfsMount
+	// StdoutLog and StderrLog append the command's streams to files on the
+	// agent, within its root, rotating them as configured. Logged streams
+	// are not relayed or captured, and cannot also go to a FIFO.
+	StdoutLog *LogFile
+	StderrLog *LogFile
+	// EgressAllow lists the IPv4 destinations ("10.0.0.0/8",
+	// "mirror.local:443") the command may reach, denying all other egress.
+	// The command runs in its own network namespace, linked to the agent's
+	// through a filter it cannot change; host names are resolved when the
+	// exec starts. Agents that cannot do this (not Linux, not root) fail
+	// the request with ErrUnsupported rather than run it unrestricted.
+	EgressAllow []string
+	// CompletionURL asks the agent to POST a signed JSON summary of the
+	// result (see CompletionSummary) to this http or https URL once the
+	// command exits, so callers of detached jobs need not poll. The agent
+	// must be started with webhooks allowed, otherwise the exec fails with
+	// ErrUnsupported.
+	CompletionURL string
+	// Tty runs the command on a pseudo-terminal allocated by the agent, as
+	// interactive shells and editors expect. Its output, stdout and stderr
+	// merged, arrives as stdout. Closing Stdin sends the terminal's EOF
+	// character instead of closing the input. Linux agents only; a Tty
+	// cannot be combined with Stdio, FIFOs or log files.
+	Tty bool
+	// TtySize is the terminal's initial size; zero uses 80x24.
+	TtySize WindowSize
+	// Resize delivers terminal size changes to the agent while a Tty
+	// command runs.
+	Resize <-chan WindowSize
+	// ReturnEnv asks the agent to report the environment the command ran
+	// with in CommandResult.Env.
+	ReturnEnv bool
+	// Stdio is passed to the agent and used as the command's stdin and
+	// stdout, for example an accepted connection obtained with
+	// (*net.TCPConn).File, so a per-connection handler talks to its peer
+	// directly. Stdin and stdout are then not relayed or captured. It
+	// requires an IPCClient connected over a Unix socket, or the
+	// LoopbackClient.
+	Stdio *os.File
+
+	// DryRun asks the agent to check the command as it would before
+	// running it, validating its paths, refusing interpreters outside a
+	// chroot, preparing the chroot and resolving User, and to report the
+	// outcome in CommandResult.DryRun instead of starting it. Nothing is
+	// created on the agent, not even a CreateWorkingDir. Agents that do not
+	// offer FeatureDryRun, and the LoopbackClient, fail it with
+	// ErrUnsupported rather than running the command.
+	DryRun bool
+}
+
+// Mount is a read-only bind mount applied to a single exec.
+type Mount struct {
+	Source string
+	Target string
+}
+
+// TmpfsMount is a memory-backed filesystem of at most SizeBytes mounted at
+// Path for a single exec.
+type TmpfsMount struct {
+	Path      string
+	SizeBytes int64
+}
+
+// WindowSize is a terminal size in character cells.
+type WindowSize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// LogFile configures an exec output log. The log is rotated before it would
+// grow past MaxBytes, preferably between lines, or once it has been open for
+// MaxAge; zero disables either trigger. Rotated logs are kept as Path.1 (newest)
+// through Path.<Keep>, and older ones are removed. With Keep zero rotation
+// discards the old contents.
+type LogFile struct {
+	Path     string
+	MaxBytes int64
+	MaxAge   time.Duration
+	Keep     int
+}
+
+// ReconnectPolicy controls how a detached ExecStream recovers from transport
+// failures. Output resumes from the last received byte; stdin is not carried
+// over to the new connection.
+type ReconnectPolicy struct {
+	MaxAttempts int
+	Delay       time.Duration
+	// OnReconnect is invoked before each attempt with the error that caused it.
+	OnReconnect func(attempt int, cause error)
 }
 
 // CommandResult captures stdout/stderr snapshots and the exit code.
@@ -27,14 +170,154 @@ type CommandResult struct {
 	Duration   time.Duration
 	StartedAt  time.Time
 	FinishedAt time.Time
+	// StdoutTruncated and StderrTruncated report that output was dropped
+	// because a result limit was reached.
+	StdoutTruncated bool
+	StderrTruncated bool
+	// StdoutTotalBytes and StderrTotalBytes count everything the command
+	// wrote to each stream, so the bytes dropped from a truncated Stdout
+	// are StdoutTotalBytes - len(Stdout). Zero from agents too old to count.
+	StdoutTotalBytes int64
+	StderrTotalBytes int64
+	// Env is the fully resolved environment of the command as sorted
+	// KEY=VALUE pairs, with secret values redacted by the agent. It is only
+	// set when the request had ReturnEnv.
+	Env []string
+	// PeakOpenFiles is the most descriptors the command itself (not its
+	// children) was seen holding open, sampled every 50ms. Zero when the
+	// agent cannot count them.
+	PeakOpenFiles int
+	// ExitReason explains an abnormal exit, such as ExitReasonOOMKilled or
+	// ExitReasonSeccomp, or a command that could not be started, such as
+	// ExitReasonCommandNotFound; empty otherwise.
+	ExitReason string
+	// TimedOut reports that the command's process group was killed because
+	// its Timeout expired.
+	TimedOut bool
+	// UserTime and SysTime are the CPU time the command and the children
+	// it waited for spent in user and kernel mode; MaxRSSBytes is their peak
+	// resident set size. All are zero where the agent cannot measure them.
+	UserTime    time.Duration
+	SysTime     time.Duration
+	MaxRSSBytes uint64
+	// BlockedSyscall names the system call that got the command killed
+	// when ExitReason is ExitReasonSeccomp and the agent could tell which.
+	BlockedSyscall string
+	// ExecID names the command's output for Logs when the agent retains
+	// it; empty otherwise.
+	ExecID string
+
+	// DryRun is the agent's report for a request with DryRun, which did not
+	// run; the other fields are zero. Nil for commands that ran.
+	DryRun *DryRunReport
+}
+
+// DryRunReport describes what the agent would have done with a command.
+type DryRunReport struct {
+	// Path and Args are the command as it would start, Path resolved
+	// against the agent's forced PATH when it has one.
+	Path string
+	Args []string
+	// WorkingDir is the directory the command would start in, as it would
+	// see it from inside Chroot.
+	WorkingDir string
+	// Chroot is the agent directory the command would be confined to;
+	// empty without chroot isolation.
+	Chroot string
+	// User is the account the command would run as when the request set
+	// User; nil when it would run as the agent.
+	User *ExecCredential
+	// Blocked reports that the agent would refuse the command, failing the
+	// exec with Err. Path, Args and WorkingDir are then as requested.
+	Blocked bool
+	Err     error
+}
+
+// ExecCredential is the account a command runs as.
+type ExecCredential struct {
+	UID    uint32
+	GID    uint32
+	Groups []uint32 // supplementary groups
 }
 
 // CommandStream supports real-time IO streaming.
 type CommandStream struct {
+	JobID  string // set for detached execs
 	Stdout <-chan []byte
 	Stderr <-chan []byte
 	Done   <-chan *CommandResult
 	Cancel context.CancelFunc
+
+	control *frameWriter  // the exec's connection; nil when not controllable
+	missed  *missedOutput // nil for streams that cannot miss output
+}
+
+// missedOutput counts the bytes of each stream a client never received.
+type missedOutput struct {
+	stdout atomic.Int64
+	stderr atomic.Int64
+}
+
+// Missed reports how many bytes of stdout and stderr a detached job's stream
+// skipped: output the job wrote past the result buffer the agent retains
+// while no client was attached, which Attach or a reconnect could no longer
+// replay. The counts are final once Done has delivered the result.
+func (s *CommandStream) Missed() (stdout, stderr int64) {
+	if s == nil || s.missed == nil {
+		return 0, 0
+	}
+	return s.missed.stdout.Load(), s.missed.stderr.Load()
+}
+
+// PauseOutput asks the agent to stop sending output until ResumeOutput. The
+// command keeps running, but once the pipes from it fill up its writes block.
+// Paused output resumes by itself if the connection drops or the exec times
+// out. Streams that are not backed by the exec's own agent connection, such
+// as those from Attach or the loopback client, return ErrUnsupported.
+func (s *CommandStream) PauseOutput() error {
+	return s.sendControl(frameTypePauseOutput, nil)
+}
+
+// ResumeOutput undoes PauseOutput; output held back meanwhile is delivered
+// first.
+func (s *CommandStream) ResumeOutput() error {
+	return s.sendControl(frameTypeResumeOutput, nil)
+}
+
+// Signal delivers sig to the command's process group in the guest, such as
+// SIGINT to interrupt it or SIGKILL to stop it outright. It does not wait for
+// the command to react; its result still arrives on Done. Streams that are
+// not backed by the exec's own agent connection return ErrUnsupported.
+func (s *CommandStream) Signal(sig os.Signal) error {
+	num, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	return s.sendControl(frameTypeSignal, signalPayload{Signal: int(num)})
+}
+
+func (s *CommandStream) sendControl(typ frameType, payload any) error {
+	if s == nil || s.control == nil {
+		return ErrUnsupported
+	}
+	return s.control.send(typ, payload)
+}
+
+// ArchiveFormat selects the container format produced by directory archives.
+type ArchiveFormat string
+
+const (
+	ArchiveFormatTar     ArchiveFormat = "tar"
+	ArchiveFormatTarGzip ArchiveFormat = "tar.gz"
+)
+
+// DiskUsage reports capacity of the filesystem backing a guest path.
+type DiskUsage struct {
+	TotalBytes     uint64 `json:"total_bytes"`
+	FreeBytes      uint64 `json:"free_bytes"`
+	AvailableBytes uint64 `json:"available_bytes"`
+	TotalInodes    uint64 `json:"total_inodes"`
+	FreeInodes     uint64 `json:"free_inodes"`
 }
 
 // Client is implemented by guest agents or proxies that can execute commands
@@ -44,6 +327,19 @@ type Client interface {
 	Exec(ctx context.Context, cmd *CommandRequest) (*CommandResult, error)
 	ExecStream(ctx context.Context, cmd *CommandRequest) (*CommandStream, error)
 	CopyTo(ctx context.Context, reader io.Reader, dst string) error
+	CopyDirTo(ctx context.Context, srcDir, dst string, progress func(CopyProgress)) error
 	CopyFrom(ctx context.Context, src string, writer io.Writer) error
+	CopyArchiveFrom(ctx context.Context, srcDir string, format ArchiveFormat, writer io.Writer) error
+	ImportArchive(ctx context.Context, reader io.Reader) error
+	Attach(ctx context.Context, jobID string) (*CommandStream, error)
+	CheckSpace(ctx context.Context, path string, needBytes int64) (bool, *DiskUsage, error)
+	Which(ctx context.Context, name string) (string, error)
+	Chown(ctx context.Context, path string, uid, gid int) error
+	SubscribeLogs(ctx context.Context, token string) (<-chan string, error)
+	Capabilities(ctx context.Context) (*Capabilities, error)
+	Info(ctx context.Context) (*AgentInfo, error)
+	ProcessStats(ctx context.Context) (*ProcessStats, error)
+	Logs(ctx context.Context, execID string, tailBytes int) ([]byte, error)
+	SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error
 	Close() error
 }
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion identifies the revision of the wire protocol described by
+// Schema. It is bumped whenever a frame or field is renamed or removed.
+const ProtocolVersion = 1
+
+// FrameSchema describes a single frame type and the JSON shape of its payload.
+type FrameSchema struct {
+	Type   string        `json:"type"`
+	Fields []FieldSchema `json:"fields,omitempty"`
+}
+
+// FieldSchema describes one JSON field of a frame payload.
+type FieldSchema struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// framePayloads maps every frame type to the payload it carries. Frames with
+// a nil payload carry no body. Keep this in sync with the frameType constants;
+// it is the source of truth for Schema.
+var framePayloads = map[frameType]any{
+	frameTypeExecRequest:          execRequestPayload{},
+	frameTypeStdout:               chunkPayload{},
+	frameTypeStderr:               chunkPayload{},
+	frameTypeResult:               execResultPayload{},
+	frameTypeError:                errorPayload{},
+	frameTypeStdinChunk:           stdinPayload{},
+	frameTypeStdinClose:           nil,
+	frameTypeStdinAck:             stdinAckPayload{},
+	frameTypeResize:               windowSizePayload{},
+	frameTypePauseOutput:          nil,
+	frameTypeResumeOutput:         nil,
+	frameTypeSignal:               signalPayload{},
+	frameTypePing:                 nil,
+	frameTypePong:                 pongPayload{},
+	frameTypeFilePutRequest:       filePutRequestPayload{},
+	frameTypeFilePutChunk:         chunkPayload{},
+	frameTypeFilePutClose:         fileClosePayload{},
+	frameTypeFilePutResult:        fileTransferResultPayload{},
+	frameTypeFileGetRequest:       fileGetRequestPayload{},
+	frameTypeFileGetChunk:         chunkPayload{},
+	frameTypeFileGetHole:          holePayload{},
+	frameTypeFileGetResult:        fileTransferResultPayload{},
+	frameTypeArchiveRequest:       archiveRequestPayload{},
+	frameTypeArchiveChunk:         chunkPayload{},
+	frameTypeArchiveResult:        fileTransferResultPayload{},
+	frameTypeArchiveImportRequest: archiveImportRequestPayload{},
+	frameTypeArchiveImportChunk:   chunkPayload{},
+	frameTypeArchiveImportClose:   nil,
+	frameTypeArchiveImportResult:  fileTransferResultPayload{},
+	frameTypeJob:                  jobPayload{},
+	frameTypeAttachRequest:        attachRequestPayload{},
+	frameTypeCheckSpaceRequest:    checkSpaceRequestPayload{},
+	frameTypeCheckSpaceResult:     checkSpaceResultPayload{},
+	frameTypeWhichRequest:         whichRequestPayload{},
+	frameTypeWhichResult:          whichResultPayload{},
+	frameTypeChownRequest:         chownRequestPayload{},
+	frameTypeChownResult:          nil,
+	frameTypeLogSubscribe:         logSubscribePayload{},
+	frameTypeLogSubscribed:        nil,
+	frameTypeLogLine:              logLinePayload{},
+	frameTypeLogUnsubscribe:       nil,
+	frameTypeLogEnd:               nil,
+	frameTypeCapabilitiesRequest:  nil,
+	frameTypeCapabilitiesResult:   capabilitiesResultPayload{},
+	frameTypeInfoRequest:          nil,
+	frameTypeInfo:                 infoPayload{},
+	frameTypeProcessStatsRequest:  nil,
+	frameTypeProcessStats:         processStatsPayload{},
+	frameTypeSignalJobRequest:     signalJobRequestPayload{},
+	frameTypeSignalJobResult:      nil,
+	frameTypeHello:                helloPayload{},
+	frameTypeLogsRequest:          logsRequestPayload{},
+	frameTypeLogs:                 logsPayload{},
+	frameTypeExecDone:             nil,
+}
+
+// Schema returns the wire schema for every frame type, sorted by type name.
+// Third-party agent implementations can use it to stay compatible.
+func Schema() []FrameSchema {
+	out := make([]FrameSchema, 0, len(framePayloads))
+	for typ, payload := range framePayloads {
+		frame := FrameSchema{Type: string(typ)}
+		if payload != nil {
+			frame.Fields = payloadFields(reflect.TypeOf(payload))
+		}
+		out = append(out, frame)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out
+}
+
+func payloadFields(t reflect.Type) []FieldSchema {
+	fields := make([]FieldSchema, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, FieldSchema{
+			Name:     name,
+			Type:     jsonTypeName(f.Type),
+			Optional: strings.Contains(opts, "omitempty"),
+		})
+	}
+	return fields
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func jsonTypeName(t reflect.Type) string {
+	if t == timeType {
+		return "timestamp"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "array<" + jsonTypeName(t.Elem()) + ">"
+	case reflect.Map:
+		return "map<string," + jsonTypeName(t.Elem()) + ">"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	default:
+		return "object"
+	}
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestFramePayloadsGolden serializes every payload in framePayloads, with
+// each field set so omitempty ones appear too, and compares the JSON with
+// testdata/frames/<type>.json. A renamed or removed JSON field, nested ones
+// included, fails it; run with -update after a deliberate protocol change.
+func TestFramePayloadsGolden(t *testing.T) {
+	dir := filepath.Join("testdata", "frames")
+	want := make(map[string]bool)
+	for typ, payload := range framePayloads {
+		name := string(typ) + ".json"
+		want[name] = true
+		got := []byte("null\n")
+		if payload != nil {
+			v := reflect.New(reflect.TypeOf(payload)).Elem()
+			populate(v)
+			var err error
+			if got, err = json.MarshalIndent(v.Interface(), "", "  "); err != nil {
+				t.Fatalf("%s: %v", typ, err)
+			}
+			got = append(got, '\n')
+		}
+		path := filepath.Join(dir, name)
+		if *update {
+			if err := os.WriteFile(path, got, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		golden, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v (run go test -update to create it)", typ, err)
+			continue
+		}
+		if !bytes.Equal(got, golden) {
+			t.Errorf("%s payload changed; got:\n%s\nwant:\n%s", typ, got, golden)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if !want[entry.Name()] {
+			if *update {
+				_ = os.Remove(filepath.Join(dir, entry.Name()))
+				continue
+			}
+			t.Errorf("%s has no frame type any more", entry.Name())
+		}
+	}
+}
+
+// TestSchemaCoversFrames checks that Schema lists each frame exactly once.
+func TestSchemaCoversFrames(t *testing.T) {
+	schema := Schema()
+	if len(schema) != len(framePayloads) {
+		t.Fatalf("Schema has %d frames, framePayloads %d", len(schema), len(framePayloads))
+	}
+	if !sort.SliceIsSorted(schema, func(i, j int) bool { return schema[i].Type < schema[j].Type }) {
+		t.Error("Schema is not sorted by type")
+	}
+	for _, frame := range schema {
+		if _, ok := framePayloads[frameType(frame.Type)]; !ok {
+			t.Errorf("Schema lists unknown frame %q", frame.Type)
+		}
+	}
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+
+// populate sets every exported field reachable from v to a fixed non-zero
+// value: one element for slices and maps, allocated pointers.
+func populate(v reflect.Value) {
+	switch {
+	case v.Type() == timeType:
+		v.Set(reflect.ValueOf(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+		return
+	case v.Type() == rawMessageType:
+		v.SetBytes([]byte(`{}`))
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1.5)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		populate(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		populate(v.Index(0))
+	case reflect.Map:
+		key := reflect.New(v.Type().Key()).Elem()
+		elem := reflect.New(v.Type().Elem()).Elem()
+		populate(key)
+		populate(elem)
+		v.Set(reflect.MakeMap(v.Type()))
+		v.SetMapIndex(key, elem)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() && !strings.HasPrefix(v.Type().Field(i).Tag.Get("json"), "-") {
+				populate(v.Field(i))
+			}
+		}
+	}
+}
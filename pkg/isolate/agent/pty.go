@@ -0,0 +1,29 @@
+package agent
+
+import "os"
+
+// defaultWindowSize is the terminal size of tty execs that do not set one.
+var defaultWindowSize = WindowSize{Rows: 24, Cols: 80}
+
+// ttyInput feeds stdin to a pseudo-terminal master. Closing it sends the EOF
+// character (^D) instead of closing the master, which still carries the
+// command's output.
+type ttyInput struct {
+	master *os.File
+}
+
+func (t ttyInput) Write(p []byte) (int, error) {
+	return t.master.Write(p)
+}
+
+func (t ttyInput) Close() error {
+	_, err := t.master.Write([]byte{0x04})
+	return err
+}
+
+func (p *windowSizePayload) windowSize() WindowSize {
+	if p == nil || p.Rows == 0 || p.Cols == 0 {
+		return defaultWindowSize
+	}
+	return WindowSize{Rows: p.Rows, Cols: p.Cols}
+}
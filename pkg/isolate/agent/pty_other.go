@@ -0,0 +1,20 @@
+//go:build !linux
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+)
+
+const ttySupported = false
+
+func openPTY() (master, slave *os.File, err error) {
+	return nil, nil, errTTYUnsupported
+}
+
+func setWindowSize(master *os.File, size WindowSize) error {
+	return errTTYUnsupported
+}
+
+func attachTTY(cmd *exec.Cmd, slave *os.File) {}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Bandwidth caps the throughput between a client and its agent in bits per
+// second, seen from the guest: egress carries command output and files
+// copied out of it, ingress stdin and files copied in. Zero or negative is
+// unlimited.
+type Bandwidth struct {
+	IngressBitsPerSec int64
+	EgressBitsPerSec  int64
+}
+
+// tokenBucket meters bytes at a fixed rate. It holds up to a tenth of a
+// second's worth, so short idle spells do not let a large burst through.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for bitsPerSec, or nil when that is
+// unlimited.
+func newTokenBucket(bitsPerSec int64) *tokenBucket {
+	if bitsPerSec <= 0 {
+		return nil
+	}
+	rate := float64(bitsPerSec) / 8
+	burst := max(rate/10, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// chunk is the most a single call should take at once, so one large write
+// cannot run the bucket deep into debt.
+func (b *tokenBucket) chunk() int {
+	return int(b.burst)
+}
+
+// take takes n bytes from the bucket and sleeps until they are paid for.
+// The bucket may go into debt, which callers after it wait out.
+func (b *tokenBucket) take(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// RateLimitWriter passes writes on to another writer at no more than a
+// fixed rate. Writers sharing a limit share its rate, so a RateLimitWriter
+// is safe for concurrent use when the underlying writer is.
+type RateLimitWriter struct {
+	w      io.Writer
+	bucket *tokenBucket // nil when unlimited
+}
+
+// NewRateLimitWriter returns a writer passing at most bitsPerSec bits per
+// second on to w. A bitsPerSec of zero or less does not limit w.
+func NewRateLimitWriter(w io.Writer, bitsPerSec int64) *RateLimitWriter {
+	return &RateLimitWriter{w: w, bucket: newTokenBucket(bitsPerSec)}
+}
+
+func (r *RateLimitWriter) Write(p []byte) (int, error) {
+	if r.bucket == nil {
+		return r.w.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), r.bucket.chunk())
+		r.bucket.take(n)
+		m, err := r.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// rateLimitReader meters reads from r through bucket. Bytes are paid for
+// after they are read, so a read returns as soon as data is available and
+// the next one waits out the debt.
+type rateLimitReader struct {
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+// limitReader returns r metered through bucket, or r itself when bucket is
+// nil.
+func limitReader(r io.Reader, bucket *tokenBucket) io.Reader {
+	if bucket == nil || r == nil {
+		return r
+	}
+	return &rateLimitReader{r: r, bucket: bucket}
+}
+
+func (r *rateLimitReader) Read(p []byte) (int, error) {
+	if len(p) > r.bucket.chunk() {
+		p = p[:r.bucket.chunk()]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.bucket.take(n)
+	}
+	return n, err
+}
+
+// shaper holds the buckets of a client's Bandwidth. The buckets are shared
+// by all of the client's connections and commands, like a link they share.
+type shaper struct {
+	ingress *tokenBucket // host to guest; nil when unlimited
+	egress  *tokenBucket // guest to host; nil when unlimited
+}
+
+func newShaper(bw Bandwidth) *shaper {
+	return &shaper{ingress: newTokenBucket(bw.IngressBitsPerSec), egress: newTokenBucket(bw.EgressBitsPerSec)}
+}
+
+// conn meters a client's connection to its agent: what the client reads
+// came from the guest, what it writes goes to it.
+func (s *shaper) conn(conn net.Conn) net.Conn {
+	if s.ingress == nil && s.egress == nil {
+		return conn
+	}
+	return &shapedConn{Conn: conn, shaper: s}
+}
+
+// shapedConn is a client connection metered by a shaper.
+type shapedConn struct {
+	net.Conn
+	shaper *shaper
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	if c.shaper.egress == nil {
+		return c.Conn.Read(p)
+	}
+	return (&rateLimitReader{r: c.Conn, bucket: c.shaper.egress}).Read(p)
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	return (&RateLimitWriter{w: c.Conn, bucket: c.shaper.ingress}).Write(p)
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactedPlaceholder replaces values masked by the default redactor.
+const RedactedPlaceholder = "[REDACTED]"
+
+// Redactor masks sensitive data before the server logs command details.
+// RedactString is applied to free text such as the command path and each
+// argument; RedactEnv is applied to every environment value.
+type Redactor interface {
+	RedactString(s string) string
+	RedactEnv(key, value string) string
+}
+
+var (
+	secretKeyPattern = regexp.MustCompile(`(?i)(secret|token|passw(or)?d|api[_-]?key|access[_-]?key|private[_-]?key|credential|auth)`)
+	// secretAssignPattern matches key=value / key: value pairs and flags such
+	// as --password=... whose key looks secret, keeping the key visible.
+	secretAssignPattern = regexp.MustCompile(`(?i)((?:secret|token|passw(?:or)?d|api[_-]?key|access[_-]?key|private[_-]?key|credential|auth)[\w.-]*\s*[=:]\s*(?:(?:bearer|basic)\s+)?)("[^"]*"|'[^']*'|\S+)`)
+	bearerPattern       = regexp.MustCompile(`(?i)(bearer\s+)\S+`)
+)
+
+type defaultRedactor struct{}
+
+// DefaultRedactor masks environment variables whose names look like secrets
+// (TOKEN, SECRET, PASSWORD, API_KEY, ...) and secret-looking key=value pairs
+// or bearer tokens embedded in strings.
+func DefaultRedactor() Redactor { return defaultRedactor{} }
+
+func (defaultRedactor) RedactString(s string) string {
+	s = secretAssignPattern.ReplaceAllString(s, "${1}"+RedactedPlaceholder)
+	return bearerPattern.ReplaceAllString(s, "${1}"+RedactedPlaceholder)
+}
+
+func (r defaultRedactor) RedactEnv(key, value string) string {
+	if secretKeyPattern.MatchString(key) {
+		return RedactedPlaceholder
+	}
+	return r.RedactString(value)
+}
+
+// describeExec renders an exec request for the log with the redactor applied
+// to the path, arguments and environment.
+func (s *Server) describeExec(payload *execRequestPayload) string {
+	var b strings.Builder
+	b.WriteString(s.redactor.RedactString(payload.Path))
+	for _, arg := range payload.Args {
+		b.WriteByte(' ')
+		b.WriteString(s.redactor.RedactString(arg))
+	}
+	if len(payload.Env) > 0 {
+		keys := make([]string, 0, len(payload.Env))
+		for k := range payload.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString(" env=[")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(k)
+			b.WriteByte('=')
+			b.WriteString(s.redactor.RedactEnv(k, payload.Env[k]))
+		}
+		b.WriteByte(']')
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a bytes.Buffer safe to read while the server logs to it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSecretsStayOutOfLogsAndErrors(t *testing.T) {
+	const secret = "hunter2"
+	var logs lockedBuffer
+	_, client := startServer(t, ServerConfig{Logger: log.New(&logs, "", 0)})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := client.Exec(ctx, &CommandRequest{
+		Path:      "/bin/sh",
+		Args:      []string{"-c", "exit 0", "--password=" + secret, "Authorization: Bearer " + secret},
+		Env:       map[string]string{"API_TOKEN": secret, "NOTES": "token=" + secret},
+		ReturnEnv: true,
+	})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	for _, kv := range result.Env {
+		if strings.Contains(kv, secret) {
+			t.Errorf("result env holds the secret: %q", kv)
+		}
+	}
+
+	// A command that cannot start is reported without its arguments.
+	result, err = client.Exec(ctx, &CommandRequest{Path: "/no/such/command", Args: []string{"--api-key=" + secret}})
+	if err != nil {
+		if strings.Contains(err.Error(), secret) {
+			t.Errorf("error holds the secret: %v", err)
+		}
+	} else if result.ExitReason != ExitReasonCommandNotFound {
+		t.Errorf("exit reason = %q, want %q", result.ExitReason, ExitReasonCommandNotFound)
+	} else if bytes.Contains(result.Stderr, []byte(secret)) {
+		t.Errorf("stderr holds the secret: %q", result.Stderr)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "/bin/sh") {
+		t.Fatalf("the exec was not logged:\n%s", out)
+	}
+	if strings.Contains(out, secret) {
+		t.Errorf("logs hold the secret:\n%s", out)
+	}
+	if !strings.Contains(out, "API_TOKEN="+RedactedPlaceholder) {
+		t.Errorf("logs lack the masked API_TOKEN:\n%s", out)
+	}
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoint is a concrete agent address. Network is "unix" (Address is the
+// socket path), "vsock" (Address is "cid:port") or "tcp" (Address is
+// "host:port", dialed without TLS).
+type Endpoint struct {
+	Network string
+	Address string
+}
+
+// ParseEndpoint parses "unix:///path/to/agent.sock", "vsock://cid:port" or
+// "tcp://host:port".
+func ParseEndpoint(raw string) (Endpoint, error) {
+	scheme, addr, ok := strings.Cut(raw, "://")
+	if !ok || addr == "" {
+		return Endpoint{}, fmt.Errorf("invalid agent endpoint %q", raw)
+	}
+	ep := Endpoint{Network: scheme, Address: addr}
+	if _, err := ep.Dialer(0); err != nil {
+		return Endpoint{}, err
+	}
+	return ep, nil
+}
+
+func (e Endpoint) String() string {
+	return e.Network + "://" + e.Address
+}
+
+// Dialer returns a dialer connecting to the endpoint.
+func (e Endpoint) Dialer(timeout time.Duration) (Dialer, error) {
+	switch e.Network {
+	case "unix":
+		return &UnixDialer{Path: e.Address, Timeout: timeout}, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(e.Address); err != nil {
+			return nil, fmt.Errorf("invalid tcp address %q", e.Address)
+		}
+		return &TCPDialer{Address: e.Address, Timeout: timeout}, nil
+	case "vsock":
+		cidStr, portStr, ok := strings.Cut(e.Address, ":")
+		cid, errCID := strconv.ParseUint(cidStr, 10, 32)
+		port, errPort := strconv.ParseUint(portStr, 10, 32)
+		if !ok || errCID != nil || errPort != nil {
+			return nil, fmt.Errorf("invalid vsock address %q", e.Address)
+		}
+		return &VsockDialer{CID: uint32(cid), Port: uint32(port), Timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unsupported agent network %q", e.Network)
+	}
+}
+
+// Resolver maps a logical service name to the endpoint of the agent that
+// currently serves it, for deployments where agents are found through DNS
+// or a discovery backend rather than a fixed path.
+type Resolver interface {
+	Resolve(ctx context.Context, name string) (Endpoint, error)
+}
+
+// DNSResolver resolves a service name through its DNS TXT records, each of
+// which may hold an endpoint such as "vsock://3:1024". The first record that
+// parses wins.
+type DNSResolver struct {
+	// Resolver performs the lookups; nil uses net.DefaultResolver.
+	Resolver *net.Resolver
+}
+
+func (r *DNSResolver) Resolve(ctx context.Context, name string) (Endpoint, error) {
+	res := net.DefaultResolver
+	if r != nil && r.Resolver != nil {
+		res = r.Resolver
+	}
+	records, err := res.LookupTXT(ctx, name)
+	if err != nil {
+		return Endpoint{}, fmt.Errorf("resolve %s: %w", name, err)
+	}
+	for _, record := range records {
+		if ep, err := ParseEndpoint(strings.TrimSpace(record)); err == nil {
+			return ep, nil
+		}
+	}
+	return Endpoint{}, fmt.Errorf("resolve %s: no agent endpoint in TXT records", name)
+}
+
+// NewCachingResolver wraps r so each name is resolved at most once per ttl.
+// Failed lookups are not cached.
+func NewCachingResolver(r Resolver, ttl time.Duration) Resolver {
+	return &cachingResolver{resolver: r, ttl: ttl, entries: make(map[string]cachedEndpoint)}
+}
+
+type cachingResolver struct {
+	resolver Resolver
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedEndpoint
+}
+
+type cachedEndpoint struct {
+	endpoint Endpoint
+	expires  time.Time
+}
+
+func (r *cachingResolver) Resolve(ctx context.Context, name string) (Endpoint, error) {
+	r.mu.Lock()
+	entry, ok := r.entries[name]
+	r.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.endpoint, nil
+	}
+
+	ep, err := r.resolver.Resolve(ctx, name)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	r.mu.Lock()
+	r.entries[name] = cachedEndpoint{endpoint: ep, expires: time.Now().Add(r.ttl)}
+	r.mu.Unlock()
+	return ep, nil
+}
+
+// ServiceDialer resolves Name on every dial and connects to the endpoint it
+// maps to, so a client follows the agent if it moves.
+type ServiceDialer struct {
+	Name string
+	// Resolver looks up Name; nil uses an uncached DNSResolver.
+	Resolver Resolver
+	Timeout  time.Duration
+}
+
+func (d *ServiceDialer) Dial(ctx context.Context) (net.Conn, error) {
+	if d == nil || d.Name == "" {
+		return nil, fmt.Errorf("service name is required")
+	}
+	var resolver Resolver = &DNSResolver{}
+	if d.Resolver != nil {
+		resolver = d.Resolver
+	}
+	ep, err := resolver.Resolve(ctx, d.Name)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := ep.Dialer(d.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("service %s: %w", d.Name, err)
+	}
+	return dialer.Dial(ctx)
+}
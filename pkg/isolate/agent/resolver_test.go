@@ -0,0 +1,126 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver maps service names to fixed endpoints and counts lookups.
+type fakeResolver struct {
+	mu        sync.Mutex
+	endpoints map[string]Endpoint
+	lookups   int
+}
+
+func (r *fakeResolver) Resolve(ctx context.Context, name string) (Endpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	ep, ok := r.endpoints[name]
+	if !ok {
+		return Endpoint{}, errors.New("no such service " + name)
+	}
+	return ep, nil
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// serveUnix serves a Server built from cfg for the duration of the test and
+// returns the socket path.
+func serveUnix(t *testing.T, cfg ServerConfig) string {
+	t.Helper()
+	srv := NewServer(cfg)
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Shutdown)
+	return sock
+}
+
+func TestServiceDialerFollowsResolver(t *testing.T) {
+	resolver := &fakeResolver{endpoints: map[string]Endpoint{
+		"agent.web": {Network: "unix", Address: serveUnix(t, ServerConfig{})},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := NewIPCClient(&ServiceDialer{Name: "agent.web", Resolver: resolver})
+	result, err := client.Exec(ctx, &CommandRequest{Path: "/bin/echo", Args: []string{"resolved"}})
+	if err != nil || string(result.Stdout) != "resolved\n" {
+		t.Fatalf("Exec through the service = %+v, %v", result, err)
+	}
+	if resolver.count() == 0 {
+		t.Error("the resolver was never consulted")
+	}
+
+	// The agent moves: the next connection follows it.
+	resolver.mu.Lock()
+	resolver.endpoints["agent.web"] = Endpoint{Network: "unix", Address: serveUnix(t, ServerConfig{})}
+	resolver.mu.Unlock()
+	conn, err := (&ServiceDialer{Name: "agent.web", Resolver: resolver}).Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial after the move: %v", err)
+	}
+	conn.Close()
+
+	if _, err := (&ServiceDialer{Name: "agent.db", Resolver: resolver}).Dial(ctx); err == nil {
+		t.Error("dialing an unknown service succeeded")
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	backend := &fakeResolver{endpoints: map[string]Endpoint{"web": {Network: "vsock", Address: "3:1024"}}}
+	resolver := NewCachingResolver(backend, 50*time.Millisecond)
+	ctx := context.Background()
+
+	for range 3 {
+		if ep, err := resolver.Resolve(ctx, "web"); err != nil || ep.String() != "vsock://3:1024" {
+			t.Fatalf("Resolve = %v, %v", ep, err)
+		}
+	}
+	if n := backend.count(); n != 1 {
+		t.Errorf("%d lookups within the TTL, want 1", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := resolver.Resolve(ctx, "web"); err != nil {
+		t.Fatal(err)
+	}
+	if n := backend.count(); n != 2 {
+		t.Errorf("%d lookups after the TTL, want 2", n)
+	}
+
+	// Failures are not cached.
+	for range 2 {
+		if _, err := resolver.Resolve(ctx, "db"); err == nil {
+			t.Error("an unknown name resolved")
+		}
+	}
+	if n := backend.count(); n != 4 {
+		t.Errorf("%d lookups after two failures, want 4", n)
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for _, raw := range []string{"unix:///run/agent.sock", "vsock://3:1024", "tcp://127.0.0.1:9000"} {
+		if ep, err := ParseEndpoint(raw); err != nil || ep.String() != raw {
+			t.Errorf("ParseEndpoint(%q) = %v, %v", raw, ep, err)
+		}
+	}
+	for _, raw := range []string{"", "unix://", "/run/agent.sock", "vsock://3", "tcp://localhost", "http://host:80"} {
+		if ep, err := ParseEndpoint(raw); err == nil {
+			t.Errorf("ParseEndpoint(%q) = %v, want an error", raw, ep)
+		}
+	}
+}
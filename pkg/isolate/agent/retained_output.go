@@ -0,0 +1,129 @@
+package agent
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// retainedOutput keeps the most recent output of one exec, stdout and stderr
+// interleaved in the order the agent read them, in a ring of fixed size.
+type retainedOutput struct {
+	id   string
+	size int
+
+	mu   sync.Mutex
+	buf  []byte // grows to size, then wraps around at next
+	next int    // where the oldest byte is once buf is full
+}
+
+func (l *retainedOutput) write(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(p) >= l.size {
+		l.buf = append(l.buf[:0], p[len(p)-l.size:]...)
+		l.next = 0
+		return
+	}
+	if n := min(len(p), l.size-len(l.buf)); n > 0 {
+		l.buf = append(l.buf, p[:n]...)
+		p = p[n:]
+	}
+	for len(p) > 0 {
+		n := copy(l.buf[l.next:], p)
+		p = p[n:]
+		l.next = (l.next + n) % l.size
+	}
+}
+
+// tail returns the last n retained bytes, or all of them when n is zero or
+// less.
+func (l *retainedOutput) tail(n int) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]byte, 0, len(l.buf))
+	out = append(out, l.buf[l.next:]...)
+	out = append(out, l.buf[:l.next]...)
+	if n > 0 && n < len(out) {
+		out = out[len(out)-n:]
+	}
+	return out
+}
+
+// retainedOutputs keeps the output of recent execs for logs_request, keyed
+// by exec ID, for a while after they finish. Each reserves its full size
+// from the server's buffer budget.
+type retainedOutputs struct {
+	retention time.Duration
+	size      int
+	budget    *bufferBudget
+
+	mu      sync.Mutex
+	outputs map[string]*retainedOutput
+}
+
+func newRetainedOutputs(retention time.Duration, size int, budget *bufferBudget) *retainedOutputs {
+	if retention <= 0 || size <= 0 {
+		return nil
+	}
+	return &retainedOutputs{retention: retention, size: size, budget: budget, outputs: make(map[string]*retainedOutput)}
+}
+
+// start retains the output of the exec id. It returns nil when retention is
+// off or the buffer budget has no room left, and the exec's output is then
+// not kept.
+func (r *retainedOutputs) start(id string) *retainedOutput {
+	if r == nil || !r.budget.reserve(int64(r.size)) {
+		return nil
+	}
+	l := &retainedOutput{id: id, size: r.size}
+	r.mu.Lock()
+	r.outputs[id] = l
+	r.mu.Unlock()
+	return l
+}
+
+// finish forgets l once the retention period has passed.
+func (r *retainedOutputs) finish(l *retainedOutput) {
+	if l == nil {
+		return
+	}
+	time.AfterFunc(r.retention, func() {
+		r.mu.Lock()
+		delete(r.outputs, l.id)
+		r.mu.Unlock()
+		r.budget.release(int64(r.size))
+	})
+}
+
+func (r *retainedOutputs) lookup(id string) *retainedOutput {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.outputs[id]
+}
+
+func (s *Server) handleLogs(writer *frameWriter, payload logsRequestPayload) {
+	if s.retained == nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "exec output is not retained by this agent", Code: errorCodeUnsupported})
+		return
+	}
+	l := s.retained.lookup(payload.ID)
+	if l == nil {
+		_ = writer.send(frameTypeError, errorPayload{Message: "unknown exec " + payload.ID})
+		return
+	}
+	_ = writer.send(frameTypeLogs, logsPayload{Data: l.tail(payload.TailBytes)})
+}
+
+// Logs returns the last tailBytes bytes of an exec's output, stdout and
+// stderr interleaved, or all the agent kept when tailBytes is zero or less.
+// execID is the JobID of a detached exec or the ExecID of a result; output
+// stays available for the agent's ExecLogRetention after the exec finishes.
+// Agents that keep no output return ErrUnsupported.
+func (c *IPCClient) Logs(ctx context.Context, execID string, tailBytes int) ([]byte, error) {
+	var result logsPayload
+	if err := c.call(ctx, frameTypeLogsRequest, logsRequestPayload{ID: execID, TailBytes: tailBytes}, frameTypeLogs, &result); err != nil {
+		return nil, err
+	}
+	return result.Data, nil
+}
@@ -0,0 +1,71 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy makes an IPCClient retry dials that fail because the agent is
+// not listening yet: connection refused, or a socket path that does not
+// exist. Other dial errors are returned at once.
+type RetryPolicy struct {
+	// MaxAttempts counts the first dial; values below 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the wait before the second attempt.
+	BaseDelay time.Duration
+	// Factor multiplies the delay after each retry; values below 1 keep it
+	// constant.
+	Factor float64
+	// Jitter randomizes each delay by up to this fraction of it, in 0..1.
+	Jitter float64
+}
+
+// DefaultRetryPolicy covers an agent that is still starting: six attempts
+// over roughly 1.5 seconds.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{MaxAttempts: 6, BaseDelay: 50 * time.Millisecond, Factor: 2, Jitter: 0.2}
+}
+
+// delay returns the wait before attempt n, counting the first retry as 1.
+func (p *RetryPolicy) delay(n int) time.Duration {
+	d := float64(p.BaseDelay)
+	for i := 1; i < n && p.Factor > 1; i++ {
+		d *= p.Factor
+	}
+	if j := min(max(p.Jitter, 0), 1); j > 0 {
+		d += d * j * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// retryableDialError reports whether err means nothing is listening yet.
+func retryableDialError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, os.ErrNotExist)
+}
+
+// dialRetry dials with d, retrying under policy. It gives up early when
+// ctx ends or when the next wait would outlast its deadline.
+func dialRetry(ctx context.Context, d Dialer, policy *RetryPolicy) (net.Conn, error) {
+	for attempt := 1; ; attempt++ {
+		conn, err := d.Dial(ctx)
+		if err == nil || policy == nil || attempt >= policy.MaxAttempts || !retryableDialError(err) {
+			return conn, err
+		}
+		wait := policy.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return nil, err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
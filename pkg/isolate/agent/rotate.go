@@ -0,0 +1,204 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rotatingFile appends to path and rotates it before it would exceed
+// maxBytes, or once it has been open for maxAge. Writes are split on line
+// boundaries where possible, so lines only straddle files when a single line
+// is longer than maxBytes. Rotated files are kept as path.1 (newest) through
+// path.<keep>.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	keep     int
+	file     *os.File
+	size     int64
+	opened   time.Time
+}
+
+func openRotatingFile(path string, spec *logFilePayload) (*rotatingFile, error) {
+	if spec.MaxBytes < 0 || spec.MaxAgeMilli < 0 || spec.Keep < 0 {
+		return nil, fmt.Errorf("log %s: rotation limits must not be negative", path)
+	}
+	if dir := filepath.Dir(path); dir != "" && dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	r := &rotatingFile{
+		path:     path,
+		maxBytes: spec.MaxBytes,
+		maxAge:   time.Duration(spec.MaxAgeMilli) * time.Millisecond,
+		keep:     spec.Keep,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, defaultFileMode)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		if r.size > 0 && r.maxAge > 0 && time.Since(r.opened) >= r.maxAge {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+		}
+		n := len(p)
+		if r.maxBytes > 0 && r.size+int64(n) > r.maxBytes {
+			n = fitLines(p, r.maxBytes-r.size)
+			if n == 0 && r.size > 0 {
+				if err := r.rotate(); err != nil {
+					return written, err
+				}
+				continue
+			}
+			if n == 0 {
+				// Not even one line fits in an empty file; split it.
+				n = int(r.maxBytes)
+			}
+		}
+		k, err := r.file.Write(p[:n])
+		r.size += int64(k)
+		written += k
+		if err != nil {
+			return written, err
+		}
+		p = p[k:]
+	}
+	return written, nil
+}
+
+// fitLines returns the length of the longest run of whole lines at the start
+// of p that fits in room bytes.
+func fitLines(p []byte, room int64) int {
+	if room <= 0 {
+		return 0
+	}
+	if room < int64(len(p)) {
+		p = p[:room]
+	}
+	return bytes.LastIndexByte(p, '\n') + 1
+}
+
+// rotate shifts the kept files up by one, moves the current file to path.1
+// (or drops it when nothing is kept) and reopens path.
+func (r *rotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	if r.keep == 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, r.keep))
+	for i := r.keep - 1; i >= 1; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// execLogs holds the rotating files an exec's output is written to.
+type execLogs struct {
+	stdout *rotatingFile
+	stderr *rotatingFile
+}
+
+// openExecLogs opens the log files named in the request within the agent's
+// root. A stream cannot go to both a log and a FIFO.
+func (s *Server) openExecLogs(payload *execRequestPayload) (*execLogs, error) {
+	logs := &execLogs{}
+	specs := []struct {
+		name string
+		spec *logFilePayload
+		fifo string
+		dst  **rotatingFile
+	}{
+		{"stdout", payload.StdoutLog, payload.StdoutFIFO, &logs.stdout},
+		{"stderr", payload.StderrLog, payload.StderrFIFO, &logs.stderr},
+	}
+	for _, spec := range specs {
+		if spec.spec == nil {
+			continue
+		}
+		if spec.spec.Path == "" {
+			logs.close()
+			return nil, fmt.Errorf("%s log path is required", spec.name)
+		}
+		if spec.fifo != "" {
+			logs.close()
+			return nil, fmt.Errorf("%s cannot be sent to both a log and a fifo", spec.name)
+		}
+		path, err := s.resolveRootedPath(spec.spec.Path)
+		if err != nil {
+			logs.close()
+			return nil, fmt.Errorf("security violation: %w", err)
+		}
+		file, err := openRotatingFile(path, spec.spec)
+		if err != nil {
+			logs.close()
+			return nil, err
+		}
+		*spec.dst = file
+	}
+	return logs, nil
+}
+
+func (l *execLogs) close() {
+	for _, file := range []*rotatingFile{l.stdout, l.stderr} {
+		if file != nil {
+			_ = file.Close()
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "job.log")
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// 200 lines of 9 bytes: 11 fit in each 100 byte file.
+	result, err := client.Exec(ctx, &CommandRequest{
+		Path:      "/bin/sh",
+		Args:      []string{"-c", `i=1; while [ $i -le 200 ]; do printf 'line %03d\n' $i; i=$((i+1)); done; echo done >&2`},
+		Detach:    true,
+		StdoutLog: &LogFile{Path: path, MaxBytes: 100, Keep: 3},
+	})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if result.ExitCode != 0 || len(result.Stdout) != 0 || string(result.Stderr) != "done\n" {
+		t.Errorf("result = exit %d, stdout %q, stderr %q; want stdout only in the log", result.ExitCode, result.Stdout, result.Stderr)
+	}
+
+	// The kept files, oldest first, hold the last lines without gaps.
+	var kept []string
+	for _, name := range []string{path + ".3", path + ".2", path + ".1", path} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 100 || len(data)%9 != 0 {
+			t.Errorf("%s holds %d bytes, want whole lines within 100", filepath.Base(name), len(data))
+		}
+		kept = append(kept, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+	}
+	last := 200 - len(kept) + 1
+	for i, line := range kept {
+		if want := fmt.Sprintf("line %03d", last+i); line != want {
+			t.Fatalf("kept line %d = %q, want %q", i, line, want)
+		}
+	}
+	if len(kept) < 3*11 {
+		t.Errorf("kept %d lines, want the three rotated files full", len(kept))
+	}
+	if _, err := os.Stat(path + ".4"); !os.IsNotExist(err) {
+		t.Errorf("a fourth rotated file exists: %v", err)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "age.log")
+	r, err := openRotatingFile(path, &logFilePayload{MaxAgeMilli: 50, Keep: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Write([]byte("old\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := r.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{path + ".1": "old\n", path: "new\n"} {
+		if got, err := os.ReadFile(name); err != nil || string(got) != want {
+			t.Errorf("%s = %q, %v; want %q", filepath.Base(name), got, err, want)
+		}
+	}
+}
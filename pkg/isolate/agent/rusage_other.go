@@ -0,0 +1,10 @@
+//go:build !unix
+
+package agent
+
+import "os"
+
+// maxRSSBytes is zero where the platform reports no rusage.
+func maxRSSBytes(state *os.ProcessState) uint64 {
+	return 0
+}
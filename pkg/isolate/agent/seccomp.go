@@ -0,0 +1,190 @@
+package agent
+
+//go:generate go run mkseccomp.go
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Built-in seccomp profiles accepted by ServerConfig.SeccompProfile.
+const (
+	// SeccompProfileDefault allows everything except system calls that
+	// administer the host or escape isolation: module loading, mounts,
+	// namespaces, ptrace, bpf, reboot, clock and swap changes and the like.
+	SeccompProfileDefault = "default"
+	// SeccompProfileStrict allows only the system calls ordinary programs
+	// need for file, memory, process and time handling. Networking,
+	// tracing and all administration are blocked.
+	SeccompProfileStrict = "strict"
+)
+
+// ExitReasonSeccomp is the exit reason of a command killed for making a
+// system call its seccomp profile blocks.
+const ExitReasonSeccomp = "seccomp_killed"
+
+// errSeccompUnsupported is returned on platforms without seccomp, where a
+// configured profile is ignored with a warning.
+var errSeccompUnsupported = errors.New("seccomp filters require linux")
+
+// Profile actions, as named by Docker and OCI seccomp profiles.
+const (
+	seccompActAllow       = "SCMP_ACT_ALLOW"
+	seccompActErrno       = "SCMP_ACT_ERRNO"
+	seccompActKill        = "SCMP_ACT_KILL"
+	seccompActKillThread  = "SCMP_ACT_KILL_THREAD"
+	seccompActKillProcess = "SCMP_ACT_KILL_PROCESS"
+	seccompActTrap        = "SCMP_ACT_TRAP"
+	seccompActLog         = "SCMP_ACT_LOG"
+)
+
+// seccompProfile is the subset of the Docker/OCI seccomp profile format the
+// agent understands. Architecture lists are ignored: profiles are compiled
+// for the agent's own architecture.
+type seccompProfile struct {
+	DefaultAction   string        `json:"defaultAction"`
+	DefaultErrnoRet *uint32       `json:"defaultErrnoRet,omitempty"`
+	Syscalls        []seccompRule `json:"syscalls"`
+}
+
+// seccompRule applies Action to the named system calls. Argument filters
+// and capability or architecture conditions are not evaluated; see
+// seccompRule.conditional.
+type seccompRule struct {
+	Names    []string          `json:"names"`
+	Name     string            `json:"name,omitempty"` // older single-name form
+	Action   string            `json:"action"`
+	ErrnoRet *uint32           `json:"errnoRet,omitempty"`
+	Args     []json.RawMessage `json:"args,omitempty"`
+	Includes json.RawMessage   `json:"includes,omitempty"`
+	Excludes json.RawMessage   `json:"excludes,omitempty"`
+}
+
+// conditional reports whether the rule only applies under conditions the
+// agent cannot evaluate. Such rules are dropped when they allow and applied
+// unconditionally otherwise, so the compiled filter is never more
+// permissive than the profile.
+func (r seccompRule) conditional() bool {
+	return len(r.Args) > 0 || !emptyJSON(r.Includes) || !emptyJSON(r.Excludes)
+}
+
+func emptyJSON(raw json.RawMessage) bool {
+	s := string(raw)
+	return s == "" || s == "null" || s == "{}"
+}
+
+func (r seccompRule) names() []string {
+	if r.Name != "" {
+		return append([]string{r.Name}, r.Names...)
+	}
+	return r.Names
+}
+
+// bpfInsn is one classic BPF instruction of a compiled seccomp filter, in
+// the layout of struct sock_filter.
+type bpfInsn struct {
+	Code uint16 `json:"c"`
+	Jt   uint8  `json:"t,omitempty"`
+	Jf   uint8  `json:"f,omitempty"`
+	K    uint32 `json:"k,omitempty"`
+}
+
+// loadSeccompFilter loads the profile called name and compiles it for this
+// platform. An empty name means no filter.
+func loadSeccompFilter(name string) ([]bpfInsn, error) {
+	if name == "" {
+		return nil, nil
+	}
+	profile, err := loadSeccompProfile(name)
+	if err != nil {
+		return nil, err
+	}
+	return compileSeccomp(profile)
+}
+
+// loadSeccompProfile returns the built-in profile called name, or reads a
+// JSON profile from the file name.
+func loadSeccompProfile(name string) (*seccompProfile, error) {
+	switch name {
+	case SeccompProfileDefault:
+		return &seccompProfile{
+			DefaultAction: seccompActAllow,
+			Syscalls:      []seccompRule{{Names: seccompDefaultDenied, Action: seccompActKillProcess}},
+		}, nil
+	case SeccompProfileStrict:
+		return &seccompProfile{
+			DefaultAction: seccompActKillProcess,
+			Syscalls:      []seccompRule{{Names: seccompStrictAllowed, Action: seccompActAllow}},
+		}, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var profile seccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", name, err)
+	}
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("%s: defaultAction is required", name)
+	}
+	return &profile, nil
+}
+
+// seccompDefaultDenied are the system calls SeccompProfileDefault kills a
+// command for.
+var seccompDefaultDenied = []string{
+	"_sysctl", "acct", "add_key", "adjtimex", "bpf", "clock_adjtime",
+	"clock_settime", "create_module", "delete_module", "finit_module",
+	"fsconfig", "fsmount", "fsopen", "fspick", "get_kernel_syms",
+	"init_module", "ioperm", "iopl", "kcmp", "kexec_file_load", "kexec_load",
+	"keyctl", "lookup_dcookie", "mount", "mount_setattr", "move_mount",
+	"name_to_handle_at", "nfsservctl", "open_by_handle_at", "open_tree",
+	"perf_event_open", "pivot_root", "process_vm_readv", "process_vm_writev",
+	"ptrace", "query_module", "quotactl", "quotactl_fd", "reboot",
+	"request_key", "setns", "settimeofday", "swapoff", "swapon", "syslog",
+	"umount2", "unshare", "uselib", "userfaultfd", "ustat", "vhangup",
+}
+
+// seccompStrictAllowed are the only system calls SeccompProfileStrict
+// permits.
+var seccompStrictAllowed = []string{
+	// Files and descriptors.
+	"read", "write", "readv", "writev", "pread64", "pwrite64", "preadv",
+	"pwritev", "preadv2", "pwritev2", "open", "openat", "openat2", "creat",
+	"close", "close_range", "stat", "fstat", "lstat", "newfstatat", "statx",
+	"statfs", "fstatfs", "access", "faccessat", "faccessat2", "lseek",
+	"ioctl", "fcntl", "flock", "fsync", "fdatasync", "ftruncate",
+	"truncate", "fallocate", "fadvise64", "getdents", "getdents64",
+	"getcwd", "chdir", "fchdir", "rename", "renameat", "renameat2", "mkdir",
+	"mkdirat", "rmdir", "link", "linkat", "unlink", "unlinkat", "symlink",
+	"symlinkat", "readlink", "readlinkat", "chmod", "fchmod", "fchmodat",
+	"chown", "fchown", "fchownat", "lchown", "umask", "utime", "utimes",
+	"utimensat", "futimesat", "dup", "dup2", "dup3", "pipe", "pipe2",
+	"socketpair", "sendfile", "splice", "tee", "copy_file_range",
+	"memfd_create", "select", "pselect6", "poll", "ppoll", "epoll_create",
+	"epoll_create1", "epoll_ctl", "epoll_wait", "epoll_pwait",
+	"epoll_pwait2", "eventfd", "eventfd2", "timerfd_create",
+	"timerfd_settime", "timerfd_gettime", "signalfd", "signalfd4",
+	// Memory.
+	"brk", "mmap", "munmap", "mremap", "mprotect", "madvise", "msync",
+	"mincore", "membarrier",
+	// Processes, threads and signals.
+	"clone", "clone3", "fork", "vfork", "execve", "execveat", "exit",
+	"exit_group", "wait4", "waitid", "kill", "tkill", "tgkill",
+	"rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "rt_sigsuspend",
+	"rt_sigpending", "rt_sigtimedwait", "sigaltstack", "restart_syscall",
+	"futex", "set_robust_list", "get_robust_list", "set_tid_address",
+	"rseq", "arch_prctl", "prctl", "capget", "sched_yield",
+	"sched_getaffinity", "sched_getparam", "sched_getscheduler",
+	"getpid", "getppid", "gettid", "getuid", "geteuid", "getgid",
+	"getegid", "getgroups", "getresuid", "getresgid", "getpgrp", "getpgid",
+	"setpgid", "getsid", "setsid", "getrlimit", "prlimit64", "getrusage",
+	// Time and system information.
+	"nanosleep", "clock_nanosleep", "clock_gettime", "clock_getres",
+	"gettimeofday", "time", "times", "alarm", "getitimer", "setitimer",
+	"timer_create", "timer_settime", "timer_gettime", "timer_getoverrun",
+	"timer_delete", "uname", "sysinfo", "getrandom",
+}
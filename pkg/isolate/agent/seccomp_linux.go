@@ -0,0 +1,235 @@
+//go:build linux
+
+package agent
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Filter return values from linux/seccomp.h; the low 16 bits carry data.
+const (
+	seccompRetKillProcess = 0x80000000
+	seccompRetKillThread  = 0x00000000
+	seccompRetTrap        = 0x00030000
+	seccompRetErrno       = 0x00050000
+	seccompRetLog         = 0x7ffc0000
+	seccompRetAllow       = 0x7fff0000
+
+	// Offsets into struct seccomp_data.
+	seccompDataNr   = 0
+	seccompDataArch = 4
+
+	// x32 system calls on amd64 have this bit set in their number.
+	x32SyscallBit = 0x40000000
+
+	bpfMaxInsns = 4096
+
+	// auditSeccomp is the audit record type of a logged seccomp action.
+	auditSeccomp = "type=1326"
+)
+
+// compileSeccomp translates profile into a BPF filter for the running
+// architecture. Calls from any other architecture are killed. Names the
+// architecture does not have are skipped, as libseccomp does. A system call
+// named by several rules gets the most restrictive of their actions.
+func compileSeccomp(profile *seccompProfile) ([]bpfInsn, error) {
+	if seccompSyscalls == nil {
+		return nil, fmt.Errorf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	defaultRet, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, fmt.Errorf("defaultAction: %w", err)
+	}
+	rets := make(map[uint32]uint32)
+	for i, rule := range profile.Syscalls {
+		ret, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, fmt.Errorf("syscalls[%d]: %w", i, err)
+		}
+		if rule.conditional() && ret == seccompRetAllow {
+			continue
+		}
+		for _, name := range rule.names() {
+			nr, ok := seccompSyscalls[name]
+			if !ok {
+				continue
+			}
+			if prev, ok := rets[nr]; !ok || moreRestrictive(ret, prev) {
+				rets[nr] = ret
+			}
+		}
+	}
+
+	nrs := make([]uint32, 0, len(rets))
+	for nr, ret := range rets {
+		if ret != defaultRet {
+			nrs = append(nrs, nr)
+		}
+	}
+	sort.Slice(nrs, func(i, j int) bool { return nrs[i] < nrs[j] })
+
+	prog := []bpfInsn{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompAuditArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+	}
+	if seccompAuditArch == unix.AUDIT_ARCH_X86_64 {
+		prog = append(prog,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, seccompRetKillProcess),
+		)
+	}
+	for _, nr := range nrs {
+		prog = append(prog,
+			bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, rets[nr]),
+		)
+	}
+	prog = append(prog, bpfStmt(unix.BPF_RET|unix.BPF_K, defaultRet))
+	if len(prog) > bpfMaxInsns {
+		return nil, fmt.Errorf("profile compiles to %d instructions, more than the kernel's %d", len(prog), bpfMaxInsns)
+	}
+	return prog, nil
+}
+
+func seccompAction(action string, errnoRet *uint32) (uint32, error) {
+	switch action {
+	case seccompActAllow:
+		return seccompRetAllow, nil
+	case seccompActErrno:
+		errno := uint32(syscall.EPERM)
+		if errnoRet != nil {
+			errno = *errnoRet
+		}
+		return seccompRetErrno | errno&0xffff, nil
+	case seccompActKill, seccompActKillThread:
+		return seccompRetKillThread, nil
+	case seccompActKillProcess:
+		return seccompRetKillProcess, nil
+	case seccompActTrap:
+		return seccompRetTrap, nil
+	case seccompActLog:
+		return seccompRetLog, nil
+	default:
+		return 0, fmt.Errorf("unsupported action %q", action)
+	}
+}
+
+// moreRestrictive orders return values the way the kernel does when several
+// filters apply: by action, as a signed value, lowest first.
+func moreRestrictive(a, b uint32) bool {
+	return int32(a&0xffff0000) < int32(b&0xffff0000)
+}
+
+func bpfStmt(code uint16, k uint32) bpfInsn {
+	return bpfInsn{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) bpfInsn {
+	return bpfInsn{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// installSeccomp loads prog as the calling thread's seccomp filter, which
+// execve passes on to the new program. Callers must have locked the
+// goroutine to its thread. Without root, no_new_privs is set first, as the
+// kernel requires.
+func installSeccomp(prog []bpfInsn) error {
+	if os.Geteuid() != 0 {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("set no_new_privs: %w", err)
+		}
+	}
+	filters := make([]unix.SockFilter, len(prog))
+	for i, insn := range prog {
+		filters[i] = unix.SockFilter{Code: insn.Code, Jt: insn.Jt, Jf: insn.Jf, K: insn.K}
+	}
+	fprog := unix.SockFprog{Len: uint16(len(filters)), Filter: &filters[0]}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0); err != nil {
+		return fmt.Errorf("install seccomp filter: %w", err)
+	}
+	return nil
+}
+
+// seccompKilled reports whether a command died of the SIGSYS a seccomp
+// filter raises when it kills or traps a system call.
+func seccompKilled(state *os.ProcessState) bool {
+	if state == nil {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGSYS
+}
+
+// blockedSyscall finds the kernel's audit record of the seccomp kill of pid
+// in /dev/kmsg and returns the system call it names. It returns "" when the
+// log cannot be read, which needs CAP_SYSLOG or kernel.dmesg_restrict=0, or
+// holds no such record, e.g. because auditing is disabled. The record is
+// written asynchronously, so a missing one is looked for a few times.
+func blockedSyscall(pid int) string {
+	pidField := " pid=" + strconv.Itoa(pid) + " "
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		nr, err := findAuditSyscall(pidField)
+		if err != nil {
+			return ""
+		}
+		if nr < 0 {
+			continue
+		}
+		for name, n := range seccompSyscalls {
+			if int64(n) == nr {
+				return name
+			}
+		}
+		return "syscall " + strconv.FormatInt(nr, 10)
+	}
+	return ""
+}
+
+// findAuditSyscall returns the system call number of the last seccomp audit
+// record in the kernel log containing pidField, or -1 if there is none.
+func findAuditSyscall(pidField string) (int64, error) {
+	// Read the device directly: through os.File the poller would wait for
+	// new records instead of reporting the end of the log.
+	fd, err := syscall.Open("/dev/kmsg", syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(fd)
+	nr := int64(-1)
+	buf := make([]byte, 8192)
+	for {
+		// Each read returns one record.
+		n, err := syscall.Read(fd, buf)
+		if err == syscall.EPIPE || err == syscall.EINTR {
+			// EPIPE: the record was overwritten; the next read resumes.
+			continue
+		}
+		if err != nil || n <= 0 {
+			return nr, nil
+		}
+		record := string(buf[:n])
+		if !strings.Contains(record, auditSeccomp) || !strings.Contains(record, pidField) {
+			continue
+		}
+		if _, rest, ok := strings.Cut(record, " syscall="); ok {
+			field, _, _ := strings.Cut(rest, " ")
+			if v, err := strconv.ParseInt(field, 10, 64); err == nil {
+				nr = v
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package agent
+
+import "os"
+
+func compileSeccomp(profile *seccompProfile) ([]bpfInsn, error) {
+	return nil, errSeccompUnsupported
+}
+
+func seccompKilled(state *os.ProcessState) bool {
+	return false
+}
+
+func blockedSyscall(pid int) string {
+	return ""
+}
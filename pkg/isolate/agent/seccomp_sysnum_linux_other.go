@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !arm64
+
+package agent
+
+// Seccomp profiles are only compiled for the architectures mkseccomp.go
+// generates tables for; elsewhere compileSeccomp refuses them.
+const seccompAuditArch = 0
+
+var seccompSyscalls map[string]uint32
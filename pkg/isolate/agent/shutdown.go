@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrServerClosed is returned by Serve once the server has shut down.
+var ErrServerClosed = errors.New("agent server closed")
+
+// Shutdown stops the server accepting connections: the listeners passed to
+// Serve are closed and Done is closed. Connections already accepted, and
+// their execs, run to completion. Calling it again does nothing.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() {
+		close(s.shutdown)
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		for ln := range s.listeners {
+			_ = ln.Close()
+		}
+	})
+}
+
+// Done is closed when the server shuts down, such as after IdleTimeout.
+func (s *Server) Done() <-chan struct{} {
+	return s.shutdown
+}
+
+// trackListener registers l to be closed by Shutdown, reporting false when
+// the server has already shut down.
+func (s *Server) trackListener(l net.Listener) bool {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	if s.closed() {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.listenersMu.Lock()
+	delete(s.listeners, l)
+	s.listenersMu.Unlock()
+}
+
+// closed reports whether the server has shut down.
+func (s *Server) closed() bool {
+	select {
+	case <-s.shutdown:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,146 @@
+package agent
+
+import (
+	"hash"
+	"io"
+	"os"
+)
+
+// sendSparseFile streams file as data chunks separated by file_get_hole
+// frames. It returns false without sending anything when the holes of file
+// cannot be located, leaving the caller to fall back to a dense copy.
+func (s *Server) sendSparseFile(writer *frameWriter, file *os.File, sum hash.Hash) bool {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	size := info.Size()
+	start, end, ok, err := nextDataRegion(file, 0)
+	if err != nil {
+		return false
+	}
+
+	buf := make([]byte, s.chunkSize)
+	var off int64
+	fail := func(err error) bool {
+		_ = writer.send(frameTypeFileGetResult, fileTransferResultPayload{Bytes: off, Error: err.Error()})
+		return true
+	}
+	for {
+		if !ok || start > size {
+			start, end = size, size
+		}
+		if start > off {
+			if err := writer.send(frameTypeFileGetHole, holePayload{Length: start - off}); err != nil {
+				return true
+			}
+			hashZeros(sum, start-off)
+			off = start
+		}
+		if off >= size {
+			break
+		}
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return fail(err)
+		}
+		region := io.LimitReader(file, end-start)
+		for {
+			n, readErr := region.Read(buf)
+			if n > 0 {
+				chunk := append([]byte(nil), buf[:n]...)
+				off += int64(n)
+				if sum != nil {
+					sum.Write(chunk)
+				}
+				if err := writer.send(frameTypeFileGetChunk, chunkPayload{Data: chunk}); err != nil {
+					return true
+				}
+			}
+			if readErr == io.EOF {
+				break
+			}
+			if readErr != nil {
+				return fail(readErr)
+			}
+		}
+		if off < end {
+			// The file shrank underneath us; report what was sent.
+			break
+		}
+		if start, end, ok, err = nextDataRegion(file, off); err != nil {
+			return fail(err)
+		}
+	}
+	_ = writer.send(frameTypeFileGetResult, fileTransferResultPayload{Bytes: off, SHA256: checksumHex(sum)})
+	return true
+}
+
+// isZero reports whether b holds only zero bytes.
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// holeWriter recreates the holes announced by file_get_hole frames. Writers
+// that can seek (such as *os.File) skip over them, leaving the destination
+// sparse; anything else receives the equivalent run of zeros.
+type holeWriter struct {
+	w        io.Writer
+	seeker   io.Seeker
+	trailing bool // the last hole was skipped by seeking
+}
+
+func newHoleWriter(w io.Writer) *holeWriter {
+	hw := &holeWriter{w: w}
+	if seeker, ok := w.(io.Seeker); ok {
+		hw.seeker = seeker
+	}
+	return hw
+}
+
+func (hw *holeWriter) Write(p []byte) (int, error) {
+	hw.trailing = false
+	return hw.w.Write(p)
+}
+
+func (hw *holeWriter) hole(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if hw.seeker != nil {
+		if _, err := hw.seeker.Seek(n, io.SeekCurrent); err == nil {
+			hw.trailing = true
+			return nil
+		}
+		// Not actually seekable (a pipe or terminal); write zeros.
+		hw.seeker = nil
+	}
+	hw.trailing = false
+	zeros := make([]byte, min(n, defaultChunkSize))
+	for n > 0 {
+		k, err := hw.w.Write(zeros[:min(n, int64(len(zeros)))])
+		if err != nil {
+			return err
+		}
+		n -= int64(k)
+	}
+	return nil
+}
+
+// finish extends the destination over a trailing hole, which seeking alone
+// does not do, by writing its final byte.
+func (hw *holeWriter) finish() error {
+	if !hw.trailing {
+		return nil
+	}
+	hw.trailing = false
+	if _, err := hw.seeker.Seek(-1, io.SeekCurrent); err != nil {
+		return err
+	}
+	_, err := hw.w.Write([]byte{0})
+	return err
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package agent
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lseek whence values for locating data and holes (see lseek(2)).
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// nextDataRegion returns the bounds of the first data region of f at or
+// after off. ok is false when only a hole remains up to the end of the file.
+func nextDataRegion(f *os.File, off int64) (start, end int64, ok bool, err error) {
+	start, err = f.Seek(off, seekData)
+	if err != nil {
+		if errors.Is(err, syscall.ENXIO) {
+			return 0, 0, false, nil
+		}
+		return 0, 0, false, err
+	}
+	end, err = f.Seek(start, seekHole)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return start, end, true, nil
+}
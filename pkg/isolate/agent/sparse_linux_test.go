@@ -0,0 +1,116 @@
+//go:build linux
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const sparseSize = 4 << 20
+
+// writeSparseFile writes a 4 MiB file holding two small data regions, the
+// rest of it holes, including a trailing one.
+func writeSparseFile(t *testing.T, path string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, region := range []struct {
+		off  int64
+		data string
+	}{{0, "head"}, {1 << 20, "middle"}} {
+		if _, err := f.WriteAt(bytes.Repeat([]byte(region.data), 1024), region.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(sparseSize); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// allocated returns the bytes of disk allocated to path.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+// checkSparseCopy verifies that dst has src's content and stays sparse.
+func checkSparseCopy(t *testing.T, src, dst string) {
+	t.Helper()
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("copy differs: %d bytes, want %d", len(got), len(want))
+	}
+	if n := allocated(t, dst); n > sparseSize/4 {
+		t.Errorf("copy allocates %d of its %d bytes, want it sparse", n, sparseSize)
+	}
+}
+
+func TestSparseTransfers(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "disk.img")
+	writeSparseFile(t, src)
+	if allocated(t, src) > sparseSize/4 {
+		t.Skip("the file system does not keep files sparse")
+	}
+	_, client := startServer(t, ServerConfig{})
+	client.VerifyChecksum = true
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("get", func(t *testing.T) {
+		dst := filepath.Join(dir, "got.img")
+		f, err := os.Create(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := client.CopyFrom(ctx, src, f); err != nil {
+			t.Fatalf("CopyFrom: %v", err)
+		}
+		checkSparseCopy(t, src, dst)
+	})
+
+	t.Run("get to a stream", func(t *testing.T) {
+		// Writers that cannot seek receive the holes as zeros.
+		var buf bytes.Buffer
+		if err := client.CopyFrom(ctx, src, &buf); err != nil {
+			t.Fatalf("CopyFrom: %v", err)
+		}
+		if want, _ := os.ReadFile(src); !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("streamed copy differs: %d bytes, want %d", buf.Len(), len(want))
+		}
+	})
+
+	t.Run("put", func(t *testing.T) {
+		f, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		dst := filepath.Join(dir, "put.img")
+		if err := client.CopyTo(ctx, f, dst); err != nil {
+			t.Fatalf("CopyTo: %v", err)
+		}
+		checkSparseCopy(t, src, dst)
+	})
+}
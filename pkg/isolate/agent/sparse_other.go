@@ -0,0 +1,14 @@
+//go:build !linux
+
+package agent
+
+import (
+	"errors"
+	"os"
+)
+
+// nextDataRegion is only implemented on Linux; elsewhere files are always
+// transferred densely.
+func nextDataRegion(f *os.File, off int64) (start, end int64, ok bool, err error) {
+	return 0, 0, false, errors.New("locating holes is not supported on this platform")
+}
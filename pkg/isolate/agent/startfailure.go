@@ -0,0 +1,113 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// ExitReasonCommandNotFound is the exit reason of a command whose executable
+// does not exist. Its exit code is 127, as a shell would report.
+const ExitReasonCommandNotFound = "command_not_found"
+
+// ExitReasonNotExecutable is the exit reason of a command whose executable
+// exists but cannot be run, for lack of permission or because it is not in
+// a format the kernel can execute. Its exit code is 126, as a shell would
+// report.
+const ExitReasonNotExecutable = "not_executable"
+
+const (
+	exitCodeCommandNotFound = 127
+	exitCodeNotExecutable   = 126
+)
+
+// startFailure maps err, a failure to start a command, to the exit code and
+// reason a shell gives it. ok is false for failures that say nothing about
+// the executable itself, such as a missing working directory.
+func startFailure(err error) (exitCode int, reason string, ok bool) {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && pathErr.Op == "chdir" {
+		return 0, "", false
+	}
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return exitCodeCommandNotFound, ExitReasonCommandNotFound, true
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.ENOEXEC):
+		return exitCodeNotExecutable, ExitReasonNotExecutable, true
+	}
+	return 0, "", false
+}
+
+// startFailureResult is the result of a command that failed to start with
+// err, or nil when startFailure does not map err to an exit code. The error
+// takes the place of the command's stderr.
+func startFailureResult(err error) *execResultPayload {
+	exitCode, reason, ok := startFailure(err)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	return &execResultPayload{
+		ExitCode:   exitCode,
+		Stderr:     []byte(err.Error() + "\n"),
+		StartedAt:  now,
+		FinishedAt: now,
+		ExitReason: reason,
+	}
+}
+
+// sendStartFailure reports a command that failed to start with err: as a
+// result with a shell's exit code where startFailure has one, otherwise as
+// an error frame.
+func sendStartFailure(writer *frameWriter, err error) {
+	if result := startFailureResult(err); result != nil {
+		_ = writer.send(frameTypeResult, result)
+		return
+	}
+	_ = writer.send(frameTypeError, errorPayload{Message: err.Error()})
+}
+
+// startFailed reports a command that failed to start with err, or a dry run
+// that found it would.
+func (s *Server) startFailed(frames frameSource, writer *frameWriter, payload *execRequestPayload, err error, keepAlive bool) (reusable bool) {
+	if payload.DryRun {
+		return s.refuseExec(frames, writer, payload, errorPayload{Message: err.Error()}, keepAlive)
+	}
+	sendStartFailure(writer, err)
+	return s.awaitResultAck(frames, writer, payload, keepAlive)
+}
+
+// awaitResultAck follows a result sent for an exec that never ran. A client
+// keeping its connection acknowledges it with exec_done as it does any
+// result, and is waited for so the connection can serve it again.
+func (s *Server) awaitResultAck(frames frameSource, writer *frameWriter, payload *execRequestPayload, keepAlive bool) (reusable bool) {
+	if !keepAlive || payload.Detach || payload.StdioFD {
+		return false
+	}
+	stdinDone := make(chan bool, 1)
+	go s.consumeStdin(frames, writer, discardStdin{}, payload.StdinAck, newOutputGate(), nil, func(syscall.Signal) {}, stdinDone)
+	return awaitExecDone(frames, stdinDone)
+}
+
+// discardStdin stands in for the stdin of a command that never started.
+type discardStdin struct{}
+
+func (discardStdin) Write(p []byte) (int, error) { return len(p), nil }
+
+func (discardStdin) Close() error { return nil }
+
+// commandNotFoundError reports a command name that is not in the PATH the
+// agent looked it up in. It matches exec.ErrNotFound.
+type commandNotFoundError struct {
+	name     string
+	pathList string
+}
+
+func (e *commandNotFoundError) Error() string {
+	return fmt.Sprintf("command %q not found in PATH %q", e.name, e.pathList)
+}
+
+func (e *commandNotFoundError) Unwrap() error { return exec.ErrNotFound }
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package agent
+
+import "syscall"
+
+func statFilesystem(path string) (*DiskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	return &DiskUsage{
+		TotalBytes:     uint64(st.Blocks) * bsize,
+		FreeBytes:      uint64(st.Bfree) * bsize,
+		AvailableBytes: uint64(st.Bavail) * bsize,
+		TotalInodes:    uint64(st.Files),
+		FreeInodes:     uint64(st.Ffree),
+	}, nil
+}
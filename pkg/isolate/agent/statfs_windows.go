@@ -0,0 +1,9 @@
+//go:build windows
+
+package agent
+
+import "fmt"
+
+func statFilesystem(path string) (*DiskUsage, error) {
+	return nil, fmt.Errorf("filesystem statistics not supported on Windows")
+}
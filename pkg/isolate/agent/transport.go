@@ -0,0 +1,63 @@
+package agent
+
+import "net"
+
+// Socket buffer sizing. The kernel defaults (around 208 KiB for Unix sockets
+// and 256 KiB for vsock) limit throughput of bulk CopyTo/CopyFrom transfers;
+// 1-4 MiB on both ends is a good starting point for vsock bulk transfer.
+// Zero keeps the default.
+
+// bufferSizer is implemented by connections whose socket buffers can be
+// tuned directly, such as *net.UnixConn and *net.TCPConn.
+type bufferSizer interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// applyBufferSizes tunes conn's socket buffers where the connection type
+// supports it; other connections are left unchanged.
+func applyBufferSizes(conn net.Conn, read, write int) error {
+	if read <= 0 && write <= 0 {
+		return nil
+	}
+	sizer, ok := conn.(bufferSizer)
+	if !ok {
+		return setPlatformBufferSizes(conn, read, write)
+	}
+	if read > 0 {
+		if err := sizer.SetReadBuffer(read); err != nil {
+			return err
+		}
+	}
+	if write > 0 {
+		if err := sizer.SetWriteBuffer(write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithBufferSizes wraps l so every accepted connection gets the given socket
+// buffer sizes. Tuning is best-effort: connections that reject it are served
+// with their defaults.
+func WithBufferSizes(l net.Listener, read, write int) net.Listener {
+	if read <= 0 && write <= 0 {
+		return l
+	}
+	return &bufferedListener{Listener: l, read: read, write: write}
+}
+
+type bufferedListener struct {
+	net.Listener
+	read  int
+	write int
+}
+
+func (l *bufferedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	_ = applyBufferSizes(conn, l.read, l.write)
+	return conn, nil
+}
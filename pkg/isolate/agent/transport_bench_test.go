@@ -0,0 +1,43 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// BenchmarkCopyTo uploads a large file over a Unix socket with the kernel's
+// default socket buffers and with buffers tuned for bulk transfer.
+func BenchmarkCopyTo(b *testing.B) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4<<20/16) // 4MiB
+	for _, size := range []int{0, 256 << 10, 4 << 20} {
+		name := "default"
+		if size > 0 {
+			name = fmt.Sprintf("%dKiB", size>>10)
+		}
+		b.Run(name, func(b *testing.B) {
+			dir := b.TempDir()
+			sock := filepath.Join(dir, "agent.sock")
+			ln, err := net.Listen("unix", sock)
+			if err != nil {
+				b.Fatal(err)
+			}
+			srv := NewServer(ServerConfig{})
+			go func() { _ = srv.Serve(WithBufferSizes(ln, size, size)) }()
+			b.Cleanup(srv.Shutdown)
+			client := NewIPCClient(&UnixDialer{Path: sock, ReadBufferSize: size, WriteBufferSize: size})
+			dst := filepath.Join(dir, "upload")
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for range b.N {
+				if err := client.CopyTo(context.Background(), bytes.NewReader(data), dst); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHandshakeReply bounds the "OK <port>" line Firecracker answers a
+// CONNECT with.
+const maxHandshakeReply = 64
+
+// HybridVsockDialer connects to a guest agent through the Unix socket a
+// Firecracker VMM exposes for its vsock device. Each connection starts with
+// a "CONNECT <port>" line, which Firecracker answers with "OK <host port>"
+// once the guest has accepted on Port.
+type HybridVsockDialer struct {
+	Path    string
+	Port    uint32
+	Timeout time.Duration
+	// ReadBufferSize and WriteBufferSize set the socket buffers in bytes;
+	// zero keeps the kernel default.
+	ReadBufferSize  int
+	WriteBufferSize int
+}
+
+func (d *HybridVsockDialer) Dial(ctx context.Context) (net.Conn, error) {
+	if d == nil || d.Path == "" {
+		return nil, fmt.Errorf("vsock socket path is required")
+	}
+	if d.Port == 0 {
+		return nil, fmt.Errorf("vsock port is required")
+	}
+	conn, err := (&UnixDialer{
+		Path:            d.Path,
+		Timeout:         d.Timeout,
+		ReadBufferSize:  d.ReadBufferSize,
+		WriteBufferSize: d.WriteBufferSize,
+	}).Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.handshake(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *HybridVsockDialer) handshake(ctx context.Context, conn net.Conn) error {
+	deadline, ok := ctx.Deadline()
+	if d.Timeout > 0 && (!ok || time.Until(deadline) > d.Timeout) {
+		deadline, ok = time.Now().Add(d.Timeout), true
+	}
+	if ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+		defer conn.SetDeadline(time.Time{})
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", d.Port); err != nil {
+		return fmt.Errorf("vsock handshake: %w", err)
+	}
+	// Read one byte at a time: anything after the reply line belongs to the
+	// agent protocol.
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("vsock handshake: %w", err)
+		}
+		if buf[0] == '\n' {
+			break
+		}
+		if len(line) == maxHandshakeReply {
+			return fmt.Errorf("vsock handshake: reply too long")
+		}
+		line = append(line, buf[0])
+	}
+	reply := strings.TrimSpace(string(line))
+	hostPort, ok := strings.CutPrefix(reply, "OK ")
+	if !ok {
+		return fmt.Errorf("vsock handshake: unexpected reply %q", reply)
+	}
+	if _, err := strconv.ParseUint(hostPort, 10, 32); err != nil {
+		return fmt.Errorf("vsock handshake: unexpected reply %q", reply)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds how long the server waits for a TCP client to
+// complete the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TCPDialer connects to a guest agent listening on a TCP address, such as
+// one running on another host.
+type TCPDialer struct {
+	Address string
+	Timeout time.Duration
+	// TLSConfig, when set, runs TLS over the connection. Its certificates
+	// authenticate the client to agents that verify client certificates.
+	// An empty ServerName is taken from Address.
+	TLSConfig *tls.Config
+	// ReadBufferSize and WriteBufferSize set the socket buffers in bytes;
+	// zero keeps the kernel default.
+	ReadBufferSize  int
+	WriteBufferSize int
+}
+
+func (d *TCPDialer) Dial(ctx context.Context) (net.Conn, error) {
+	if d == nil || d.Address == "" {
+		return nil, fmt.Errorf("tcp address is required")
+	}
+	var nd net.Dialer
+	if d.Timeout > 0 {
+		nd.Timeout = d.Timeout
+	}
+	conn, err := nd.DialContext(ctx, "tcp", d.Address)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyBufferSizes(conn, d.ReadBufferSize, d.WriteBufferSize); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set socket buffers: %w", err)
+	}
+	if d.TLSConfig == nil {
+		return conn, nil
+	}
+
+	cfg := d.TLSConfig
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(d.Address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tls handshake: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// ListenTCP listens for agent connections on a TCP address such as ":7000".
+// The server runs TLS on the connections it accepts from it when
+// ServerConfig.TLSConfig is set.
+func ListenTCP(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+// isTCP reports whether conn came from a TCP listener.
+func isTCP(conn net.Conn) bool {
+	addr := conn.LocalAddr()
+	return addr != nil && addr.Network() == "tcp"
+}
+
+// secureConn runs the server's TLS handshake on TCP connections, before
+// any frame is read, so clients without an acceptable certificate are
+// turned away without being served. Other connections, and all of them
+// when no TLSConfig is set, are returned unchanged.
+func (s *Server) secureConn(conn net.Conn) (net.Conn, error) {
+	if s.tlsConfig == nil || !isTCP(conn) {
+		return conn, nil
+	}
+	tlsConn := tls.Server(conn, s.tlsConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
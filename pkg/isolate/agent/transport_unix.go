@@ -4,15 +4,31 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"runtime"
+	"strings"
 	"time"
 )
 
+// errAbstractUnsupported is returned for abstract sockets off Linux, the
+// only platform with an abstract socket namespace.
+var errAbstractUnsupported = errors.New("abstract unix sockets are only supported on linux")
+
 // UnixDialer connects to a guest agent exposed via a Unix domain socket.
 type UnixDialer struct {
 	Path    string
 	Timeout time.Duration
+	// Abstract makes Path a name in Linux's abstract socket namespace
+	// rather than a file, with or without the conventional leading "@".
+	// Abstract sockets vanish with their listener, so there is no stale
+	// socket file to remove.
+	Abstract bool
+	// ReadBufferSize and WriteBufferSize set the socket buffers in bytes;
+	// zero keeps the kernel default.
+	ReadBufferSize  int
+	WriteBufferSize int
 }
 
 func (d *UnixDialer) Dial(ctx context.Context) (net.Conn, error) {
@@ -23,5 +39,40 @@ func (d *UnixDialer) Dial(ctx context.Context) (net.Conn, error) {
 	if d.Timeout > 0 {
 		nd.Timeout = d.Timeout
 	}
-	return nd.DialContext(ctx, "unix", d.Path)
+	path := d.Path
+	if d.Abstract {
+		if runtime.GOOS != "linux" {
+			return nil, errAbstractUnsupported
+		}
+		path = abstractAddress(path)
+	}
+	conn, err := nd.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyBufferSizes(conn, d.ReadBufferSize, d.WriteBufferSize); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set socket buffers: %w", err)
+	}
+	return conn, nil
+}
+
+// ListenAbstract listens on name in Linux's abstract socket namespace; a
+// leading "@" is optional. Nothing is created on the filesystem, so two
+// agents starting at once cannot race on removing a stale socket: the
+// second fails with "address already in use".
+func ListenAbstract(name string) (net.Listener, error) {
+	if runtime.GOOS != "linux" {
+		return nil, errAbstractUnsupported
+	}
+	if strings.TrimPrefix(name, "@") == "" {
+		return nil, fmt.Errorf("abstract socket name is required")
+	}
+	return net.Listen("unix", abstractAddress(name))
+}
+
+// abstractAddress returns the address of an abstract socket in the form
+// the net package expects: a leading "@" stands for the NUL byte.
+func abstractAddress(name string) string {
+	return "@" + strings.TrimPrefix(name, "@")
 }
@@ -10,9 +10,17 @@ import (
 
 // UnixDialer is not supported on Windows hosts.
 type UnixDialer struct {
-	Path string
+	Path            string
+	Abstract        bool
+	ReadBufferSize  int
+	WriteBufferSize int
 }
 
 func (d *UnixDialer) Dial(ctx context.Context) (net.Conn, error) {
 	return nil, fmt.Errorf("unix domain sockets not supported on Windows")
 }
+
+// ListenAbstract is not supported on Windows hosts.
+func ListenAbstract(name string) (net.Listener, error) {
+	return nil, fmt.Errorf("abstract unix sockets are only supported on linux")
+}
@@ -6,7 +6,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"syscall"
 	"time"
+	"unsafe"
 
 	"github.com/mdlayher/vsock"
 )
@@ -16,6 +18,11 @@ type VsockDialer struct {
 	CID     uint32
 	Port    uint32
 	Timeout time.Duration
+	// ReadBufferSize and WriteBufferSize size the vsock buffer in bytes.
+	// vsock has a single buffer per connection, so the larger value is used;
+	// zero keeps the kernel default.
+	ReadBufferSize  int
+	WriteBufferSize int
 }
 
 func (d *VsockDialer) Dial(ctx context.Context) (net.Conn, error) {
@@ -52,8 +59,50 @@ func (d *VsockDialer) Dial(ctx context.Context) (net.Conn, error) {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case res := <-resultCh:
-		return res.conn, res.err
+		if res.err != nil {
+			return nil, res.err
+		}
+		if err := applyBufferSizes(res.conn, d.ReadBufferSize, d.WriteBufferSize); err != nil {
+			res.conn.Close()
+			return nil, fmt.Errorf("set socket buffers: %w", err)
+		}
+		return res.conn, nil
+	}
+}
+
+const (
+	afVsock                  = 40
+	soVMSocketsBufferSize    = 0
+	soVMSocketsBufferMaxSize = 2
+)
+
+// setPlatformBufferSizes sizes vsock connections, which expose their buffer
+// through SO_VM_SOCKETS_BUFFER_SIZE rather than SO_RCVBUF/SO_SNDBUF.
+func setPlatformBufferSizes(conn net.Conn, read, write int) error {
+	vconn, ok := conn.(*vsock.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := vconn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	size := uint64(max(read, write))
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// Raise the ceiling first; the kernel clamps the size to it.
+		for _, opt := range []uintptr{soVMSocketsBufferMaxSize, soVMSocketsBufferSize} {
+			if _, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, fd, afVsock, opt,
+				uintptr(unsafe.Pointer(&size)), unsafe.Sizeof(size), 0); errno != 0 {
+				sockErr = errno
+				return
+			}
+		}
+	})
+	if err != nil {
+		return err
 	}
+	return sockErr
 }
 
 // ListenVsock exposes a helper for agentd to bind a vsock port.
@@ -6,18 +6,26 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"time"
 )
 
 // VsockDialer is unavailable on non-Linux platforms.
 type VsockDialer struct {
-	CID  uint32
-	Port uint32
+	CID             uint32
+	Port            uint32
+	Timeout         time.Duration
+	ReadBufferSize  int
+	WriteBufferSize int
 }
 
 func (d *VsockDialer) Dial(ctx context.Context) (net.Conn, error) {
 	return nil, fmt.Errorf("vsock transport not supported on this platform")
 }
 
+func setPlatformBufferSizes(conn net.Conn, read, write int) error {
+	return nil
+}
+
 // ListenVsock is unavailable on non-Linux platforms.
 func ListenVsock(port uint32) (net.Listener, error) {
 	return nil, fmt.Errorf("vsock transport not supported on this platform")
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// CompletionTimestampHeader carries the Unix time, in seconds, at which
+	// a completion webhook was sent.
+	CompletionTimestampHeader = "X-Agent-Timestamp"
+	// CompletionSignatureHeader carries "sha256=<hex>", the HMAC-SHA256 of
+	// the timestamp, a ".", and the request body, keyed with the agent's
+	// webhook secret. It is omitted when the agent has no secret.
+	CompletionSignatureHeader = "X-Agent-Signature"
+
+	// completionTailBytes bounds how much of each stream a summary carries.
+	completionTailBytes = 4 << 10
+	// maxCompletionSkew bounds the age of a timestamp VerifyCompletion
+	// accepts, so captured deliveries cannot be replayed later.
+	maxCompletionSkew = 5 * time.Minute
+
+	webhookAttempts       = 5
+	webhookInitialBackoff = 500 * time.Millisecond
+	webhookTimeout        = 10 * time.Second
+)
+
+// ErrInvalidSignature is returned by VerifyCompletion when a delivery is
+// unsigned, signed with another secret, or too old.
+var ErrInvalidSignature = errors.New("invalid completion signature")
+
+// CompletionSummary is the JSON body the agent POSTs to an exec's
+// CompletionURL once the command has exited.
+type CompletionSummary struct {
+	JobID         string    `json:"job_id,omitempty"`
+	Path          string    `json:"path"`
+	ExitCode      int       `json:"exit_code"`
+	Error         string    `json:"error,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	FinishedAt    time.Time `json:"finished_at"`
+	DurationMilli int64     `json:"duration_ms"`
+	// StdoutBytes and StderrBytes count everything the command wrote,
+	// whether or not it was retained.
+	StdoutBytes int64 `json:"stdout_bytes"`
+	StderrBytes int64 `json:"stderr_bytes"`
+	// StdoutTail and StderrTail hold the end of the retained output, at most
+	// 4 KiB each; the Truncated flags report that they are not all of it.
+	StdoutTail      []byte `json:"stdout_tail,omitempty"`
+	StderrTail      []byte `json:"stderr_tail,omitempty"`
+	StdoutTruncated bool   `json:"stdout_truncated,omitempty"`
+	StderrTruncated bool   `json:"stderr_truncated,omitempty"`
+}
+
+// VerifyCompletion checks the signature headers of a completion webhook
+// against secret and rejects deliveries more than five minutes old.
+func VerifyCompletion(secret string, header http.Header, body []byte) error {
+	ts := header.Get(CompletionTimestampHeader)
+	sent, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: missing or malformed timestamp", ErrInvalidSignature)
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > maxCompletionSkew || age < -maxCompletionSkew {
+		return fmt.Errorf("%w: timestamp outside the allowed window", ErrInvalidSignature)
+	}
+	want := signCompletion([]byte(secret), ts, body)
+	if !hmac.Equal([]byte(header.Get(CompletionSignatureHeader)), []byte(want)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func signCompletion(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkCompletionURL accepts absolute http and https URLs.
+func checkCompletionURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid completion url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("completion url must be an absolute http or https url")
+	}
+	return nil
+}
+
+// webhookSender delivers completion summaries, retrying with exponential
+// backoff on transport errors, 429 and 5xx responses.
+type webhookSender struct {
+	client   *http.Client
+	secret   []byte
+	logger   *log.Logger
+	redactor Redactor
+	attempts int
+	backoff  time.Duration
+}
+
+func newWebhookSender(secret string, logger *log.Logger, redactor Redactor) *webhookSender {
+	if secret == "" {
+		logger.Printf("WARNING: completion webhooks are enabled without a secret; deliveries will be unsigned")
+	}
+	return &webhookSender{
+		client:   &http.Client{Timeout: webhookTimeout},
+		secret:   []byte(secret),
+		logger:   logger,
+		redactor: redactor,
+		attempts: webhookAttempts,
+		backoff:  webhookInitialBackoff,
+	}
+}
+
+func (w *webhookSender) deliver(target string, summary *CompletionSummary) {
+	body, err := json.Marshal(summary)
+	if err != nil {
+		w.logger.Printf("completion webhook: %v", err)
+		return
+	}
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(target, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= w.attempts {
+			w.logger.Printf("completion webhook to %s failed after %d attempt(s): %v", w.redactor.RedactString(target), attempt, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one delivery and reports whether a failure is worth retrying.
+func (w *webhookSender) post(target string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(CompletionTimestampHeader, ts)
+	if len(w.secret) > 0 {
+		req.Header.Set(CompletionSignatureHeader, signCompletion(w.secret, ts, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("receiver returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("receiver returned %s", resp.Status)
+	}
+}
+
+// notifyCompletion fills in summary from the exec and its output buffers and
+// delivers it in the background when the request asked for a webhook.
+func (s *Server) notifyCompletion(payload *execRequestPayload, job *detachedJob, summary *CompletionSummary, stdout, stderr *limitedBuffer) {
+	if payload.CompletionURL == "" || s.webhooks == nil {
+		return
+	}
+	if job != nil {
+		summary.JobID = job.id
+	}
+	summary.Path = s.redactor.RedactString(payload.Path)
+	summary.DurationMilli = summary.FinishedAt.Sub(summary.StartedAt).Milliseconds()
+	summary.StdoutBytes = stdout.Total()
+	summary.StderrBytes = stderr.Total()
+	summary.StdoutTail = outputTail(stdout.Bytes())
+	summary.StderrTail = outputTail(stderr.Bytes())
+	summary.StdoutTruncated = int64(len(summary.StdoutTail)) < summary.StdoutBytes
+	summary.StderrTruncated = int64(len(summary.StderrTail)) < summary.StderrBytes
+	go s.webhooks.deliver(payload.CompletionURL, summary)
+}
+
+func outputTail(b []byte) []byte {
+	if len(b) > completionTailBytes {
+		b = b[len(b)-completionTailBytes:]
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
@@ -0,0 +1,147 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// delivery is one request received by a webhook receiver.
+type delivery struct {
+	header http.Header
+	body   []byte
+}
+
+// startReceiver serves a webhook receiver answering with the given status
+// codes in turn, then 204, and returns its URL and the deliveries it gets.
+func startReceiver(t *testing.T, statuses ...int) (string, <-chan delivery) {
+	t.Helper()
+	deliveries := make(chan delivery, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{header: r.Header.Clone(), body: body}
+		status := http.StatusNoContent
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, deliveries
+}
+
+func receive(t *testing.T, deliveries <-chan delivery) delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(10 * time.Second):
+		t.Fatal("no completion webhook was delivered")
+		return delivery{}
+	}
+}
+
+func TestCompletionWebhook(t *testing.T) {
+	const secret = "s3cret"
+	url, deliveries := startReceiver(t)
+	_, client := startServer(t, ServerConfig{AllowWebhooks: true, WebhookSecret: secret})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.ExecStream(ctx, &CommandRequest{
+		Path:          "/bin/sh",
+		Args:          []string{"-c", "echo out; echo err >&2; exit 4"},
+		Detach:        true,
+		CompletionURL: url,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range stream.Stdout {
+	}
+	for range stream.Stderr {
+	}
+	<-stream.Done
+
+	d := receive(t, deliveries)
+	if err := VerifyCompletion(secret, d.header, d.body); err != nil {
+		t.Errorf("VerifyCompletion: %v", err)
+	}
+	if err := VerifyCompletion("other", d.header, d.body); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifyCompletion with another secret = %v, want %v", err, ErrInvalidSignature)
+	}
+	tampered := append([]byte(nil), d.body...)
+	tampered[len(tampered)-2] ^= 1
+	if err := VerifyCompletion(secret, d.header, tampered); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifyCompletion of a changed body = %v, want %v", err, ErrInvalidSignature)
+	}
+
+	var summary CompletionSummary
+	if err := json.Unmarshal(d.body, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.JobID != stream.JobID || summary.Path != "/bin/sh" || summary.ExitCode != 4 {
+		t.Errorf("summary job %q, path %q, exit %d, want %q, /bin/sh, 4", summary.JobID, summary.Path, summary.ExitCode, stream.JobID)
+	}
+	if string(summary.StdoutTail) != "out\n" || string(summary.StderrTail) != "err\n" {
+		t.Errorf("tails = %q, %q, want \"out\\n\", \"err\\n\"", summary.StdoutTail, summary.StderrTail)
+	}
+	if summary.StdoutBytes != 4 || summary.StderrBytes != 4 || summary.StdoutTruncated || summary.StderrTruncated {
+		t.Errorf("summary bytes %d, %d, truncated %v, %v, want 4, 4, untruncated",
+			summary.StdoutBytes, summary.StderrBytes, summary.StdoutTruncated, summary.StderrTruncated)
+	}
+	if summary.FinishedAt.Before(summary.StartedAt) {
+		t.Errorf("finished at %v, before starting at %v", summary.FinishedAt, summary.StartedAt)
+	}
+}
+
+func TestCompletionWebhookRetries(t *testing.T) {
+	url, deliveries := startReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	srv := NewServer(ServerConfig{AllowWebhooks: true, WebhookSecret: "s3cret"})
+	srv.webhooks.backoff = time.Millisecond
+	client := serve(t, srv)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true", CompletionURL: url}); err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for range 3 {
+		d := receive(t, deliveries)
+		if err := VerifyCompletion("s3cret", d.header, d.body); err != nil {
+			t.Errorf("attempt %d: %v", len(bodies)+1, err)
+		}
+		bodies = append(bodies, string(d.body))
+	}
+	if bodies[0] != bodies[1] || bodies[1] != bodies[2] {
+		t.Error("retries sent different summaries")
+	}
+	select {
+	case <-deliveries:
+		t.Error("delivered again after the receiver accepted the summary")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCompletionWebhookDisabled(t *testing.T) {
+	url, deliveries := startReceiver(t)
+	_, client := startServer(t, ServerConfig{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := client.Exec(ctx, &CommandRequest{Path: "/bin/true", CompletionURL: url})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Errorf("Exec = %v, want %v", err, ErrUnsupported)
+	}
+	select {
+	case <-deliveries:
+		t.Error("a webhook was delivered by an agent that does not allow them")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
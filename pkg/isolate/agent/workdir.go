@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// workingDirError reports a working directory that is missing or not a
+// directory. It matches ErrWorkingDirNotFound.
+type workingDirError struct {
+	dir    string
+	reason string
+}
+
+func (e *workingDirError) Error() string {
+	return fmt.Sprintf("working directory %q %s", e.dir, e.reason)
+}
+
+func (e *workingDirError) Unwrap() error { return ErrWorkingDirNotFound }
+
+// prepareWorkingDir checks that the directory command starts in exists,
+// creating it when the request asks to. Commands confined to the root
+// directory start in the path PrepareCommand translated the working
+// directory to, so that path is looked up below the root.
+func (s *Server) prepareWorkingDir(command *exec.Cmd, payload *execRequestPayload, owner *execUser) error {
+	dir := command.Dir
+	if dir == "" {
+		return nil
+	}
+	if s.rootIsolated() {
+		dir = filepath.Join(s.rootDir, dir)
+	}
+	if payload.CreateWorkDir && s.rootDir != "" {
+		// Never create directories outside the root, even through a
+		// symlink inside it.
+		resolved, err := s.resolveRootedPath(dir)
+		if err != nil {
+			return fmt.Errorf("security violation: %w", err)
+		}
+		dir = resolved
+	}
+	if payload.DryRun && payload.CreateWorkDir {
+		// A dry run creates nothing; a missing directory is one it would.
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	return ensureWorkingDir(dir, payload.WorkingDir, payload.CreateWorkDir && !payload.DryRun, owner)
+}
+
+// ensureWorkingDir checks that dir is a directory, reporting problems
+// under the name the client used. With create, a missing dir is created
+// with mode 0755, along with its parents, and handed to owner when that is
+// set, so a command running as another user can write to it.
+func ensureWorkingDir(dir, name string, create bool, owner *execUser) error {
+	info, err := os.Stat(dir)
+	switch {
+	case err == nil:
+		if !info.IsDir() {
+			return &workingDirError{dir: name, reason: "is not a directory"}
+		}
+		return nil
+	case errors.Is(err, syscall.ENOTDIR):
+		return &workingDirError{dir: name, reason: "is below a file"}
+	case errors.Is(err, fs.ErrNotExist):
+		if !create {
+			return &workingDirError{dir: name, reason: "does not exist"}
+		}
+	default:
+		return fmt.Errorf("working directory %q: %w", name, err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create working directory %q: %w", name, err)
+	}
+	if owner != nil {
+		if err := os.Chown(dir, int(owner.UID), int(owner.GID)); err != nil {
+			return fmt.Errorf("create working directory %q: %w", name, err)
+		}
+	}
+	return nil
+}
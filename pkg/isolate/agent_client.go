@@ -12,41 +12,99 @@ type AgentClient struct {
 	client agent.Client
 }
 
-// NewAgentClient creates a new agent client connected to a Unix socket
+// NewAgentClient creates a new agent client connected to a Unix socket,
+// an abstract one on Linux when socketPath is "@name". Dials are retried
+// briefly in case the agent is still starting.
 func NewAgentClient(socketPath string) *AgentClient {
-	dialer := &agent.UnixDialer{
-		Path:    socketPath,
-		Timeout: 30 * time.Second,
-	}
+	dialer := unixDialer(socketPath, 30*time.Second)
+	client := agent.NewIPCClient(dialer).(*agent.IPCClient)
+	client.Retry = agent.DefaultRetryPolicy()
 	return &AgentClient{
-		client: agent.NewIPCClient(dialer),
+		client: client,
 	}
 }
 
 // Exec executes a command via the agent
 func (ac *AgentClient) Exec(ctx context.Context, cmd *Command) (*Result, error) {
-	req := &agent.CommandRequest{
-		Path:       cmd.Path,
-		Args:       cmd.Args,
-		Env:        cmd.Env,
-		WorkingDir: cmd.WorkingDir,
-		User:       cmd.User,
-		Timeout:    cmd.Timeout,
-	}
-
-	result, err := ac.client.Exec(ctx, req)
+	result, err := ac.client.Exec(ctx, agentRequest(cmd))
 	if err != nil {
 		return nil, err
 	}
 
-	return &Result{
+	res := &Result{
 		ExitCode:   result.ExitCode,
 		Stdout:     result.Stdout,
 		Stderr:     result.Stderr,
 		Duration:   result.Duration,
 		StartedAt:  result.StartedAt,
 		FinishedAt: result.FinishedAt,
-	}, nil
+
+		StdoutTruncated: result.StdoutTruncated,
+		StderrTruncated: result.StderrTruncated,
+		Env:             result.Env,
+		PeakOpenFiles:   result.PeakOpenFiles,
+		ExitReason:      result.ExitReason,
+		TimedOut:        result.TimedOut,
+		UserTime:        result.UserTime,
+		SysTime:         result.SysTime,
+		MaxRSSBytes:     result.MaxRSSBytes,
+		BlockedSyscall:  result.BlockedSyscall,
+
+		StdoutTotalBytes: result.StdoutTotalBytes,
+		StderrTotalBytes: result.StderrTotalBytes,
+	}
+	stripResultANSI(cmd, res)
+	return res, nil
+}
+
+// ExecStream executes a command via the agent, streaming its output and
+// forwarding cmd.Stdin.
+func (ac *AgentClient) ExecStream(ctx context.Context, cmd *Command) (*Stream, error) {
+	agentStream, err := ac.client.ExecStream(ctx, agentRequest(cmd))
+	if err != nil {
+		return nil, err
+	}
+	return newStream(ctx, cmd, agentStream, func(*Result) {}), nil
+}
+
+func agentRequest(cmd *Command) *agent.CommandRequest {
+	return &agent.CommandRequest{
+		Path:       cmd.Path,
+		Args:       cmd.Args,
+		Env:        cmd.Env,
+		Stdin:      cmd.Stdin,
+		WorkingDir: cmd.WorkingDir,
+		User:       cmd.User,
+		Timeout:    cmd.Timeout,
+
+		MaxStdoutBytes: cmd.MaxStdoutBytes,
+		MaxStderrBytes: cmd.MaxStderrBytes,
+		MaxOutputBytes: cmd.MaxOutputBytes,
+		Hostname:       cmd.Hostname,
+		OOMScoreAdj:    cmd.OOMScoreAdj,
+		MaxOpenFiles:   cmd.MaxOpenFiles,
+		StdinFIFO:      cmd.StdinFIFO,
+		StdoutFIFO:     cmd.StdoutFIFO,
+		StderrFIFO:     cmd.StderrFIFO,
+		Mounts:         execMounts(cmd.Mounts),
+		Tmpfs:          cmd.Tmpfs,
+		StdoutLog:      cmd.StdoutLog,
+		StderrLog:      cmd.StderrLog,
+		ReturnEnv:      cmd.ReturnEnv,
+		EgressAllow:    cmd.EgressAllow,
+		CompletionURL:  cmd.CompletionURL,
+		Tty:            cmd.Tty,
+		TtySize:        cmd.TtySize,
+		Resize:         cmd.Resize,
+
+		CreateWorkingDir: cmd.CreateWorkingDir,
+	}
+}
+
+// Info reports the agent's version, platform, isolation, root directory and
+// uptime.
+func (ac *AgentClient) Info(ctx context.Context) (*AgentInfo, error) {
+	return ac.client.Info(ctx)
 }
 
 // Close closes the agent client connection
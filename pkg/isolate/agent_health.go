@@ -0,0 +1,139 @@
+package isolate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+)
+
+// AgentHealth is the liveness state tracked by an AgentManager health monitor.
+type AgentHealth int
+
+const (
+	// AgentHealthUnknown means no health check has completed yet.
+	AgentHealthUnknown AgentHealth = iota
+	AgentHealthy
+	AgentUnhealthy
+)
+
+func (h AgentHealth) String() string {
+	switch h {
+	case AgentHealthy:
+		return "healthy"
+	case AgentUnhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+// agentHealthFailureThreshold is how many consecutive failed pings mark the
+// agent unhealthy and trigger a restart.
+const agentHealthFailureThreshold = 3
+
+// Health returns the state last observed by the health monitor.
+func (am *AgentManager) Health() AgentHealth {
+	am.healthMu.Lock()
+	defer am.healthMu.Unlock()
+	return am.health
+}
+
+// OnHealthChange registers fn to be called whenever the monitored health
+// state changes. It is called from the monitor goroutine and should not block.
+func (am *AgentManager) OnHealthChange(fn func(old, new AgentHealth)) {
+	am.healthMu.Lock()
+	am.onHealthChange = fn
+	am.healthMu.Unlock()
+}
+
+// StartHealthMonitor pings the agent every interval until ctx is cancelled.
+// After agentHealthFailureThreshold consecutive failures the agent is marked
+// unhealthy and restarted; it is marked healthy again once it answers. Only
+// one monitor may run per manager.
+func (am *AgentManager) StartHealthMonitor(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("health check interval must be positive")
+	}
+	am.healthMu.Lock()
+	if am.monitoring {
+		am.healthMu.Unlock()
+		return fmt.Errorf("health monitor already running")
+	}
+	am.monitoring = true
+	am.healthMu.Unlock()
+
+	go am.monitorHealth(ctx, interval)
+	return nil
+}
+
+func (am *AgentManager) monitorHealth(ctx context.Context, interval time.Duration) {
+	defer func() {
+		am.healthMu.Lock()
+		am.monitoring = false
+		am.healthMu.Unlock()
+	}()
+
+	client := agent.NewIPCClient(am.dialer(interval))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := client.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failures = 0
+			am.setHealth(AgentHealthy)
+			continue
+		}
+
+		failures++
+		if failures < agentHealthFailureThreshold {
+			continue
+		}
+		am.setHealth(AgentUnhealthy)
+		if err := am.restart(ctx); err != nil {
+			log.Printf("isolate: agent restart failed: %v", err)
+			continue
+		}
+		failures = 0
+		am.setHealth(AgentHealthy)
+	}
+}
+
+func (am *AgentManager) setHealth(h AgentHealth) {
+	am.healthMu.Lock()
+	old := am.health
+	am.health = h
+	fn := am.onHealthChange
+	am.healthMu.Unlock()
+	if fn != nil && old != h {
+		fn(old, h)
+	}
+}
+
+// restart stops the agent, if this manager started it, and starts a fresh
+// one. An unresponsive agent that this manager did not start is abandoned and
+// its socket replaced.
+func (am *AgentManager) restart(ctx context.Context) error {
+	if err := am.Stop(); err != nil {
+		return err
+	}
+	am.mu.Lock()
+	am.running = false
+	am.mu.Unlock()
+	return am.Start(ctx)
+}
@@ -0,0 +1,82 @@
+//go:build unix
+
+package isolate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHealthMonitorRestartsUnresponsiveAgent(t *testing.T) {
+	am := NewAgentManagerWithOptions(filepath.Join(t.TempDir(), "agent.sock"), "", AgentManagerOptions{
+		BinaryPath: os.Args[0],
+		Env:        []string{"ISOLATE_TEST_AGENTD=1"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := am.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() { am.Stop() })
+	first := am.cmd.Process.Pid
+
+	var mu sync.Mutex
+	var changes []AgentHealth
+	recovered := make(chan struct{})
+	am.OnHealthChange(func(old, new AgentHealth) {
+		mu.Lock()
+		defer mu.Unlock()
+		changes = append(changes, new)
+		if old == AgentUnhealthy && new == AgentHealthy {
+			close(recovered)
+		}
+	})
+	const interval = 50 * time.Millisecond
+	if err := am.StartHealthMonitor(ctx, interval); err != nil {
+		t.Fatalf("StartHealthMonitor: %v", err)
+	}
+	if err := am.StartHealthMonitor(ctx, interval); err == nil {
+		t.Error("a second monitor started")
+	}
+	for deadline := time.Now().Add(5 * time.Second); am.Health() != AgentHealthy; {
+		if time.Now().After(deadline) {
+			t.Fatalf("health = %s, want %s", am.Health(), AgentHealthy)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A stopped agent still accepts connections but never answers them.
+	stoppedAt := time.Now()
+	if err := syscall.Kill(first, syscall.SIGSTOP); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-recovered:
+	case <-time.After(15 * time.Second):
+		t.Fatalf("the agent was not restarted; health is %s", am.Health())
+	}
+	if elapsed := time.Since(stoppedAt); elapsed < agentHealthFailureThreshold*interval {
+		t.Errorf("restarted after %v, before %d failed pings", elapsed, agentHealthFailureThreshold)
+	}
+
+	mu.Lock()
+	want := []AgentHealth{AgentHealthy, AgentUnhealthy, AgentHealthy}
+	if len(changes) != len(want) || changes[0] != want[0] || changes[1] != want[1] || changes[2] != want[2] {
+		t.Errorf("health changes = %v, want %v", changes, want)
+	}
+	mu.Unlock()
+	am.mu.Lock()
+	second := am.cmd.Process.Pid
+	am.mu.Unlock()
+	if second == first {
+		t.Error("the agent process was not replaced")
+	}
+	if err := syscall.Kill(first, 0); err == nil {
+		t.Error("the unresponsive agent is still running")
+	}
+}
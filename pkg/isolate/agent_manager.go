@@ -2,11 +2,15 @@ package isolate
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"net"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -14,24 +18,77 @@ import (
 	"github.com/oarkflow/container/pkg/isolate/agent"
 )
 
+// AgentManagerOptions configures how an AgentManager runs agentd.
+type AgentManagerOptions struct {
+	// BinaryPath is the agentd executable to run. When empty the manager
+	// looks for agentd in PATH, then next to the running executable.
+	BinaryPath string
+	// Args are passed to agentd after the flags the manager sets, so they
+	// can override them.
+	Args []string
+	// Env holds extra "KEY=value" entries for agentd's environment, which
+	// otherwise is the current process's.
+	Env []string
+	// ChunkSize and MaxResultBuffer are passed as -chunk and -max-buffer
+	// when positive; otherwise agentd's defaults apply.
+	ChunkSize       int
+	MaxResultBuffer int
+	// IdleTimeout is passed as -idle-timeout when positive: agentd exits
+	// after that long without a connection, client traffic or a running
+	// exec, and the next Start runs it again.
+	IdleTimeout time.Duration
+	// AllowGoRun falls back to "go run ./cmd/agentd" when no agentd binary
+	// is found, which only works from a checkout of this repository. Without
+	// it Start fails with ErrAgentBinaryNotFound.
+	AllowGoRun bool
+	// Output receives agentd's stdout and stderr a line at a time, each
+	// prefixed with OutputPrefix. Use a rotating file writer to keep them
+	// on disk.
+	Output       io.Writer
+	OutputPrefix string
+	// Logger receives each line agentd writes as a record with the socket
+	// path, at warn or error level for agentd's warnings and errors. With
+	// neither Output nor Logger set, agentd writes to os.Stderr.
+	Logger *slog.Logger
+}
+
 // AgentManager manages the lifecycle of a local agent daemon
 type AgentManager struct {
 	socketPath string
 	rootDir    string
+	opts       AgentManagerOptions
 	cmd        *exec.Cmd
+	exited     chan struct{} // closed once cmd has been reaped
+	output     *agentOutput  // nil when agentd writes to os.Stderr
 	mu         sync.Mutex
 	running    bool
+
+	healthMu       sync.Mutex
+	health         AgentHealth
+	onHealthChange func(old, new AgentHealth)
+	monitoring     bool
 }
 
-// NewAgentManager creates a new agent manager
+// NewAgentManager creates a new agent manager. On Linux a socketPath of
+// "@name" puts the socket in the abstract namespace, which leaves no file to
+// clean up and needs no writable socket directory.
 func NewAgentManager(socketPath, rootDir string) *AgentManager {
+	return NewAgentManagerWithOptions(socketPath, rootDir, AgentManagerOptions{})
+}
+
+// NewAgentManagerWithOptions creates an agent manager that runs agentd as
+// opts describe.
+func NewAgentManagerWithOptions(socketPath, rootDir string, opts AgentManagerOptions) *AgentManager {
 	return &AgentManager{
 		socketPath: socketPath,
 		rootDir:    rootDir,
+		opts:       opts,
 	}
 }
 
-// Start starts the agent daemon if not already running
+// Start starts the agent daemon if not already running. An agent already
+// listening on the socket is reused unless it reports a root directory other
+// than the manager's, in which case a new agent takes over the socket.
 func (am *AgentManager) Start(ctx context.Context) error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
@@ -46,17 +103,22 @@ func (am *AgentManager) Start(ctx context.Context) error {
 		return nil
 	}
 
-	// Remove stale socket
-	_ = os.Remove(am.socketPath)
+	if !am.abstract() {
+		// Remove stale socket
+		_ = os.Remove(am.socketPath)
 
-	// Ensure directory exists
-	socketDir := filepath.Dir(am.socketPath)
-	if err := os.MkdirAll(socketDir, 0755); err != nil {
-		return fmt.Errorf("create socket directory: %w", err)
+		// Ensure directory exists
+		socketDir := filepath.Dir(am.socketPath)
+		if err := os.MkdirAll(socketDir, 0755); err != nil {
+			return fmt.Errorf("create socket directory: %w", err)
+		}
 	}
 
 	// Find agentd binary or use go run
-	agentCmd := am.findAgentCommand()
+	agentCmd, err := am.findAgentCommand()
+	if err != nil {
+		return err
+	}
 
 	// Build command
 	args := []string{"-unix", am.socketPath}
@@ -69,10 +131,27 @@ func (am *AgentManager) Start(ctx context.Context) error {
 			args = append(args, "--no-chroot")
 		}
 	}
+	if am.opts.ChunkSize > 0 {
+		args = append(args, "-chunk", strconv.Itoa(am.opts.ChunkSize))
+	}
+	if am.opts.MaxResultBuffer > 0 {
+		args = append(args, "-max-buffer", strconv.Itoa(am.opts.MaxResultBuffer))
+	}
+	if am.opts.IdleTimeout > 0 {
+		args = append(args, "-idle-timeout", am.opts.IdleTimeout.String())
+	}
+	args = append(args, am.opts.Args...)
 
+	outputFile, output, err := am.pipeOutput()
+	if err != nil {
+		return fmt.Errorf("pipe agent output: %w", err)
+	}
 	am.cmd = exec.Command(agentCmd[0], append(agentCmd[1:], args...)...)
-	am.cmd.Stdout = os.Stderr
-	am.cmd.Stderr = os.Stderr
+	if len(am.opts.Env) > 0 {
+		am.cmd.Env = append(os.Environ(), am.opts.Env...)
+	}
+	am.cmd.Stdout = outputFile
+	am.cmd.Stderr = outputFile
 
 	// Set process group so we can kill all child processes
 	if am.cmd.SysProcAttr == nil {
@@ -80,23 +159,39 @@ func (am *AgentManager) Start(ctx context.Context) error {
 	}
 	am.cmd.SysProcAttr.Setpgid = true
 
-	if err := am.cmd.Start(); err != nil {
+	err = am.cmd.Start()
+	if output != nil {
+		// Only agentd holds the write end now, so the pipe ends with it.
+		outputFile.Close()
+	}
+	if err != nil {
+		output.wait()
 		return fmt.Errorf("start agent: %w", err)
 	}
 
 	// Wait for socket to be ready
 	if err := am.waitForSocket(5 * time.Second); err != nil {
 		_ = am.cmd.Process.Kill()
+		_ = am.cmd.Wait()
+		output.wait()
 		return err
 	}
 
 	am.running = true
+	am.output = output
 
-	// Monitor process in background
+	// Monitor process in background. This is the only Wait call; Stop waits
+	// on exited instead.
+	cmd := am.cmd
+	exited := make(chan struct{})
+	am.exited = exited
 	go func() {
-		_ = am.cmd.Wait()
+		_ = cmd.Wait()
+		close(exited)
 		am.mu.Lock()
-		am.running = false
+		if am.cmd == cmd {
+			am.running = false
+		}
 		am.mu.Unlock()
 	}()
 
@@ -125,13 +220,8 @@ func (am *AgentManager) Stop() error {
 	}
 
 	// Wait for process to exit with timeout
-	done := make(chan error, 1)
-	go func() {
-		done <- am.cmd.Wait()
-	}()
-
 	select {
-	case <-done:
+	case <-am.exited:
 	case <-time.After(2 * time.Second):
 		// Force kill if it didn't stop gracefully
 		if pgid, err := syscall.Getpgid(am.cmd.Process.Pid); err == nil {
@@ -139,36 +229,60 @@ func (am *AgentManager) Stop() error {
 		} else {
 			_ = am.cmd.Process.Kill()
 		}
-		<-done // Wait for it to actually die
+		<-am.exited // Wait for it to actually die
 	}
+	am.output.wait()
 
 	am.running = false
-	_ = os.Remove(am.socketPath)
+	if !am.abstract() {
+		_ = os.Remove(am.socketPath)
+	}
 
 	return nil
 }
 
-// isAgentRunning checks if an agent is already running on the socket
+// isAgentRunning checks if an agent serving the manager's root directory is
+// already running on the socket
 func (am *AgentManager) isAgentRunning() bool {
-	conn, err := net.DialTimeout("unix", am.socketPath, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := am.dialer(time.Second).Dial(ctx)
 	if err != nil {
 		return false
 	}
 	defer conn.Close()
 
 	// Try to ping the agent
-	client := agent.NewIPCClient(&agent.UnixDialer{Path: am.socketPath, Timeout: time.Second})
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
+	client := agent.NewIPCClient(am.dialer(time.Second))
+
+	if client.Ping(ctx) != nil {
+		return false
+	}
+	return am.servesRoot(ctx, client)
+}
 
-	return client.Ping(ctx) == nil
+// servesRoot reports whether the agent confines operations to the manager's
+// root directory. Agents too old to say are assumed to.
+func (am *AgentManager) servesRoot(ctx context.Context, client agent.Client) bool {
+	if am.rootDir == "" {
+		return true
+	}
+	want, err := filepath.Abs(am.rootDir)
+	if err != nil {
+		return true
+	}
+	info, err := client.Info(ctx)
+	if err != nil {
+		return errors.Is(err, agent.ErrUnsupported)
+	}
+	return info.RootDir == want
 }
 
 // waitForSocket waits for the socket to become available
 func (am *AgentManager) waitForSocket(timeout time.Duration) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
-		if _, err := os.Stat(am.socketPath); err == nil {
+		if _, err := os.Stat(am.socketPath); err == nil || am.abstract() {
 			// Socket exists, try to connect
 			if am.isAgentRunning() {
 				return nil
@@ -179,16 +293,16 @@ func (am *AgentManager) waitForSocket(timeout time.Duration) error {
 	return fmt.Errorf("agent socket not ready after %v", timeout)
 }
 
-// findAgentCommand finds the agentd binary or falls back to go run
-func (am *AgentManager) findAgentCommand() []string {
-	// Try to find agentd binary
-	if path, err := exec.LookPath("agentd"); err == nil {
-		return []string{path}
+// findAgentCommand returns the configured agentd binary, or finds one, or
+// falls back to go run when the options allow it
+func (am *AgentManager) findAgentCommand() ([]string, error) {
+	if am.opts.BinaryPath != "" {
+		return []string{am.opts.BinaryPath}, nil
 	}
 
-	// Check if we're in the project directory
-	if _, err := os.Stat("cmd/agentd/main.go"); err == nil {
-		return []string{"go", "run", "./cmd/agentd/main.go"}
+	// Try to find agentd binary
+	if path, err := exec.LookPath("agentd"); err == nil {
+		return []string{path}, nil
 	}
 
 	// Try relative to current executable
@@ -196,12 +310,14 @@ func (am *AgentManager) findAgentCommand() []string {
 		exeDir := filepath.Dir(exe)
 		agentPath := filepath.Join(exeDir, "agentd")
 		if _, err := os.Stat(agentPath); err == nil {
-			return []string{agentPath}
+			return []string{agentPath}, nil
 		}
 	}
 
-	// Fallback to go run with relative path
-	return []string{"go", "run", "./cmd/agentd/main.go"}
+	if am.opts.AllowGoRun {
+		return []string{"go", "run", "./cmd/agentd/main.go"}, nil
+	}
+	return nil, ErrAgentBinaryNotFound
 }
 
 // GetSocketPath returns the socket path
@@ -209,6 +325,25 @@ func (am *AgentManager) GetSocketPath() string {
 	return am.socketPath
 }
 
+// abstract reports whether the socket is in the abstract namespace.
+func (am *AgentManager) abstract() bool {
+	return strings.HasPrefix(am.socketPath, "@")
+}
+
+func (am *AgentManager) dialer(timeout time.Duration) *agent.UnixDialer {
+	return unixDialer(am.socketPath, timeout)
+}
+
+// unixDialer returns a dialer for a socket path, which names an abstract
+// socket when it starts with "@".
+func unixDialer(path string, timeout time.Duration) *agent.UnixDialer {
+	name, abstract := strings.CutPrefix(path, "@")
+	if !abstract {
+		name = path
+	}
+	return &agent.UnixDialer{Path: name, Abstract: abstract, Timeout: timeout}
+}
+
 // IsRunning returns whether the agent is running
 func (am *AgentManager) IsRunning() bool {
 	am.mu.Lock()
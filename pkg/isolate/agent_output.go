@@ -0,0 +1,88 @@
+package isolate
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// outputDrainTimeout bounds how long Stop waits for the last of agentd's
+// output once agentd has exited. Anything still holding the pipe open after
+// that, such as a process agentd left behind, is cut off.
+const outputDrainTimeout = time.Second
+
+// agentOutput carries agentd's stdout and stderr, line by line, to an
+// AgentManager's Output or Logger.
+type agentOutput struct {
+	r    *os.File
+	done chan struct{} // closed once every line has been forwarded
+}
+
+// pipeOutput returns the file agentd should write its stdout and stderr to.
+// When the options name an Output or Logger it is the write end of a pipe
+// whose lines the returned agentOutput forwards; the caller closes it once
+// agentd has started. Otherwise it is os.Stderr and the agentOutput is nil.
+func (am *AgentManager) pipeOutput() (*os.File, *agentOutput, error) {
+	if am.opts.Output == nil && am.opts.Logger == nil {
+		return os.Stderr, nil, nil
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	out := &agentOutput{r: r, done: make(chan struct{})}
+	go out.forward(am.opts.Output, am.opts.OutputPrefix, am.opts.Logger, am.socketPath)
+	return w, out, nil
+}
+
+// forward reads lines until agentd and everything sharing its output have
+// closed the pipe, or until close cuts it off.
+func (o *agentOutput) forward(w io.Writer, prefix string, logger *slog.Logger, socket string) {
+	defer close(o.done)
+	defer o.r.Close()
+	br := bufio.NewReader(o.r)
+	for {
+		line, err := br.ReadString('\n')
+		if line = strings.TrimRight(line, "\r\n"); line != "" {
+			if w != nil {
+				_, _ = io.WriteString(w, prefix+line+"\n")
+			}
+			if logger != nil {
+				logger.Log(context.Background(), agentLogLevel(line), line, "socket", socket)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// wait waits for the rest of agentd's output for up to outputDrainTimeout,
+// then closes the pipe so forward returns.
+func (o *agentOutput) wait() {
+	if o == nil {
+		return
+	}
+	select {
+	case <-o.done:
+	case <-time.After(outputDrainTimeout):
+		o.r.Close()
+		<-o.done
+	}
+}
+
+// agentLogLevel picks the level of a line of agentd's log from the markers
+// agentd puts on its errors and warnings, such as running without chroot.
+func agentLogLevel(line string) slog.Level {
+	switch {
+	case strings.Contains(line, "ERROR:"):
+		return slog.LevelError
+	case strings.Contains(line, "WARNING:"):
+		return slog.LevelWarn
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,218 @@
+package isolate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+)
+
+// AgentPool runs up to a fixed number of local agents, each on its own
+// socket and confined to its own root directory, so jobs on different roots
+// run in parallel without sharing an agent. Agents are started on first use
+// of a root, shared by later users of the same root, and stopped once they
+// have been idle for the pool's idle timeout.
+type AgentPool struct {
+	// AgentOptions configures how every agent the pool starts is run. Set
+	// it before the first Acquire.
+	AgentOptions AgentManagerOptions
+
+	socketDir   string
+	maxAgents   int
+	idleTimeout time.Duration
+
+	mu     sync.Mutex
+	agents map[string]*pooledAgent // keyed by root directory
+	seq    int
+	closed bool
+	done   chan struct{}
+}
+
+type pooledAgent struct {
+	manager  *AgentManager
+	client   agent.Client
+	ready    chan struct{} // closed once the agent started or failed to
+	err      error
+	refs     int
+	lastUsed time.Time
+}
+
+// NewAgentPool creates a pool whose agents listen on sockets in socketDir.
+// maxAgents bounds how many agents run at once (minimum 1). Agents idle for
+// idleTimeout are stopped; zero keeps them until Close.
+func NewAgentPool(socketDir string, maxAgents int, idleTimeout time.Duration) *AgentPool {
+	if maxAgents < 1 {
+		maxAgents = 1
+	}
+	p := &AgentPool{
+		socketDir:   socketDir,
+		maxAgents:   maxAgents,
+		idleTimeout: idleTimeout,
+		agents:      make(map[string]*pooledAgent),
+		done:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go p.reapIdle()
+	}
+	return p
+}
+
+// Acquire returns a client for the agent serving rootDir, starting one if
+// needed, and a release func that must be called once the caller is done
+// with it. When the pool is full an idle agent is stopped to make room; if
+// every agent is in use ErrAgentPoolExhausted is returned.
+func (p *AgentPool) Acquire(ctx context.Context, rootDir string) (agent.Client, func(), error) {
+	root, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve root dir: %w", err)
+	}
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, ErrAgentPoolClosed
+	}
+	pa, ok := p.agents[root]
+	var evicted *pooledAgent
+	if !ok {
+		if len(p.agents) >= p.maxAgents {
+			evicted = p.evictIdleLocked()
+			if evicted == nil {
+				p.mu.Unlock()
+				return nil, nil, ErrAgentPoolExhausted
+			}
+		}
+		p.seq++
+		socket := filepath.Join(p.socketDir, fmt.Sprintf("agent-%d.sock", p.seq))
+		pa = &pooledAgent{manager: NewAgentManagerWithOptions(socket, root, p.AgentOptions), ready: make(chan struct{})}
+		p.agents[root] = pa
+		go p.start(pa, root, evicted)
+	}
+	pa.refs++
+	p.mu.Unlock()
+
+	select {
+	case <-pa.ready:
+	case <-ctx.Done():
+		p.release(pa)
+		return nil, nil, ctx.Err()
+	}
+	if pa.err != nil {
+		p.release(pa)
+		return nil, nil, pa.err
+	}
+	var once sync.Once
+	return pa.client, func() { once.Do(func() { p.release(pa) }) }, nil
+}
+
+// start launches pa's agent once the agent it displaced, if any, is gone.
+func (p *AgentPool) start(pa *pooledAgent, root string, evicted *pooledAgent) {
+	defer close(pa.ready)
+	if evicted != nil {
+		<-evicted.ready
+		_ = evicted.manager.Stop()
+	}
+	if err := os.MkdirAll(p.socketDir, 0o755); err != nil {
+		pa.err = fmt.Errorf("create socket directory: %w", err)
+	} else if err := pa.manager.Start(context.Background()); err != nil {
+		pa.err = err
+	} else {
+		pa.client = agent.NewIPCClient(unixDialer(pa.manager.GetSocketPath(), 0))
+	}
+	if pa.err != nil {
+		p.mu.Lock()
+		if p.agents[root] == pa {
+			delete(p.agents, root)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *AgentPool) release(pa *pooledAgent) {
+	p.mu.Lock()
+	pa.refs--
+	pa.lastUsed = time.Now()
+	p.mu.Unlock()
+}
+
+// evictIdleLocked removes the least recently used idle agent from the pool
+// and returns it for the caller to stop.
+func (p *AgentPool) evictIdleLocked() *pooledAgent {
+	var (
+		victimRoot string
+		victim     *pooledAgent
+	)
+	for root, pa := range p.agents {
+		if pa.refs > 0 {
+			continue
+		}
+		if victim == nil || pa.lastUsed.Before(victim.lastUsed) {
+			victimRoot, victim = root, pa
+		}
+	}
+	if victim != nil {
+		delete(p.agents, victimRoot)
+	}
+	return victim
+}
+
+func (p *AgentPool) reapIdle() {
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+		var idle []*pooledAgent
+		p.mu.Lock()
+		for root, pa := range p.agents {
+			if pa.refs == 0 && time.Since(pa.lastUsed) >= p.idleTimeout {
+				delete(p.agents, root)
+				idle = append(idle, pa)
+			}
+		}
+		p.mu.Unlock()
+		for _, pa := range idle {
+			<-pa.ready
+			_ = pa.manager.Stop()
+		}
+	}
+}
+
+// Size returns the number of agents currently in the pool.
+func (p *AgentPool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.agents)
+}
+
+// Close stops every agent in the pool, including ones still in use, and
+// makes further Acquire calls fail with ErrAgentPoolClosed.
+func (p *AgentPool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	agents := p.agents
+	p.agents = make(map[string]*pooledAgent)
+	p.mu.Unlock()
+
+	var errs []error
+	for root, pa := range agents {
+		<-pa.ready
+		if err := pa.manager.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("stop agent for %s: %w", root, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,127 @@
+//go:build unix
+
+package isolate
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestAgentPool returns a pool running the test binary as its agents.
+func newTestAgentPool(t *testing.T, maxAgents int, idleTimeout time.Duration) *AgentPool {
+	t.Helper()
+	pool := NewAgentPool(t.TempDir(), maxAgents, idleTimeout)
+	pool.AgentOptions = AgentManagerOptions{BinaryPath: os.Args[0], Env: []string{"ISOLATE_TEST_AGENTD=1"}}
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+func TestAgentPoolSeparatesRoots(t *testing.T) {
+	pool := newTestAgentPool(t, 2, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rootA, rootB := t.TempDir(), t.TempDir()
+
+	clientA, releaseA, err := pool.Acquire(ctx, rootA)
+	if err != nil {
+		t.Fatalf("Acquire(a): %v", err)
+	}
+	defer releaseA()
+	clientB, releaseB, err := pool.Acquire(ctx, rootB)
+	if err != nil {
+		t.Fatalf("Acquire(b): %v", err)
+	}
+	defer releaseB()
+	again, releaseAgain, err := pool.Acquire(ctx, rootA)
+	if err != nil {
+		t.Fatalf("Acquire(a) again: %v", err)
+	}
+	releaseAgain()
+	if again != clientA {
+		t.Error("a second user of a root got a different agent")
+	}
+
+	pool.mu.Lock()
+	a, b := pool.agents[rootA].manager, pool.agents[rootB].manager
+	pool.mu.Unlock()
+	if a.GetSocketPath() == b.GetSocketPath() {
+		t.Errorf("both roots share the socket %s", a.GetSocketPath())
+	}
+	if a.cmd.Process.Pid == b.cmd.Process.Pid {
+		t.Error("both roots share an agent process")
+	}
+	infoA, err := clientA.Info(ctx)
+	if err != nil {
+		t.Fatalf("Info(a): %v", err)
+	}
+	infoB, err := clientB.Info(ctx)
+	if err != nil {
+		t.Fatalf("Info(b): %v", err)
+	}
+	if infoA.RootDir != rootA || infoB.RootDir != rootB {
+		t.Errorf("agents serve %s and %s, want %s and %s", infoA.RootDir, infoB.RootDir, rootA, rootB)
+	}
+	if pool.Size() != 2 {
+		t.Errorf("pool size = %d, want 2", pool.Size())
+	}
+}
+
+func TestAgentPoolExhausted(t *testing.T) {
+	pool := newTestAgentPool(t, 1, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, release, err := pool.Acquire(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if _, _, err := pool.Acquire(ctx, t.TempDir()); !errors.Is(err, ErrAgentPoolExhausted) {
+		t.Errorf("Acquire with every agent in use = %v, want %v", err, ErrAgentPoolExhausted)
+	}
+	// Once released, the idle agent makes room for another root.
+	release()
+	_, release, err = pool.Acquire(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("Acquire after a release: %v", err)
+	}
+	release()
+	if pool.Size() != 1 {
+		t.Errorf("pool size = %d, want 1", pool.Size())
+	}
+}
+
+func TestAgentPoolReapsIdleAgents(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+	pool := newTestAgentPool(t, 2, idleTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	root := t.TempDir()
+
+	_, release, err := pool.Acquire(ctx, root)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	pool.mu.Lock()
+	manager := pool.agents[root].manager
+	pool.mu.Unlock()
+	socket := manager.GetSocketPath()
+	// An agent in use is never reaped.
+	time.Sleep(3 * idleTimeout)
+	if pool.Size() != 1 || !manager.IsRunning() {
+		t.Fatal("an agent in use was reaped")
+	}
+
+	release()
+	for deadline := time.Now().Add(5 * time.Second); pool.Size() != 0 || manager.IsRunning(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle agent not stopped: pool size %d, running %v", pool.Size(), manager.IsRunning())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("reaped agent's socket still exists: %v", err)
+	}
+}
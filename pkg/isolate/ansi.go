@@ -0,0 +1,89 @@
+package isolate
+
+// ansiState tracks where an ansiStripper is within an escape sequence.
+type ansiState uint8
+
+const (
+	ansiGround       ansiState = iota
+	ansiEscape                 // after ESC
+	ansiEscapeInter            // ESC followed by intermediate bytes
+	ansiCSI                    // ESC [
+	ansiString                 // OSC, DCS, SOS, PM or APC body
+	ansiStringEscape           // ESC inside a string, maybe the ST terminator
+)
+
+// ansiStripper removes ANSI/VT100 escape sequences (CSI sequences such as
+// colours and cursor movement, OSC titles and hyperlinks, DCS/APC strings and
+// two-byte escapes) from a byte stream. It keeps its state between calls, so
+// a sequence split across chunks is still removed; text is never held back.
+type ansiStripper struct {
+	state ansiState
+	osc   bool // the current string may also end with BEL
+}
+
+// stripANSI returns s without escape sequences.
+func stripANSI(s []byte) []byte {
+	var st ansiStripper
+	return st.strip(s)
+}
+
+// strip returns the text of p outside escape sequences, continuing any
+// sequence left open by the previous call.
+func (st *ansiStripper) strip(p []byte) []byte {
+	out := make([]byte, 0, len(p))
+	for _, b := range p {
+		switch st.state {
+		case ansiGround:
+			if b == 0x1b {
+				st.state = ansiEscape
+				continue
+			}
+			out = append(out, b)
+		case ansiEscape:
+			switch {
+			case b == '[':
+				st.state = ansiCSI
+			case b == ']':
+				st.state, st.osc = ansiString, true
+			case b == 'P' || b == 'X' || b == '^' || b == '_':
+				st.state, st.osc = ansiString, false
+			case b >= 0x20 && b <= 0x2f:
+				st.state = ansiEscapeInter
+			default:
+				st.state = ansiGround
+			}
+		case ansiEscapeInter:
+			if b < 0x20 || b > 0x2f {
+				st.state = ansiGround
+			}
+		case ansiCSI:
+			if b >= 0x40 && b <= 0x7e {
+				st.state = ansiGround
+			}
+		case ansiString:
+			switch {
+			case b == 0x1b:
+				st.state = ansiStringEscape
+			case b == 0x07 && st.osc:
+				st.state = ansiGround
+			}
+		case ansiStringEscape:
+			if b == '\\' {
+				st.state = ansiGround
+			} else if b != 0x1b {
+				st.state = ansiString
+			}
+		}
+	}
+	return out
+}
+
+// stripResultANSI applies Command.StripANSI to a finished result, keeping
+// the unmodified output in RawStdout and RawStderr.
+func stripResultANSI(cmd *Command, res *Result) {
+	if cmd == nil || !cmd.StripANSI || res == nil {
+		return
+	}
+	res.RawStdout, res.RawStderr = res.Stdout, res.Stderr
+	res.Stdout, res.Stderr = stripANSI(res.Stdout), stripANSI(res.Stderr)
+}
@@ -0,0 +1,82 @@
+package isolate
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStripANSI(t *testing.T) {
+	for _, tc := range []struct{ name, in, want string }{
+		{"plain", "no escapes\n", "no escapes\n"},
+		{"colours", "\x1b[1;31merror\x1b[0m: bad\n", "error: bad\n"},
+		{"cursor", "10%\x1b[2K\x1b[1G100%\n", "10%100%\n"},
+		{"osc title bel", "\x1b]0;title\x07text", "text"},
+		{"osc hyperlink st", "\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"dcs", "a\x1bPq#0;2\x1b\\b", "ab"},
+		{"two byte", "\x1b=keypad\x1b>", "keypad"},
+		{"charset", "\x1b(Bascii", "ascii"},
+	} {
+		if got := string(stripANSI([]byte(tc.in))); got != tc.want {
+			t.Errorf("%s: stripANSI(%q) = %q, want %q", tc.name, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestStripANSIAcrossChunks(t *testing.T) {
+	// Every sequence is split somewhere, one of them after its ESC.
+	chunks := []string{"\x1b", "[32mok\x1b[", "0m \x1b]0;ti", "tle\x1b", "\\done\n"}
+	var st ansiStripper
+	var got []byte
+	for _, chunk := range chunks {
+		got = append(got, st.strip([]byte(chunk))...)
+	}
+	if want := "ok done\n"; string(got) != want {
+		t.Errorf("stripped chunks = %q, want %q", got, want)
+	}
+}
+
+func TestExecStripANSI(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := startDevContainer(ctx, t, m, "ansi")
+	script := `printf '\033[32mgreen\033[0m\n'; printf '\033[31mred\033[0m\n' >&2`
+
+	result, err := c.Exec(ctx, &Command{Path: "/bin/sh", Args: []string{"-c", script}, StripANSI: true})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if string(result.Stdout) != "green\n" || string(result.Stderr) != "red\n" {
+		t.Errorf("output = %q, %q; want escapes removed", result.Stdout, result.Stderr)
+	}
+	if string(result.RawStdout) != "\x1b[32mgreen\x1b[0m\n" || string(result.RawStderr) != "\x1b[31mred\x1b[0m\n" {
+		t.Errorf("raw output = %q, %q; want it unmodified", result.RawStdout, result.RawStderr)
+	}
+
+	// Chunks are split mid-sequence here; the stripper carries its state.
+	script = `printf '\033['; sleep 0.1; printf '1mbold\033'; sleep 0.1; printf '[0m\n'`
+	stream, err := c.ExecStream(ctx, &Command{Path: "/bin/sh", Args: []string{"-c", script}, StripANSI: true})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	var stdout []byte
+	for chunk := range stream.Stdout {
+		stdout = append(stdout, chunk...)
+	}
+	for range stream.Stderr {
+	}
+	<-stream.Done
+	if string(stdout) != "bold\n" {
+		t.Errorf("streamed stdout = %q, want %q", stdout, "bold\n")
+	}
+
+	// Without StripANSI the output is untouched and Raw* stay empty.
+	result, err = c.Exec(ctx, &Command{Path: "/bin/sh", Args: []string{"-c", script}})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	if string(result.Stdout) != "\x1b[1mbold\x1b[0m\n" || result.RawStdout != nil {
+		t.Errorf("unstripped result = %q, raw %q", result.Stdout, result.RawStdout)
+	}
+}
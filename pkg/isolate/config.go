@@ -2,9 +2,13 @@ package isolate
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
+	"syscall"
 	"time"
 
+	"github.com/oarkflow/container/pkg/isolate/agent"
 	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
 )
 
@@ -18,6 +22,23 @@ type NetworkConfig = runtimectl.NetworkConfig
 // PortForward re-exports the runtime port forwarding definition.
 type PortForward = runtimectl.PortForward
 
+// PortProtocol re-exports the port forwarding transport protocols.
+type PortProtocol = runtimectl.PortProtocol
+
+const (
+	PortProtocolTCP = runtimectl.PortProtocolTCP
+	PortProtocolUDP = runtimectl.PortProtocolUDP
+)
+
+// AddressFamily re-exports the interface address family selector.
+type AddressFamily = runtimectl.AddressFamily
+
+const (
+	AddressFamilyIPv4 = runtimectl.AddressFamilyIPv4
+	AddressFamilyIPv6 = runtimectl.AddressFamilyIPv6
+	AddressFamilyDual = runtimectl.AddressFamilyDual
+)
+
 // BandwidthLimit re-exports bandwidth configuration.
 type BandwidthLimit = runtimectl.BandwidthLimit
 
@@ -30,10 +51,39 @@ type NetworkInterfaceStatus = runtimectl.NetworkInterfaceStatus
 // InterfaceStats re-exports the runtime per-interface metrics structure.
 type InterfaceStats = runtimectl.InterfaceStats
 
+// ReconnectPolicy re-exports the agent stream reconnection settings.
+type ReconnectPolicy = agent.ReconnectPolicy
+
+// LogFile re-exports the agent exec log rotation settings.
+type LogFile = agent.LogFile
+
+// TmpfsMount re-exports the agent per-exec tmpfs definition.
+type TmpfsMount = agent.TmpfsMount
+
+// WindowSize re-exports the agent terminal size.
+type WindowSize = agent.WindowSize
+
+// AgentInfo re-exports the agent's self-description; see AgentClient.Info.
+type AgentInfo = agent.AgentInfo
+
+// Exit reasons a Result reports, re-exported from the agent.
+const (
+	ExitReasonOOMKilled       = agent.ExitReasonOOMKilled
+	ExitReasonSeccomp         = agent.ExitReasonSeccomp
+	ExitReasonCommandNotFound = agent.ExitReasonCommandNotFound
+	ExitReasonNotExecutable   = agent.ExitReasonNotExecutable
+)
+
 // Mount re-exports the runtime mount definition for the same reason as
 // NetworkMode.
 type Mount = runtimectl.Mount
 
+// VMConfig re-exports the runtime VM configuration, as resolved by the runtime.
+type VMConfig = runtimectl.VMConfig
+
+// PlanStep re-exports the structured network plan step.
+type PlanStep = runtimectl.PlanStep
+
 // Config captures the resources and behaviors required to provision an
 // isolated execution environment backed by a guest VM managed by the
 // selected runtime.
@@ -50,6 +100,77 @@ type Config struct {
 	WorkingDir  string
 	Metadata    map[string]string
 	DevMode     bool // enables host-loopback agent for local development
+	// StopSignal is sent to the main workload (see Command.Main) when the
+	// container is stopped; zero means SIGTERM. PreStopCommand, if set, runs
+	// in the guest before that. Together they get StopGracePeriod (default
+	// 10s) before the VM itself is stopped.
+	StopSignal      syscall.Signal
+	PreStopCommand  *Command
+	StopGracePeriod time.Duration
+	// MetadataEnv, when set, exposes selected Metadata entries to every
+	// exec as environment variables.
+	MetadataEnv *MetadataEnv
+	// Scheduling, when set, gives the manager's admission logic the
+	// container's expected resource profile and placement constraints.
+	Scheduling *SchedulingHints
+}
+
+// Clone returns a deep copy of the configuration that is safe to mutate.
+func (c *Config) Clone() *Config {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	if c.Network != nil {
+		network := c.Network.Clone()
+		out.Network = &network
+	}
+	out.Mounts = append([]Mount(nil), c.Mounts...)
+	out.Environment = cloneStringMap(c.Environment)
+	out.Metadata = cloneStringMap(c.Metadata)
+	out.PreStopCommand = c.PreStopCommand.clone()
+	if c.MetadataEnv != nil {
+		metaEnv := *c.MetadataEnv
+		metaEnv.Keys = append([]string(nil), metaEnv.Keys...)
+		out.MetadataEnv = &metaEnv
+	}
+	out.Scheduling = c.Scheduling.Clone()
+	return &out
+}
+
+// Validate reports the first problem that would keep CreateContainer from
+// creating the container: everything VMConfig.Validate checks, applied to
+// the VM the config describes, and a negative StopGracePeriod or burst.
+func (c *Config) Validate() error {
+	if c == nil {
+		return fmt.Errorf("config is required")
+	}
+	if err := toVMConfig(c).Validate(); err != nil {
+		return err
+	}
+	if c.StopGracePeriod < 0 {
+		return fmt.Errorf("stop grace period must not be negative")
+	}
+	if hints := c.Scheduling; hints != nil {
+		if hints.BurstCPUs < 0 {
+			return fmt.Errorf("%w: burst %d", ErrInvalidCPUCount, hints.BurstCPUs)
+		}
+		if hints.BurstMemory < 0 {
+			return fmt.Errorf("%w: burst %d bytes", ErrInvalidMemory, hints.BurstMemory)
+		}
+	}
+	return nil
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
 }
 
 // Command represents a single guest execution request.
@@ -57,12 +178,105 @@ type Command struct {
 	Path       string
 	Args       []string
 	Env        map[string]string
-	Stdin      io.Reader
-	Stdout     io.Writer
-	Stderr     io.Writer
+	Stdin      io.Reader `json:"-"`
+	Stdout     io.Writer `json:"-"`
+	Stderr     io.Writer `json:"-"`
 	Timeout    time.Duration
 	WorkingDir string
 	User       string
+	Priority   int // higher values are dispatched first when execs contend for a slot
+	// CreateWorkingDir creates WorkingDir in the guest when it does not
+	// exist; otherwise a missing one fails with agent.ErrWorkingDirNotFound.
+	CreateWorkingDir bool
+	// Detach keeps the command running in the guest if the agent connection
+	// drops; Reconnect additionally re-attaches streams automatically.
+	Detach    bool
+	Reconnect *ReconnectPolicy
+	// Output limits for the captured result; zero uses the agent default.
+	// MaxOutputBytes caps stdout and stderr combined.
+	MaxStdoutBytes int
+	MaxStderrBytes int
+	MaxOutputBytes int
+	Hostname       string // run in a private UTS namespace with this hostname (Linux guests)
+	// OOMScoreAdj sets the process's oom_score_adj (-1000..1000) so the
+	// guest kernel kills it before other work under memory pressure. Zero
+	// keeps the inherited value; ignored on non-Linux guests.
+	OOMScoreAdj int
+	// MaxOpenFiles caps the process's open descriptors (RLIMIT_NOFILE);
+	// zero keeps the inherited limit. Ignored on non-Linux guests.
+	MaxOpenFiles uint64
+	// StdinFIFO, StdoutFIFO and StderrFIFO connect the process's streams to
+	// named pipes in the guest, created on demand, so separate execs can be
+	// chained without a shell. Redirected streams are not captured.
+	StdinFIFO  string
+	StdoutFIFO string
+	StderrFIFO string
+	// Mounts are bind mounted into a private mount namespace for this exec
+	// only and removed when it exits (Linux guests). They are always
+	// read-only, so Type and ReadOnly are ignored; Source is a guest path
+	// and Target must already exist.
+	Mounts []Mount
+	// Tmpfs mounts a size-limited, memory-backed scratch filesystem at each
+	// Path for this exec only, like `docker run --tmpfs` (Linux guests).
+	// Paths must be existing directories within the agent's root.
+	Tmpfs []TmpfsMount
+	// StdoutLog and StderrLog persist the process's streams to rotating
+	// files in the guest, for long-running detached jobs. Logged streams are
+	// not captured.
+	StdoutLog *LogFile
+	StderrLog *LogFile
+	// Main marks the process as the container's main workload, which Stop
+	// signals with Config.StopSignal before halting the VM. It only applies
+	// to ExecStream and implies Detach.
+	Main bool
+	// ReturnEnv records the fully resolved environment of the process in
+	// Result.Env, for reproducing or comparing runs.
+	ReturnEnv bool
+	// EgressAllow restricts the destinations the process may reach; see
+	// agent.CommandRequest.EgressAllow.
+	EgressAllow []string
+	// CompletionURL has the agent POST a summary of the result to this URL
+	// when the process exits; see agent.CommandRequest.CompletionURL.
+	CompletionURL string
+	// StripANSI removes terminal escape sequences (colours, cursor
+	// movement, titles) from Result.Stdout and Result.Stderr and from the
+	// chunks of an ExecStream, keeping the unmodified output in
+	// Result.RawStdout and Result.RawStderr. Output written to Stdout and
+	// Stderr writers is passed through unchanged.
+	StripANSI bool
+	// Tty runs the process on a pseudo-terminal in the guest, with stdout
+	// and stderr merged into Stdout; see agent.CommandRequest.Tty. TtySize
+	// sets the initial size and Resize carries later changes.
+	Tty     bool
+	TtySize WindowSize
+	Resize  <-chan WindowSize `json:"-"`
+}
+
+// clone returns a copy of the command sharing no slices, maps or options
+// with it; its streams and Resize channel are the same.
+func (c *Command) clone() *Command {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	out.Args = append([]string(nil), c.Args...)
+	out.Env = cloneStringMap(c.Env)
+	out.Mounts = append([]Mount(nil), c.Mounts...)
+	out.Tmpfs = append([]TmpfsMount(nil), c.Tmpfs...)
+	out.EgressAllow = append([]string(nil), c.EgressAllow...)
+	if c.Reconnect != nil {
+		policy := *c.Reconnect
+		out.Reconnect = &policy
+	}
+	if c.StdoutLog != nil {
+		log := *c.StdoutLog
+		out.StdoutLog = &log
+	}
+	if c.StderrLog != nil {
+		log := *c.StderrLog
+		out.StderrLog = &log
+	}
+	return &out
 }
 
 // Result contains the captured command output.
@@ -73,14 +287,58 @@ type Result struct {
 	Duration   time.Duration
 	StartedAt  time.Time
 	FinishedAt time.Time
+	// StdoutTruncated and StderrTruncated are set when an output limit
+	// dropped part of the stream.
+	StdoutTruncated bool
+	StderrTruncated bool
+	// StdoutTotalBytes and StderrTotalBytes count everything the command
+	// wrote to each stream, so a truncated Stdout is missing the last
+	// StdoutTotalBytes - len(Stdout) bytes. Zero when the guest agent is
+	// too old to count.
+	StdoutTotalBytes int64
+	StderrTotalBytes int64
+	// Env records the environment the process ran with (sorted KEY=VALUE,
+	// secrets redacted) when the command set ReturnEnv.
+	Env []string
+	// PeakOpenFiles is the most descriptors the process was seen holding
+	// open, or zero when the guest cannot report it.
+	PeakOpenFiles int
+	// ExitReason explains an abnormal exit; "oom_killed" means the guest
+	// agent's memory limit was exceeded and "seccomp_killed" that its
+	// seccomp profile blocked a system call. A command that could not be
+	// started has "command_not_found" with ExitCode 127 when its executable
+	// does not exist, or "not_executable" with 126 when it cannot be run.
+	// Empty otherwise.
+	ExitReason string
+	// TimedOut reports that the guest killed the process, and everything it
+	// started, because Command.Timeout expired.
+	TimedOut bool
+	// UserTime and SysTime are the CPU time the process spent in user and
+	// kernel mode, and MaxRSSBytes its peak resident memory. They are zero
+	// when the guest cannot report resource usage.
+	UserTime    time.Duration
+	SysTime     time.Duration
+	MaxRSSBytes uint64
+	// BlockedSyscall names the system call behind a "seccomp_killed" exit,
+	// when the guest could tell which.
+	BlockedSyscall string
+	// RawStdout and RawStderr hold the output before escape sequences were
+	// removed, when the command set StripANSI.
+	RawStdout []byte
+	RawStderr []byte
 }
 
 // Stream transports live stdout/stderr events alongside the eventual result.
 type Stream struct {
+	JobID  string // set for detached execs
 	Stdout <-chan []byte
 	Stderr <-chan []byte
 	Done   <-chan *Result
-	cancel context.CancelFunc
+	// Summary receives a single StreamSummary once the result has been
+	// delivered on Done and both output channels have been drained.
+	Summary <-chan *StreamSummary
+	cancel  context.CancelFunc
+	agent   *agent.CommandStream
 }
 
 // Close stops the stream and releases resources.
@@ -90,10 +348,38 @@ func (s *Stream) Close() {
 	}
 }
 
+// PauseOutput asks the agent to hold back output until ResumeOutput; see
+// agent.CommandStream.PauseOutput.
+func (s *Stream) PauseOutput() error {
+	if s == nil || s.agent == nil {
+		return agent.ErrUnsupported
+	}
+	return s.agent.PauseOutput()
+}
+
+// ResumeOutput delivers output held back by PauseOutput and lets it flow
+// again.
+func (s *Stream) ResumeOutput() error {
+	if s == nil || s.agent == nil {
+		return agent.ErrUnsupported
+	}
+	return s.agent.ResumeOutput()
+}
+
+// Signal delivers sig to the command's process group in the guest; see
+// agent.CommandStream.Signal.
+func (s *Stream) Signal(sig os.Signal) error {
+	if s == nil || s.agent == nil {
+		return agent.ErrUnsupported
+	}
+	return s.agent.Signal(sig)
+}
+
 // Status mirrors the VM status from the runtime layer.
 type Status struct {
 	ID          string
 	Name        string
+	SetID       string // sandbox set membership, if any
 	State       runtimectl.VMState
 	CreatedAt   time.Time
 	StartedAt   time.Time
@@ -102,6 +388,8 @@ type Status struct {
 	Interfaces  []NetworkInterfaceStatus
 	ResolvedIPs []string
 	NetworkPlan []string
+	// NetworkPlanSteps is NetworkPlan in machine-readable form.
+	NetworkPlanSteps []PlanStep
 }
 
 // Stats mirrors low-level runtime metrics in a simplified format for callers.
@@ -109,7 +397,13 @@ type Stats struct {
 	CPUPercent     float64
 	MemoryBytes    uint64
 	DiskBytes      uint64
+	DiskReadBytes  uint64
+	DiskWriteBytes uint64
 	NetworkRxBytes uint64
 	NetworkTxBytes uint64
 	Interfaces     []InterfaceStats
+	// Estimated is set when CPU and memory are estimates from the
+	// configuration, e.g. in dev mode on a platform the agent cannot
+	// sample processes on.
+	Estimated bool
 }
@@ -0,0 +1,109 @@
+package isolate
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// fillValue sets every exported field reachable from v to a non-zero value,
+// giving slices and maps one element, so a clone that misses a field shows.
+func fillValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(1)
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillValue(v.Elem())
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(v.Index(0))
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key, elem := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		fillValue(key)
+		fillValue(elem)
+		m.SetMapIndex(key, elem)
+		v.Set(m)
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if v.Field(i).CanSet() {
+				fillValue(v.Field(i))
+			}
+		}
+	}
+}
+
+// sharedMemory lists the paths of the slices, maps and pointers a and b
+// have in common.
+func sharedMemory(path string, a, b reflect.Value) []string {
+	switch a.Kind() {
+	case reflect.Pointer:
+		if a.IsNil() || b.IsNil() {
+			return nil
+		}
+		if a.Pointer() == b.Pointer() {
+			return []string{path}
+		}
+		return sharedMemory(path, a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Len() == 0 || b.Len() == 0 {
+			return nil
+		}
+		if a.Pointer() == b.Pointer() {
+			return []string{path}
+		}
+		var shared []string
+		for i := range min(a.Len(), b.Len()) {
+			shared = append(shared, sharedMemory(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i))...)
+		}
+		return shared
+	case reflect.Map:
+		if !a.IsNil() && !b.IsNil() && a.Pointer() == b.Pointer() {
+			return []string{path}
+		}
+	case reflect.Struct:
+		var shared []string
+		for i := range a.NumField() {
+			if a.Type().Field(i).IsExported() {
+				shared = append(shared, sharedMemory(path+"."+a.Type().Field(i).Name, a.Field(i), b.Field(i))...)
+			}
+		}
+		return shared
+	}
+	return nil
+}
+
+func TestConfigCloneSharesNothing(t *testing.T) {
+	var cfg Config
+	fillValue(reflect.ValueOf(&cfg).Elem())
+	clone := cfg.Clone()
+	if !reflect.DeepEqual(clone, &cfg) {
+		t.Errorf("Clone differs from the original:\n%+v\n%+v", clone, &cfg)
+	}
+	if shared := sharedMemory("Config", reflect.ValueOf(&cfg), reflect.ValueOf(clone)); len(shared) > 0 {
+		t.Errorf("Config.Clone shares %v with the original", shared)
+	}
+}
+
+func TestVMConfigCloneSharesNothing(t *testing.T) {
+	var cfg runtimectl.VMConfig
+	fillValue(reflect.ValueOf(&cfg).Elem())
+	clone := cfg.Clone()
+	if !reflect.DeepEqual(clone, &cfg) {
+		t.Errorf("Clone differs from the original:\n%+v\n%+v", clone, &cfg)
+	}
+	if shared := sharedMemory("VMConfig", reflect.ValueOf(&cfg), reflect.ValueOf(clone)); len(shared) > 0 {
+		t.Errorf("VMConfig.Clone shares %v with the original", shared)
+	}
+}
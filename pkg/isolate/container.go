@@ -16,19 +16,45 @@ type Container interface {
 	Create(ctx context.Context, cfg *Config) error
 	Start(ctx context.Context) error
 	Stop(ctx context.Context, timeout time.Duration) error
+	// Pause freezes a running container, which keeps its memory but uses no
+	// CPU; Exec is refused until Resume thaws it.
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
 	Delete(ctx context.Context) error
 	Exec(ctx context.Context, cmd *Command) (*Result, error)
 	ExecStream(ctx context.Context, cmd *Command) (*Stream, error)
+	SetExecHooks(pre ExecPreHook, post ExecPostHook)
 	Status(ctx context.Context) (*Status, error)
 	Stats(ctx context.Context) (*Stats, error)
+	// Snapshot captures the running container into the directory dst, for
+	// Manager.CreateFromSnapshot. The container keeps running.
+	Snapshot(ctx context.Context, dst string) error
+	// Config returns a copy of the configuration the container was created
+	// with; ResolvedVMConfig returns a copy of the VM configuration after the
+	// runtime applied its defaults, or nil before Create.
+	Config() *Config
+	ResolvedVMConfig() *VMConfig
 }
 
 // containerImpl wires the high-level container API to a runtime VM.
 type containerImpl struct {
-	mu      sync.RWMutex
-	cfg     *Config
-	runtime runtimectl.Runtime
-	vm      runtimectl.VM
+	mu        sync.RWMutex
+	cfg       *Config
+	runtime   runtimectl.Runtime
+	vm        runtimectl.VM
+	scheduler *execScheduler
+	hooks     execHooks
+	main      *mainWorkload
+	deleted   bool
+
+	resolvMu sync.Mutex
+	resolvVM runtimectl.VM // the VM resolv.conf was installed in
+
+	onTransition func(Transition)
+	onExec       func(name string)
+	// releaseCapacity returns the container's admission reservation to the
+	// manager once it is deleted.
+	releaseCapacity func()
 }
 
 func newContainer(rt runtimectl.Runtime, cfg *Config) *containerImpl {
@@ -51,110 +77,290 @@ func (c *containerImpl) Create(ctx context.Context, cfg *Config) error {
 
 	c.cfg = cfg
 	c.vm = vm
+	c.deleted = false
 	return nil
 }
 
 func (c *containerImpl) Start(ctx context.Context) error {
-	c.mu.RLock()
-	vm := c.vm
-	c.mu.RUnlock()
-
-	if vm == nil {
-		return ErrContainerNotCreated
+	vm, err := c.vmFor(runtimectl.VMOpStart)
+	if err != nil {
+		return err
 	}
 
-	return vm.Start(ctx)
+	from := vm.State()
+	if from == runtimectl.VMStateRunning {
+		return nil
+	}
+	if err := vm.Start(ctx); err != nil {
+		return err
+	}
+	c.transitioned(from, vm.State())
+	return nil
 }
 
 func (c *containerImpl) Stop(ctx context.Context, timeout time.Duration) error {
-	c.mu.RLock()
-	vm := c.vm
-	c.mu.RUnlock()
+	vm, err := c.vmFor(runtimectl.VMOpStop)
+	if err != nil {
+		return err
+	}
 
-	if vm == nil {
-		return ErrContainerNotCreated
+	from := vm.State()
+	if from == runtimectl.VMStateStopped {
+		return nil
 	}
 
+	c.preStop(ctx, vm)
+
 	stopCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	return vm.Stop(stopCtx, false)
+	// A stop cut short by ctx may still have halted the VM.
+	err = vm.Stop(stopCtx, false)
+	if to := vm.State(); to != from {
+		c.transitioned(from, to)
+	}
+	return err
+}
+
+func (c *containerImpl) Pause(ctx context.Context) error {
+	return c.setPaused(ctx, runtimectl.VMOpPause)
+}
+
+func (c *containerImpl) Resume(ctx context.Context) error {
+	return c.setPaused(ctx, runtimectl.VMOpResume)
+}
+
+func (c *containerImpl) setPaused(ctx context.Context, op runtimectl.VMOp) error {
+	vm, err := c.vmFor(op)
+	if err != nil {
+		return err
+	}
+
+	from := vm.State()
+	if op == runtimectl.VMOpPause {
+		err = vm.Pause(ctx)
+	} else {
+		err = vm.Resume(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	c.transitioned(from, vm.State())
+	return nil
 }
 
+// Delete stops the VM gracefully if it is still running and then deletes it.
+// The runtime gets deleteTimeout to delete the VM; Delete returns ctx.Err()
+// when ctx ends first.
 func (c *containerImpl) Delete(ctx context.Context) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	return c.delete(ctx, false)
+}
 
-	if c.vm == nil {
+// delete removes the VM, stopping it first when it is running. With force
+// the pre-stop hooks are skipped and the VM is halted immediately.
+func (c *containerImpl) delete(ctx context.Context, force bool) error {
+	c.mu.RLock()
+	vm := c.vm
+	c.mu.RUnlock()
+
+	if vm == nil {
 		return nil
 	}
 
-	if err := c.vm.Delete(ctx); err != nil {
-		return err
+	if state := vm.State(); state == runtimectl.VMStateRunning || state == runtimectl.VMStatePaused {
+		if err := c.stopForDelete(ctx, vm, force); err != nil {
+			return fmt.Errorf("stop vm: %w", err)
+		}
+		c.transitioned(state, vm.State())
 	}
 
+	c.mu.Lock()
+	if c.vm != vm {
+		// Deleted concurrently while we were stopping it.
+		c.mu.Unlock()
+		return nil
+	}
+	from := vm.State()
+	deleteCtx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	err := vm.Delete(deleteCtx)
+	cancel()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
 	c.vm = nil
+	c.deleted = true
+	c.mu.Unlock()
+
+	c.transitioned(from, runtimectl.VMStateDeleted)
 	return nil
 }
 
+// abandon detaches c from a VM that could not be deleted, so c behaves as
+// deleted while the VM is left to the runtime.
+func (c *containerImpl) abandon() {
+	c.mu.Lock()
+	c.vm = nil
+	c.deleted = true
+	c.mu.Unlock()
+}
+
 func (c *containerImpl) Exec(ctx context.Context, cmd *Command) (*Result, error) {
-	vm, err := c.getVM()
+	vm, err := c.vmFor(runtimectl.VMOpExec)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.installResolvConf(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	release, err := c.acquireSlot(ctx, cmd)
 	if err != nil {
 		return nil, err
 	}
+	defer release()
+
+	hooks := c.execHooks()
+	hooks.before(cmd)
+	c.execDispatched()
 
 	req := toCommandRequest(cmd)
+	c.applyMetadataEnv(req)
 	execResult, err := vm.Execute(ctx, req)
 	if err != nil {
+		hooks.after(cmd, nil)
 		return nil, err
 	}
 
-	return &Result{
+	result := &Result{
 		ExitCode:   execResult.ExitCode,
 		Stdout:     append([]byte(nil), execResult.Stdout...),
 		Stderr:     append([]byte(nil), execResult.Stderr...),
 		Duration:   execResult.Duration,
 		StartedAt:  execResult.StartedAt,
 		FinishedAt: execResult.FinishedAt,
-	}, nil
+
+		StdoutTruncated: execResult.StdoutTruncated,
+		StderrTruncated: execResult.StderrTruncated,
+		Env:             execResult.Env,
+		PeakOpenFiles:   execResult.PeakOpenFiles,
+		ExitReason:      execResult.ExitReason,
+		TimedOut:        execResult.TimedOut,
+		UserTime:        execResult.UserTime,
+		SysTime:         execResult.SysTime,
+		MaxRSSBytes:     execResult.MaxRSSBytes,
+		BlockedSyscall:  execResult.BlockedSyscall,
+
+		StdoutTotalBytes: execResult.StdoutTotalBytes,
+		StderrTotalBytes: execResult.StderrTotalBytes,
+	}
+	stripResultANSI(cmd, result)
+	hooks.after(cmd, result)
+	return result, nil
 }
 
 func (c *containerImpl) ExecStream(ctx context.Context, cmd *Command) (*Stream, error) {
-	vm, err := c.getVM()
+	vm, err := c.vmFor(runtimectl.VMOpExec)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.installResolvConf(ctx, vm); err != nil {
+		return nil, err
+	}
+
+	release, err := c.acquireSlot(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks := c.execHooks()
+	hooks.before(cmd)
+	c.execDispatched()
 
 	req := toCommandRequest(cmd)
+	c.applyMetadataEnv(req)
+	if cmd.Main {
+		req.Detach = true
+	}
 	agentStream, err := vm.ExecStream(ctx, req)
 	if err != nil {
+		release()
+		hooks.after(cmd, nil)
 		return nil, err
 	}
+	var main *mainWorkload
+	if cmd.Main {
+		main = c.trackMain(agentStream.JobID)
+	}
 
+	return newStream(ctx, cmd, agentStream, func(result *Result) {
+		release()
+		c.mainExited(main)
+		hooks.after(cmd, result)
+	}), nil
+}
+
+// newStream relays agentStream as a Stream. finish runs with the converted
+// result, or nil if the exec failed, before the result is delivered.
+func newStream(ctx context.Context, cmd *Command, agentStream *agent.CommandStream, finish func(*Result)) *Stream {
 	done := make(chan *Result, 1)
+	summary := make(chan *StreamSummary, 1)
+	relayCtx, relayCancel := context.WithCancel(ctx)
+	counter := &streamCounter{}
+	stdout := counter.relay(relayCtx, agentStream.Stdout, &counter.stdoutBytes, cmd.StripANSI)
+	stderr := counter.relay(relayCtx, agentStream.Stderr, &counter.stderrBytes, cmd.StripANSI)
 
 	go func() {
+		defer relayCancel()
 		res := <-agentStream.Done
 		if res == nil {
+			finish(nil)
 			done <- nil
+			summary <- counter.summarize(agentStream.JobID, nil)
 			return
 		}
-		done <- &Result{
+		result := &Result{
 			ExitCode:   res.ExitCode,
 			Stdout:     append([]byte(nil), res.Stdout...),
 			Stderr:     append([]byte(nil), res.Stderr...),
 			Duration:   res.Duration,
 			StartedAt:  res.StartedAt,
 			FinishedAt: res.FinishedAt,
+
+			StdoutTruncated: res.StdoutTruncated,
+			StderrTruncated: res.StderrTruncated,
+			Env:             res.Env,
+			PeakOpenFiles:   res.PeakOpenFiles,
+			ExitReason:      res.ExitReason,
+			TimedOut:        res.TimedOut,
+			UserTime:        res.UserTime,
+			SysTime:         res.SysTime,
+			MaxRSSBytes:     res.MaxRSSBytes,
+			BlockedSyscall:  res.BlockedSyscall,
+
+			StdoutTotalBytes: res.StdoutTotalBytes,
+			StderrTotalBytes: res.StderrTotalBytes,
 		}
+		stripResultANSI(cmd, result)
+		finish(result)
+		done <- result
+		summary <- counter.summarize(agentStream.JobID, result)
 	}()
 
 	return &Stream{
-		Stdout: agentStream.Stdout,
-		Stderr: agentStream.Stderr,
-		Done:   done,
-		cancel: agentStream.Cancel,
-	}, nil
+		JobID:   agentStream.JobID,
+		Stdout:  stdout,
+		Stderr:  stderr,
+		Done:    done,
+		Summary: summary,
+		agent:   agentStream,
+		cancel: func() {
+			relayCancel()
+			if agentStream.Cancel != nil {
+				agentStream.Cancel()
+			}
+		},
+	}
 }
 
 func (c *containerImpl) Status(ctx context.Context) (*Status, error) {
@@ -171,6 +377,7 @@ func (c *containerImpl) Status(ctx context.Context) (*Status, error) {
 	return &Status{
 		ID:          vm.ID(),
 		Name:        c.cfg.Name,
+		SetID:       c.cfg.Metadata[SandboxSetMetadataKey],
 		State:       vmStatus.State,
 		CreatedAt:   vmStatus.CreatedAt,
 		StartedAt:   vmStatus.StartedAt,
@@ -179,6 +386,8 @@ func (c *containerImpl) Status(ctx context.Context) (*Status, error) {
 		Interfaces:  append([]runtimectl.NetworkInterfaceStatus(nil), vmStatus.Interfaces...),
 		ResolvedIPs: append([]string(nil), vmStatus.ResolvedIPs...),
 		NetworkPlan: append([]string(nil), vmStatus.NetworkPlan...),
+
+		NetworkPlanSteps: runtimectl.ClonePlanSteps(vmStatus.NetworkPlanSteps),
 	}, nil
 }
 
@@ -197,12 +406,43 @@ func (c *containerImpl) Stats(ctx context.Context) (*Stats, error) {
 		CPUPercent:     vmStats.CPUPercent,
 		MemoryBytes:    vmStats.MemoryBytes,
 		DiskBytes:      vmStats.DiskBytes,
+		DiskReadBytes:  vmStats.DiskReadBytes,
+		DiskWriteBytes: vmStats.DiskWriteBytes,
 		NetworkRxBytes: vmStats.NetworkRxBytes,
 		NetworkTxBytes: vmStats.NetworkTxBytes,
 		Interfaces:     append([]runtimectl.InterfaceStats(nil), vmStats.Interfaces...),
+		Estimated:      vmStats.Estimated,
 	}, nil
 }
 
+// acquireSlot waits for the manager's scheduler to admit cmd. Containers that
+// are not scheduled get a no-op release func.
+func (c *containerImpl) acquireSlot(ctx context.Context, cmd *Command) (func(), error) {
+	if c.scheduler == nil {
+		return func() {}, nil
+	}
+	priority := 0
+	if cmd != nil {
+		priority = cmd.Priority
+	}
+	return c.scheduler.acquire(ctx, priority)
+}
+
+func (c *containerImpl) Config() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cfg.Clone()
+}
+
+func (c *containerImpl) ResolvedVMConfig() *VMConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.vm == nil {
+		return nil
+	}
+	return c.vm.Config().Clone()
+}
+
 func (c *containerImpl) getVM() (runtimectl.VM, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
@@ -253,26 +493,7 @@ func toRuntimeNetworkConfig(cfg *Config) runtimectl.NetworkConfig {
 	if cfg.Network == nil {
 		return runtimectl.NetworkConfig{Mode: cfg.NetworkMode}
 	}
-	src := cfg.Network
-	copyDNS := append([]string(nil), src.DNS...)
-	portForwards := make([]runtimectl.PortForward, len(src.PortForwards))
-	copy(portForwards, src.PortForwards)
-	interfaces := make([]runtimectl.NetworkInterface, len(src.Interfaces))
-	copy(interfaces, src.Interfaces)
-	var bandwidth *runtimectl.BandwidthLimit
-	if src.Bandwidth != nil {
-		bw := *src.Bandwidth
-		bandwidth = &bw
-	}
-	return runtimectl.NetworkConfig{
-		Mode:          src.Mode,
-		Hostname:      src.Hostname,
-		DNS:           copyDNS,
-		PortForwards:  portForwards,
-		Interfaces:    interfaces,
-		Bandwidth:     bandwidth,
-		EnableMetrics: src.EnableMetrics,
-	}
+	return cfg.Network.Clone()
 }
 
 func toCommandRequest(cmd *Command) *agent.CommandRequest {
@@ -305,5 +526,40 @@ func toCommandRequest(cmd *Command) *agent.CommandRequest {
 		Timeout:    cmd.Timeout,
 		WorkingDir: cmd.WorkingDir,
 		User:       cmd.User,
+		Detach:     cmd.Detach,
+		Reconnect:  cmd.Reconnect,
+
+		MaxStdoutBytes: cmd.MaxStdoutBytes,
+		MaxStderrBytes: cmd.MaxStderrBytes,
+		MaxOutputBytes: cmd.MaxOutputBytes,
+		Hostname:       cmd.Hostname,
+		OOMScoreAdj:    cmd.OOMScoreAdj,
+		MaxOpenFiles:   cmd.MaxOpenFiles,
+		StdinFIFO:      cmd.StdinFIFO,
+		StdoutFIFO:     cmd.StdoutFIFO,
+		StderrFIFO:     cmd.StderrFIFO,
+		Mounts:         execMounts(cmd.Mounts),
+		Tmpfs:          cmd.Tmpfs,
+		StdoutLog:      cmd.StdoutLog,
+		StderrLog:      cmd.StderrLog,
+		ReturnEnv:      cmd.ReturnEnv,
+		EgressAllow:    cmd.EgressAllow,
+		CompletionURL:  cmd.CompletionURL,
+		Tty:            cmd.Tty,
+		TtySize:        cmd.TtySize,
+		Resize:         cmd.Resize,
+
+		CreateWorkingDir: cmd.CreateWorkingDir,
+	}
+}
+
+func execMounts(mounts []Mount) []agent.Mount {
+	if len(mounts) == 0 {
+		return nil
+	}
+	out := make([]agent.Mount, len(mounts))
+	for i, m := range mounts {
+		out[i] = agent.Mount{Source: m.Source, Target: m.Target}
 	}
+	return out
 }
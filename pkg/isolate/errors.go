@@ -1,6 +1,10 @@
 package isolate
 
-import "errors"
+import (
+	"errors"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
 
 var (
 	ErrContainerExists      = errors.New("container already exists")
@@ -8,4 +12,26 @@ var (
 	ErrContainerNotCreated  = errors.New("container not created")
 	ErrRuntimeUnavailable   = errors.New("no runtime available for this host")
 	ErrExecutionUnavailable = errors.New("guest agent unavailable for execution")
+	ErrInvalidSpec          = errors.New("invalid container spec")
+	ErrInvalidCommand       = errors.New("invalid command")
+	ErrAgentPoolExhausted   = errors.New("every agent in the pool is in use")
+	ErrAgentPoolClosed      = errors.New("agent pool closed")
+	ErrAgentBinaryNotFound  = errors.New("agentd binary not found")
+	ErrInsufficientCapacity = errors.New("insufficient capacity")
+	ErrAffinityUnsatisfied  = errors.New("no container matches the affinity labels")
+	ErrAntiAffinity         = errors.New("anti-affinity conflict with an existing container")
+)
+
+// Errors Config.Validate wraps, re-exported from the runtime.
+var (
+	ErrInvalidCPUCount      = runtimectl.ErrInvalidCPUCount
+	ErrInvalidMemory        = runtimectl.ErrInvalidMemory
+	ErrInvalidDiskSize      = runtimectl.ErrInvalidDiskSize
+	ErrInvalidNetworkMode   = runtimectl.ErrInvalidNetworkMode
+	ErrInvalidAddressFamily = runtimectl.ErrInvalidAddressFamily
+	ErrInvalidDNS           = runtimectl.ErrInvalidDNS
+	ErrInvalidInterface     = runtimectl.ErrInvalidInterface
+	ErrDuplicateInterface   = runtimectl.ErrDuplicateInterface
+	ErrInvalidPortForward   = runtimectl.ErrInvalidPortForward
+	ErrPortForwardConflict  = runtimectl.ErrPortForwardConflict
 )
@@ -0,0 +1,117 @@
+package isolate
+
+import (
+	"sync"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// EventKind classifies the events a manager publishes to subscribers.
+type EventKind string
+
+const (
+	EventCreated EventKind = "created"
+	EventStarted EventKind = "started"
+	EventStopped EventKind = "stopped"
+	EventDeleted EventKind = "deleted"
+	EventFailed  EventKind = "failed"
+	// EventExec is published when a command is dispatched to the guest,
+	// by Exec or ExecStream.
+	EventExec EventKind = "exec"
+)
+
+// Event reports something that happened to a container owned by a manager.
+type Event struct {
+	Name string
+	Kind EventKind
+	At   time.Time
+}
+
+// eventBufferSize is the capacity of each subscriber's channel.
+const eventBufferSize = 64
+
+// eventBus fans events out to subscribers. Sends never block, so publishing
+// and unsubscribing cannot deadlock each other.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving the manager's container events and
+// a func that unsubscribes and closes the channel; calling it more than once
+// is harmless. Each subscriber has its own buffer of 64 events. Events a
+// subscriber has no room for are dropped rather than holding up the
+// container operation that published them.
+//
+// Events are published when a container is created, on state transitions
+// into running, stopped, failed and deleted (pausing and resuming publish
+// nothing), and for every exec.
+func (m *Manager) Subscribe() (<-chan Event, func()) {
+	return m.events.subscribe()
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, ch)
+			close(ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+func (m *Manager) publish(name string, kind EventKind) {
+	m.events.publish(Event{Name: name, Kind: kind, At: time.Now()})
+}
+
+// transitionEvent maps a state transition to the event it publishes, if
+// any.
+func transitionEvent(t Transition) (EventKind, bool) {
+	switch t.To {
+	case runtimectl.VMStateRunning:
+		if t.From == runtimectl.VMStatePaused {
+			return "", false
+		}
+		return EventStarted, true
+	case runtimectl.VMStateStopped:
+		return EventStopped, true
+	case runtimectl.VMStateFailed:
+		return EventFailed, true
+	case runtimectl.VMStateDeleted:
+		return EventDeleted, true
+	}
+	return "", false
+}
+
+// execDispatched publishes EventExec for the container.
+func (c *containerImpl) execDispatched() {
+	if c.onExec == nil {
+		return
+	}
+	c.mu.RLock()
+	name := c.cfg.Name
+	c.mu.RUnlock()
+	c.onExec(name)
+}
@@ -0,0 +1,277 @@
+package isolate
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ExecOptions builds a Command one option at a time:
+//
+//	cmd, err := isolate.NewExec("make", "test").
+//		InDir("/src").
+//		AsUser("builder").
+//		WithTimeout(5 * time.Minute).
+//		TTY().
+//		Build()
+//
+// Build checks the options against each other, so combinations the agent
+// would refuse or silently ignore are reported before anything runs. The
+// Command fields remain available for callers that prefer them.
+type ExecOptions struct {
+	cmd Command
+}
+
+// NewExec starts building a command that runs path with args.
+func NewExec(path string, args ...string) *ExecOptions {
+	return &ExecOptions{cmd: Command{Path: path, Args: append([]string(nil), args...)}}
+}
+
+// WithEnv sets one environment variable.
+func (o *ExecOptions) WithEnv(key, value string) *ExecOptions {
+	if o.cmd.Env == nil {
+		o.cmd.Env = make(map[string]string)
+	}
+	o.cmd.Env[key] = value
+	return o
+}
+
+// WithEnvMap sets every variable in env.
+func (o *ExecOptions) WithEnvMap(env map[string]string) *ExecOptions {
+	for k, v := range env {
+		o.WithEnv(k, v)
+	}
+	return o
+}
+
+// InDir sets the working directory.
+func (o *ExecOptions) InDir(dir string) *ExecOptions {
+	o.cmd.WorkingDir = dir
+	return o
+}
+
+// CreateWorkingDir creates the working directory in the guest if it does
+// not exist yet.
+func (o *ExecOptions) CreateWorkingDir() *ExecOptions {
+	o.cmd.CreateWorkingDir = true
+	return o
+}
+
+// AsUser runs the command as user, a name or uid optionally followed by
+// ":group". The guest agent must run as root to switch users.
+func (o *ExecOptions) AsUser(user string) *ExecOptions {
+	o.cmd.User = user
+	return o
+}
+
+// WithTimeout bounds how long the command may run.
+func (o *ExecOptions) WithTimeout(d time.Duration) *ExecOptions {
+	o.cmd.Timeout = d
+	return o
+}
+
+// WithPriority sets the dispatch priority; see Command.Priority.
+func (o *ExecOptions) WithPriority(priority int) *ExecOptions {
+	o.cmd.Priority = priority
+	return o
+}
+
+// WithStdin feeds r to the command's standard input.
+func (o *ExecOptions) WithStdin(r io.Reader) *ExecOptions {
+	o.cmd.Stdin = r
+	return o
+}
+
+// WithStdout copies the command's standard output to w.
+func (o *ExecOptions) WithStdout(w io.Writer) *ExecOptions {
+	o.cmd.Stdout = w
+	return o
+}
+
+// WithStderr copies the command's standard error to w.
+func (o *ExecOptions) WithStderr(w io.Writer) *ExecOptions {
+	o.cmd.Stderr = w
+	return o
+}
+
+// WithOutputLimits caps the captured stdout, stderr and their combined
+// size; zero keeps the agent default for that limit.
+func (o *ExecOptions) WithOutputLimits(stdout, stderr, combined int) *ExecOptions {
+	o.cmd.MaxStdoutBytes = stdout
+	o.cmd.MaxStderrBytes = stderr
+	o.cmd.MaxOutputBytes = combined
+	return o
+}
+
+// WithHostname runs the command in a private UTS namespace with hostname.
+func (o *ExecOptions) WithHostname(hostname string) *ExecOptions {
+	o.cmd.Hostname = hostname
+	return o
+}
+
+// WithOOMScoreAdj sets the command's oom_score_adj (-1000..1000).
+func (o *ExecOptions) WithOOMScoreAdj(adj int) *ExecOptions {
+	o.cmd.OOMScoreAdj = adj
+	return o
+}
+
+// WithMaxOpenFiles caps the command's open descriptors.
+func (o *ExecOptions) WithMaxOpenFiles(n uint64) *ExecOptions {
+	o.cmd.MaxOpenFiles = n
+	return o
+}
+
+// WithMount adds a read-only bind mount for this exec.
+func (o *ExecOptions) WithMount(m Mount) *ExecOptions {
+	o.cmd.Mounts = append(o.cmd.Mounts, m)
+	return o
+}
+
+// WithTmpfs adds a size-limited scratch tmpfs for this exec.
+func (o *ExecOptions) WithTmpfs(t TmpfsMount) *ExecOptions {
+	o.cmd.Tmpfs = append(o.cmd.Tmpfs, t)
+	return o
+}
+
+// WithFIFOs connects the command's streams to named pipes in the guest; an
+// empty name leaves that stream alone.
+func (o *ExecOptions) WithFIFOs(stdin, stdout, stderr string) *ExecOptions {
+	o.cmd.StdinFIFO = stdin
+	o.cmd.StdoutFIFO = stdout
+	o.cmd.StderrFIFO = stderr
+	return o
+}
+
+// LogTo persists the command's streams to rotating guest files; nil leaves
+// that stream alone.
+func (o *ExecOptions) LogTo(stdout, stderr *LogFile) *ExecOptions {
+	o.cmd.StdoutLog = stdout
+	o.cmd.StderrLog = stderr
+	return o
+}
+
+// Detached keeps the command running if the agent connection drops.
+func (o *ExecOptions) Detached() *ExecOptions {
+	o.cmd.Detach = true
+	return o
+}
+
+// Reconnecting re-attaches streams automatically after a transport failure.
+// It implies Detached.
+func (o *ExecOptions) Reconnecting(policy ReconnectPolicy) *ExecOptions {
+	o.cmd.Detach = true
+	o.cmd.Reconnect = &policy
+	return o
+}
+
+// AsMain marks the command as the container's main workload. It implies
+// Detached.
+func (o *ExecOptions) AsMain() *ExecOptions {
+	o.cmd.Main = true
+	o.cmd.Detach = true
+	return o
+}
+
+// ReturnEnv records the resolved environment in Result.Env.
+func (o *ExecOptions) ReturnEnv() *ExecOptions {
+	o.cmd.ReturnEnv = true
+	return o
+}
+
+// StripANSI removes terminal escape sequences from the captured output.
+func (o *ExecOptions) StripANSI() *ExecOptions {
+	o.cmd.StripANSI = true
+	return o
+}
+
+// NotifyURL has the agent POST a result summary to url when the command
+// exits.
+func (o *ExecOptions) NotifyURL(url string) *ExecOptions {
+	o.cmd.CompletionURL = url
+	return o
+}
+
+// TTY runs the command on a pseudo-terminal, with stderr merged into
+// stdout.
+func (o *ExecOptions) TTY() *ExecOptions {
+	o.cmd.Tty = true
+	return o
+}
+
+// TTYSize sets the terminal's initial size.
+func (o *ExecOptions) TTYSize(rows, cols uint16) *ExecOptions {
+	o.cmd.TtySize = WindowSize{Rows: rows, Cols: cols}
+	return o
+}
+
+// ResizeFrom forwards terminal size changes received on resize.
+func (o *ExecOptions) ResizeFrom(resize <-chan WindowSize) *ExecOptions {
+	o.cmd.Resize = resize
+	return o
+}
+
+// Build validates the options and returns the command. Each call returns a
+// new Command, so a builder can be reused as a template. Every problem
+// found is reported, each wrapping ErrInvalidCommand.
+func (o *ExecOptions) Build() (*Command, error) {
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o.cmd.clone(), nil
+}
+
+func (o *ExecOptions) validate() error {
+	c := &o.cmd
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidCommand}, args...)...))
+	}
+
+	if c.Path == "" {
+		fail("path is required")
+	}
+	if c.Timeout < 0 {
+		fail("timeout must not be negative")
+	}
+	if c.MaxStdoutBytes < 0 || c.MaxStderrBytes < 0 || c.MaxOutputBytes < 0 {
+		fail("output limits must not be negative")
+	}
+	if c.OOMScoreAdj < -1000 || c.OOMScoreAdj > 1000 {
+		fail("oom score adjustment %d is outside -1000..1000", c.OOMScoreAdj)
+	}
+
+	streams := []struct {
+		name   string
+		writer bool
+		fifo   string
+		log    *LogFile
+	}{
+		{"stdin", c.Stdin != nil, c.StdinFIFO, nil},
+		{"stdout", c.Stdout != nil, c.StdoutFIFO, c.StdoutLog},
+		{"stderr", c.Stderr != nil, c.StderrFIFO, c.StderrLog},
+	}
+	for _, s := range streams {
+		if s.fifo != "" && s.log != nil {
+			fail("%s cannot go to both a fifo and a log", s.name)
+		}
+		if s.writer && (s.fifo != "" || s.log != nil) {
+			fail("%s is redirected in the guest and cannot also be copied locally", s.name)
+		}
+		if c.Tty && (s.fifo != "" || s.log != nil) {
+			fail("%s cannot be redirected when running on a tty", s.name)
+		}
+	}
+
+	if c.Tty {
+		if c.Stderr != nil {
+			fail("a tty merges stderr into stdout; set only a stdout writer")
+		}
+		if c.MaxStderrBytes > 0 {
+			fail("a tty merges stderr into stdout; limit stdout instead")
+		}
+	} else if c.TtySize != (WindowSize{}) || c.Resize != nil {
+		fail("terminal size options need TTY")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,109 @@
+package isolate
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecOptionsBuild(t *testing.T) {
+	args := []string{"test", "./..."}
+	opts := NewExec("make", args...).
+		InDir("/src").
+		CreateWorkingDir().
+		AsUser("builder:staff").
+		WithEnv("GOFLAGS", "-race").
+		WithTimeout(5*time.Minute).
+		WithPriority(3).
+		WithOutputLimits(1<<20, 0, 2<<20).
+		WithTmpfs(TmpfsMount{Path: "/tmp", SizeBytes: 64 << 20}).
+		TTY().
+		TTYSize(24, 80)
+	cmd, err := opts.Build()
+	if err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+	want := &Command{
+		Path:             "make",
+		Args:             []string{"test", "./..."},
+		Env:              map[string]string{"GOFLAGS": "-race"},
+		WorkingDir:       "/src",
+		CreateWorkingDir: true,
+		User:             "builder:staff",
+		Timeout:          5 * time.Minute,
+		Priority:         3,
+		MaxStdoutBytes:   1 << 20,
+		MaxOutputBytes:   2 << 20,
+		Tmpfs:            []TmpfsMount{{Path: "/tmp", SizeBytes: 64 << 20}},
+		Tty:              true,
+		TtySize:          WindowSize{Rows: 24, Cols: 80},
+	}
+	if !reflect.DeepEqual(cmd, want) {
+		t.Errorf("Build() = %+v\nwant %+v", cmd, want)
+	}
+
+	// The builder is a template: neither the caller's slices nor later
+	// options change a built command.
+	args[0] = "changed"
+	opts.WithEnv("CGO_ENABLED", "0")
+	if cmd.Args[0] != "test" || len(cmd.Env) != 1 {
+		t.Errorf("built command changed afterwards: args %q, env %v", cmd.Args, cmd.Env)
+	}
+}
+
+func TestExecOptionsImplied(t *testing.T) {
+	cmd, err := NewExec("server").AsMain().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmd.Main || !cmd.Detach {
+		t.Errorf("AsMain: main %v, detach %v, want both", cmd.Main, cmd.Detach)
+	}
+	cmd, err = NewExec("worker").Reconnecting(ReconnectPolicy{MaxAttempts: 3}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmd.Detach || cmd.Reconnect == nil || cmd.Reconnect.MaxAttempts != 3 {
+		t.Errorf("Reconnecting: detach %v, policy %+v", cmd.Detach, cmd.Reconnect)
+	}
+}
+
+func TestExecOptionsRejectsConflicts(t *testing.T) {
+	log := &LogFile{Path: "/var/log/out"}
+	for _, tc := range []struct {
+		name string
+		opts *ExecOptions
+		want string
+	}{
+		{"missing path", NewExec(""), "path is required"},
+		{"negative timeout", NewExec("sh").WithTimeout(-time.Second), "timeout"},
+		{"negative limit", NewExec("sh").WithOutputLimits(-1, 0, 0), "output limits"},
+		{"oom score", NewExec("sh").WithOOMScoreAdj(1001), "oom score"},
+		{"tty with stderr writer", NewExec("sh").TTY().WithStderr(io.Discard), "merges stderr"},
+		{"tty with stderr limit", NewExec("sh").TTY().WithOutputLimits(0, 10, 0), "merges stderr"},
+		{"tty with fifo", NewExec("sh").TTY().WithFIFOs("", "/run/out", ""), "tty"},
+		{"tty with log", NewExec("sh").TTY().LogTo(log, nil), "tty"},
+		{"fifo and log", NewExec("sh").WithFIFOs("", "/run/out", "").LogTo(log, nil), "both a fifo and a log"},
+		{"writer and log", NewExec("sh").WithStdout(io.Discard).LogTo(log, nil), "copied locally"},
+		{"size without tty", NewExec("sh").TTYSize(24, 80), "need TTY"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cmd, err := tc.opts.Build()
+			if err == nil {
+				t.Fatalf("Build() = %+v, want an error", cmd)
+			}
+			if !errors.Is(err, ErrInvalidCommand) || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Build() error = %v, want %v mentioning %q", err, ErrInvalidCommand, tc.want)
+			}
+		})
+	}
+
+	// Every problem is reported at once.
+	_, err := NewExec("").TTY().WithStderr(io.Discard).Build()
+	if got := strings.Count(err.Error(), ErrInvalidCommand.Error()); got != 2 {
+		t.Errorf("Build() reported %d problems, want 2: %v", got, err)
+	}
+}
@@ -0,0 +1,74 @@
+package isolate
+
+import (
+	"context"
+	"flag"
+	"net"
+	"os"
+	goruntime "runtime"
+	"testing"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// TestMain lets tests run the test binary as agentd: with ISOLATE_TEST_AGENTD
+// set it serves an agent on the -unix socket it is given instead of running
+// the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("ISOLATE_TEST_AGENTD") != "" {
+		runTestAgentd()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func runTestAgentd() {
+	flags := flag.NewFlagSet("agentd", flag.ExitOnError)
+	socket := flags.String("unix", "", "")
+	root := flags.String("root", "", "")
+	flags.Bool("no-chroot", false, "")
+	_ = flags.Parse(os.Args[1:])
+	ln, err := net.Listen("unix", *socket)
+	if err != nil {
+		os.Exit(1)
+	}
+	_ = agent.NewServer(agent.ServerConfig{RootDir: *root, AllowInsecure: true}).Serve(ln)
+}
+
+// newTestManager returns a manager on one of the host's stub runtimes,
+// which keep VMs in memory. Containers created with DevMode run their
+// commands on the host through the loopback agent.
+func newTestManager(t *testing.T) *Manager {
+	t.Helper()
+	for _, desc := range runtimectl.AvailableRuntimes(goruntime.GOOS) {
+		if desc.Hypervisor == "firecracker" {
+			continue
+		}
+		rt, err := runtimectl.Acquire(desc.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := NewManager(rt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	t.Skipf("no stub runtime registered for %s", goruntime.GOOS)
+	return nil
+}
+
+// startDevContainer creates and starts a DevMode container named name on m.
+func startDevContainer(ctx context.Context, t *testing.T, m *Manager, name string) Container {
+	t.Helper()
+	c, err := m.CreateContainer(ctx, &Config{Name: name, DevMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,58 @@
+package isolate
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// ExecPreHook runs before a command is sent to the guest.
+type ExecPreHook func(cmd *Command)
+
+// ExecPostHook runs once a command has finished. result is nil when the exec
+// failed before producing a result.
+type ExecPostHook func(cmd *Command, result *Result)
+
+type execHooks struct {
+	pre  ExecPreHook
+	post ExecPostHook
+}
+
+// SetExecHooks installs hooks invoked around every Exec and ExecStream call.
+// Either hook may be nil. The pre hook runs in the caller's goroutine once an
+// exec slot has been granted. For Exec the post hook runs in the caller's
+// goroutine before Exec returns; for ExecStream it runs on the goroutine
+// that delivers the result, before the result is sent on Done. A panicking
+// hook is recovered and logged and does not affect the exec.
+func (c *containerImpl) SetExecHooks(pre ExecPreHook, post ExecPostHook) {
+	c.mu.Lock()
+	c.hooks = execHooks{pre: pre, post: post}
+	c.mu.Unlock()
+}
+
+func (c *containerImpl) execHooks() execHooks {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hooks
+}
+
+func (h execHooks) before(cmd *Command) {
+	if h.pre == nil {
+		return
+	}
+	defer recoverHook("pre")
+	h.pre(cmd)
+}
+
+func (h execHooks) after(cmd *Command, result *Result) {
+	if h.post == nil {
+		return
+	}
+	defer recoverHook("post")
+	h.post(cmd, result)
+}
+
+func recoverHook(kind string) {
+	if r := recover(); r != nil {
+		log.Printf("isolate: %s-exec hook panicked: %v\n%s", kind, r, debug.Stack())
+	}
+}
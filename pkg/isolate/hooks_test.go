@@ -0,0 +1,116 @@
+package isolate
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hookRecorder records every hook call in order.
+type hookRecorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *hookRecorder) install(c Container) {
+	c.SetExecHooks(func(cmd *Command) {
+		r.record("pre %s %v", cmd.Path, cmd.Args)
+	}, func(cmd *Command, result *Result) {
+		if result == nil {
+			r.record("post %s %v failed", cmd.Path, cmd.Args)
+			return
+		}
+		r.record("post %s %v exit %d %q", cmd.Path, cmd.Args, result.ExitCode, result.Stdout)
+	})
+}
+
+func (r *hookRecorder) record(format string, args ...any) {
+	r.mu.Lock()
+	r.calls = append(r.calls, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *hookRecorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+func TestExecHooks(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := m.CreateContainer(ctx, &Config{Name: "hooks", DevMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var rec hookRecorder
+	rec.install(c)
+
+	if _, err := c.Exec(ctx, &Command{Path: "/bin/sh", Args: []string{"-c", "printf one; exit 2"}}); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	want := []string{
+		`pre /bin/sh [-c printf one; exit 2]`,
+		`post /bin/sh [-c printf one; exit 2] exit 2 "one"`,
+	}
+	if got := rec.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Exec hook calls = %q, want %q", got, want)
+	}
+
+	stream, err := c.ExecStream(ctx, &Command{Path: "/bin/echo", Args: []string{"two"}})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	for range stream.Stdout {
+	}
+	for range stream.Stderr {
+	}
+	result := <-stream.Done
+	// The post hook has run by the time the result is delivered.
+	want = []string{
+		`pre /bin/echo [two]`,
+		fmt.Sprintf(`post /bin/echo [two] exit 0 %q`, result.Stdout),
+	}
+	if got := rec.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExecStream hook calls = %q, want %q", got, want)
+	}
+
+	// A panicking hook does not affect the exec.
+	c.SetExecHooks(func(*Command) { panic("pre") }, func(*Command, *Result) { panic("post") })
+	if result, err := c.Exec(ctx, &Command{Path: "/bin/true"}); err != nil || result.ExitCode != 0 {
+		t.Errorf("Exec with panicking hooks = %+v, %v", result, err)
+	}
+}
+
+func TestExecHooksSeeFailedExecs(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// Outside dev mode the stub VM has no agent to run the command.
+	c, err := m.CreateContainer(ctx, &Config{Name: "hooks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var rec hookRecorder
+	rec.install(c)
+
+	if _, err := c.Exec(ctx, &Command{Path: "/bin/true"}); err == nil {
+		t.Fatal("Exec succeeded without an agent")
+	}
+	want := []string{`pre /bin/true []`, `post /bin/true [] failed`}
+	if got := rec.take(); !reflect.DeepEqual(got, want) {
+		t.Errorf("hook calls = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package isolate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// maxJSONLLineBytes bounds how much of an unterminated line ExecJSONL buffers
+// before reporting it as an error and skipping to the next newline.
+const maxJSONLLineBytes = 4 * 1024 * 1024
+
+// ExecJSONL runs cmd with ExecStream and decodes each line of its stdout as a
+// JSON value of type T. Lines may span stream chunks; blank lines are skipped.
+// Malformed lines, oversized lines and a non-zero exit code are reported on
+// the error channel without stopping decoding. Stderr is discarded.
+//
+// Both channels are closed once the command has finished, and callers must
+// receive from both until then (for example in a select loop). Cancelling
+// ctx stops the command.
+func ExecJSONL[T any](ctx context.Context, c Container, cmd *Command) (<-chan T, <-chan error, error) {
+	stream, err := c.ExecStream(ctx, cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	events := make(chan T)
+	errs := make(chan error)
+
+	go func() {
+		defer close(events)
+		defer close(errs)
+		defer stream.Close()
+
+		go func() {
+			for range stream.Stderr {
+			}
+		}()
+
+		sendErr := func(err error) bool {
+			select {
+			case errs <- err:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		lineNo := 0
+		decode := func(line []byte) bool {
+			lineNo++
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 {
+				return true
+			}
+			var event T
+			if err := json.Unmarshal(line, &event); err != nil {
+				return sendErr(fmt.Errorf("line %d: %w", lineNo, err))
+			}
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var pending []byte
+		skipping := false
+		for chunk := range stream.Stdout {
+			pending = append(pending, chunk...)
+			for {
+				idx := bytes.IndexByte(pending, '\n')
+				if idx < 0 {
+					break
+				}
+				line := pending[:idx]
+				pending = pending[idx+1:]
+				if skipping {
+					skipping = false
+					lineNo++
+					continue
+				}
+				if !decode(line) {
+					return
+				}
+			}
+			if !skipping && len(pending) > maxJSONLLineBytes {
+				skipping = true
+				if !sendErr(fmt.Errorf("line %d: exceeds %d bytes", lineNo+1, maxJSONLLineBytes)) {
+					return
+				}
+			}
+			if skipping {
+				pending = pending[:0]
+			}
+		}
+		if len(pending) > 0 && !skipping {
+			if !decode(pending) {
+				return
+			}
+		}
+
+		select {
+		case res := <-stream.Done:
+			if res != nil && res.ExitCode != 0 {
+				sendErr(fmt.Errorf("command exited with code %d", res.ExitCode))
+			}
+		case <-ctx.Done():
+		}
+	}()
+
+	return events, errs, nil
+}
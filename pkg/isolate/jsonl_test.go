@@ -0,0 +1,64 @@
+package isolate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecJSONL(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := m.CreateContainer(ctx, &Config{Name: "jsonl", DevMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	type event struct {
+		N    int    `json:"n"`
+		Name string `json:"name"`
+	}
+	// The second event is split across two writes, a blank line is
+	// skipped, the fourth line is not JSON and the last has no newline.
+	script := `printf '{"n":1,"name":"a"}\n{"n":2,'; sleep 0.1; printf '"name":"b"}\n\n'
+printf 'not json\n{"n":3,"name":"c"}'
+echo ignored >&2
+exit 3`
+	events, errs, err := ExecJSONL[event](ctx, c, &Command{Path: "/bin/sh", Args: []string{"-c", script}})
+	if err != nil {
+		t.Fatalf("ExecJSONL: %v", err)
+	}
+
+	var got []event
+	var gotErrs []string
+	for events != nil || errs != nil {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			got = append(got, e)
+		case err, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			gotErrs = append(gotErrs, err.Error())
+		}
+	}
+
+	want := []event{{1, "a"}, {2, "b"}, {3, "c"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %+v, want %+v", got, want)
+	}
+	if len(gotErrs) != 2 || !strings.HasPrefix(gotErrs[0], "line 4: ") || gotErrs[1] != "command exited with code 3" {
+		t.Errorf("errors = %q, want line 4 malformed and exit code 3", gotErrs)
+	}
+}
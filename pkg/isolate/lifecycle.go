@@ -0,0 +1,86 @@
+package isolate
+
+import (
+	"log"
+	"runtime/debug"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// ErrInvalidTransition is wrapped by the errors returned for lifecycle
+// operations the container's state does not allow.
+var ErrInvalidTransition = runtimectl.ErrInvalidTransition
+
+// TransitionError re-exports the runtime error for rejected lifecycle
+// operations, such as Start after Delete or Exec while stopped.
+type TransitionError = runtimectl.TransitionError
+
+// Transition describes a change in a container's lifecycle state.
+type Transition struct {
+	Name string
+	From runtimectl.VMState
+	To   runtimectl.VMState
+	At   time.Time
+}
+
+// TransitionHook observes container state changes.
+type TransitionHook func(Transition)
+
+// SetTransitionHook installs a hook called after every state change of a
+// container owned by the manager, or removes it when hook is nil. It runs
+// synchronously in the goroutine that changed the state, so it should return
+// quickly. A panicking hook is recovered and logged.
+func (m *Manager) SetTransitionHook(hook TransitionHook) {
+	m.hookMu.Lock()
+	m.transitionHook = hook
+	m.hookMu.Unlock()
+}
+
+func (m *Manager) notifyTransition(t Transition) {
+	if kind, ok := transitionEvent(t); ok {
+		m.events.publish(Event{Name: t.Name, Kind: kind, At: t.At})
+	}
+	m.hookMu.RLock()
+	hook := m.transitionHook
+	m.hookMu.RUnlock()
+	if hook == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("isolate: transition hook panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	hook(t)
+}
+
+// vmFor returns the container's VM if its state allows op. A deleted
+// container rejects every operation.
+func (c *containerImpl) vmFor(op runtimectl.VMOp) (runtimectl.VM, error) {
+	c.mu.RLock()
+	vm, deleted := c.vm, c.deleted
+	c.mu.RUnlock()
+
+	if deleted {
+		return nil, &TransitionError{Op: op, From: runtimectl.VMStateDeleted}
+	}
+	if vm == nil {
+		return nil, ErrContainerNotCreated
+	}
+	if _, err := runtimectl.CheckTransition(vm.State(), op); err != nil {
+		return nil, err
+	}
+	return vm, nil
+}
+
+// transitioned reports a state change to the manager's transition hook.
+func (c *containerImpl) transitioned(from, to runtimectl.VMState) {
+	if c.onTransition == nil || from == to {
+		return
+	}
+	c.mu.RLock()
+	name := c.cfg.Name
+	c.mu.RUnlock()
+	c.onTransition(Transition{Name: name, From: from, To: to, At: time.Now()})
+}
@@ -0,0 +1,67 @@
+package isolate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+func TestIllegalTransitionsLeaveStateUnchanged(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	created, err := m.CreateContainer(ctx, &Config{Name: "lifecycle", DevMode: true})
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+	c := created.(*containerImpl)
+	state := func() runtimectl.VMState {
+		status, err := c.Status(ctx)
+		if err != nil {
+			t.Fatalf("Status: %v", err)
+		}
+		return status.State
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := c.Stop(ctx, time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	for _, op := range []runtimectl.VMOp{runtimectl.VMOpPause, runtimectl.VMOpResume, runtimectl.VMOpExec, runtimectl.VMOpSnapshot} {
+		if _, err := c.vmFor(op); !errors.Is(err, ErrInvalidTransition) {
+			t.Errorf("vmFor(%s) on a stopped container = %v, want %v", op, err, ErrInvalidTransition)
+		}
+	}
+	if err := c.Pause(ctx); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Pause on a stopped container = %v, want %v", err, ErrInvalidTransition)
+	}
+	if got := state(); got != runtimectl.VMStateStopped {
+		t.Errorf("state after an illegal pause = %s, want %s", got, runtimectl.VMStateStopped)
+	}
+	if _, err := c.vmFor(runtimectl.VMOpStart); err != nil {
+		t.Errorf("vmFor(start) on a stopped container: %v", err)
+	}
+
+	if err := c.Delete(ctx); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, op := range []runtimectl.VMOp{runtimectl.VMOpStart, runtimectl.VMOpStop, runtimectl.VMOpResume, runtimectl.VMOpExec} {
+		_, err := c.vmFor(op)
+		var transitionErr *TransitionError
+		if !errors.As(err, &transitionErr) || transitionErr.From != runtimectl.VMStateDeleted {
+			t.Errorf("vmFor(%s) on a deleted container = %v, want a transition from %s", op, err, runtimectl.VMStateDeleted)
+		}
+	}
+	if err := c.Start(ctx); !errors.Is(err, ErrInvalidTransition) {
+		t.Errorf("Start on a deleted container = %v, want %v", err, ErrInvalidTransition)
+	}
+	if c.vm != nil || !c.deleted {
+		t.Error("an illegal start revived the deleted container")
+	}
+}
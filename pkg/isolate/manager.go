@@ -2,8 +2,12 @@ package isolate
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 
 	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
 )
@@ -13,9 +17,22 @@ import (
 type Manager struct {
 	runtime    runtimectl.Runtime
 	containers map[string]*containerImpl
+	scheduler  *execScheduler
+	admission  *admission
+	nameSeq    uint64
 	mu         sync.RWMutex
+	// stateDir, when set, holds a record of every container; see
+	// NewManagerWithState.
+	stateDir string
+
+	hookMu         sync.RWMutex
+	transitionHook TransitionHook
+	events         eventBus
 }
 
+// defaultNamePrefix prefixes the names generated for configs without one.
+const defaultNamePrefix = "container"
+
 // NewManager wires a runtime implementation into a container manager.
 func NewManager(rt runtimectl.Runtime) (*Manager, error) {
 	if rt == nil {
@@ -27,6 +44,8 @@ func NewManager(rt runtimectl.Runtime) (*Manager, error) {
 	return &Manager{
 		runtime:    rt,
 		containers: make(map[string]*containerImpl),
+		scheduler:  newExecScheduler(),
+		admission:  newAdmission(),
 	}, nil
 }
 
@@ -39,27 +58,138 @@ func NewDefaultManager() (*Manager, error) {
 	return NewManager(rt)
 }
 
-// CreateContainer allocates a VM according to the provided config.
+// CreateContainer allocates a VM according to the provided config. When
+// cfg.Name is empty a unique name is generated as by GenerateName and stored
+// in cfg.Name. A cfg that fails Validate is rejected before anything is
+// reserved for it.
+//
+// The container must first be admitted against the manager's capacity and
+// the affinity rules in cfg.Scheduling; see SetCapacity.
 func (m *Manager) CreateContainer(ctx context.Context, cfg *Config) (Container, error) {
-	if cfg == nil {
-		return nil, fmt.Errorf("config is required")
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	// Admission may wait for capacity; don't hold the manager lock for it.
+	release, err := m.admission.admit(ctx, cfg)
+	if err != nil {
+		return nil, err
 	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if cfg.Name == "" {
+		cfg.Name = m.generateNameLocked(defaultNamePrefix)
+	}
 	if _, exists := m.containers[cfg.Name]; exists {
+		release()
 		return nil, ErrContainerExists
 	}
 
-	c := newContainer(m.runtime, cfg)
+	c := m.newContainer(cfg)
+	c.releaseCapacity = release
 	if err := c.Create(ctx, cfg); err != nil {
+		release()
+		return nil, err
+	}
+	if err := m.saveState(c); err != nil {
+		c.vm.Delete(ctx)
+		release()
 		return nil, err
 	}
 
 	m.containers[cfg.Name] = c
+	m.publish(cfg.Name, EventCreated)
 	return c, nil
 }
 
+// newContainer returns a container for cfg wired to the manager's scheduler
+// and notifications.
+func (m *Manager) newContainer(cfg *Config) *containerImpl {
+	c := newContainer(m.runtime, cfg)
+	c.scheduler = m.scheduler
+	c.onTransition = m.notifyTransition
+	c.onExec = func(name string) { m.publish(name, EventExec) }
+	return c
+}
+
+// SetCapacity bounds the CPUs and memory of the containers the manager
+// admits. Each container reserves the larger of its config's CPUs and Memory
+// and its SchedulingHints burst until it is deleted. Creations that would
+// exceed the capacity fail with ErrInsufficientCapacity, or with c.Wait are
+// queued by priority until capacity is freed. The zero Capacity removes the
+// bounds; affinity rules are enforced either way.
+func (m *Manager) SetCapacity(c Capacity) {
+	m.admission.setCapacity(c)
+}
+
+// runOnceCleanupTimeout bounds how long RunOnce spends deleting its
+// container, including after ctx has been cancelled.
+const runOnceCleanupTimeout = 30 * time.Second
+
+// RunOnce creates a container from cfg, starts it, runs cmd and deletes the
+// container again, like `docker run --rm`. The container is torn down even
+// when a step fails or ctx is cancelled; cleanup failures are joined with the
+// error that caused them. A command that runs but exits non-zero is not an
+// error: its Result is returned as usual.
+func (m *Manager) RunOnce(ctx context.Context, cfg *Config, cmd *Command) (result *Result, err error) {
+	if cmd == nil {
+		return nil, fmt.Errorf("command is required")
+	}
+	c, err := m.CreateContainer(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), runOnceCleanupTimeout)
+		defer cancel()
+		var errs []error
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if deleteErr := m.DeleteContainer(cleanupCtx, cfg.Name); deleteErr != nil {
+			errs = append(errs, fmt.Errorf("delete %s: %w", cfg.Name, deleteErr))
+		}
+		err = errors.Join(errs...)
+	}()
+
+	if err := c.Start(ctx); err != nil {
+		return nil, fmt.Errorf("start %s: %w", cfg.Name, err)
+	}
+	return c.Exec(ctx, cmd)
+}
+
+// GenerateName returns "<prefix>-<n>" for the next sequence number n whose
+// name is not taken by a container of this manager. Names are never handed
+// out twice by the same manager, so concurrent callers receive distinct
+// names. An empty prefix uses "container".
+func (m *Manager) GenerateName(prefix string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.generateNameLocked(prefix)
+}
+
+func (m *Manager) generateNameLocked(prefix string) string {
+	if prefix == "" {
+		prefix = defaultNamePrefix
+	}
+	for {
+		m.nameSeq++
+		name := fmt.Sprintf("%s-%d", prefix, m.nameSeq)
+		if _, exists := m.containers[name]; !exists {
+			return name
+		}
+	}
+}
+
+// SetExecConcurrency caps the number of execs running at once across every
+// container owned by the manager. Queued execs are dispatched by
+// Command.Priority; a waiting exec gains one priority level per aging interval
+// so low priority work is not starved. A limit <= 0 removes the cap, and a
+// zero aging keeps the current interval.
+func (m *Manager) SetExecConcurrency(limit int, aging time.Duration) {
+	m.scheduler.setLimit(limit, aging)
+}
+
 // GetContainer fetches an existing container by name.
 func (m *Manager) GetContainer(name string) (Container, bool) {
 	m.mu.RLock()
@@ -71,22 +201,84 @@ func (m *Manager) GetContainer(name string) (Container, bool) {
 	return c, true
 }
 
-// DeleteContainer removes a container and associated VM resources.
+// DeleteContainer removes a container and associated VM resources. A running
+// container is stopped gracefully first, as with Container.Stop.
 func (m *Manager) DeleteContainer(ctx context.Context, name string) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.deleteContainer(ctx, name, false)
+}
+
+// ForceDeleteContainer is like DeleteContainer but halts a running container
+// immediately, skipping the pre-stop command and the stop grace period.
+func (m *Manager) ForceDeleteContainer(ctx context.Context, name string) error {
+	return m.deleteContainer(ctx, name, true)
+}
 
+func (m *Manager) deleteContainer(ctx context.Context, name string, force bool) error {
+	m.mu.RLock()
 	c, ok := m.containers[name]
+	m.mu.RUnlock()
 	if !ok {
 		return ErrContainerNotFound
 	}
 
-	if err := c.Delete(ctx); err != nil {
+	// Stopping can take a grace period; don't hold the manager lock for it.
+	if err := c.delete(ctx, force); err != nil {
 		return err
 	}
+	return m.forget(name, c)
+}
+
+// PurgeContainer deletes a container like ForceDeleteContainer, but stops
+// managing it even when its VM cannot be stopped or deleted: the failure is
+// logged and the VM left to the runtime. It clears containers out of a
+// runtime backend that has got into a bad state.
+func (m *Manager) PurgeContainer(ctx context.Context, name string) error {
+	m.mu.RLock()
+	c, ok := m.containers[name]
+	m.mu.RUnlock()
+	if !ok {
+		return ErrContainerNotFound
+	}
+
+	if err := c.delete(ctx, true); err != nil {
+		log.Printf("isolate: purging %s despite failed delete: %v", name, err)
+		c.abandon()
+	}
+	return m.forget(name, c)
+}
+
+// DeleteAll deletes every managed container as DeleteContainer does.
+// Containers that fail to delete stay managed, and the error names each of
+// them.
+func (m *Manager) DeleteAll(ctx context.Context) error {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.containers))
+	for name := range m.containers {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if err := m.DeleteContainer(ctx, name); err != nil && !errors.Is(err, ErrContainerNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
 
+// forget stops managing c, which was deleted, unless another container has
+// taken its name in the meantime.
+func (m *Manager) forget(name string, c *containerImpl) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.containers[name] != c {
+		return nil
+	}
 	delete(m.containers, name)
-	return nil
+	c.releaseCapacity()
+	return m.removeState(name)
 }
 
 // ListStatuses returns current status from each managed container.
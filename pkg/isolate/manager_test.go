@@ -0,0 +1,96 @@
+package isolate
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+)
+
+func TestRunOnce(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := m.RunOnce(ctx, &Config{Name: "once", DevMode: true}, &Command{
+		Path: "/bin/sh",
+		Args: []string{"-c", "echo hello; exit 3"},
+	})
+	if err != nil {
+		t.Fatalf("RunOnce: %v", err)
+	}
+	if string(result.Stdout) != "hello\n" || result.ExitCode != 3 {
+		t.Errorf("result = %q, exit %d, want \"hello\\n\", exit 3", result.Stdout, result.ExitCode)
+	}
+	if _, ok := m.GetContainer("once"); ok {
+		t.Error("RunOnce left its container behind")
+	}
+}
+
+func TestRunOnceDeletesContainerWhenExecFails(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Outside dev mode the stub VM has no agent to run the command.
+	_, err := m.RunOnce(ctx, &Config{Name: "once"}, &Command{Path: "/bin/true"})
+	if err == nil {
+		t.Fatal("RunOnce succeeded without an agent")
+	}
+	if !errors.Is(err, agent.ErrUnavailable) {
+		t.Errorf("RunOnce = %v, want the exec to fail with %v", err, agent.ErrUnavailable)
+	}
+	if _, ok := m.GetContainer("once"); ok {
+		t.Error("RunOnce left its container behind after the exec failed")
+	}
+	// The name is free again.
+	if _, err := m.RunOnce(ctx, &Config{Name: "once", DevMode: true}, &Command{Path: "/bin/true"}); err != nil {
+		t.Errorf("RunOnce reusing the name: %v", err)
+	}
+}
+
+func TestCreateContainerGeneratesUniqueNamesConcurrently(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const n = 32
+	names := make(chan string, n)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg := &Config{DevMode: true}
+			if _, err := m.CreateContainer(ctx, cfg); err != nil {
+				errs <- err
+				return
+			}
+			names <- cfg.Name
+		}()
+	}
+	wg.Wait()
+	close(names)
+	close(errs)
+	for err := range errs {
+		t.Errorf("CreateContainer: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for name := range names {
+		if name == "" || seen[name] {
+			t.Errorf("generated name %q handed out twice or empty", name)
+		}
+		seen[name] = true
+		if _, ok := m.GetContainer(name); !ok {
+			t.Errorf("container %q is not registered", name)
+		}
+	}
+	if len(seen) != n {
+		t.Errorf("%d distinct names for %d containers", len(seen), n)
+	}
+}
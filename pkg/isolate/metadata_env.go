@@ -0,0 +1,65 @@
+package isolate
+
+import (
+	"strings"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+)
+
+// DefaultMetadataEnvPrefix prefixes projected metadata variables when
+// MetadataEnv.Prefix is empty.
+const DefaultMetadataEnvPrefix = "CONTAINER_META_"
+
+// MetadataEnv selects Config.Metadata entries to expose to every exec as
+// environment variables, so job details such as a build id or commit need
+// not be repeated in each Command.Env. A key is upper-cased, has every
+// character other than a letter or digit replaced by '_', and is prefixed:
+// "build.id" becomes CONTAINER_META_BUILD_ID by default. Missing keys are
+// skipped, and variables set in Command.Env take precedence.
+type MetadataEnv struct {
+	Keys   []string
+	Prefix string // default DefaultMetadataEnvPrefix
+}
+
+// MetadataEnvName returns the variable name key is projected to with prefix.
+func MetadataEnvName(prefix, key string) string {
+	if prefix == "" {
+		prefix = DefaultMetadataEnvPrefix
+	}
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	return prefix + name
+}
+
+// applyMetadataEnv adds the metadata selected by the container's MetadataEnv
+// to req.Env.
+func (c *containerImpl) applyMetadataEnv(req *agent.CommandRequest) {
+	c.mu.RLock()
+	cfg := c.cfg
+	c.mu.RUnlock()
+	if cfg == nil || cfg.MetadataEnv == nil {
+		return
+	}
+	for _, key := range cfg.MetadataEnv.Keys {
+		value, ok := cfg.Metadata[key]
+		if !ok {
+			continue
+		}
+		name := MetadataEnvName(cfg.MetadataEnv.Prefix, key)
+		if _, set := req.Env[name]; set {
+			continue
+		}
+		if req.Env == nil {
+			req.Env = make(map[string]string)
+		}
+		req.Env[name] = value
+	}
+}
@@ -0,0 +1,78 @@
+package isolate
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadataEnvName(t *testing.T) {
+	for _, tc := range []struct{ prefix, key, want string }{
+		{"", "build.id", "CONTAINER_META_BUILD_ID"},
+		{"", "Git-SHA", "CONTAINER_META_GIT_SHA"},
+		{"JOB_", "owner/team 2", "JOB_OWNER_TEAM_2"},
+	} {
+		if got := MetadataEnvName(tc.prefix, tc.key); got != tc.want {
+			t.Errorf("MetadataEnvName(%q, %q) = %q, want %q", tc.prefix, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestExecSeesMetadataEnv(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := m.CreateContainer(ctx, &Config{
+		Name:        "metadata-env",
+		DevMode:     true,
+		Metadata:    map[string]string{"build.id": "42", "git-sha": "abc123", "token": "secret"},
+		MetadataEnv: &MetadataEnv{Keys: []string{"build.id", "git-sha", "missing"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	metaVars := func(stdout []byte) []string {
+		var vars []string
+		for _, line := range strings.Split(string(stdout), "\n") {
+			if strings.HasPrefix(line, DefaultMetadataEnvPrefix) {
+				vars = append(vars, line)
+			}
+		}
+		return vars
+	}
+	result, err := c.Exec(ctx, &Command{Path: "/bin/sh", Args: []string{"-c", "env | sort"}})
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+	want := []string{"CONTAINER_META_BUILD_ID=42", "CONTAINER_META_GIT_SHA=abc123"}
+	if got := metaVars(result.Stdout); !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata variables = %q, want %q", got, want)
+	}
+
+	// Command.Env wins, and the caller's map is left alone.
+	env := map[string]string{"CONTAINER_META_BUILD_ID": "override"}
+	stream, err := c.ExecStream(ctx, &Command{Path: "/bin/sh", Args: []string{"-c", "env | sort"}, Env: env})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	var stdout []byte
+	for chunk := range stream.Stdout {
+		stdout = append(stdout, chunk...)
+	}
+	for range stream.Stderr {
+	}
+	<-stream.Done
+	want = []string{"CONTAINER_META_BUILD_ID=override", "CONTAINER_META_GIT_SHA=abc123"}
+	if got := metaVars(stdout); !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata variables with an override = %q, want %q", got, want)
+	}
+	if len(env) != 1 {
+		t.Errorf("Command.Env was modified: %v", env)
+	}
+}
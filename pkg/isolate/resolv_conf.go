@@ -0,0 +1,92 @@
+package isolate
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// resolvConfPath is where the guest's resolver configuration is installed,
+// relative to the agent's root directory.
+const resolvConfPath = "/etc/resolv.conf"
+
+// renderResolvConf returns the resolv.conf for network, or nil when it sets
+// no nameservers and the guest's own file is left alone.
+func renderResolvConf(network *NetworkConfig) []byte {
+	if network == nil || len(network.DNS) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("# Generated by isolate from the container's network configuration.\n")
+	for _, server := range network.DNS {
+		fmt.Fprintf(&b, "nameserver %s\n", server)
+	}
+	if len(network.SearchDomains) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(network.SearchDomains, " "))
+	}
+	return []byte(b.String())
+}
+
+// installResolvConf writes the configured DNS servers and search domains to
+// the guest's /etc/resolv.conf, once per VM, before the container's first
+// exec. Containers without DNS servers keep the guest's file. Agents whose
+// /etc/resolv.conf may be the host's are skipped: the loopback agent of dev
+// mode, and agents serving a stub VM from the host without confining execs
+// to a root (see guestResolvConfPath).
+func (c *containerImpl) installResolvConf(ctx context.Context, vm runtimectl.VM) error {
+	c.mu.RLock()
+	cfg := c.cfg
+	c.mu.RUnlock()
+	if cfg == nil {
+		return nil
+	}
+	data := renderResolvConf(cfg.Network)
+	if data == nil {
+		return nil
+	}
+
+	c.resolvMu.Lock()
+	defer c.resolvMu.Unlock()
+	if c.resolvVM == vm {
+		return nil
+	}
+	path, err := guestResolvConfPath(ctx, vm)
+	if err == nil && path != "" {
+		err = vm.CopyTo(ctx, bytes.NewReader(data), path)
+	}
+	if err != nil && !errors.Is(err, agent.ErrUnavailable) {
+		return fmt.Errorf("install %s: %w", resolvConfPath, err)
+	}
+	c.resolvVM = vm
+	return nil
+}
+
+// guestResolvConfPath returns where the agent serving vm must write
+// resolv.conf for its execs to read it as /etc/resolv.conf, or "" when no
+// such place is safe to write. File transfers take paths as the agent sees
+// them, not as a chrooted exec does, so an agent confining execs to its root
+// directory gets the file under that root. Otherwise only an agent inside a
+// guest of its own may write /etc/resolv.conf itself: an unconfined agent on
+// the host, such as the agentd AgentManager starts for stub VMs, would
+// overwrite the host's.
+func guestResolvConfPath(ctx context.Context, vm runtimectl.VM) (string, error) {
+	if infoer, ok := vm.(runtimectl.AgentInfoer); ok {
+		info, err := infoer.AgentInfo(ctx)
+		if err != nil && !errors.Is(err, agent.ErrUnsupported) {
+			return "", err
+		}
+		if err == nil && info.RootDir != "" && (info.Chroot || info.Namespaces) {
+			return filepath.Join(info.RootDir, resolvConfPath), nil
+		}
+	}
+	if guest, ok := vm.(runtimectl.GuestAgent); ok && guest.GuestAgent() {
+		return resolvConfPath, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,49 @@
+package runtime
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+)
+
+// DefaultAgentResolverTTL is how long the default agent resolver caches a
+// service name.
+const DefaultAgentResolverTTL = 30 * time.Second
+
+var (
+	agentResolverMu sync.RWMutex
+	agentResolver   = agent.NewCachingResolver(&agent.DNSResolver{}, DefaultAgentResolverTTL)
+)
+
+// SetAgentResolver replaces the resolver used for "service://" agent
+// endpoints. The default looks names up in DNS and caches them for
+// DefaultAgentResolverTTL. Passing nil restores the default.
+func SetAgentResolver(r agent.Resolver) {
+	if r == nil {
+		r = agent.NewCachingResolver(&agent.DNSResolver{}, DefaultAgentResolverTTL)
+	}
+	agentResolverMu.Lock()
+	agentResolver = r
+	agentResolverMu.Unlock()
+}
+
+func currentAgentResolver() agent.Resolver {
+	agentResolverMu.RLock()
+	defer agentResolverMu.RUnlock()
+	return agentResolver
+}
+
+// endpointDialer builds the dialer for an agent.endpoint metadata value.
+// Service names are resolved on each dial, not here.
+func endpointDialer(raw string) (agent.Dialer, error) {
+	if name, ok := strings.CutPrefix(raw, "service://"); ok {
+		return &agent.ServiceDialer{Name: name, Resolver: currentAgentResolver()}, nil
+	}
+	ep, err := agent.ParseEndpoint(raw)
+	if err != nil {
+		return nil, err
+	}
+	return ep.Dialer(0)
+}
@@ -0,0 +1,49 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+)
+
+// staticResolver maps service names to fixed endpoints.
+type staticResolver map[string]agent.Endpoint
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (agent.Endpoint, error) {
+	if ep, ok := r[name]; ok {
+		return ep, nil
+	}
+	return agent.Endpoint{}, errors.New("no such service " + name)
+}
+
+func TestServiceAgentEndpoint(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := agent.NewServer(agent.ServerConfig{})
+	go srv.Serve(ln)
+	t.Cleanup(srv.Shutdown)
+
+	SetAgentResolver(staticResolver{"agents.web": {Network: "unix", Address: sock}})
+	t.Cleanup(func() { SetAgentResolver(nil) })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := selectAgentClient(&VMConfig{Metadata: map[string]string{MetadataAgentEndpoint: "service://agents.web"}})
+	result, err := client.Exec(ctx, &agent.CommandRequest{Path: "/bin/echo", Args: []string{"via service"}})
+	if err != nil || string(result.Stdout) != "via service\n" {
+		t.Fatalf("Exec = %+v, %v", result, err)
+	}
+
+	client = selectAgentClient(&VMConfig{Metadata: map[string]string{MetadataAgentEndpoint: "service://agents.db"}})
+	if err := client.Ping(ctx); err == nil {
+		t.Error("an agent behind an unknown service answered")
+	}
+}
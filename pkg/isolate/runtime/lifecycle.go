@@ -0,0 +1,72 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidTransition is wrapped by every TransitionError.
+var ErrInvalidTransition = errors.New("invalid lifecycle transition")
+
+// VMOp names a lifecycle operation whose validity depends on the VM's state.
+type VMOp string
+
+const (
+	VMOpStart  VMOp = "start"
+	VMOpStop   VMOp = "stop"
+	VMOpDelete VMOp = "delete"
+	VMOpExec   VMOp = "exec"
+	// VMOpSnapshot captures a running VM; see VM.Snapshot.
+	VMOpSnapshot VMOp = "snapshot"
+	VMOpPause    VMOp = "pause"
+	VMOpResume   VMOp = "resume"
+)
+
+// TransitionError reports an operation attempted in a state that does not
+// allow it, such as starting a deleted VM or executing in a stopped one.
+type TransitionError struct {
+	Op   VMOp
+	From VMState
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot %s a %s vm", e.Op, e.From)
+}
+
+func (e *TransitionError) Unwrap() error { return ErrInvalidTransition }
+
+// vmTransitions maps each operation to the states it may start from and the
+// state it leads to. Starting a running VM and stopping a stopped one are
+// allowed and leave the state unchanged; exec and snapshot require a running
+// VM and do not change its state. Pausing a paused VM and resuming a running
+// one are likewise no-ops; a paused VM can only be resumed, stopped or
+// deleted.
+var vmTransitions = map[VMOp]struct {
+	from []VMState
+	to   VMState
+}{
+	VMOpStart:  {from: []VMState{VMStatePending, VMStateStopped, VMStateFailed, VMStateRunning}, to: VMStateRunning},
+	VMOpStop:   {from: []VMState{VMStatePending, VMStateRunning, VMStateFailed, VMStateStopped, VMStatePaused}, to: VMStateStopped},
+	VMOpDelete: {from: []VMState{VMStatePending, VMStateRunning, VMStateStopped, VMStateFailed, VMStatePaused}, to: VMStateDeleted},
+	VMOpExec:   {from: []VMState{VMStateRunning}, to: VMStateRunning},
+
+	VMOpSnapshot: {from: []VMState{VMStateRunning}, to: VMStateRunning},
+	VMOpPause:    {from: []VMState{VMStateRunning, VMStatePaused}, to: VMStatePaused},
+	VMOpResume:   {from: []VMState{VMStatePaused, VMStateRunning}, to: VMStateRunning},
+}
+
+// CheckTransition validates op against a VM in state from and returns the
+// state the VM is in once op succeeds. Runtimes call it before acting on a
+// VM; the isolate package checks it too so every backend is covered.
+func CheckTransition(from VMState, op VMOp) (VMState, error) {
+	t, ok := vmTransitions[op]
+	if !ok {
+		return from, fmt.Errorf("unknown lifecycle operation %q", op)
+	}
+	for _, state := range t.from {
+		if state == from {
+			return t.to, nil
+		}
+	}
+	return from, &TransitionError{Op: op, From: from}
+}
@@ -0,0 +1,64 @@
+package runtime
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	for _, tc := range []struct {
+		from VMState
+		op   VMOp
+		to   VMState // empty when the transition is illegal
+	}{
+		{VMStatePending, VMOpStart, VMStateRunning},
+		{VMStateStopped, VMOpStart, VMStateRunning},
+		{VMStateFailed, VMOpStart, VMStateRunning},
+		{VMStateRunning, VMOpStart, VMStateRunning},
+		{VMStateRunning, VMOpStop, VMStateStopped},
+		{VMStateStopped, VMOpStop, VMStateStopped},
+		{VMStatePaused, VMOpStop, VMStateStopped},
+		{VMStateRunning, VMOpExec, VMStateRunning},
+		{VMStateRunning, VMOpSnapshot, VMStateRunning},
+		{VMStateRunning, VMOpPause, VMStatePaused},
+		{VMStatePaused, VMOpPause, VMStatePaused},
+		{VMStatePaused, VMOpResume, VMStateRunning},
+		{VMStateRunning, VMOpResume, VMStateRunning},
+		{VMStateStopped, VMOpDelete, VMStateDeleted},
+		{VMStatePaused, VMOpDelete, VMStateDeleted},
+
+		{VMStateStopped, VMOpPause, ""},
+		{VMStatePending, VMOpPause, ""},
+		{VMStateStopped, VMOpResume, ""},
+		{VMStateStopped, VMOpExec, ""},
+		{VMStatePaused, VMOpExec, ""},
+		{VMStatePaused, VMOpStart, ""},
+		{VMStatePaused, VMOpSnapshot, ""},
+		{VMStateDeleted, VMOpStart, ""},
+		{VMStateDeleted, VMOpStop, ""},
+		{VMStateDeleted, VMOpDelete, ""},
+		{VMStateDeleted, VMOpExec, ""},
+		{VMStateDeleted, VMOpResume, ""},
+	} {
+		got, err := CheckTransition(tc.from, tc.op)
+		if tc.to != "" {
+			if err != nil || got != tc.to {
+				t.Errorf("%s from %s = %s, %v, want %s", tc.op, tc.from, got, err, tc.to)
+			}
+			continue
+		}
+		var transitionErr *TransitionError
+		if !errors.Is(err, ErrInvalidTransition) || !errors.As(err, &transitionErr) {
+			t.Errorf("%s from %s = %v, want a TransitionError", tc.op, tc.from, err)
+		} else if transitionErr.Op != tc.op || transitionErr.From != tc.from {
+			t.Errorf("%s from %s reported as %s from %s", tc.op, tc.from, transitionErr.Op, transitionErr.From)
+		}
+		if got != tc.from {
+			t.Errorf("illegal %s from %s changed the state to %s", tc.op, tc.from, got)
+		}
+	}
+
+	if got, err := CheckTransition(VMStateRunning, "reboot"); err == nil || got != VMStateRunning {
+		t.Errorf("unknown operation = %s, %v, want an error and the state unchanged", got, err)
+	}
+}
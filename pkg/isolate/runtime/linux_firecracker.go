@@ -2,20 +2,1159 @@
 
 package runtime
 
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// firecrackerBootArgs is the kernel command line used unless the VM's
+	// metadata sets MetadataKernelArgs.
+	firecrackerBootArgs = "console=ttyS0 reboot=k panic=1 pci=off"
+	// firecrackerDefaultMemory is the guest memory when VMConfig.MemoryBytes
+	// is unset; Firecracker needs an explicit size.
+	firecrackerDefaultMemory = 128 << 20
+	// firecrackerBootTimeout bounds how long Start waits for the guest agent
+	// to answer once the VMM is running.
+	firecrackerBootTimeout = 30 * time.Second
+	// firecrackerShutdownTimeout bounds a graceful Stop before the VMM is
+	// killed.
+	firecrackerShutdownTimeout = 10 * time.Second
+)
+
+var firecrackerDescriptor = Descriptor{
+	Name:       "linux-firecracker",
+	OS:         "linux",
+	Hypervisor: "firecracker",
+	Priority:   10,
+	Notes:      "Fast microVM runtime leveraging Firecracker",
+}
+
 func init() {
-	Register(Descriptor{
-		Name:       "linux-firecracker",
-		OS:         "linux",
-		Hypervisor: "firecracker",
-		Priority:   10,
-		Notes:      "Fast microVM runtime leveraging Firecracker",
-	}, func() Runtime {
-		return newStubRuntime(Descriptor{
-			Name:       "linux-firecracker",
-			OS:         "linux",
-			Hypervisor: "firecracker",
-			Priority:   10,
-			Notes:      "Firecracker stub",
-		}, "firecracker")
+	Register(firecrackerDescriptor, func() Runtime {
+		return newFirecrackerRuntime()
+	})
+}
+
+// firecrackerRuntime boots each VM in its own firecracker process. CreateVM
+// writes the VMM's config file into a state directory named after the VM
+// ID, Start boots from it and waits for the guest agent, which is reached
+// through the VMM's vsock socket. The directory also holds a record of the
+// VM and its VMM, so GetVM finds VMs created by an earlier process. The VMM
+// runs without the jailer and the guest gets no network interfaces yet.
+type firecrackerRuntime struct {
+	desc    Descriptor
+	binary  string // path of the firecracker executable; empty if not installed
+	baseDir string // parent of the per-VM state directories
+	vsock   *vsockAllocator
+
+	versionOnce sync.Once
+	versionInfo string
+
+	mu  sync.RWMutex
+	vms map[string]*firecrackerVM
+}
+
+func newFirecrackerRuntime() *firecrackerRuntime {
+	binary, _ := exec.LookPath("firecracker")
+	return &firecrackerRuntime{
+		desc:    firecrackerDescriptor,
+		binary:  binary,
+		baseDir: filepath.Join(os.TempDir(), "isolate-firecracker"),
+		// Firecracker guests get their vsock CID from the host, so the
+		// runtime allocates one per VM and records it in the metadata.
+		vsock: newVsockAllocator(),
+		vms:   make(map[string]*firecrackerVM),
+	}
+}
+
+func (r *firecrackerRuntime) Name() string       { return r.desc.Name }
+func (r *firecrackerRuntime) OS() string         { return r.desc.OS }
+func (r *firecrackerRuntime) Hypervisor() string { return r.desc.Hypervisor }
+
+// Version reports the installed firecracker's version, e.g. "v1.7.0".
+func (r *firecrackerRuntime) Version() string {
+	r.versionOnce.Do(func() {
+		r.versionInfo = "unknown"
+		if r.binary == "" {
+			return
+		}
+		out, err := exec.Command(r.binary, "--version").Output()
+		if err != nil {
+			return
+		}
+		// The first line reads "Firecracker v1.7.0".
+		line, _, _ := strings.Cut(string(out), "\n")
+		if fields := strings.Fields(line); len(fields) > 0 {
+			r.versionInfo = fields[len(fields)-1]
+		}
 	})
+	return r.versionInfo
+}
+
+// Available reports whether firecracker is installed and KVM is usable.
+func (r *firecrackerRuntime) Available() bool {
+	return r.binary != "" && unix.Access("/dev/kvm", unix.R_OK|unix.W_OK) == nil
+}
+
+func (r *firecrackerRuntime) CreateVM(ctx context.Context, cfg *VMConfig) (VM, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("vm config is required")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	warnNetwork(cfg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := cfg.ID
+	if id == "" {
+		id = fmt.Sprintf("%s-%d", r.desc.Name, atomic.AddUint64(&vmCounter, 1))
+	}
+	if _, exists := r.vms[id]; exists {
+		return nil, fmt.Errorf("vm %s already exists", id)
+	}
+
+	cfgCopy := cfg.Clone()
+	cfgCopy.ID = id
+	if cfgCopy.KernelImage == "" {
+		cfgCopy.KernelImage = cfgCopy.Metadata[MetadataKernelImage]
+	}
+	if cfgCopy.CPUs <= 0 {
+		cfgCopy.CPUs = 1
+	}
+	if cfgCopy.MemoryBytes <= 0 {
+		cfgCopy.MemoryBytes = firecrackerDefaultMemory
+	}
+	resolveNetworkDefaults(cfgCopy)
+	if !cfgCopy.DevMode {
+		if err := checkBootFiles(cfgCopy); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.vsock.assign(cfgCopy); err != nil {
+		return nil, err
+	}
+
+	vm, err := r.newVM(cfgCopy, "", false)
+	if err != nil {
+		r.vsock.release(cfgCopy)
+		return nil, err
+	}
+	r.vms[id] = vm
+	return vm, nil
+}
+
+// checkBootFiles verifies that the kernel, initrd and root filesystem a VM
+// boots from exist, so a bad config fails at creation rather than at Start.
+func checkBootFiles(cfg *VMConfig) error {
+	if cfg.KernelImage == "" {
+		return fmt.Errorf("firecracker needs a kernel image: set KernelImage or the %s metadata", MetadataKernelImage)
+	}
+	if cfg.ImagePath == "" {
+		return fmt.Errorf("firecracker needs a root filesystem image")
+	}
+	for _, path := range []string{cfg.KernelImage, cfg.InitrdPath, cfg.ImagePath} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newVM sets up the state directory of a stopped VM. Its root filesystem is
+// cfg.ImagePath, or a private copy of cloneDisk when that is set. restored
+// marks a VM restored from a snapshot, whose vsock CID is not reserved.
+func (r *firecrackerRuntime) newVM(cfg *VMConfig, cloneDisk string, restored bool) (*firecrackerVM, error) {
+	if err := os.MkdirAll(r.baseDir, 0o700); err != nil {
+		return nil, err
+	}
+	dir := r.vmDir(cfg.ID)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("vm %s already exists", cfg.ID)
+		}
+		return nil, err
+	}
+	vm := &firecrackerVM{
+		id:       cfg.ID,
+		cfg:      cfg,
+		runtime:  r,
+		dir:      dir,
+		restored: restored,
+		state:    VMStateStopped,
+	}
+	vm.agent = firecrackerAgentClient(cfg, vm.vsockPath())
+	if !cfg.DevMode {
+		if err := vm.prepareRootfs(cloneDisk); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		if err := vm.writeConfig(); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	vm.createdAt = time.Now()
+	vm.updatedAt = vm.createdAt
+	if err := vm.writeRecord(0, time.Time{}); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return vm, nil
+}
+
+// vmDir names the state directory of the VM id. IDs may be long or contain
+// separators while Unix socket paths must stay short, so the name is a hash
+// of the ID; the record in the directory holds the ID itself.
+func (r *firecrackerRuntime) vmDir(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(r.baseDir, "vm-"+hex.EncodeToString(sum[:8]))
+}
+
+// firecrackerAgentClient reaches the guest agent through the VMM's vsock
+// socket at udsPath, unless the metadata names another endpoint or the VM
+// is in dev mode.
+func firecrackerAgentClient(cfg *VMConfig, udsPath string) agent.Client {
+	meta := cfg.Metadata
+	if cfg.DevMode || meta[MetadataAgentUnix] != "" || meta[MetadataAgentEndpoint] != "" {
+		return selectAgentClient(cfg)
+	}
+	port, err := strconv.ParseUint(meta[MetadataAgentVsockPort], 10, 32)
+	if err != nil {
+		return agent.NewNopClient()
+	}
+	return agent.NewIPCClient(&agent.HybridVsockDialer{Path: udsPath, Port: uint32(port)})
+}
+
+func (r *firecrackerRuntime) ListVMs(ctx context.Context) ([]VM, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	vms := make([]VM, 0, len(r.vms))
+	for _, vm := range r.vms {
+		vms = append(vms, vm)
+	}
+	return vms, nil
+}
+
+// GetVM returns the VM id. A VM created by an earlier process is found
+// again through the record in its state directory: while its VMM runs the
+// VM is running or paused and the runtime reattaches to the VMM; otherwise
+// it is stopped and Start boots it afresh.
+func (r *firecrackerRuntime) GetVM(ctx context.Context, id string) (VM, error) {
+	r.mu.RLock()
+	vm, ok := r.vms[id]
+	r.mu.RUnlock()
+	if ok {
+		return vm, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if vm, ok := r.vms[id]; ok {
+		return vm, nil
+	}
+	vm, err := r.loadVM(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	r.vms[id] = vm
+	return vm, nil
+}
+
+// loadVM rebuilds the VM id from its state directory.
+func (r *firecrackerRuntime) loadVM(ctx context.Context, id string) (*firecrackerVM, error) {
+	dir := r.vmDir(id)
+	rec, err := readFCRecord(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("vm %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if rec.ID != id {
+		return nil, fmt.Errorf("vm %s not found", id)
+	}
+	if !rec.Restored {
+		if err := r.vsock.assign(rec.Config); err != nil {
+			return nil, err
+		}
+	}
+	vm := &firecrackerVM{
+		id:        id,
+		cfg:       rec.Config,
+		runtime:   r,
+		dir:       dir,
+		restored:  rec.Restored,
+		state:     VMStateStopped,
+		createdAt: rec.CreatedAt,
+		updatedAt: time.Now(),
+	}
+	vm.agent = firecrackerAgentClient(rec.Config, vm.vsockPath())
+	if rec.PID <= 0 || !isVMM(rec.PID, vm.apiSocket()) {
+		return vm, nil
+	}
+	process, err := os.FindProcess(rec.PID)
+	if err != nil {
+		return vm, nil
+	}
+	proc := &firecrackerProcess{process: process, done: make(chan struct{})}
+	vm.proc = proc
+	vm.state = VMStateRunning
+	vm.startedAt = rec.StartedAt
+	infoCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	var info fcInstanceInfo
+	if newFirecrackerAPI(vm.apiSocket()).get(infoCtx, "/", &info) == nil && info.State == fcVMPaused {
+		vm.state = VMStatePaused
+	}
+	go vm.watch(proc, func() error { return waitForExit(rec.PID) })
+	return vm, nil
+}
+
+// ReclaimVM kills the VMM of the VM id and removes its state directory, for
+// a VM GetVM cannot return, for instance because its record is unreadable.
+// The VMM is recognised by its API socket, which lives in the state
+// directory, so one the record does not name is found too.
+func (r *firecrackerRuntime) ReclaimVM(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.vms[id]; ok {
+		return fmt.Errorf("vm %s is in use", id)
+	}
+	dir := r.vmDir(id)
+	// A directory another ID hashes to is not this VM's to remove.
+	if rec, err := readFCRecord(dir); err == nil && rec.ID != id {
+		return nil
+	}
+	pids, err := vmmPIDs(filepath.Join(dir, fcAPISocketName))
+	if err != nil {
+		return err
+	}
+	for _, pid := range pids {
+		if err := unix.Kill(pid, unix.SIGKILL); err != nil && !errors.Is(err, unix.ESRCH) {
+			return fmt.Errorf("kill firecracker %d: %w", pid, err)
+		}
+	}
+	return os.RemoveAll(dir)
+}
+
+func (r *firecrackerRuntime) ImportImage(ctx context.Context, path string) error {
+	return fmt.Errorf("%s runtime does not manage images", r.Name())
+}
+
+func (r *firecrackerRuntime) ListImages(ctx context.Context) ([]Image, error) {
+	return nil, nil
+}
+
+type firecrackerVM struct {
+	id       string
+	cfg      *VMConfig
+	runtime  *firecrackerRuntime
+	agent    agent.Client
+	dir      string // state directory holding the record, config, sockets and log
+	restored bool   // restored from a snapshot; its vsock CID is not reserved
+
+	mu        sync.RWMutex
+	state     VMState
+	proc      *firecrackerProcess // nil unless the VMM is running
+	createdAt time.Time
+	startedAt time.Time
+	updatedAt time.Time
+}
+
+// firecrackerProcess is a running VMM, started by this process or by an
+// earlier one; done is closed once it has exited.
+type firecrackerProcess struct {
+	process *os.Process
+	done    chan struct{}
+	err     error
+}
+
+func (v *firecrackerVM) ID() string        { return v.id }
+func (v *firecrackerVM) Config() *VMConfig { return v.cfg }
+func (v *firecrackerVM) State() VMState {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.state
+}
+
+func (v *firecrackerVM) recordPath() string { return filepath.Join(v.dir, fcRecordName) }
+func (v *firecrackerVM) configPath() string { return filepath.Join(v.dir, "config.json") }
+func (v *firecrackerVM) apiSocket() string  { return filepath.Join(v.dir, fcAPISocketName) }
+func (v *firecrackerVM) vsockPath() string  { return filepath.Join(v.dir, fcVsockName) }
+func (v *firecrackerVM) logPath() string    { return filepath.Join(v.dir, "firecracker.log") }
+
+const (
+	fcRecordName    = "vm.json"
+	fcAPISocketName = "api.sock"
+)
+
+// fcVMRecord is the record in a VM's state directory from which a runtime
+// in a later process finds the VM and its VMM again.
+type fcVMRecord struct {
+	ID        string    `json:"id"`
+	Config    *VMConfig `json:"config"`
+	Restored  bool      `json:"restored,omitempty"`
+	PID       int       `json:"pid,omitempty"` // of the VMM last started; zero before the first boot
+	APISocket string    `json:"api_socket"`
+	VsockPath string    `json:"vsock_path"`
+	CreatedAt time.Time `json:"created_at"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+}
+
+// writeRecord records the VM with the pid of its VMM and when that started.
+// The record is replaced by a rename so a crash never leaves it truncated.
+func (v *firecrackerVM) writeRecord(pid int, startedAt time.Time) error {
+	data, err := json.MarshalIndent(fcVMRecord{
+		ID:        v.id,
+		Config:    v.cfg,
+		Restored:  v.restored,
+		PID:       pid,
+		APISocket: v.apiSocket(),
+		VsockPath: v.vsockPath(),
+		CreatedAt: v.createdAt,
+		StartedAt: startedAt,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := v.recordPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write vm record: %w", err)
+	}
+	if err := os.Rename(tmp, v.recordPath()); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write vm record: %w", err)
+	}
+	return nil
+}
+
+func readFCRecord(dir string) (*fcVMRecord, error) {
+	data, err := os.ReadFile(filepath.Join(dir, fcRecordName))
+	if err != nil {
+		return nil, err
+	}
+	var rec fcVMRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parse vm record in %s: %w", dir, err)
+	}
+	if rec.ID == "" || rec.Config == nil {
+		return nil, fmt.Errorf("vm record in %s is incomplete", dir)
+	}
+	return &rec, nil
+}
+
+// isVMM reports whether pid is a firecracker serving its API on apiSocket,
+// rather than an unrelated process that reused the pid of an exited VMM.
+func isVMM(pid int, apiSocket string) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(data), "\x00")
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "--api-sock" && args[i+1] == apiSocket {
+			return true
+		}
+	}
+	return false
+}
+
+// vmmPIDs returns the processes serving a firecracker API on apiSocket.
+func vmmPIDs(apiSocket string) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		if isVMM(pid, apiSocket) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// waitForExit blocks until pid exits. The VMM of a reattached VM is not a
+// child of this process, so it cannot be waited for and its exit status is
+// unknown.
+func waitForExit(pid int) error {
+	fd, err := unix.PidfdOpen(pid, 0)
+	if err != nil {
+		// Kernels before 5.3 have no pidfds; poll for the process instead.
+		for unix.Kill(pid, 0) == nil {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return nil
+	}
+	defer unix.Close(fd)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		if _, err := unix.Poll(fds, -1); err != unix.EINTR {
+			return nil
+		}
+	}
+}
+
+// The VMM runs in the state directory and is configured with these paths
+// relative to it, so a snapshot, which records them, restores against the
+// restoring VM's own disk and socket.
+const (
+	fcRootfsName = "rootfs"
+	fcVsockName  = "vsock.sock"
+)
+
+// prepareRootfs links the VM's image into its state directory or, for a
+// restored VM, copies the snapshot's disk there and makes the copy its
+// image.
+func (v *firecrackerVM) prepareRootfs(cloneDisk string) error {
+	path := filepath.Join(v.dir, fcRootfsName)
+	if cloneDisk != "" {
+		if err := copySparse(cloneDisk, path); err != nil {
+			return fmt.Errorf("copy snapshot disk: %w", err)
+		}
+		v.cfg.ImagePath = path
+		return nil
+	}
+	image, err := filepath.Abs(v.cfg.ImagePath)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(image, path)
+}
+
+// writeConfig writes the machine config the VMM boots from.
+func (v *firecrackerVM) writeConfig() error {
+	bootArgs := v.cfg.Metadata[MetadataKernelArgs]
+	if bootArgs == "" {
+		bootArgs = firecrackerBootArgs
+	}
+	config := fcConfig{
+		BootSource: fcBootSource{
+			KernelImagePath: v.cfg.KernelImage,
+			InitrdPath:      v.cfg.InitrdPath,
+			BootArgs:        bootArgs,
+		},
+		Drives: []fcDrive{{
+			DriveID:      "rootfs",
+			PathOnHost:   fcRootfsName,
+			IsRootDevice: true,
+		}},
+		MachineConfig: fcMachineConfig{
+			VCPUCount:  v.cfg.CPUs,
+			MemSizeMiB: (v.cfg.MemoryBytes + 1<<20 - 1) >> 20,
+		},
+	}
+	if raw := v.cfg.Metadata[MetadataAgentVsockCID]; raw != "" {
+		cid, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid vsock cid %q", raw)
+		}
+		config.Vsock = &fcVsock{GuestCID: uint32(cid), UDSPath: fcVsockName}
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(v.configPath(), data, 0o600)
+}
+
+// Start boots the VM and waits until its agent answers. Dev mode VMs run no
+// VMM: their commands run on the host through the loopback agent.
+func (v *firecrackerVM) Start(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if _, err := CheckTransition(v.state, VMOpStart); err != nil {
+		return err
+	}
+	if v.state == VMStateRunning {
+		return nil
+	}
+	if !v.cfg.DevMode {
+		if err := v.launchLocked(ctx, nil); err != nil {
+			v.state = VMStateFailed
+			v.updatedAt = time.Now()
+			return err
+		}
+	}
+	v.state = VMStateRunning
+	v.startedAt = time.Now()
+	v.updatedAt = v.startedAt
+	return nil
+}
+
+// launchLocked starts the VMM and waits for the guest agent. The VMM boots
+// from the VM's config file, or with load from a snapshot.
+func (v *firecrackerVM) launchLocked(ctx context.Context, load *fcSnapshotLoad) error {
+	if v.runtime.binary == "" {
+		return fmt.Errorf("firecracker binary not found in PATH")
+	}
+	// Sockets left behind by a previous boot would make the VMM fail.
+	for _, path := range []string{v.apiSocket(), v.vsockPath()} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	logFile, err := os.OpenFile(v.logPath(), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	args := []string{"--api-sock", v.apiSocket()}
+	if load == nil {
+		args = append(args, "--config-file", v.configPath())
+	}
+	cmd := exec.Command(v.runtime.binary, args...)
+	cmd.Dir = v.dir
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	// Keep the VMM out of the caller's session so terminal signals meant
+	// for the caller do not kill guests.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start firecracker: %w", err)
+	}
+	proc := &firecrackerProcess{process: cmd.Process, done: make(chan struct{})}
+	v.proc = proc
+	go v.watch(proc, cmd.Wait)
+	if err := v.writeRecord(cmd.Process.Pid, time.Now()); err != nil {
+		v.shutdownLocked(ctx, true)
+		return err
+	}
+
+	if err := v.waitForAPI(ctx, proc); err != nil {
+		v.shutdownLocked(ctx, true)
+		return err
+	}
+	if load != nil {
+		if err := newFirecrackerAPI(v.apiSocket()).put(ctx, "/snapshot/load", load); err != nil {
+			v.shutdownLocked(ctx, true)
+			return err
+		}
+	}
+	if err := v.waitForAgent(ctx, proc); err != nil {
+		v.shutdownLocked(ctx, true)
+		return err
+	}
+	return nil
+}
+
+// watch records the VMM's exit, which wait blocks for. A VMM that exits on
+// its own, because the guest powered off or crashed, leaves the VM stopped
+// or failed.
+func (v *firecrackerVM) watch(proc *firecrackerProcess, wait func() error) {
+	proc.err = wait()
+	close(proc.done)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.proc != proc {
+		return
+	}
+	v.proc = nil
+	if proc.err != nil {
+		v.state = VMStateFailed
+	} else {
+		v.state = VMStateStopped
+	}
+	v.updatedAt = time.Now()
+}
+
+// waitForAPI waits for the VMM to create its API socket, which Stop and
+// Snapshot rely on.
+func (v *firecrackerVM) waitForAPI(ctx context.Context, proc *firecrackerProcess) error {
+	ctx, cancel := context.WithTimeout(ctx, firecrackerBootTimeout)
+	defer cancel()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(v.apiSocket()); err == nil {
+			return nil
+		}
+		select {
+		case <-proc.done:
+			return fmt.Errorf("firecracker exited during boot: %v%s", proc.err, v.logTail())
+		case <-ctx.Done():
+			return fmt.Errorf("firecracker api socket did not appear: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitForAgent pings the guest agent until it answers, the VMM exits or
+// firecrackerBootTimeout passes.
+func (v *firecrackerVM) waitForAgent(ctx context.Context, proc *firecrackerProcess) error {
+	ctx, cancel := context.WithTimeout(ctx, firecrackerBootTimeout)
+	defer cancel()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		pingCtx, cancelPing := context.WithTimeout(ctx, time.Second)
+		err := v.agent.Ping(pingCtx)
+		cancelPing()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-proc.done:
+			return fmt.Errorf("firecracker exited during boot: %v%s", proc.err, v.logTail())
+		case <-ctx.Done():
+			return fmt.Errorf("guest agent did not answer: %w", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// logTail returns the end of the VMM's log, which holds its errors and the
+// guest console, for boot failure messages.
+func (v *firecrackerVM) logTail() string {
+	data, err := os.ReadFile(v.logPath())
+	if err != nil {
+		return ""
+	}
+	const max = 1024
+	if len(data) > max {
+		data = data[len(data)-max:]
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return ""
+	}
+	return "\n" + string(data)
+}
+
+// shutdownLocked stops the VMM. Unless force is set the guest is first asked
+// to shut down and given firecrackerShutdownTimeout, bounded by ctx, to do
+// so. A VMM still running after that is killed. When ctx ends first,
+// shutdownLocked returns its error without waiting for the killed VMM to be
+// reaped.
+func (v *firecrackerVM) shutdownLocked(ctx context.Context, force bool) error {
+	proc := v.proc
+	if proc == nil {
+		return nil
+	}
+	v.proc = nil
+	var err error
+	if !force && v.requestShutdown(ctx) == nil {
+		timer := time.NewTimer(firecrackerShutdownTimeout)
+		defer timer.Stop()
+		select {
+		case <-proc.done:
+		case <-timer.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	select {
+	case <-proc.done:
+	default:
+		_ = proc.process.Kill()
+		select {
+		case <-proc.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	for _, path := range []string{v.apiSocket(), v.vsockPath()} {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+func (v *firecrackerVM) requestShutdown(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	return newFirecrackerAPI(v.apiSocket()).put(ctx, "/actions", fcAction{ActionType: fcActionCtrlAltDel})
+}
+
+// Pause freezes the guest's vCPUs through the VMM's API; its memory stays
+// allocated. A dev mode VM only changes state.
+func (v *firecrackerVM) Pause(ctx context.Context) error {
+	return v.setPaused(ctx, VMOpPause, fcVMPaused)
+}
+
+func (v *firecrackerVM) Resume(ctx context.Context) error {
+	return v.setPaused(ctx, VMOpResume, fcVMResumed)
+}
+
+func (v *firecrackerVM) setPaused(ctx context.Context, op VMOp, vmState string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	to, err := CheckTransition(v.state, op)
+	if err != nil {
+		return err
+	}
+	if to == v.state {
+		return nil
+	}
+	if v.proc != nil {
+		if err := newFirecrackerAPI(v.apiSocket()).patch(ctx, "/vm", fcVMState{State: vmState}); err != nil {
+			return err
+		}
+	}
+	v.state = to
+	v.updatedAt = time.Now()
+	return nil
+}
+
+// Stop shuts the VMM down. A paused guest cannot shut itself down, so it
+// is always killed. When ctx ends during the shutdown the VMM is killed and
+// Stop returns ctx.Err(), with the VM stopped all the same.
+func (v *firecrackerVM) Stop(ctx context.Context, force bool) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, err := CheckTransition(v.state, VMOpStop); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := v.shutdownLocked(ctx, force || v.state == VMStatePaused)
+	v.state = VMStateStopped
+	v.updatedAt = time.Now()
+	return err
+}
+
+// Delete kills the VMM if it is still running and removes the VM's state
+// directory. When ctx ends before the VMM exits, Delete returns ctx.Err()
+// and leaves the VM stopped, so the delete can be retried.
+func (v *firecrackerVM) Delete(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, err := CheckTransition(v.state, VMOpDelete); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := v.shutdownLocked(ctx, true); err != nil {
+		v.state = VMStateStopped
+		v.updatedAt = time.Now()
+		return err
+	}
+	_ = v.agent.Close()
+	if err := os.RemoveAll(v.dir); err != nil {
+		return err
+	}
+	v.state = VMStateDeleted
+	v.updatedAt = time.Now()
+
+	v.runtime.mu.Lock()
+	delete(v.runtime.vms, v.id)
+	v.runtime.mu.Unlock()
+	v.runtime.vsock.release(v.cfg)
+	return nil
+}
+
+// checkExec refuses commands the guest cannot run, such as while it is
+// paused, instead of letting them wait for an agent that cannot answer.
+func (v *firecrackerVM) checkExec() error {
+	_, err := CheckTransition(v.State(), VMOpExec)
+	return err
+}
+
+func (v *firecrackerVM) Execute(ctx context.Context, cmd *agent.CommandRequest) (*ExecResult, error) {
+	if err := v.checkExec(); err != nil {
+		return nil, err
+	}
+	result, err := v.agent.Exec(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return execResultFrom(result), nil
+}
+
+func (v *firecrackerVM) ExecStream(ctx context.Context, cmd *agent.CommandRequest) (*agent.CommandStream, error) {
+	if err := v.checkExec(); err != nil {
+		return nil, err
+	}
+	return v.agent.ExecStream(ctx, cmd)
+}
+
+func (v *firecrackerVM) SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error {
+	return v.agent.SignalJob(ctx, jobID, sig)
+}
+
+func (v *firecrackerVM) AgentInfo(ctx context.Context) (*agent.AgentInfo, error) {
+	return v.agent.Info(ctx)
+}
+
+// GuestAgent reports true: the agent runs inside the microVM.
+func (v *firecrackerVM) GuestAgent() bool { return true }
+
+func (v *firecrackerVM) CopyTo(ctx context.Context, reader io.Reader, dst string) error {
+	return v.agent.CopyTo(ctx, reader, dst)
+}
+
+func (v *firecrackerVM) CopyFrom(ctx context.Context, src string, writer io.Writer) error {
+	return v.agent.CopyFrom(ctx, src, writer)
+}
+
+// Files of a Firecracker snapshot next to its manifest.
+const (
+	fcSnapshotState  = "vmstate"
+	fcSnapshotMemory = "memory"
+	fcSnapshotDisk   = "rootfs"
+)
+
+// Snapshot pauses the guest, has the VMM write its device state and memory
+// to dst, copies the root filesystem there while the guest cannot change it
+// and resumes the guest. A dev mode VM has no guest; only its config is
+// saved.
+func (v *firecrackerVM) Snapshot(ctx context.Context, dst string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, err := CheckTransition(v.state, VMOpSnapshot); err != nil {
+		return err
+	}
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0o700); err != nil {
+		return err
+	}
+	if v.proc != nil {
+		api := newFirecrackerAPI(v.apiSocket())
+		if err := api.patch(ctx, "/vm", fcVMState{State: fcVMPaused}); err != nil {
+			return err
+		}
+		err := v.snapshotPaused(ctx, api, dst)
+		// Resume even when ctx is done; the guest must not stay paused.
+		if resumeErr := api.patch(context.WithoutCancel(ctx), "/vm", fcVMState{State: fcVMResumed}); err == nil {
+			err = resumeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return writeSnapshotManifest(dst, &snapshotManifest{
+		Runtime: v.runtime.desc.Name,
+		TakenAt: time.Now(),
+		Config:  v.cfg,
+	})
+}
+
+func (v *firecrackerVM) snapshotPaused(ctx context.Context, api *firecrackerAPI, dst string) error {
+	if err := api.put(ctx, "/snapshot/create", fcSnapshotCreate{
+		SnapshotType: "Full",
+		SnapshotPath: filepath.Join(dst, fcSnapshotState),
+		MemFilePath:  filepath.Join(dst, fcSnapshotMemory),
+	}); err != nil {
+		return err
+	}
+	return copySparse(filepath.Join(v.dir, fcRootfsName), filepath.Join(dst, fcSnapshotDisk))
+}
+
+// RestoreVM boots a clone of a snapshot taken by Snapshot. The clone runs on
+// its own copy of the snapshot's disk and maps the snapshot's memory file
+// copy-on-write, so the snapshot must stay unchanged while clones run. The
+// guest keeps its vsock CID: it only names the guest inside its own VMM, so
+// clones may share it and it is not reserved.
+func (r *firecrackerRuntime) RestoreVM(ctx context.Context, cfg *VMConfig, snapshotPath string) (VM, error) {
+	snapshotPath, err := filepath.Abs(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := readSnapshotManifest(snapshotPath, r.Name())
+	if err != nil {
+		return nil, err
+	}
+	restored := restoredConfig(manifest.Config, cfg)
+
+	r.mu.Lock()
+	if restored.ID == "" {
+		restored.ID = fmt.Sprintf("%s-%d", r.desc.Name, atomic.AddUint64(&vmCounter, 1))
+	}
+	if _, exists := r.vms[restored.ID]; exists {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("vm %s already exists", restored.ID)
+	}
+	var cloneDisk string
+	if !restored.DevMode {
+		cloneDisk = filepath.Join(snapshotPath, fcSnapshotDisk)
+	}
+	vm, err := r.newVM(restored, cloneDisk, true)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, err
+	}
+	r.vms[restored.ID] = vm
+	r.mu.Unlock()
+
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if !restored.DevMode {
+		err := vm.launchLocked(ctx, &fcSnapshotLoad{
+			SnapshotPath: filepath.Join(snapshotPath, fcSnapshotState),
+			MemBackend: fcMemBackend{
+				BackendType: "File",
+				BackendPath: filepath.Join(snapshotPath, fcSnapshotMemory),
+			},
+			ResumeVM: true,
+		})
+		if err != nil {
+			r.mu.Lock()
+			delete(r.vms, restored.ID)
+			r.mu.Unlock()
+			os.RemoveAll(vm.dir)
+			return nil, fmt.Errorf("restore %s: %w", restored.ID, err)
+		}
+	}
+	vm.state = VMStateRunning
+	vm.startedAt = time.Now()
+	vm.updatedAt = vm.startedAt
+	return vm, nil
+}
+
+// copySparse copies the file src to dst, leaving holes where src has runs
+// of zeros so disk images stay sparse.
+func copySparse(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1<<20)
+	var size int64
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				_, err = out.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = out.Write(buf[:n])
+			}
+			if err != nil {
+				out.Close()
+				return err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	// A trailing hole is only recorded by the file size.
+	if err := out.Truncate(size); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (v *firecrackerVM) Status(ctx context.Context) (*VMStatus, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return &VMStatus{
+		State:     v.state,
+		CreatedAt: v.createdAt,
+		StartedAt: v.startedAt,
+		UpdatedAt: v.updatedAt,
+	}, nil
+}
+
+// Stats reports the VMM process's CPU use since Start and resident memory,
+// and the space allocated to the root filesystem image.
+func (v *firecrackerVM) Stats(ctx context.Context) (*VMStats, error) {
+	v.mu.RLock()
+	proc, startedAt := v.proc, v.startedAt
+	v.mu.RUnlock()
+
+	stats := &VMStats{}
+	var st syscall.Stat_t
+	if v.cfg.ImagePath != "" && syscall.Stat(v.cfg.ImagePath, &st) == nil {
+		stats.DiskBytes = uint64(st.Blocks) * 512
+	}
+	if proc == nil {
+		return stats, nil
+	}
+	cpu, rss, err := processUsage(proc.process.Pid)
+	if err != nil {
+		return nil, err
+	}
+	stats.MemoryBytes = rss
+	if elapsed := time.Since(startedAt); elapsed > 0 {
+		stats.CPUPercent = 100 * cpu.Seconds() / elapsed.Seconds()
+	}
+	return stats, nil
+}
+
+// clockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat,
+// which is 100 on every architecture Firecracker supports.
+const clockTicks = 100
+
+// processUsage returns the CPU time pid has used and its resident memory.
+func processUsage(pid int) (time.Duration, uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, 0, err
+	}
+	// The command name may contain spaces; fields resume after its ')'.
+	idx := bytes.LastIndexByte(data, ')')
+	if idx < 0 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[idx+1:]))
+	// fields[0] is the state (field 3); utime, stime and rss are fields
+	// 14, 15 and 24.
+	if len(fields) < 22 {
+		return 0, 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rssPages, _ := strconv.ParseUint(fields[21], 10, 64)
+	cpu := time.Duration(utime+stime) * time.Second / clockTicks
+	return cpu, rssPages * uint64(os.Getpagesize()), nil
 }
@@ -0,0 +1,162 @@
+//go:build linux
+
+package runtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// firecrackerAPI is a minimal client for the REST API a Firecracker VMM
+// serves on its --api-sock Unix socket.
+type firecrackerAPI struct {
+	client *http.Client
+}
+
+func newFirecrackerAPI(socket string) *firecrackerAPI {
+	return &firecrackerAPI{client: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+			DisableKeepAlives: true,
+		},
+	}}
+}
+
+// fcConfig is the --config-file a VMM boots from without further API calls.
+type fcConfig struct {
+	BootSource    fcBootSource    `json:"boot-source"`
+	Drives        []fcDrive       `json:"drives"`
+	MachineConfig fcMachineConfig `json:"machine-config"`
+	Vsock         *fcVsock        `json:"vsock,omitempty"`
+}
+
+type fcMachineConfig struct {
+	VCPUCount  int   `json:"vcpu_count"`
+	MemSizeMiB int64 `json:"mem_size_mib"`
+}
+
+type fcBootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
+	BootArgs        string `json:"boot_args,omitempty"`
+}
+
+type fcDrive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+type fcVsock struct {
+	GuestCID uint32 `json:"guest_cid"`
+	UDSPath  string `json:"uds_path"`
+}
+
+type fcVMState struct {
+	State string `json:"state"`
+}
+
+// States accepted by PATCH /vm.
+const (
+	fcVMPaused  = "Paused"
+	fcVMResumed = "Resumed"
+)
+
+// fcInstanceInfo is the part of GET / the runtime reads; State is "Not
+// started", "Running" or "Paused".
+type fcInstanceInfo struct {
+	State string `json:"state"`
+}
+
+type fcSnapshotCreate struct {
+	SnapshotType string `json:"snapshot_type"`
+	SnapshotPath string `json:"snapshot_path"`
+	MemFilePath  string `json:"mem_file_path"`
+}
+
+type fcSnapshotLoad struct {
+	SnapshotPath string       `json:"snapshot_path"`
+	MemBackend   fcMemBackend `json:"mem_backend"`
+	ResumeVM     bool         `json:"resume_vm"`
+}
+
+type fcMemBackend struct {
+	BackendType string `json:"backend_type"`
+	BackendPath string `json:"backend_path"`
+}
+
+type fcAction struct {
+	ActionType string `json:"action_type"`
+}
+
+// fcActionCtrlAltDel asks the guest to shut down; Firecracker only
+// supports it on x86_64.
+const fcActionCtrlAltDel = "SendCtrlAltDel"
+
+func (a *firecrackerAPI) put(ctx context.Context, path string, body any) error {
+	return a.do(ctx, http.MethodPut, path, body)
+}
+
+func (a *firecrackerAPI) patch(ctx context.Context, path string, body any) error {
+	return a.do(ctx, http.MethodPatch, path, body)
+}
+
+// get decodes the JSON Firecracker answers GET path with into out.
+func (a *firecrackerAPI) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("firecracker %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("firecracker %s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// do sends body as JSON to path. Firecracker answers successful requests
+// with 204 No Content and failures with {"fault_message": "..."}.
+func (a *firecrackerAPI) do(ctx context.Context, method, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("firecracker %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var fault struct {
+		FaultMessage string `json:"fault_message"`
+	}
+	msg := strings.TrimSpace(string(raw))
+	if json.Unmarshal(raw, &fault) == nil && fault.FaultMessage != "" {
+		msg = fault.FaultMessage
+	}
+	return fmt.Errorf("firecracker %s: %s: %s", path, resp.Status, msg)
+}
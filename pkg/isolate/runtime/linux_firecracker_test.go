@@ -0,0 +1,242 @@
+//go:build linux
+
+package runtime
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestFirecracker returns a runtime keeping its state in dir, standing
+// in for one process of a series that share the default directory.
+func newTestFirecracker(dir string) *firecrackerRuntime {
+	r := newFirecrackerRuntime()
+	r.baseDir = dir
+	return r
+}
+
+// createTestVM creates the stopped VM id with placeholder boot files.
+func createTestVM(t *testing.T, r *firecrackerRuntime, id string) *firecrackerVM {
+	t.Helper()
+	files := t.TempDir()
+	kernel := filepath.Join(files, "vmlinux")
+	image := filepath.Join(files, "rootfs.ext4")
+	for _, path := range []string{kernel, image} {
+		if err := os.WriteFile(path, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	vm, err := r.CreateVM(context.Background(), &VMConfig{ID: id, KernelImage: kernel, ImagePath: image})
+	if err != nil {
+		t.Fatalf("CreateVM: %v", err)
+	}
+	return vm.(*firecrackerVM)
+}
+
+// startFakeVMM starts a process whose command line names apiSocket the way
+// a firecracker VMM's does, and reaps it when the test ends.
+func startFakeVMM(t *testing.T, apiSocket string) *exec.Cmd {
+	t.Helper()
+	// The trailing ":" keeps the shell from exec'ing sleep, which would
+	// drop the arguments.
+	cmd := exec.Command("sh", "-c", "sleep 60; :", "--api-sock", apiSocket)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+// serveFakeAPI answers the firecracker API on apiSocket as a guest in the
+// given state would, and returns the action types PUT to /actions.
+func serveFakeAPI(t *testing.T, apiSocket, state string) <-chan string {
+	t.Helper()
+	ln, err := net.Listen("unix", apiSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := make(chan string, 10)
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/":
+			json.NewEncoder(w).Encode(fcInstanceInfo{State: state})
+		case r.Method == http.MethodPut && r.URL.Path == "/actions":
+			var action fcAction
+			data, _ := io.ReadAll(r.Body)
+			json.Unmarshal(data, &action)
+			actions <- action.ActionType
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(func() { ln.Close() })
+	return actions
+}
+
+// reattach has a runtime in a later process pick up created, whose VMM is
+// the fake process vmm.
+func reattach(t *testing.T, created *firecrackerVM, vmm *exec.Cmd) VM {
+	t.Helper()
+	if err := created.writeRecord(vmm.Process.Pid, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	vm, err := newTestFirecracker(created.runtime.baseDir).GetVM(context.Background(), created.id)
+	if err != nil {
+		t.Fatalf("GetVM: %v", err)
+	}
+	return vm
+}
+
+// exited reports whether cmd exits within a few seconds.
+func exited(cmd *exec.Cmd) bool {
+	done := make(chan struct{})
+	go func() {
+		cmd.Process.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
+}
+
+func TestFirecrackerGetVMFromEarlierProcess(t *testing.T) {
+	dir := t.TempDir()
+	created := createTestVM(t, newTestFirecracker(dir), "web")
+
+	r := newTestFirecracker(dir)
+	vm, err := r.GetVM(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("GetVM: %v", err)
+	}
+	if vm.State() != VMStateStopped {
+		t.Errorf("state = %s, want %s", vm.State(), VMStateStopped)
+	}
+	if got, want := vm.Config().Metadata[MetadataAgentVsockCID], created.cfg.Metadata[MetadataAgentVsockCID]; got != want {
+		t.Errorf("vsock cid = %q, want %q", got, want)
+	}
+	if _, err := r.CreateVM(context.Background(), &VMConfig{ID: "web", DevMode: true}); err == nil {
+		t.Error("CreateVM reused the ID of a recorded VM")
+	}
+	if _, err := r.GetVM(context.Background(), "db"); err == nil {
+		t.Error("GetVM found a VM that was never created")
+	}
+}
+
+func TestFirecrackerDeleteReattachedVM(t *testing.T) {
+	dir := t.TempDir()
+	created := createTestVM(t, newTestFirecracker(dir), "web")
+	vmm := startFakeVMM(t, created.apiSocket())
+	vm := reattach(t, created, vmm)
+	if vm.State() != VMStateRunning {
+		t.Fatalf("state = %s, want %s", vm.State(), VMStateRunning)
+	}
+	if err := vm.Delete(context.Background()); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if !exited(vmm) {
+		t.Error("Delete left the VMM running")
+	}
+	if _, err := os.Stat(created.dir); !os.IsNotExist(err) {
+		t.Errorf("state directory still exists: %v", err)
+	}
+}
+
+func TestFirecrackerGetVMReattachesPausedVM(t *testing.T) {
+	created := createTestVM(t, newTestFirecracker(t.TempDir()), "web")
+	vmm := startFakeVMM(t, created.apiSocket())
+	serveFakeAPI(t, created.apiSocket(), fcVMPaused)
+
+	if vm := reattach(t, created, vmm); vm.State() != VMStatePaused {
+		t.Errorf("state = %s, want %s", vm.State(), VMStatePaused)
+	}
+}
+
+func TestFirecrackerStopReturnsWhenContextEnds(t *testing.T) {
+	created := createTestVM(t, newTestFirecracker(t.TempDir()), "web")
+	// The fake VMM accepts the shutdown request but, having no guest,
+	// never exits on its own.
+	vmm := startFakeVMM(t, created.apiSocket())
+	actions := serveFakeAPI(t, created.apiSocket(), "Running")
+	vm := reattach(t, created, vmm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	start := time.Now()
+	err := vm.Stop(ctx, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Stop = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > firecrackerShutdownTimeout/2 {
+		t.Errorf("Stop took %v after the context was cancelled", elapsed)
+	}
+	select {
+	case action := <-actions:
+		if action != fcActionCtrlAltDel {
+			t.Errorf("shutdown action = %q, want %q", action, fcActionCtrlAltDel)
+		}
+	default:
+		t.Error("Stop did not ask the guest to shut down")
+	}
+	if vm.State() != VMStateStopped {
+		t.Errorf("state = %s, want %s", vm.State(), VMStateStopped)
+	}
+	if !exited(vmm) {
+		t.Error("the VMM is still running after Stop")
+	}
+}
+
+func TestFirecrackerGetVMIgnoresReusedPID(t *testing.T) {
+	dir := t.TempDir()
+	created := createTestVM(t, newTestFirecracker(dir), "web")
+	other := startFakeVMM(t, filepath.Join(t.TempDir(), "api.sock"))
+	if err := created.writeRecord(other.Process.Pid, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	vm, err := newTestFirecracker(dir).GetVM(context.Background(), "web")
+	if err != nil {
+		t.Fatalf("GetVM: %v", err)
+	}
+	if vm.State() != VMStateStopped {
+		t.Errorf("state = %s, want %s", vm.State(), VMStateStopped)
+	}
+}
+
+func TestFirecrackerReclaimVM(t *testing.T) {
+	dir := t.TempDir()
+	created := createTestVM(t, newTestFirecracker(dir), "web")
+	vmm := startFakeVMM(t, created.apiSocket())
+	if err := os.WriteFile(created.recordPath(), []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestFirecracker(dir)
+	if _, err := r.GetVM(context.Background(), "web"); err == nil {
+		t.Fatal("GetVM succeeded with a corrupt record")
+	}
+	if err := r.ReclaimVM(context.Background(), "web"); err != nil {
+		t.Fatalf("ReclaimVM: %v", err)
+	}
+	if !exited(vmm) {
+		t.Error("ReclaimVM left the VMM running")
+	}
+	if _, err := os.Stat(created.dir); !os.IsNotExist(err) {
+		t.Errorf("state directory still exists: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PlanStepKind identifies what a network plan step configures.
+type PlanStepKind string
+
+const (
+	PlanStepMode       PlanStepKind = "mode"
+	PlanStepInterfaces PlanStepKind = "interfaces"
+	PlanStepFamily     PlanStepKind = "family"
+	PlanStepHostname   PlanStepKind = "hostname"
+	PlanStepDNS        PlanStepKind = "dns"
+	PlanStepForward    PlanStepKind = "forward"
+	PlanStepBandwidth  PlanStepKind = "bandwidth"
+	PlanStepMetrics    PlanStepKind = "metrics"
+)
+
+// PlanStep is the structured form of one network plan entry. Only the fields
+// relevant to Kind are set. String renders the same text as the matching
+// VMStatus.NetworkPlan entry.
+type PlanStep struct {
+	Kind       PlanStepKind
+	Mode       NetworkMode     // PlanStepMode
+	Interfaces int             // PlanStepInterfaces
+	Family     AddressFamily   // PlanStepFamily
+	Hostname   string          // PlanStepHostname
+	DNS        []string        // PlanStepDNS
+	Search     []string        // PlanStepDNS
+	Forward    *PortForward    // PlanStepForward, with protocol, host IP and range end defaults applied
+	Bandwidth  *BandwidthLimit // PlanStepBandwidth
+}
+
+func (s PlanStep) String() string {
+	switch s.Kind {
+	case PlanStepMode:
+		return fmt.Sprintf("mode=%s", s.Mode)
+	case PlanStepInterfaces:
+		return fmt.Sprintf("interfaces=%d", s.Interfaces)
+	case PlanStepFamily:
+		return fmt.Sprintf("family=%s", s.Family)
+	case PlanStepHostname:
+		return fmt.Sprintf("hostname=%s", s.Hostname)
+	case PlanStepDNS:
+		if len(s.Search) > 0 {
+			return fmt.Sprintf("dns=%s search=%s", strings.Join(s.DNS, ","), strings.Join(s.Search, ","))
+		}
+		return fmt.Sprintf("dns=%s", strings.Join(s.DNS, ","))
+	case PlanStepForward:
+		if s.Forward == nil {
+			return "forward"
+		}
+		return "forward " + s.Forward.String()
+	case PlanStepBandwidth:
+		if s.Bandwidth == nil {
+			return "bandwidth"
+		}
+		return fmt.Sprintf("bandwidth ingress=%dbps egress=%dbps", s.Bandwidth.IngressBitsPerSec, s.Bandwidth.EgressBitsPerSec)
+	case PlanStepMetrics:
+		return "metrics=enabled"
+	default:
+		return string(s.Kind)
+	}
+}
+
+// Clone returns a deep copy of the step.
+func (s PlanStep) Clone() PlanStep {
+	out := s
+	out.DNS = append([]string(nil), s.DNS...)
+	out.Search = append([]string(nil), s.Search...)
+	if s.Forward != nil {
+		forward := *s.Forward
+		out.Forward = &forward
+	}
+	if s.Bandwidth != nil {
+		bandwidth := *s.Bandwidth
+		out.Bandwidth = &bandwidth
+	}
+	return out
+}
+
+// ClonePlanSteps deep-copies a structured network plan.
+func ClonePlanSteps(steps []PlanStep) []PlanStep {
+	if steps == nil {
+		return nil
+	}
+	out := make([]PlanStep, len(steps))
+	for i, step := range steps {
+		out[i] = step.Clone()
+	}
+	return out
+}
+
+func renderNetworkPlan(steps []PlanStep) []string {
+	plan := make([]string, len(steps))
+	for i, step := range steps {
+		plan[i] = step.String()
+	}
+	return plan
+}
+
+func buildNetworkPlan(mode NetworkMode, cfg *NetworkConfig, ifaceCount int) []PlanStep {
+	plan := []PlanStep{
+		{Kind: PlanStepMode, Mode: mode},
+		{Kind: PlanStepInterfaces, Interfaces: ifaceCount},
+	}
+	if cfg == nil {
+		return plan
+	}
+	if cfg.AddressFamily != "" {
+		plan = append(plan, PlanStep{Kind: PlanStepFamily, Family: cfg.AddressFamily})
+	}
+	if cfg.Hostname != "" {
+		plan = append(plan, PlanStep{Kind: PlanStepHostname, Hostname: cfg.Hostname})
+	}
+	if len(cfg.DNS) > 0 {
+		plan = append(plan, PlanStep{Kind: PlanStepDNS, DNS: append([]string(nil), cfg.DNS...), Search: append([]string(nil), cfg.SearchDomains...)})
+	}
+	for _, pf := range cfg.PortForwards {
+		pf = pf.normalized()
+		plan = append(plan, PlanStep{Kind: PlanStepForward, Forward: &pf})
+	}
+	if cfg.Bandwidth != nil {
+		bandwidth := *cfg.Bandwidth
+		plan = append(plan, PlanStep{Kind: PlanStepBandwidth, Bandwidth: &bandwidth})
+	}
+	if cfg.EnableMetrics {
+		plan = append(plan, PlanStep{Kind: PlanStepMetrics})
+	}
+	return plan
+}
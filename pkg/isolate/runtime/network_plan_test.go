@@ -0,0 +1,75 @@
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNetworkPlanStepsMatchPlan(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		cfg       *VMConfig
+		wantPlan  []string
+		wantSteps []PlanStep
+	}{
+		{
+			name:     "no config",
+			wantPlan: []string{"mode=nat", "interfaces=1"},
+			wantSteps: []PlanStep{
+				{Kind: PlanStepMode, Mode: NetworkModeNAT},
+				{Kind: PlanStepInterfaces, Interfaces: 1},
+			},
+		},
+		{
+			name: "everything",
+			cfg: &VMConfig{Network: NetworkConfig{
+				Mode:          NetworkModeBridge,
+				AddressFamily: AddressFamilyDual,
+				Hostname:      "web",
+				DNS:           []string{"1.1.1.1", "8.8.8.8"},
+				SearchDomains: []string{"corp"},
+				PortForwards: []PortForward{
+					{HostPort: 8080, GuestPort: 80},
+					{Protocol: PortProtocolUDP, HostIP: "127.0.0.1", HostPort: 5000, HostPortEnd: 5002, GuestPort: 6000},
+				},
+				Bandwidth:     &BandwidthLimit{IngressBitsPerSec: 1000, EgressBitsPerSec: 2000},
+				EnableMetrics: true,
+			}},
+			wantPlan: []string{
+				"mode=bridge",
+				"interfaces=1",
+				"family=dual",
+				"hostname=web",
+				"dns=1.1.1.1,8.8.8.8 search=corp",
+				"forward 0.0.0.0:8080 -> 80/tcp",
+				"forward 127.0.0.1:5000-5002 -> 6000-6002/udp",
+				"bandwidth ingress=1000bps egress=2000bps",
+				"metrics=enabled",
+			},
+			wantSteps: []PlanStep{
+				{Kind: PlanStepMode, Mode: NetworkModeBridge},
+				{Kind: PlanStepInterfaces, Interfaces: 1},
+				{Kind: PlanStepFamily, Family: AddressFamilyDual},
+				{Kind: PlanStepHostname, Hostname: "web"},
+				{Kind: PlanStepDNS, DNS: []string{"1.1.1.1", "8.8.8.8"}, Search: []string{"corp"}},
+				{Kind: PlanStepForward, Forward: &PortForward{Protocol: PortProtocolTCP, HostIP: "0.0.0.0", HostPort: 8080, GuestPort: 80}},
+				{Kind: PlanStepForward, Forward: &PortForward{Protocol: PortProtocolUDP, HostIP: "127.0.0.1", HostPort: 5000, HostPortEnd: 5002, GuestPort: 6000, GuestPortEnd: 6002}},
+				{Kind: PlanStepBandwidth, Bandwidth: &BandwidthLimit{IngressBitsPerSec: 1000, EgressBitsPerSec: 2000}},
+				{Kind: PlanStepMetrics},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, _, plan, steps := synthesizeNetworkMetadata(tc.cfg)
+			if !reflect.DeepEqual(plan, tc.wantPlan) {
+				t.Errorf("plan = %q, want %q", plan, tc.wantPlan)
+			}
+			if !reflect.DeepEqual(steps, tc.wantSteps) {
+				t.Errorf("steps = %+v, want %+v", steps, tc.wantSteps)
+			}
+			if rendered := renderNetworkPlan(steps); !reflect.DeepEqual(rendered, plan) {
+				t.Errorf("rendered steps = %q, want the plan %q", rendered, plan)
+			}
+		})
+	}
+}
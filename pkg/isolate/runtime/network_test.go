@@ -0,0 +1,85 @@
+package runtime
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveNetworkDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		cfg       VMConfig
+		wantMode  NetworkMode
+		wantIface []NetworkInterface
+	}{
+		{
+			name:     "empty",
+			wantMode: NetworkModeNAT,
+			wantIface: []NetworkInterface{{
+				Name: "eth0", MACAddress: "02:00:00:01:02:03", SubnetCIDR: "10.0.0.0/24",
+				Gateway: "10.0.0.1", IPv4: "10.0.0.2", IPv6: "fd00::2", MTU: 1500,
+			}},
+		},
+		{
+			name:     "mode from the config",
+			cfg:      VMConfig{NetworkMode: NetworkModeBridge, Network: NetworkConfig{AddressFamily: AddressFamilyIPv6}},
+			wantMode: NetworkModeBridge,
+			wantIface: []NetworkInterface{{
+				Name: "eth0", MACAddress: "02:00:00:01:02:03", SubnetCIDR: "fd00::/64",
+				Gateway: "fd00::1", IPv6: "fd00::2", MTU: 1500,
+			}},
+		},
+		{
+			name: "interfaces filled in",
+			cfg: VMConfig{Network: NetworkConfig{
+				Mode:          NetworkModeIsolated,
+				AddressFamily: AddressFamilyIPv4,
+				Interfaces:    []NetworkInterface{{}, {Name: "wan", MACAddress: "02:aa:bb:cc:dd:ee", IPv4: "192.168.1.5"}},
+			}},
+			wantMode: NetworkModeIsolated,
+			wantIface: []NetworkInterface{
+				{Name: "eth0", MACAddress: "02:00:00:01:02:03", IPv4: "10.20.0.10"},
+				{Name: "wan", MACAddress: "02:aa:bb:cc:dd:ee", IPv4: "192.168.1.5"},
+			},
+		},
+		{
+			name: "dual stack addresses",
+			cfg: VMConfig{Network: NetworkConfig{
+				Interfaces: []NetworkInterface{{Name: "a"}, {Name: "b"}},
+			}},
+			wantMode: NetworkModeNAT,
+			wantIface: []NetworkInterface{
+				{Name: "a", MACAddress: "02:00:00:01:02:03", IPv4: "10.20.0.10", IPv6: "fd00::2"},
+				{Name: "b", MACAddress: "02:00:01:02:03:04", IPv4: "10.20.1.11", IPv6: "fd00::3"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			original := tc.cfg.Clone()
+			cfg := tc.cfg.Clone()
+			resolveNetworkDefaults(cfg)
+			if cfg.NetworkMode != tc.wantMode || cfg.Network.Mode != tc.wantMode {
+				t.Errorf("modes = %q, %q, want %q", cfg.NetworkMode, cfg.Network.Mode, tc.wantMode)
+			}
+			if !reflect.DeepEqual(cfg.Network.Interfaces, tc.wantIface) {
+				t.Errorf("interfaces =\n%+v\nwant\n%+v", cfg.Network.Interfaces, tc.wantIface)
+			}
+
+			// The interfaces written back are a new slice; the caller's
+			// are left as they were.
+			in := tc.cfg.Clone()
+			before := in.Network.Interfaces
+			resolveNetworkDefaults(in)
+			if !reflect.DeepEqual(before, original.Network.Interfaces) {
+				t.Errorf("caller's interfaces changed to %+v", before)
+			}
+
+			// Resolving is idempotent.
+			again := cfg.Clone()
+			resolveNetworkDefaults(again)
+			if !reflect.DeepEqual(again, cfg) {
+				t.Errorf("resolving twice =\n%+v\nwant\n%+v", again, cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// HostPorts returns the first and last host port pf binds, which are the
+// same for a single-port forward.
+func (pf PortForward) HostPorts() (first, last int) {
+	if pf.HostPortEnd == 0 {
+		return pf.HostPort, pf.HostPort
+	}
+	return pf.HostPort, pf.HostPortEnd
+}
+
+// GuestPorts returns the first and last guest port pf forwards to.
+func (pf PortForward) GuestPorts() (first, last int) {
+	if pf.GuestPortEnd != 0 {
+		return pf.GuestPort, pf.GuestPortEnd
+	}
+	hostFirst, hostLast := pf.HostPorts()
+	return pf.GuestPort, pf.GuestPort + hostLast - hostFirst
+}
+
+// Expand returns the single-port forwards pf stands for, in port order: one
+// per port of a range, or pf itself.
+func (pf PortForward) Expand() []PortForward {
+	hostFirst, hostLast := pf.HostPorts()
+	guestFirst, _ := pf.GuestPorts()
+	out := make([]PortForward, 0, hostLast-hostFirst+1)
+	for offset := 0; offset <= hostLast-hostFirst; offset++ {
+		single := pf
+		single.HostPort, single.HostPortEnd = hostFirst+offset, 0
+		single.GuestPort, single.GuestPortEnd = guestFirst+offset, 0
+		out = append(out, single)
+	}
+	return out
+}
+
+// String renders pf as "hostIP:hostPorts -> guestPorts/protocol", with the
+// TCP and 0.0.0.0 defaults spelled out and ranges as "first-last".
+func (pf PortForward) String() string {
+	pf = pf.normalized()
+	return fmt.Sprintf("%s:%s -> %s/%s", pf.HostIP, portSpan(pf.HostPorts()), portSpan(pf.GuestPorts()), pf.Protocol)
+}
+
+// normalized returns pf with its defaults filled in: TCP, host IP 0.0.0.0
+// and, for a range, the end of the guest range.
+func (pf PortForward) normalized() PortForward {
+	if pf.Protocol == "" {
+		pf.Protocol = PortProtocolTCP
+	}
+	if pf.HostIP == "" {
+		pf.HostIP = "0.0.0.0"
+	}
+	if pf.HostPortEnd != 0 {
+		_, pf.GuestPortEnd = pf.GuestPorts()
+	}
+	return pf
+}
+
+func portSpan(first, last int) string {
+	if first == last {
+		return strconv.Itoa(first)
+	}
+	return fmt.Sprintf("%d-%d", first, last)
+}
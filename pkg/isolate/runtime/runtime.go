@@ -7,6 +7,7 @@ import (
 	"runtime"
 	"sort"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/oarkflow/container/pkg/isolate/agent"
@@ -34,16 +35,23 @@ const (
 	PortProtocolUDP PortProtocol = "udp"
 )
 
-// PortForward exposes a single host<->guest port mapping.
+// PortForward exposes a host<->guest port mapping, or a range of them.
 type PortForward struct {
-	Protocol    PortProtocol
-	HostIP      string
-	HostPort    int
-	GuestPort   int
-	Description string
+	Protocol  PortProtocol
+	HostIP    string
+	HostPort  int
+	GuestPort int
+	// HostPortEnd, when set, makes the forward a range: HostPort through
+	// HostPortEnd map port by port onto GuestPort through GuestPortEnd. A
+	// zero GuestPortEnd gives the guest range the host range's length.
+	HostPortEnd  int
+	GuestPortEnd int
+	Description  string
 }
 
-// BandwidthLimit constrains network throughput in bits per second.
+// BandwidthLimit constrains network throughput in bits per second. Until
+// runtimes shape guest traffic themselves, the stub runtimes apply it to the
+// VM's agent connection; see agent.Bandwidth.
 type BandwidthLimit struct {
 	IngressBitsPerSec int64
 	EgressBitsPerSec  int64
@@ -60,18 +68,54 @@ type NetworkInterface struct {
 	MTU        int
 }
 
+// AddressFamily selects the IP versions a guest's interfaces get addresses
+// for.
+type AddressFamily string
+
+const (
+	AddressFamilyIPv4 AddressFamily = "ipv4"
+	AddressFamilyIPv6 AddressFamily = "ipv6"
+	AddressFamilyDual AddressFamily = "dual"
+)
+
+func (f AddressFamily) hasIPv4() bool { return f != AddressFamilyIPv6 }
+
+func (f AddressFamily) hasIPv6() bool { return f != AddressFamilyIPv4 }
+
 // NetworkConfig captures advanced networking configuration beyond the
 // high-level mode selector.
 type NetworkConfig struct {
-	Mode          NetworkMode
+	Mode NetworkMode
+	// AddressFamily limits interfaces to IPv4 or IPv6 addresses; empty is
+	// dual-stack. With IPv6 only, the guest IP is the first interface's
+	// IPv6 address.
+	AddressFamily AddressFamily
 	Hostname      string
+	// DNS lists the guest's nameservers and SearchDomains the domains
+	// short names are looked up in. When DNS is set the isolate layer
+	// installs them as the guest's /etc/resolv.conf before its first exec.
 	DNS           []string
+	SearchDomains []string
 	PortForwards  []PortForward
 	Interfaces    []NetworkInterface
 	Bandwidth     *BandwidthLimit
 	EnableMetrics bool
 }
 
+// Clone returns a deep copy of the network configuration.
+func (n NetworkConfig) Clone() NetworkConfig {
+	out := n
+	out.DNS = append([]string(nil), n.DNS...)
+	out.SearchDomains = append([]string(nil), n.SearchDomains...)
+	out.PortForwards = append([]PortForward(nil), n.PortForwards...)
+	out.Interfaces = append([]NetworkInterface(nil), n.Interfaces...)
+	if n.Bandwidth != nil {
+		bw := *n.Bandwidth
+		out.Bandwidth = &bw
+	}
+	return out
+}
+
 // NetworkInterfaceStatus represents the realized state of a guest-facing
 // interface and the host resources backing it.
 type NetworkInterfaceStatus struct {
@@ -133,6 +177,39 @@ type VMConfig struct {
 	DevMode     bool
 }
 
+// Metadata keys for the guest kernel, for callers that can only set VM
+// metadata. Runtimes that boot a kernel directly use MetadataKernelImage when
+// VMConfig.KernelImage is empty; MetadataKernelArgs replaces their default
+// kernel command line.
+const (
+	MetadataKernelImage = "kernel.image"
+	MetadataKernelArgs  = "kernel.args"
+)
+
+// Clone returns a deep copy of the VM configuration that is safe to mutate.
+func (c *VMConfig) Clone() *VMConfig {
+	if c == nil {
+		return nil
+	}
+	out := *c
+	out.Network = c.Network.Clone()
+	out.Mounts = append([]Mount(nil), c.Mounts...)
+	out.Environment = cloneStringMap(c.Environment)
+	out.Metadata = cloneStringMap(c.Metadata)
+	return &out
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
 // Image contains metadata for VM images managed by a runtime.
 type Image struct {
 	ID          string
@@ -151,16 +228,39 @@ type ExecResult struct {
 	Duration   time.Duration
 	StartedAt  time.Time
 	FinishedAt time.Time
+
+	StdoutTruncated bool
+	StderrTruncated bool
+	Env             []string // resolved environment, when requested
+	PeakOpenFiles   int      // most descriptors seen open; zero if unknown
+	ExitReason      string   // why the process died abnormally, e.g. "oom_killed"
+	TimedOut        bool     // killed, with its process group, when its timeout expired
+	UserTime        time.Duration
+	SysTime         time.Duration
+	MaxRSSBytes     uint64
+	BlockedSyscall  string // system call a seccomp filter killed the process for
+
+	// StdoutTotalBytes and StderrTotalBytes count all the output written,
+	// including any the truncated buffers dropped.
+	StdoutTotalBytes int64
+	StderrTotalBytes int64
 }
 
 // VMStats exposes lightweight performance metrics.
 type VMStats struct {
-	CPUPercent     float64
-	MemoryBytes    uint64
-	DiskBytes      uint64
+	CPUPercent  float64
+	MemoryBytes uint64
+	DiskBytes   uint64
+	// DiskReadBytes and DiskWriteBytes are the storage I/O of the commands
+	// running in the guest, where the runtime can measure it.
+	DiskReadBytes  uint64
+	DiskWriteBytes uint64
 	NetworkRxBytes uint64
 	NetworkTxBytes uint64
 	Interfaces     []InterfaceStats
+	// Estimated is set when CPUPercent and MemoryBytes are derived from the
+	// VM's configuration rather than measured.
+	Estimated bool
 }
 
 // VMState enumerates the lifecycle phases of a guest.
@@ -172,6 +272,9 @@ const (
 	VMStateStopped VMState = "stopped"
 	VMStateDeleted VMState = "deleted"
 	VMStateFailed  VMState = "failed"
+	// VMStatePaused is a VM whose vCPUs are frozen by Pause. It keeps its
+	// memory but uses no CPU and cannot run commands until resumed.
+	VMStatePaused VMState = "paused"
 )
 
 // VMStatus bundles human friendly lifecycle data.
@@ -184,6 +287,9 @@ type VMStatus struct {
 	Interfaces  []NetworkInterfaceStatus
 	ResolvedIPs []string
 	NetworkPlan []string
+	// NetworkPlanSteps is the structured form of NetworkPlan, one step per
+	// entry in the same order.
+	NetworkPlanSteps []PlanStep
 }
 
 // Runtime defines the hypervisor abstraction shared by all platforms.
@@ -197,6 +303,13 @@ type Runtime interface {
 	CreateVM(ctx context.Context, cfg *VMConfig) (VM, error)
 	ListVMs(ctx context.Context) ([]VM, error)
 	GetVM(ctx context.Context, id string) (VM, error)
+	// RestoreVM creates a running VM from a snapshot this runtime took with
+	// VM.Snapshot. The image, kernel, CPUs, memory and mounts are the
+	// snapshot's. cfg, which may be nil, supplies the ID and name and
+	// overrides the environment, working directory, network and individual
+	// metadata keys. Interface addresses and MACs cfg leaves empty are
+	// assigned afresh, so clones of one snapshot never share them.
+	RestoreVM(ctx context.Context, cfg *VMConfig, snapshotPath string) (VM, error)
 
 	ImportImage(ctx context.Context, path string) error
 	ListImages(ctx context.Context) ([]Image, error)
@@ -208,6 +321,9 @@ type VM interface {
 	Config() *VMConfig
 	State() VMState
 	Start(ctx context.Context) error
+	// Stop and Delete return ctx.Err() once ctx is done rather than wait on
+	// a backend that does not respond. A Stop cut short may still leave the
+	// VM stopped, halted by force; check State.
 	Stop(ctx context.Context, force bool) error
 	Delete(ctx context.Context) error
 	Execute(ctx context.Context, cmd *agent.CommandRequest) (*ExecResult, error)
@@ -216,6 +332,38 @@ type VM interface {
 	CopyFrom(ctx context.Context, src string, writer io.Writer) error
 	Status(ctx context.Context) (*VMStatus, error)
 	Stats(ctx context.Context) (*VMStats, error)
+	// Pause freezes a running VM and Resume thaws it again.
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	// Snapshot captures the running VM into the directory dst, creating it,
+	// for RestoreVM. The VM keeps running.
+	Snapshot(ctx context.Context, dst string) error
+}
+
+// JobSignaler is implemented by VMs whose agent can signal detached execs,
+// identified by the JobID of their stream.
+type JobSignaler interface {
+	SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error
+}
+
+// AgentInfoer is implemented by VMs that can describe their guest agent,
+// including the root directory its file operations are relative to.
+type AgentInfoer interface {
+	AgentInfo(ctx context.Context) (*agent.AgentInfo, error)
+}
+
+// GuestAgent is implemented by VMs whose agent runs inside a guest of its
+// own, such as a Firecracker microVM, so the files it writes are never the
+// host's, confined to a root directory or not.
+type GuestAgent interface {
+	GuestAgent() bool
+}
+
+// VMReclaimer is implemented by runtimes that keep state for a VM outside
+// the process, such as a VMM process and its files, and can release it by
+// ID when GetVM cannot return the VM.
+type VMReclaimer interface {
+	ReclaimVM(ctx context.Context, id string) error
 }
 
 // Descriptor captures metadata about runtime implementations for registry usage.
@@ -0,0 +1,129 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// SnapshotManifest names the file in every snapshot directory that
+// describes the VM the snapshot was taken from. Runtimes may store further
+// files, such as guest memory, next to it.
+const SnapshotManifest = "snapshot.json"
+
+type snapshotManifest struct {
+	Runtime string    `json:"runtime"`
+	TakenAt time.Time `json:"taken_at"`
+	Config  *VMConfig `json:"config"`
+}
+
+// cloneCounter numbers restored VMs, so each gets addresses of its own.
+var cloneCounter uint64
+
+func writeSnapshotManifest(dir string, m *snapshotManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, SnapshotManifest), data, 0o600)
+}
+
+// SnapshotConfig returns the configuration of the VM the snapshot in dir was
+// taken from.
+func SnapshotConfig(dir string) (*VMConfig, error) {
+	m, err := loadSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	return m.Config, nil
+}
+
+// readSnapshotManifest loads the manifest in dir, which must have been
+// written by the runtime called runtimeName.
+func readSnapshotManifest(dir, runtimeName string) (*snapshotManifest, error) {
+	m, err := loadSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m.Runtime != runtimeName {
+		return nil, fmt.Errorf("snapshot was taken by runtime %s, not %s", m.Runtime, runtimeName)
+	}
+	return m, nil
+}
+
+func loadSnapshotManifest(dir string) (*snapshotManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, SnapshotManifest))
+	if err != nil {
+		return nil, fmt.Errorf("read snapshot: %w", err)
+	}
+	var m snapshotManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("parse snapshot manifest: %w", err)
+	}
+	if m.Config == nil {
+		return nil, fmt.Errorf("snapshot manifest has no vm config")
+	}
+	return &m, nil
+}
+
+// restoredConfig derives the config of a VM restored from a snapshot of a
+// VM configured as saved, with cfg applied as Runtime.RestoreVM describes.
+// The snapshot's interface addresses and MACs belong to the VM it was taken
+// from and are dropped.
+func restoredConfig(saved, cfg *VMConfig) *VMConfig {
+	out := saved.Clone()
+	out.ID, out.Name = "", ""
+	for i := range out.Network.Interfaces {
+		iface := &out.Network.Interfaces[i]
+		iface.MACAddress, iface.IPv4, iface.IPv6 = "", "", ""
+	}
+	if cfg != nil {
+		out.ID = cfg.ID
+		out.Name = cfg.Name
+		if cfg.Environment != nil {
+			out.Environment = cloneStringMap(cfg.Environment)
+		}
+		if cfg.WorkingDir != "" {
+			out.WorkingDir = cfg.WorkingDir
+		}
+		if len(cfg.Metadata) > 0 && out.Metadata == nil {
+			out.Metadata = make(map[string]string, len(cfg.Metadata))
+		}
+		for k, v := range cfg.Metadata {
+			out.Metadata[k] = v
+		}
+		if cfg.Network.Mode != "" || len(cfg.Network.Interfaces) > 0 {
+			out.Network = cfg.Network.Clone()
+			out.NetworkMode = cfg.NetworkMode
+		} else if cfg.NetworkMode != "" {
+			out.NetworkMode = cfg.NetworkMode
+			out.Network.Mode = cfg.NetworkMode
+		}
+	}
+	assignCloneAddresses(out, atomic.AddUint64(&cloneCounter, 1))
+	resolveNetworkDefaults(out)
+	return out
+}
+
+// assignCloneAddresses gives every interface of cfg without a MAC or
+// address one derived from n, from ranges the creation defaults never use.
+func assignCloneAddresses(cfg *VMConfig, n uint64) {
+	interfaces := ensureInterfaces(&cfg.Network)
+	for idx := range interfaces {
+		iface := &interfaces[idx]
+		if iface.MACAddress == "" {
+			iface.MACAddress = fmt.Sprintf("02:01:%02x:%02x:%02x:%02x", idx, byte(n>>16), byte(n>>8), byte(n))
+		}
+		if iface.IPv4 == "" && cfg.Network.AddressFamily.hasIPv4() {
+			host := n % (254 * 256)
+			iface.IPv4 = fmt.Sprintf("10.%d.%d.%d", 64+idx, host/254, host%254+1)
+		}
+		if iface.IPv6 == "" && cfg.Network.AddressFamily.hasIPv6() {
+			iface.IPv6 = fmt.Sprintf("fd00:%x::%x", 0x40+idx, n)
+		}
+	}
+	cfg.Network.Interfaces = interfaces
+}
@@ -0,0 +1,34 @@
+package runtime
+
+import (
+	"context"
+	"fmt"
+)
+
+// StatsProvider computes the statistics a stub VM reports from Stats. The
+// stub runtimes use fixed synthetic numbers by default; tests can install a
+// provider to script scenarios such as CPU spikes or growing network traffic.
+// Providers are called without runtime locks held and may use any VM method.
+type StatsProvider interface {
+	VMStats(ctx context.Context, vm VM) (*VMStats, error)
+}
+
+// StatsProviderFunc adapts a function to StatsProvider.
+type StatsProviderFunc func(ctx context.Context, vm VM) (*VMStats, error)
+
+func (f StatsProviderFunc) VMStats(ctx context.Context, vm VM) (*VMStats, error) {
+	return f(ctx, vm)
+}
+
+// SetStatsProvider installs p on rt, which must be one of the stub runtimes,
+// for all of its VMs. A nil p restores the default synthetic stats.
+func SetStatsProvider(rt Runtime, p StatsProvider) error {
+	s, ok := rt.(*stubRuntime)
+	if !ok {
+		return fmt.Errorf("runtime %s does not support injected stats", rt.Name())
+	}
+	s.mu.Lock()
+	s.stats = p
+	s.mu.Unlock()
+	return nil
+}
@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/oarkflow/container/pkg/isolate/agent"
@@ -34,6 +36,8 @@ type stubRuntime struct {
 	vms         map[string]*stubVM
 	mu          sync.RWMutex
 	versionInfo string
+	vsock       *vsockAllocator // set for hypervisors that expect the host to pick guest CIDs
+	stats       StatsProvider   // nil uses agentStats
 }
 
 func newStubRuntime(desc Descriptor, binaryNames ...string) *stubRuntime {
@@ -67,8 +71,17 @@ func (s *stubRuntime) CreateVM(ctx context.Context, cfg *VMConfig) (VM, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("vm config is required")
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	warnNetwork(cfg)
+	return s.addVMLocked(cfg.Clone())
+}
 
-	id := cfg.ID
+// addVMLocked registers a stopped VM for cfg, which it takes ownership of,
+// after applying the runtime's defaults.
+func (s *stubRuntime) addVMLocked(cfgCopy *VMConfig) (*stubVM, error) {
+	id := cfgCopy.ID
 	if id == "" {
 		id = fmt.Sprintf("%s-%d", s.desc.Name, atomic.AddUint64(&vmCounter, 1))
 	}
@@ -77,24 +90,57 @@ func (s *stubRuntime) CreateVM(ctx context.Context, cfg *VMConfig) (VM, error) {
 		return nil, fmt.Errorf("vm %s already exists", id)
 	}
 
-	cfgCopy := *cfg
-	guestIP, ifaceStatus, resolvedIPs, plan := synthesizeNetworkMetadata(&cfgCopy)
+	cfgCopy.ID = id
+	resolveNetworkDefaults(cfgCopy)
+	if s.vsock != nil {
+		if err := s.vsock.assign(cfgCopy); err != nil {
+			return nil, err
+		}
+	}
+	guestIP, ifaceStatus, resolvedIPs, plan, planSteps := synthesizeNetworkMetadata(cfgCopy)
 	vm := &stubVM{
 		id:                 id,
-		cfg:                &cfgCopy,
+		cfg:                cfgCopy,
 		runtime:            s,
 		state:              VMStateStopped,
-		agent:              selectAgentClient(&cfgCopy),
+		agent:              selectAgentClient(cfgCopy),
 		guestIP:            guestIP,
 		interfaceTemplates: ifaceStatus,
 		resolvedIPs:        resolvedIPs,
 		networkPlan:        plan,
+		networkPlanSteps:   planSteps,
 	}
 
 	s.vms[id] = vm
 	return vm, nil
 }
 
+// RestoreVM recreates a VM from the state Snapshot saved. The clone gets
+// its own vsock CID unless cfg names one.
+func (s *stubRuntime) RestoreVM(ctx context.Context, cfg *VMConfig, snapshotPath string) (VM, error) {
+	manifest, err := readSnapshotManifest(snapshotPath, s.Name())
+	if err != nil {
+		return nil, err
+	}
+	restored := restoredConfig(manifest.Config, cfg)
+	if cfg == nil || cfg.Metadata[MetadataAgentVsockCID] == "" {
+		delete(restored.Metadata, MetadataAgentVsockCID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm, err := s.addVMLocked(restored)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	vm.state = VMStateRunning
+	vm.createdAt = now
+	vm.startedAt = now
+	vm.updatedAt = now
+	return vm, nil
+}
+
 func (s *stubRuntime) ListVMs(ctx context.Context) ([]VM, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -139,6 +185,7 @@ type stubVM struct {
 	interfaceTemplates []NetworkInterfaceStatus
 	resolvedIPs        []string
 	networkPlan        []string
+	networkPlanSteps   []PlanStep
 }
 
 var vmCounter uint64
@@ -155,6 +202,9 @@ func (v *stubVM) Start(ctx context.Context) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 
+	if _, err := CheckTransition(v.state, VMOpStart); err != nil {
+		return err
+	}
 	v.state = VMStateRunning
 	if v.createdAt.IsZero() {
 		v.createdAt = time.Now()
@@ -164,23 +214,63 @@ func (v *stubVM) Start(ctx context.Context) error {
 	return nil
 }
 
+// Stop marks the VM stopped. Like Delete, it does nothing and returns
+// ctx.Err() once ctx is done.
 func (v *stubVM) Stop(ctx context.Context, force bool) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
+	if _, err := CheckTransition(v.state, VMOpStop); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	v.state = VMStateStopped
 	v.updatedAt = time.Now()
 	return nil
 }
 
+// Pause marks the VM paused; paused stub VMs report no CPU use.
+func (v *stubVM) Pause(ctx context.Context) error {
+	return v.transition(VMOpPause)
+}
+
+func (v *stubVM) Resume(ctx context.Context) error {
+	return v.transition(VMOpResume)
+}
+
+func (v *stubVM) transition(op VMOp) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	to, err := CheckTransition(v.state, op)
+	if err != nil {
+		return err
+	}
+	if to != v.state {
+		v.state = to
+		v.updatedAt = time.Now()
+	}
+	return nil
+}
+
 func (v *stubVM) Delete(ctx context.Context) error {
 	v.mu.Lock()
 	defer v.mu.Unlock()
+	if _, err := CheckTransition(v.state, VMOpDelete); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	v.state = VMStateDeleted
 	v.updatedAt = time.Now()
 
 	v.runtime.mu.Lock()
 	delete(v.runtime.vms, v.id)
 	v.runtime.mu.Unlock()
+	if v.runtime.vsock != nil {
+		v.runtime.vsock.release(v.cfg)
+	}
 
 	return nil
 }
@@ -193,6 +283,11 @@ func (v *stubVM) Execute(ctx context.Context, cmd *agent.CommandRequest) (*ExecR
 	if err != nil {
 		return nil, err
 	}
+	return execResultFrom(result), nil
+}
+
+// execResultFrom converts an agent command result for the runtime boundary.
+func execResultFrom(result *agent.CommandResult) *ExecResult {
 	return &ExecResult{
 		ExitCode:   result.ExitCode,
 		Stdout:     append([]byte(nil), result.Stdout...),
@@ -200,7 +295,21 @@ func (v *stubVM) Execute(ctx context.Context, cmd *agent.CommandRequest) (*ExecR
 		Duration:   result.Duration,
 		StartedAt:  result.StartedAt,
 		FinishedAt: result.FinishedAt,
-	}, nil
+
+		StdoutTruncated: result.StdoutTruncated,
+		StderrTruncated: result.StderrTruncated,
+		Env:             result.Env,
+		PeakOpenFiles:   result.PeakOpenFiles,
+		ExitReason:      result.ExitReason,
+		TimedOut:        result.TimedOut,
+		UserTime:        result.UserTime,
+		SysTime:         result.SysTime,
+		MaxRSSBytes:     result.MaxRSSBytes,
+		BlockedSyscall:  result.BlockedSyscall,
+
+		StdoutTotalBytes: result.StdoutTotalBytes,
+		StderrTotalBytes: result.StderrTotalBytes,
+	}
 }
 
 func (v *stubVM) ExecStream(ctx context.Context, cmd *agent.CommandRequest) (*agent.CommandStream, error) {
@@ -210,6 +319,20 @@ func (v *stubVM) ExecStream(ctx context.Context, cmd *agent.CommandRequest) (*ag
 	return v.agent.ExecStream(ctx, cmd)
 }
 
+func (v *stubVM) SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error {
+	if v.agent == nil {
+		return errAgentUnavailable
+	}
+	return v.agent.SignalJob(ctx, jobID, sig)
+}
+
+func (v *stubVM) AgentInfo(ctx context.Context) (*agent.AgentInfo, error) {
+	if v.agent == nil {
+		return nil, errAgentUnavailable
+	}
+	return v.agent.Info(ctx)
+}
+
 func (v *stubVM) CopyTo(ctx context.Context, reader io.Reader, dst string) error {
 	return v.agent.CopyTo(ctx, reader, dst)
 }
@@ -218,6 +341,23 @@ func (v *stubVM) CopyFrom(ctx context.Context, src string, writer io.Writer) err
 	return v.agent.CopyFrom(ctx, src, writer)
 }
 
+// Snapshot saves the VM's configuration; the stub has no guest state.
+func (v *stubVM) Snapshot(ctx context.Context, dst string) error {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if _, err := CheckTransition(v.state, VMOpSnapshot); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	return writeSnapshotManifest(dst, &snapshotManifest{
+		Runtime: v.runtime.desc.Name,
+		TakenAt: time.Now(),
+		Config:  v.cfg,
+	})
+}
+
 func (v *stubVM) Status(ctx context.Context) (*VMStatus, error) {
 	v.mu.RLock()
 	defer v.mu.RUnlock()
@@ -230,10 +370,33 @@ func (v *stubVM) Status(ctx context.Context) (*VMStatus, error) {
 		Interfaces:  stampInterfaceStatus(v.interfaceTemplates),
 		ResolvedIPs: append([]string(nil), v.resolvedIPs...),
 		NetworkPlan: append([]string(nil), v.networkPlan...),
+
+		NetworkPlanSteps: ClonePlanSteps(v.networkPlanSteps),
 	}, nil
 }
 
 func (v *stubVM) Stats(ctx context.Context) (*VMStats, error) {
+	var provider StatsProvider = agentStats{}
+	if v.runtime != nil {
+		v.runtime.mu.RLock()
+		if v.runtime.stats != nil {
+			provider = v.runtime.stats
+		}
+		v.runtime.mu.RUnlock()
+	}
+	return provider.VMStats(ctx, v)
+}
+
+// syntheticStats reports fixed per-interface traffic samples, a fraction of
+// the configured memory and disk, and a CPU estimate derived from the VM's
+// shape.
+type syntheticStats struct{}
+
+func (syntheticStats) VMStats(ctx context.Context, vm VM) (*VMStats, error) {
+	v, ok := vm.(*stubVM)
+	if !ok {
+		return nil, fmt.Errorf("synthetic stats require a stub vm")
+	}
 	v.mu.RLock()
 	defer v.mu.RUnlock()
 
@@ -267,29 +430,79 @@ func (v *stubVM) Stats(ctx context.Context) (*VMStats, error) {
 		NetworkRxBytes: totalRx,
 		NetworkTxBytes: totalTx,
 		Interfaces:     ifaceStats,
+		Estimated:      true,
 	}, nil
 }
 
+// agentStats is the default stub StatsProvider. CPU, memory and I/O are
+// what the guest agent measures for the commands it is running; where the
+// agent cannot sample them, syntheticStats' estimates stand in. Disk size
+// and network traffic are always synthetic.
+type agentStats struct{}
+
+func (agentStats) VMStats(ctx context.Context, vm VM) (*VMStats, error) {
+	stats, err := syntheticStats{}.VMStats(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+	v := vm.(*stubVM)
+	v.mu.RLock()
+	client, running := v.agent, v.state == VMStateRunning
+	v.mu.RUnlock()
+	if client == nil || !running {
+		return stats, nil
+	}
+	procs, err := client.ProcessStats(ctx)
+	if err != nil {
+		return stats, nil
+	}
+	stats.CPUPercent = procs.CPUPercent
+	stats.MemoryBytes = procs.RSSBytes
+	stats.DiskReadBytes = procs.ReadBytes
+	stats.DiskWriteBytes = procs.WriteBytes
+	stats.Estimated = false
+	return stats, nil
+}
+
+// selectAgentClient picks the agent client cfg's metadata points at, or the
+// loopback agent in dev mode. Clients are throttled to the network's
+// bandwidth limit, as the VM's traffic would be.
 func selectAgentClient(cfg *VMConfig) agent.Client {
 	if cfg == nil {
 		return agent.NewNopClient()
 	}
+	var bw agent.Bandwidth
+	if limit := cfg.Network.Bandwidth; limit != nil {
+		bw = agent.Bandwidth{IngressBitsPerSec: limit.IngressBitsPerSec, EgressBitsPerSec: limit.EgressBitsPerSec}
+	}
+	ipc := func(d agent.Dialer) agent.Client {
+		client := agent.NewIPCClient(d).(*agent.IPCClient)
+		client.Bandwidth = bw
+		return client
+	}
 	if meta := cfg.Metadata; meta != nil {
-		if path := meta["agent.unix"]; path != "" {
-			return agent.NewIPCClient(&agent.UnixDialer{Path: path})
+		if raw := meta[MetadataAgentEndpoint]; raw != "" {
+			if dialer, err := endpointDialer(raw); err == nil {
+				return ipc(dialer)
+			}
+		}
+		if path := meta[MetadataAgentUnix]; path != "" {
+			return ipc(&agent.UnixDialer{Path: path, Abstract: strings.HasPrefix(path, "@")})
 		}
-		cidStr := meta["agent.vsock.cid"]
-		portStr := meta["agent.vsock.port"]
+		cidStr := meta[MetadataAgentVsockCID]
+		portStr := meta[MetadataAgentVsockPort]
 		if cidStr != "" && portStr != "" {
 			cid, errCID := strconv.ParseUint(cidStr, 10, 32)
 			port, errPort := strconv.ParseUint(portStr, 10, 32)
 			if errCID == nil && errPort == nil {
-				return agent.NewIPCClient(&agent.VsockDialer{CID: uint32(cid), Port: uint32(port)})
+				return ipc(&agent.VsockDialer{CID: uint32(cid), Port: uint32(port)})
 			}
 		}
 	}
 	if cfg.DevMode {
-		return agent.NewLoopbackClient(cfg.Environment)
+		client := agent.NewLoopbackClient(cfg.Environment).(*agent.LoopbackClient)
+		client.Bandwidth = bw
+		return client
 	}
 	return agent.NewNopClient()
 }
@@ -308,7 +521,7 @@ func stampInterfaceStatus(templates []NetworkInterfaceStatus) []NetworkInterface
 	return out
 }
 
-func synthesizeNetworkMetadata(cfg *VMConfig) (string, []NetworkInterfaceStatus, []string, []string) {
+func synthesizeNetworkMetadata(cfg *VMConfig) (string, []NetworkInterfaceStatus, []string, []string, []PlanStep) {
 	if cfg == nil {
 		defaultIface := NetworkInterface{
 			Name:       "eth0",
@@ -334,8 +547,8 @@ func synthesizeNetworkMetadata(cfg *VMConfig) (string, []NetworkInterfaceStatus,
 			},
 		}
 		resolved := dedupeStrings([]string{defaultIface.IPv4, defaultIface.IPv6})
-		plan := buildNetworkPlan(NetworkModeNAT, &NetworkConfig{}, 1)
-		return defaultIface.IPv4, []NetworkInterfaceStatus{status}, resolved, plan
+		steps := buildNetworkPlan(NetworkModeNAT, &NetworkConfig{}, 1)
+		return defaultIface.IPv4, []NetworkInterfaceStatus{status}, resolved, renderNetworkPlan(steps), steps
 	}
 
 	netCfg := cfg.Network
@@ -347,7 +560,9 @@ func synthesizeNetworkMetadata(cfg *VMConfig) (string, []NetworkInterfaceStatus,
 		mode = NetworkModeNAT
 	}
 
+	family := netCfg.AddressFamily
 	interfaces := ensureInterfaces(&netCfg)
+	forwards, forwardRules := forwardStatus(netCfg.PortForwards)
 	statuses := make([]NetworkInterfaceStatus, 0, len(interfaces))
 	resolved := make([]string, 0, len(interfaces)*2)
 	hostName := cfg.Name
@@ -364,27 +579,34 @@ func synthesizeNetworkMetadata(cfg *VMConfig) (string, []NetworkInterfaceStatus,
 			mac = fmt.Sprintf("02:00:%02x:%02x:%02x:%02x", idx, idx+1, idx+2, idx+3)
 		}
 		ipv4 := iface.IPv4
-		if ipv4 == "" {
+		if ipv4 == "" && family.hasIPv4() {
 			ipv4 = defaultIPv4(idx)
 		}
 		ipv6 := iface.IPv6
-		if ipv6 == "" {
+		if ipv6 == "" && family.hasIPv6() {
 			ipv6 = defaultIPv6(idx)
 		}
+		rules := []string{
+			fmt.Sprintf("allow egress via %s", mode),
+			"allow established ingress",
+		}
+		switch family {
+		case AddressFamilyIPv4:
+			rules = append(rules, "deny ipv6")
+		case AddressFamilyIPv6:
+			rules = append(rules, "deny ipv4")
+		}
 		status := NetworkInterfaceStatus{
-			Name:         name,
-			MACAddress:   mac,
-			HostDevice:   fmt.Sprintf("%s-%s", hostName, name),
-			Bridge:       bridgeName(mode),
-			Switch:       switchName(mode),
-			GuestIPv4:    ipv4,
-			GuestIPv6:    ipv6,
-			State:        "up",
-			PortForwards: append([]PortForward(nil), netCfg.PortForwards...),
-			FirewallRules: []string{
-				fmt.Sprintf("allow egress via %s", mode),
-				"allow established ingress",
-			},
+			Name:          name,
+			MACAddress:    mac,
+			HostDevice:    fmt.Sprintf("%s-%s", hostName, name),
+			Bridge:        bridgeName(mode),
+			Switch:        switchName(mode),
+			GuestIPv4:     ipv4,
+			GuestIPv6:     ipv6,
+			State:         "up",
+			PortForwards:  append([]PortForward(nil), forwards...),
+			FirewallRules: append(rules, forwardRules...),
 		}
 		statuses = append(statuses, status)
 		if ipv4 != "" {
@@ -404,21 +626,81 @@ func synthesizeNetworkMetadata(cfg *VMConfig) (string, []NetworkInterfaceStatus,
 		}
 	}
 
-	plan := buildNetworkPlan(mode, &netCfg, len(statuses))
+	steps := buildNetworkPlan(mode, &netCfg, len(statuses))
 
-	return guestIP, statuses, dedupeStrings(resolved), plan
+	return guestIP, statuses, dedupeStrings(resolved), renderNetworkPlan(steps), steps
+}
+
+// forwardStatus returns the port forwards an interface status reports, with
+// their defaults filled in and ranges kept whole, and the firewall rules
+// that admit their traffic.
+func forwardStatus(forwards []PortForward) ([]PortForward, []string) {
+	if len(forwards) == 0 {
+		return nil, nil
+	}
+	out := make([]PortForward, len(forwards))
+	rules := make([]string, len(forwards))
+	for i, pf := range forwards {
+		out[i] = pf.normalized()
+		rules[i] = fmt.Sprintf("allow ingress %s/%s", out[i].Protocol, portSpan(out[i].GuestPorts()))
+	}
+	return out, rules
+}
+
+// resolveNetworkDefaults writes the network mode and per-interface defaults
+// the VM will actually use back into cfg, so VM.Config reports the effective
+// configuration rather than the sparse one the caller supplied.
+func resolveNetworkDefaults(cfg *VMConfig) {
+	if cfg.Network.Mode == "" {
+		cfg.Network.Mode = cfg.NetworkMode
+	}
+	if cfg.Network.Mode == "" {
+		cfg.Network.Mode = NetworkModeNAT
+	}
+	if cfg.NetworkMode == "" {
+		cfg.NetworkMode = cfg.Network.Mode
+	}
+
+	interfaces := ensureInterfaces(&cfg.Network)
+	for idx := range interfaces {
+		iface := &interfaces[idx]
+		if iface.Name == "" {
+			iface.Name = fmt.Sprintf("eth%d", idx)
+		}
+		if iface.MACAddress == "" {
+			iface.MACAddress = fmt.Sprintf("02:00:%02x:%02x:%02x:%02x", idx, idx+1, idx+2, idx+3)
+		}
+		if iface.IPv4 == "" && cfg.Network.AddressFamily.hasIPv4() {
+			iface.IPv4 = defaultIPv4(idx)
+		}
+		if iface.IPv6 == "" && cfg.Network.AddressFamily.hasIPv6() {
+			iface.IPv6 = defaultIPv6(idx)
+		}
+	}
+	cfg.Network.Interfaces = interfaces
 }
 
 func ensureInterfaces(cfg *NetworkConfig) []NetworkInterface {
-	if cfg == nil || len(cfg.Interfaces) == 0 {
-		return []NetworkInterface{defaultInterfaceDefinition()}
+	if cfg == nil {
+		return []NetworkInterface{defaultInterfaceDefinition("")}
+	}
+	if len(cfg.Interfaces) == 0 {
+		return []NetworkInterface{defaultInterfaceDefinition(cfg.AddressFamily)}
 	}
 	interfaces := make([]NetworkInterface, len(cfg.Interfaces))
 	copy(interfaces, cfg.Interfaces)
 	return interfaces
 }
 
-func defaultInterfaceDefinition() NetworkInterface {
+// defaultInterfaceDefinition is the interface of a VM configured without
+// any, addressed for family.
+func defaultInterfaceDefinition(family AddressFamily) NetworkInterface {
+	switch family {
+	case AddressFamilyIPv4:
+		return NetworkInterface{Name: "eth0", SubnetCIDR: "10.0.0.0/24", Gateway: "10.0.0.1", IPv4: "10.0.0.2", MTU: 1500}
+	case AddressFamilyIPv6:
+		return NetworkInterface{Name: "eth0", SubnetCIDR: "fd00::/64", Gateway: "fd00::1", IPv6: "fd00::2", MTU: 1500}
+	}
 	return NetworkInterface{
 		Name:       "eth0",
 		SubnetCIDR: "10.0.0.0/24",
@@ -453,37 +735,6 @@ func switchName(mode NetworkMode) string {
 	}
 }
 
-func buildNetworkPlan(mode NetworkMode, cfg *NetworkConfig, ifaceCount int) []string {
-	plan := []string{fmt.Sprintf("mode=%s", mode), fmt.Sprintf("interfaces=%d", ifaceCount)}
-	if cfg == nil {
-		return plan
-	}
-	if cfg.Hostname != "" {
-		plan = append(plan, fmt.Sprintf("hostname=%s", cfg.Hostname))
-	}
-	if len(cfg.DNS) > 0 {
-		plan = append(plan, fmt.Sprintf("dns=%s", strings.Join(cfg.DNS, ",")))
-	}
-	for _, pf := range cfg.PortForwards {
-		proto := pf.Protocol
-		if proto == "" {
-			proto = PortProtocolTCP
-		}
-		hostIP := pf.HostIP
-		if hostIP == "" {
-			hostIP = "0.0.0.0"
-		}
-		plan = append(plan, fmt.Sprintf("forward %s:%d -> %d/%s", hostIP, pf.HostPort, pf.GuestPort, proto))
-	}
-	if cfg.Bandwidth != nil {
-		plan = append(plan, fmt.Sprintf("bandwidth ingress=%dbps egress=%dbps", cfg.Bandwidth.IngressBitsPerSec, cfg.Bandwidth.EgressBitsPerSec))
-	}
-	if cfg.EnableMetrics {
-		plan = append(plan, "metrics=enabled")
-	}
-	return plan
-}
-
 func dedupeStrings(values []string) []string {
 	if len(values) == 0 {
 		return nil
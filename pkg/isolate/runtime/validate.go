@@ -0,0 +1,284 @@
+package runtime
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Errors Validate wraps, with the offending value, for configurations no
+// runtime can create a VM from.
+var (
+	ErrInvalidCPUCount      = errors.New("invalid cpu count")
+	ErrInvalidMemory        = errors.New("invalid memory size")
+	ErrInvalidDiskSize      = errors.New("invalid disk size")
+	ErrInvalidNetworkMode   = errors.New("invalid network mode")
+	ErrInvalidAddressFamily = errors.New("invalid address family")
+	ErrInvalidDNS           = errors.New("invalid dns configuration")
+	ErrInvalidInterface     = errors.New("invalid network interface")
+	ErrDuplicateInterface   = errors.New("duplicate network interface")
+	ErrInvalidPortForward   = errors.New("invalid port forward")
+	ErrPortForwardConflict  = errors.New("conflicting port forwards")
+)
+
+// Validate reports the first problem that would keep the configuration from
+// describing a working VM. Zero CPUs, memory and disk size are valid and
+// leave the choice to the runtime; negative ones are not. Interfaces must
+// have distinct names, counting the "ethN" a runtime gives an unnamed one,
+// and static addresses of the network's address family. Addresses and
+// gateways must lie in the interface's SubnetCIDR, and a gateway must not be
+// the interface's own address. No two port forwards may bind the same host
+// address, port and protocol, counting every port of a range, and
+// nameservers must be IP addresses.
+func (c *VMConfig) Validate() error {
+	if c == nil {
+		return fmt.Errorf("vm config is required")
+	}
+	if c.CPUs < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidCPUCount, c.CPUs)
+	}
+	if c.MemoryBytes < 0 {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidMemory, c.MemoryBytes)
+	}
+	if c.DiskSize < 0 {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidDiskSize, c.DiskSize)
+	}
+	for _, mode := range []NetworkMode{c.NetworkMode, c.Network.Mode} {
+		if !validNetworkMode(mode) {
+			return fmt.Errorf("%w: %q", ErrInvalidNetworkMode, mode)
+		}
+	}
+	switch c.Network.AddressFamily {
+	case "", AddressFamilyIPv4, AddressFamilyIPv6, AddressFamilyDual:
+	default:
+		return fmt.Errorf("%w: %q", ErrInvalidAddressFamily, c.Network.AddressFamily)
+	}
+	if err := validateDNS(c.Network); err != nil {
+		return err
+	}
+	if err := validateInterfaces(c.Network.Interfaces, c.Network.AddressFamily); err != nil {
+		return err
+	}
+	return validatePortForwards(c.Network.PortForwards)
+}
+
+func validNetworkMode(mode NetworkMode) bool {
+	switch mode {
+	case "", NetworkModeIsolated, NetworkModeNAT, NetworkModeBridge:
+		return true
+	}
+	return false
+}
+
+// validateDNS checks that nameservers are IP addresses and that search
+// domains are single words, as resolv.conf needs them.
+func validateDNS(n NetworkConfig) error {
+	for _, server := range n.DNS {
+		if net.ParseIP(server) == nil {
+			return fmt.Errorf("%w: nameserver %q is not an IP address", ErrInvalidDNS, server)
+		}
+	}
+	for _, domain := range n.SearchDomains {
+		if domain == "" || strings.ContainsAny(domain, " \t\r\n") {
+			return fmt.Errorf("%w: search domain %q", ErrInvalidDNS, domain)
+		}
+	}
+	return nil
+}
+
+func validateInterfaces(interfaces []NetworkInterface, family AddressFamily) error {
+	seen := make(map[string]bool, len(interfaces))
+	for idx, iface := range interfaces {
+		name := iface.Name
+		if name == "" {
+			name = fmt.Sprintf("eth%d", idx)
+		}
+		if seen[name] {
+			return fmt.Errorf("%w: %s", ErrDuplicateInterface, name)
+		}
+		seen[name] = true
+		if iface.MTU < 0 {
+			return fmt.Errorf("%w: %s has MTU %d", ErrInvalidInterface, name, iface.MTU)
+		}
+		if iface.IPv4 != "" && net.ParseIP(iface.IPv4).To4() == nil {
+			return fmt.Errorf("%w: %s has invalid IPv4 address %q", ErrInvalidInterface, name, iface.IPv4)
+		}
+		if iface.IPv6 != "" && !isIPv6(iface.IPv6) {
+			return fmt.Errorf("%w: %s has invalid IPv6 address %q", ErrInvalidInterface, name, iface.IPv6)
+		}
+		if iface.IPv4 != "" && !family.hasIPv4() {
+			return fmt.Errorf("%w: %s has IPv4 address %q on an IPv6-only network", ErrInvalidInterface, name, iface.IPv4)
+		}
+		if iface.IPv6 != "" && !family.hasIPv6() {
+			return fmt.Errorf("%w: %s has IPv6 address %q on an IPv4-only network", ErrInvalidInterface, name, iface.IPv6)
+		}
+		if err := validateSubnet(name, iface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateSubnet checks that iface's gateway and addresses lie in its
+// SubnetCIDR and that the gateway is not one of the addresses. Addresses of
+// the other IP version than the subnet's are not checked against it.
+func validateSubnet(name string, iface NetworkInterface) error {
+	if iface.Gateway != "" {
+		gateway, err := netip.ParseAddr(iface.Gateway)
+		if err != nil {
+			return fmt.Errorf("%w: %s has invalid gateway %q", ErrInvalidInterface, name, iface.Gateway)
+		}
+		for _, addr := range []string{iface.IPv4, iface.IPv6} {
+			if ip, err := netip.ParseAddr(addr); err == nil && ip == gateway {
+				return fmt.Errorf("%w: %s has its own address %s as gateway", ErrInvalidInterface, name, addr)
+			}
+		}
+	}
+	if iface.SubnetCIDR == "" {
+		return nil
+	}
+	subnet, err := netip.ParsePrefix(iface.SubnetCIDR)
+	if err != nil {
+		return fmt.Errorf("%w: %s has invalid subnet %q", ErrInvalidInterface, name, iface.SubnetCIDR)
+	}
+	subnet = subnet.Masked()
+	for _, addr := range []string{iface.IPv4, iface.IPv6, iface.Gateway} {
+		ip, err := netip.ParseAddr(addr)
+		if err != nil || ip.Is4() != subnet.Addr().Is4() {
+			continue
+		}
+		if !subnet.Contains(ip) {
+			return fmt.Errorf("%w: %s address %s is outside its subnet %s", ErrInvalidInterface, name, addr, subnet)
+		}
+	}
+	return nil
+}
+
+// networkWarnings describes addresses that Validate accepts but that are
+// unlikely to route: an interface address or gateway that is the network
+// address of its subnet or, for IPv4, the broadcast address.
+func networkWarnings(cfg *VMConfig) []string {
+	var warnings []string
+	for idx, iface := range cfg.Network.Interfaces {
+		subnet, err := netip.ParsePrefix(iface.SubnetCIDR)
+		if err != nil {
+			continue
+		}
+		subnet = subnet.Masked()
+		if subnet.Bits() >= subnet.Addr().BitLen()-1 {
+			// /31 and /32 (/127 and /128) subnets have no network or
+			// broadcast address to avoid.
+			continue
+		}
+		name := iface.Name
+		if name == "" {
+			name = fmt.Sprintf("eth%d", idx)
+		}
+		for _, addr := range []string{iface.IPv4, iface.IPv6, iface.Gateway} {
+			ip, err := netip.ParseAddr(addr)
+			if err != nil || !subnet.Contains(ip) {
+				continue
+			}
+			switch {
+			case ip == subnet.Addr():
+				warnings = append(warnings, fmt.Sprintf("interface %s address %s is the network address of %s", name, addr, subnet))
+			case ip.Is4() && ip == lastAddr(subnet):
+				warnings = append(warnings, fmt.Sprintf("interface %s address %s is the broadcast address of %s", name, addr, subnet))
+			}
+		}
+	}
+	return warnings
+}
+
+// warnNetwork logs the networkWarnings of cfg.
+func warnNetwork(cfg *VMConfig) {
+	for _, warning := range networkWarnings(cfg) {
+		log.Printf("runtime: %s: %s", cfg.Name, warning)
+	}
+}
+
+// lastAddr returns the highest address in subnet, which must be masked.
+func lastAddr(subnet netip.Prefix) netip.Addr {
+	b := subnet.Addr().AsSlice()
+	for i := range b {
+		hostBits := max(0, min(8, (i+1)*8-subnet.Bits()))
+		b[i] |= byte(1<<hostBits - 1)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+func isIPv6(s string) bool {
+	ip := net.ParseIP(s)
+	return ip != nil && ip.To4() == nil
+}
+
+func validatePortForwards(forwards []PortForward) error {
+	for i, pf := range forwards {
+		if err := validatePortForward(pf); err != nil {
+			return err
+		}
+		for _, prev := range forwards[:i] {
+			if portForwardsConflict(prev, pf) {
+				return fmt.Errorf("%w: %s and %s", ErrPortForwardConflict, prev, pf)
+			}
+		}
+	}
+	return nil
+}
+
+func validatePortForward(pf PortForward) error {
+	switch pf.Protocol {
+	case "", PortProtocolTCP, PortProtocolUDP:
+	default:
+		return fmt.Errorf("%w: %s has unknown protocol %q", ErrInvalidPortForward, pf, pf.Protocol)
+	}
+	if pf.HostIP != "" && net.ParseIP(pf.HostIP) == nil {
+		return fmt.Errorf("%w: %s has invalid host IP", ErrInvalidPortForward, pf)
+	}
+	if !validPort(pf.HostPort) || !validPort(pf.GuestPort) {
+		return fmt.Errorf("%w: %s has a port outside 1-65535", ErrInvalidPortForward, pf)
+	}
+	if pf.HostPortEnd != 0 && (!validPort(pf.HostPortEnd) || pf.HostPortEnd < pf.HostPort) {
+		return fmt.Errorf("%w: %s has host port range end %d", ErrInvalidPortForward, pf, pf.HostPortEnd)
+	}
+	if pf.GuestPortEnd != 0 {
+		if pf.HostPortEnd == 0 {
+			return fmt.Errorf("%w: %s has a guest port range but no host port range", ErrInvalidPortForward, pf)
+		}
+		if pf.GuestPortEnd-pf.GuestPort != pf.HostPortEnd-pf.HostPort {
+			return fmt.Errorf("%w: %s has host and guest port ranges of different lengths", ErrInvalidPortForward, pf)
+		}
+	}
+	if _, last := pf.GuestPorts(); !validPort(last) {
+		return fmt.Errorf("%w: %s has a port outside 1-65535", ErrInvalidPortForward, pf)
+	}
+	return nil
+}
+
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
+
+// portForwardsConflict reports whether a and b would bind a host port in
+// common for the same protocol on a shared address. A forward without a
+// host IP, or with an unspecified one, binds every address.
+func portForwardsConflict(a, b PortForward) bool {
+	a, b = a.normalized(), b.normalized()
+	if a.Protocol != b.Protocol {
+		return false
+	}
+	aFirst, aLast := a.HostPorts()
+	bFirst, bLast := b.HostPorts()
+	if aFirst > bLast || bFirst > aLast {
+		return false
+	}
+	ipA, ipB := net.ParseIP(a.HostIP), net.ParseIP(b.HostIP)
+	if ipA == nil || ipB == nil || ipA.IsUnspecified() || ipB.IsUnspecified() {
+		return true
+	}
+	return ipA.Equal(ipB)
+}
@@ -0,0 +1,104 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Metadata keys used to tell the runtime how to reach a VM's guest agent.
+const (
+	MetadataAgentUnix      = "agent.unix"
+	MetadataAgentVsockCID  = "agent.vsock.cid"
+	MetadataAgentVsockPort = "agent.vsock.port"
+	// MetadataAgentEndpoint holds "unix:///path", "vsock://cid:port" or
+	// "service://name"; service names are looked up with the agent resolver.
+	MetadataAgentEndpoint = "agent.endpoint"
+)
+
+// DefaultAgentVsockPort is the port agentd is expected to listen on inside
+// guests whose vsock endpoint is allocated by the runtime.
+const DefaultAgentVsockPort = 1024
+
+// firstGuestCID is the lowest CID usable by a guest; 0-2 are reserved for
+// the hypervisor, local loopback and the host.
+const firstGuestCID = 3
+
+// vsockAllocator hands out unique guest CIDs for runtimes whose hypervisor
+// expects the host to choose them.
+type vsockAllocator struct {
+	mu    sync.Mutex
+	inUse map[uint32]string // CID -> VM ID
+	next  uint32
+}
+
+func newVsockAllocator() *vsockAllocator {
+	return &vsockAllocator{inUse: make(map[uint32]string), next: firstGuestCID}
+}
+
+// assign fills in the agent vsock metadata for cfg. A CID already present in
+// the metadata is reserved as-is; otherwise the next free CID is allocated.
+// VMs that reach their agent another way (unix socket, explicit endpoint or
+// dev loopback) are left untouched.
+func (a *vsockAllocator) assign(cfg *VMConfig) error {
+	if cfg.DevMode || cfg.Metadata[MetadataAgentUnix] != "" || cfg.Metadata[MetadataAgentEndpoint] != "" {
+		return nil
+	}
+	if cfg.Metadata == nil {
+		cfg.Metadata = make(map[string]string, 2)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var cid uint32
+	if raw := cfg.Metadata[MetadataAgentVsockCID]; raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 32)
+		if err != nil || parsed < firstGuestCID {
+			return fmt.Errorf("invalid vsock cid %q", raw)
+		}
+		cid = uint32(parsed)
+		if owner, taken := a.inUse[cid]; taken {
+			return fmt.Errorf("vsock cid %d already in use by vm %s", cid, owner)
+		}
+	} else {
+		cid = a.nextFreeLocked()
+		if cid == 0 {
+			return fmt.Errorf("no free vsock cid")
+		}
+		cfg.Metadata[MetadataAgentVsockCID] = strconv.FormatUint(uint64(cid), 10)
+	}
+	if cfg.Metadata[MetadataAgentVsockPort] == "" {
+		cfg.Metadata[MetadataAgentVsockPort] = strconv.Itoa(DefaultAgentVsockPort)
+	}
+	a.inUse[cid] = cfg.ID
+	return nil
+}
+
+func (a *vsockAllocator) nextFreeLocked() uint32 {
+	for i := uint32(0); i < ^uint32(0)-firstGuestCID; i++ {
+		cid := a.next
+		a.next++
+		if a.next < firstGuestCID || a.next == ^uint32(0) {
+			a.next = firstGuestCID
+		}
+		if _, taken := a.inUse[cid]; !taken {
+			return cid
+		}
+	}
+	return 0
+}
+
+// release frees the CID recorded in cfg's metadata, if it was allocated to
+// that VM.
+func (a *vsockAllocator) release(cfg *VMConfig) {
+	parsed, err := strconv.ParseUint(cfg.Metadata[MetadataAgentVsockCID], 10, 32)
+	if err != nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.inUse[uint32(parsed)] == cfg.ID {
+		delete(a.inUse, uint32(parsed))
+	}
+}
@@ -0,0 +1,99 @@
+package runtime
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// assignTestCID allocates a CID for a VM with id and returns it.
+func assignTestCID(t *testing.T, a *vsockAllocator, id string) string {
+	t.Helper()
+	cfg := &VMConfig{ID: id}
+	if err := a.assign(cfg); err != nil {
+		t.Fatalf("assign %s: %v", id, err)
+	}
+	if port := cfg.Metadata[MetadataAgentVsockPort]; port != fmt.Sprint(DefaultAgentVsockPort) {
+		t.Errorf("port of %s = %q, want %d", id, port, DefaultAgentVsockPort)
+	}
+	return cfg.Metadata[MetadataAgentVsockCID]
+}
+
+func TestVsockAllocatorUniqueCIDs(t *testing.T) {
+	a := newVsockAllocator()
+	const n = 64
+	cids := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg := &VMConfig{ID: fmt.Sprintf("vm%d", i)}
+			if err := a.assign(cfg); err != nil {
+				t.Errorf("assign: %v", err)
+			}
+			cids[i] = cfg.Metadata[MetadataAgentVsockCID]
+		}()
+	}
+	wg.Wait()
+	seen := make(map[string]bool)
+	for _, cid := range cids {
+		if cid == "" || cid == "0" || cid == "1" || cid == "2" || seen[cid] {
+			t.Errorf("CID %q reserved or handed out twice", cid)
+		}
+		seen[cid] = true
+	}
+
+	// VMs reaching their agent another way get no CID.
+	for _, cfg := range []*VMConfig{
+		{ID: "dev", DevMode: true},
+		{ID: "unix", Metadata: map[string]string{MetadataAgentUnix: "/run/agent.sock"}},
+		{ID: "endpoint", Metadata: map[string]string{MetadataAgentEndpoint: "service://agent"}},
+	} {
+		if err := a.assign(cfg); err != nil || cfg.Metadata[MetadataAgentVsockCID] != "" {
+			t.Errorf("assign(%s) = %v, cid %q, want none", cfg.ID, err, cfg.Metadata[MetadataAgentVsockCID])
+		}
+	}
+}
+
+func TestVsockAllocatorReusesReleasedCIDs(t *testing.T) {
+	a := newVsockAllocator()
+	first := assignTestCID(t, a, "a")
+	second := assignTestCID(t, a, "b")
+	if first != "3" || second != "4" {
+		t.Fatalf("first CIDs = %s, %s, want 3, 4", first, second)
+	}
+
+	explicit := func(id, cid string) error {
+		return a.assign(&VMConfig{ID: id, Metadata: map[string]string{MetadataAgentVsockCID: cid}})
+	}
+	if err := explicit("c", second); err == nil {
+		t.Errorf("CID %s reserved twice", second)
+	}
+	if err := explicit("c", "2"); err == nil {
+		t.Error("the host's CID was reserved for a guest")
+	}
+	// Only the VM holding a CID releases it.
+	a.release(&VMConfig{ID: "c", Metadata: map[string]string{MetadataAgentVsockCID: second}})
+	if err := explicit("c", second); err == nil {
+		t.Errorf("CID %s freed by a VM that did not hold it", second)
+	}
+	a.release(&VMConfig{ID: "b", Metadata: map[string]string{MetadataAgentVsockCID: second}})
+	if err := explicit("c", second); err != nil {
+		t.Errorf("released CID %s: %v", second, err)
+	}
+
+	// Allocation wraps around and picks up released CIDs, skipping taken
+	// ones.
+	a.release(&VMConfig{ID: "a", Metadata: map[string]string{MetadataAgentVsockCID: first}})
+	a.next = ^uint32(0) - 1
+	if cid := assignTestCID(t, a, "d"); cid != fmt.Sprint(^uint32(0)-1) {
+		t.Errorf("CID before wrapping = %s, want %d", cid, ^uint32(0)-1)
+	}
+	if cid := assignTestCID(t, a, "e"); cid != first {
+		t.Errorf("CID after wrapping = %s, want the released %s", cid, first)
+	}
+	if cid := assignTestCID(t, a, "f"); cid != "5" {
+		t.Errorf("next CID = %s, want 5 as %s is taken", cid, second)
+	}
+}
@@ -0,0 +1,125 @@
+package isolate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SandboxSetMetadataKey tags a container's metadata with the ID of the
+// sandbox set it belongs to.
+const SandboxSetMetadataKey = "isolate.set"
+
+// SandboxSet groups related containers (for example a build environment and
+// the services it talks to) so they can be created, started, stopped and
+// deleted together. Bulk operations are best-effort: every member is
+// attempted and failures are aggregated into a single error.
+type SandboxSet struct {
+	id      string
+	manager *Manager
+
+	mu      sync.Mutex
+	members []string
+}
+
+// NewSandboxSet returns an empty set whose members will be tagged with id.
+func (m *Manager) NewSandboxSet(id string) *SandboxSet {
+	return &SandboxSet{id: id, manager: m}
+}
+
+// ID returns the set identifier.
+func (s *SandboxSet) ID() string { return s.id }
+
+// Members returns the names of the containers in the set.
+func (s *SandboxSet) Members() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.members...)
+}
+
+// Create provisions one container per config. If any member fails to create,
+// the members created by this call are deleted again and the combined error
+// is returned.
+func (s *SandboxSet) Create(ctx context.Context, cfgs ...*Config) error {
+	created := make([]string, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg == nil {
+			return s.rollback(ctx, created, fmt.Errorf("config is required"))
+		}
+		member := *cfg
+		member.Metadata = make(map[string]string, len(cfg.Metadata)+1)
+		for k, v := range cfg.Metadata {
+			member.Metadata[k] = v
+		}
+		member.Metadata[SandboxSetMetadataKey] = s.id
+
+		if _, err := s.manager.CreateContainer(ctx, &member); err != nil {
+			return s.rollback(ctx, created, fmt.Errorf("create %s: %w", member.Name, err))
+		}
+		created = append(created, member.Name)
+	}
+
+	s.mu.Lock()
+	s.members = append(s.members, created...)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *SandboxSet) rollback(ctx context.Context, created []string, cause error) error {
+	errs := []error{cause}
+	for _, name := range created {
+		if err := s.manager.DeleteContainer(ctx, name); err != nil {
+			errs = append(errs, fmt.Errorf("rollback %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// StartAll starts every member of the set.
+func (s *SandboxSet) StartAll(ctx context.Context) error {
+	return s.each(func(name string, c Container) error {
+		return c.Start(ctx)
+	})
+}
+
+// StopAll stops every member of the set, giving each the provided timeout.
+func (s *SandboxSet) StopAll(ctx context.Context, timeout time.Duration) error {
+	return s.each(func(name string, c Container) error {
+		return c.Stop(ctx, timeout)
+	})
+}
+
+// DeleteAll deletes every member of the set. Members that were deleted
+// successfully are removed from the set even when others fail.
+func (s *SandboxSet) DeleteAll(ctx context.Context) error {
+	var errs []error
+	remaining := make([]string, 0)
+	for _, name := range s.Members() {
+		if err := s.manager.DeleteContainer(ctx, name); err != nil && !errors.Is(err, ErrContainerNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			remaining = append(remaining, name)
+		}
+	}
+
+	s.mu.Lock()
+	s.members = remaining
+	s.mu.Unlock()
+	return errors.Join(errs...)
+}
+
+func (s *SandboxSet) each(fn func(name string, c Container) error) error {
+	var errs []error
+	for _, name := range s.Members() {
+		c, ok := s.manager.GetContainer(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: %w", name, ErrContainerNotFound))
+			continue
+		}
+		if err := fn(name, c); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,79 @@
+package isolate
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+func TestSandboxSetLifecycle(t *testing.T) {
+	m := newTestManager(t)
+	ctx := context.Background()
+	set := m.NewSandboxSet("build-42")
+	if err := set.Create(ctx, &Config{Name: "env"}, &Config{Name: "db"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if got := set.Members(); !slices.Equal(got, []string{"env", "db"}) {
+		t.Errorf("Members() = %q, want env, db", got)
+	}
+
+	if err := set.StartAll(ctx); err != nil {
+		t.Fatalf("StartAll: %v", err)
+	}
+	for _, name := range set.Members() {
+		c, _ := m.GetContainer(name)
+		status, err := c.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.SetID != "build-42" || status.State != runtimectl.VMStateRunning {
+			t.Errorf("%s: set %q, state %s, want build-42, running", name, status.SetID, status.State)
+		}
+	}
+	if err := set.StopAll(ctx, time.Second); err != nil {
+		t.Fatalf("StopAll: %v", err)
+	}
+	if err := set.DeleteAll(ctx); err != nil {
+		t.Fatalf("DeleteAll: %v", err)
+	}
+	if got := set.Members(); len(got) != 0 {
+		t.Errorf("Members() = %q after DeleteAll, want none", got)
+	}
+	for _, name := range []string{"env", "db"} {
+		if _, ok := m.GetContainer(name); ok {
+			t.Errorf("DeleteAll left %s", name)
+		}
+	}
+}
+
+func TestSandboxSetCreateRollsBack(t *testing.T) {
+	m := newTestManager(t)
+	ctx := context.Background()
+	// A container outside the set takes the name of the set's second
+	// member, so creating that member fails.
+	if _, err := m.CreateContainer(ctx, &Config{Name: "db"}); err != nil {
+		t.Fatal(err)
+	}
+
+	set := m.NewSandboxSet("build-43")
+	err := set.Create(ctx, &Config{Name: "env"}, &Config{Name: "db"}, &Config{Name: "cache"})
+	if !errors.Is(err, ErrContainerExists) {
+		t.Fatalf("Create = %v, want %v", err, ErrContainerExists)
+	}
+	if _, ok := m.GetContainer("env"); ok {
+		t.Error("the member created before the failure was not rolled back")
+	}
+	if _, ok := m.GetContainer("cache"); ok {
+		t.Error("a member after the failure was created")
+	}
+	if _, ok := m.GetContainer("db"); !ok {
+		t.Error("rollback deleted a container outside the set")
+	}
+	if got := set.Members(); len(got) != 0 {
+		t.Errorf("Members() = %q after a failed Create, want none", got)
+	}
+}
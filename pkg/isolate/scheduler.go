@@ -0,0 +1,138 @@
+package isolate
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultPriorityAging is how long a queued exec waits before its effective
+// priority is bumped by one level.
+const defaultPriorityAging = time.Second
+
+// execScheduler bounds the number of concurrent execs and dispatches queued
+// requests by priority. Waiting requests age so low priority work is never
+// starved indefinitely.
+type execScheduler struct {
+	mu       sync.Mutex
+	limit    int
+	aging    time.Duration
+	inFlight int
+	seq      uint64
+	queue    []*execWaiter
+}
+
+type execWaiter struct {
+	priority int
+	enqueued time.Time
+	seq      uint64
+	ready    chan struct{}
+}
+
+func newExecScheduler() *execScheduler {
+	return &execScheduler{aging: defaultPriorityAging}
+}
+
+// setLimit updates the concurrency limit. A limit <= 0 disables scheduling.
+func (s *execScheduler) setLimit(limit int, aging time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = limit
+	if aging > 0 {
+		s.aging = aging
+	}
+	s.dispatchLocked()
+}
+
+// acquire blocks until a slot is available for a request with the given
+// priority. The returned release func must be called exactly once.
+func (s *execScheduler) acquire(ctx context.Context, priority int) (func(), error) {
+	s.mu.Lock()
+	if s.limit <= 0 || (s.inFlight < s.limit && len(s.queue) == 0) {
+		s.inFlight++
+		s.mu.Unlock()
+		return s.releaseFunc(), nil
+	}
+
+	s.seq++
+	w := &execWaiter{
+		priority: priority,
+		enqueued: time.Now(),
+		seq:      s.seq,
+		ready:    make(chan struct{}),
+	}
+	s.queue = append(s.queue, w)
+	s.dispatchLocked()
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return s.releaseFunc(), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		select {
+		case <-w.ready:
+			// Dispatched concurrently with cancellation; hand the slot back.
+			s.inFlight--
+			s.dispatchLocked()
+		default:
+			s.removeLocked(w)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *execScheduler) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.inFlight--
+			s.dispatchLocked()
+		})
+	}
+}
+
+// dispatchLocked hands free slots to the waiters with the highest effective
+// priority, breaking ties in arrival order.
+func (s *execScheduler) dispatchLocked() {
+	for len(s.queue) > 0 && (s.limit <= 0 || s.inFlight < s.limit) {
+		now := time.Now()
+		best := 0
+		for i := 1; i < len(s.queue); i++ {
+			if s.before(s.queue[i], s.queue[best], now) {
+				best = i
+			}
+		}
+		w := s.queue[best]
+		s.queue = append(s.queue[:best], s.queue[best+1:]...)
+		s.inFlight++
+		close(w.ready)
+	}
+}
+
+func (s *execScheduler) before(a, b *execWaiter, now time.Time) bool {
+	pa, pb := s.effectivePriority(a, now), s.effectivePriority(b, now)
+	if pa != pb {
+		return pa > pb
+	}
+	return a.seq < b.seq
+}
+
+func (s *execScheduler) effectivePriority(w *execWaiter, now time.Time) int {
+	if s.aging <= 0 {
+		return w.priority
+	}
+	return w.priority + int(now.Sub(w.enqueued)/s.aging)
+}
+
+func (s *execScheduler) removeLocked(w *execWaiter) {
+	for i, queued := range s.queue {
+		if queued == w {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package isolate
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// queueExecs holds the only slot of a depth-1 scheduler, queues an exec for
+// each priority in turn, optionally pausing between them, then frees the
+// slot and returns the order in which the execs were dispatched, as indexes
+// into priorities.
+func queueExecs(t *testing.T, s *execScheduler, priorities []int, pause time.Duration) []int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s.setLimit(1, 0)
+	hold, err := s.acquire(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i, priority := range priorities {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.acquire(ctx, priority)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			release()
+		}()
+		waitQueued(t, s, i+1)
+		time.Sleep(pause)
+	}
+	hold()
+	wg.Wait()
+	return order
+}
+
+// waitQueued waits until n execs are queued on s.
+func waitQueued(t *testing.T, s *execScheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		queued := len(s.queue)
+		s.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d execs queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerDispatchesByPriority(t *testing.T) {
+	s := newExecScheduler()
+	s.aging = time.Hour
+	order := queueExecs(t, s, []int{0, 5, 1, 5, -1}, 0)
+	// Higher priorities first; equal ones in arrival order.
+	want := []int{1, 3, 2, 0, 4}
+	if !slices.Equal(order, want) {
+		t.Errorf("dispatch order = %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerAgesWaitingExecs(t *testing.T) {
+	s := newExecScheduler()
+	s.aging = 20 * time.Millisecond
+	// The first exec waits long enough to gain well over the two levels
+	// the second starts ahead by.
+	order := queueExecs(t, s, []int{0, 2}, 200*time.Millisecond)
+	want := []int{0, 1}
+	if !slices.Equal(order, want) {
+		t.Errorf("dispatch order = %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerCancelledWaiterLeavesQueue(t *testing.T) {
+	s := newExecScheduler()
+	s.setLimit(1, 0)
+	hold, err := s.acquire(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.acquire(ctx, 0)
+		done <- err
+	}()
+	waitQueued(t, s, 1)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("acquire = %v, want %v", err, context.Canceled)
+	}
+	waitQueued(t, s, 0)
+	hold()
+	if s.inFlight != 0 {
+		t.Errorf("%d slots in use after release, want 0", s.inFlight)
+	}
+}
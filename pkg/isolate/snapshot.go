@@ -0,0 +1,86 @@
+package isolate
+
+import (
+	"context"
+	"fmt"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+func (c *containerImpl) Snapshot(ctx context.Context, dst string) error {
+	vm, err := c.vmFor(runtimectl.VMOpSnapshot)
+	if err != nil {
+		return err
+	}
+	return vm.Snapshot(ctx, dst)
+}
+
+// restore is Create for a container restored from a snapshot.
+func (c *containerImpl) restore(ctx context.Context, cfg *Config, snapshotPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	vm, err := c.runtime.RestoreVM(ctx, toVMConfig(cfg), snapshotPath)
+	if err != nil {
+		return fmt.Errorf("restore vm: %w", err)
+	}
+	c.cfg = cfg
+	c.vm = vm
+	c.deleted = false
+	return nil
+}
+
+// CreateFromSnapshot creates a running container from a snapshot taken with
+// Container.Snapshot under the same runtime, for fast starts of many clones.
+// The snapshot fixes the image, CPUs, memory and disk size, which are
+// written into cfg before admission; the rest of cfg applies as for
+// CreateContainer, and cfg may be nil. Interface addresses and MACs cfg
+// leaves unset are assigned afresh, so clones of one snapshot never share
+// them. The transition hook sees the container go from stopped to running.
+func (m *Manager) CreateFromSnapshot(ctx context.Context, cfg *Config, snapshotPath string) (Container, error) {
+	saved, err := runtimectl.SnapshotConfig(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	cfg.Image = saved.ImagePath
+	cfg.CPUs = saved.CPUs
+	cfg.Memory = saved.MemoryBytes
+	cfg.DiskSize = saved.DiskSize
+
+	release, err := m.admission.admit(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if cfg.Name == "" {
+		cfg.Name = m.generateNameLocked(defaultNamePrefix)
+	}
+	if _, exists := m.containers[cfg.Name]; exists {
+		m.mu.Unlock()
+		release()
+		return nil, ErrContainerExists
+	}
+
+	c := m.newContainer(cfg)
+	c.releaseCapacity = release
+	if err := c.restore(ctx, cfg, snapshotPath); err != nil {
+		m.mu.Unlock()
+		release()
+		return nil, err
+	}
+	if err := m.saveState(c); err != nil {
+		m.mu.Unlock()
+		c.vm.Delete(ctx)
+		release()
+		return nil, err
+	}
+	m.containers[cfg.Name] = c
+	m.mu.Unlock()
+
+	m.publish(cfg.Name, EventCreated)
+	c.transitioned(runtimectl.VMStateStopped, runtimectl.VMStateRunning)
+	return c, nil
+}
@@ -0,0 +1,282 @@
+package isolate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// Spec is a declarative, Docker-style description of a container. It can be
+// decoded from JSON with ParseSpec, or from YAML with any decoder honouring
+// the yaml struct tags, and converted into a Config with ToConfig.
+type Spec struct {
+	Name       string            `json:"name" yaml:"name"`
+	Image      string            `json:"image" yaml:"image"`
+	Entrypoint []string          `json:"entrypoint,omitempty" yaml:"entrypoint,omitempty"`
+	Cmd        []string          `json:"cmd,omitempty" yaml:"cmd,omitempty"`
+	Env        []string          `json:"env,omitempty" yaml:"env,omitempty"`         // KEY=VALUE
+	Volumes    []string          `json:"volumes,omitempty" yaml:"volumes,omitempty"` // host:guest[:ro|rw]
+	Ports      []string          `json:"ports,omitempty" yaml:"ports,omitempty"`     // [hostIP:]hostPort[-end]:guestPort[-end][/proto]
+	Network    NetworkMode       `json:"network,omitempty" yaml:"network,omitempty"`
+	WorkingDir string            `json:"working_dir,omitempty" yaml:"working_dir,omitempty"`
+	Resources  SpecResources     `json:"resources,omitempty" yaml:"resources,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// SpecResources expresses resource limits with human-readable sizes such as
+// "512m" or "2GiB".
+type SpecResources struct {
+	CPUs   int    `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Disk   string `json:"disk,omitempty" yaml:"disk,omitempty"`
+}
+
+// ParseSpec decodes a JSON spec. Unknown fields are rejected so typos do not
+// silently drop configuration.
+func ParseSpec(data []byte) (*Spec, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var spec Spec
+	if err := dec.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	return &spec, nil
+}
+
+// ToConfig validates the spec and maps it onto a Config. Publishing ports
+// selects NAT networking unless a network mode is given explicitly.
+func (s *Spec) ToConfig() (*Config, error) {
+	if s.Name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidSpec)
+	}
+	if s.Resources.CPUs < 0 {
+		return nil, fmt.Errorf("%w: cpus must not be negative", ErrInvalidSpec)
+	}
+
+	env, err := parseSpecEnv(s.Env)
+	if err != nil {
+		return nil, err
+	}
+	memory, err := parseByteSize(s.Resources.Memory)
+	if err != nil {
+		return nil, fmt.Errorf("%w: memory: %v", ErrInvalidSpec, err)
+	}
+	disk, err := parseByteSize(s.Resources.Disk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: disk: %v", ErrInvalidSpec, err)
+	}
+
+	cfg := &Config{
+		Name:        s.Name,
+		Image:       s.Image,
+		CPUs:        s.Resources.CPUs,
+		Memory:      memory,
+		DiskSize:    disk,
+		NetworkMode: s.Network,
+		Environment: env,
+		WorkingDir:  s.WorkingDir,
+	}
+	if len(s.Labels) > 0 {
+		cfg.Metadata = make(map[string]string, len(s.Labels))
+		for k, v := range s.Labels {
+			cfg.Metadata[k] = v
+		}
+	}
+
+	for _, volume := range s.Volumes {
+		mount, err := parseVolume(volume)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Mounts = append(cfg.Mounts, mount)
+	}
+
+	if len(s.Ports) > 0 {
+		forwards := make([]PortForward, 0, len(s.Ports))
+		for _, port := range s.Ports {
+			forward, err := parsePort(port)
+			if err != nil {
+				return nil, err
+			}
+			forwards = append(forwards, forward)
+		}
+		if cfg.NetworkMode == "" {
+			cfg.NetworkMode = runtimectl.NetworkModeNAT
+		}
+		cfg.Network = &NetworkConfig{Mode: cfg.NetworkMode, PortForwards: forwards}
+	}
+
+	return cfg, nil
+}
+
+// Command returns the spec's default command (entrypoint followed by cmd), or
+// nil when neither is set.
+func (s *Spec) Command() *Command {
+	argv := append(append([]string(nil), s.Entrypoint...), s.Cmd...)
+	if len(argv) == 0 {
+		return nil
+	}
+	env, _ := parseSpecEnv(s.Env)
+	return &Command{
+		Path:       argv[0],
+		Args:       argv[1:],
+		Env:        env,
+		WorkingDir: s.WorkingDir,
+	}
+}
+
+func parseSpecEnv(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	env := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: env %q must be KEY=VALUE", ErrInvalidSpec, entry)
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// parseVolume parses "host:guest[:ro|rw]". An absolute (or ./-relative) host
+// part is a bind mount; anything else names a runtime-managed volume.
+func parseVolume(volume string) (Mount, error) {
+	parts := strings.Split(volume, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return Mount{}, fmt.Errorf("%w: volume %q must be host:guest[:ro|rw]", ErrInvalidSpec, volume)
+	}
+	mount := Mount{Source: parts[0], Target: parts[1], Type: runtimectl.MountTypeBind}
+	if mount.Source == "" || mount.Target == "" {
+		return Mount{}, fmt.Errorf("%w: volume %q has an empty path", ErrInvalidSpec, volume)
+	}
+	if !filepath.IsAbs(mount.Target) {
+		return Mount{}, fmt.Errorf("%w: volume %q guest path must be absolute", ErrInvalidSpec, volume)
+	}
+	if !filepath.IsAbs(mount.Source) && !strings.HasPrefix(mount.Source, ".") {
+		mount.Type = runtimectl.MountTypeVolume
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			mount.ReadOnly = true
+		case "rw":
+		default:
+			return Mount{}, fmt.Errorf("%w: volume %q has unknown mode %q", ErrInvalidSpec, volume, parts[2])
+		}
+	}
+	return mount, nil
+}
+
+// parsePort parses "[hostIP:]hostPort:guestPort[/proto]" or a bare
+// "port[/proto]", which publishes the same port on host and guest. Either
+// port may be a "first-last" range, as in "8000-8010:9000-9010/udp".
+func parsePort(spec string) (PortForward, error) {
+	invalid := func(reason string) (PortForward, error) {
+		return PortForward{}, fmt.Errorf("%w: port %q %s", ErrInvalidSpec, spec, reason)
+	}
+
+	forward := PortForward{Protocol: runtimectl.PortProtocolTCP}
+	mapping, proto, hasProto := strings.Cut(spec, "/")
+	if hasProto {
+		switch runtimectl.PortProtocol(strings.ToLower(proto)) {
+		case runtimectl.PortProtocolTCP:
+		case runtimectl.PortProtocolUDP:
+			forward.Protocol = runtimectl.PortProtocolUDP
+		default:
+			return invalid("has unknown protocol " + strconv.Quote(proto))
+		}
+	}
+
+	var hostPart, guestPart string
+	if i := strings.LastIndex(mapping, ":"); i >= 0 {
+		hostPart, guestPart = mapping[:i], mapping[i+1:]
+		if j := strings.LastIndex(hostPart, ":"); j >= 0 {
+			forward.HostIP = strings.Trim(hostPart[:j], "[]")
+			hostPart = hostPart[j+1:]
+			if net.ParseIP(forward.HostIP) == nil {
+				return invalid("has invalid host IP")
+			}
+		}
+	} else {
+		hostPart, guestPart = mapping, mapping
+	}
+
+	var err error
+	if forward.HostPort, forward.HostPortEnd, err = parsePortRange(hostPart); err != nil {
+		return invalid("host port " + err.Error())
+	}
+	if forward.GuestPort, forward.GuestPortEnd, err = parsePortRange(guestPart); err != nil {
+		return invalid("guest port " + err.Error())
+	}
+	if forward.GuestPortEnd != 0 && forward.HostPortEnd == 0 {
+		return invalid("maps a guest port range to a single host port")
+	}
+	if forward.GuestPortEnd != 0 && forward.GuestPortEnd-forward.GuestPort != forward.HostPortEnd-forward.HostPort {
+		return invalid("has host and guest ranges of different lengths")
+	}
+	return forward, nil
+}
+
+// parsePortRange parses a port or a "first-last" range. end is zero for a
+// single port.
+func parsePortRange(s string) (first, end int, err error) {
+	firstPart, lastPart, isRange := strings.Cut(s, "-")
+	if first, err = parsePortNumber(firstPart); err != nil || !isRange {
+		return first, 0, err
+	}
+	if end, err = parsePortNumber(lastPart); err != nil {
+		return 0, 0, err
+	}
+	if end < first {
+		return 0, 0, fmt.Errorf("range %q ends before it starts", s)
+	}
+	return first, end, nil
+}
+
+func parsePortNumber(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("must be between 1 and 65535")
+	}
+	return n, nil
+}
+
+// parseByteSize parses sizes such as "512m", "2G" or "1GiB" using binary
+// multiples. An empty string is zero.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	lower := strings.ToLower(s)
+	lower = strings.TrimSuffix(strings.TrimSuffix(lower, "b"), "i")
+	multiplier := int64(1)
+	if n := len(lower); n > 0 {
+		switch lower[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		case 't':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			lower = lower[:n-1]
+		}
+	}
+	value, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,103 @@
+package isolate
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+const testSpecJSON = `{
+	"name": "web",
+	"image": "alpine:3.20",
+	"entrypoint": ["/bin/sh", "-c"],
+	"cmd": ["exec httpd -f"],
+	"env": ["MODE=prod", "EMPTY="],
+	"volumes": ["/srv/data:/data:ro", "cache:/var/cache"],
+	"ports": ["8080:80", "127.0.0.1:5353:53/udp", "9000-9002:7000-7002"],
+	"working_dir": "/srv",
+	"resources": {"cpus": 2, "memory": "512m", "disk": "1GiB"},
+	"labels": {"team": "edge"}
+}`
+
+func TestSpecToConfig(t *testing.T) {
+	spec, err := ParseSpec([]byte(testSpecJSON))
+	if err != nil {
+		t.Fatalf("ParseSpec: %v", err)
+	}
+	cfg, err := spec.ToConfig()
+	if err != nil {
+		t.Fatalf("ToConfig: %v", err)
+	}
+
+	want := &Config{
+		Name:        "web",
+		Image:       "alpine:3.20",
+		CPUs:        2,
+		Memory:      512 << 20,
+		DiskSize:    1 << 30,
+		NetworkMode: runtimectl.NetworkModeNAT,
+		Environment: map[string]string{"MODE": "prod", "EMPTY": ""},
+		WorkingDir:  "/srv",
+		Metadata:    map[string]string{"team": "edge"},
+		Mounts: []Mount{
+			{Source: "/srv/data", Target: "/data", Type: runtimectl.MountTypeBind, ReadOnly: true},
+			{Source: "cache", Target: "/var/cache", Type: runtimectl.MountTypeVolume},
+		},
+		Network: &NetworkConfig{
+			Mode: runtimectl.NetworkModeNAT,
+			PortForwards: []PortForward{
+				{Protocol: PortProtocolTCP, HostPort: 8080, GuestPort: 80},
+				{Protocol: PortProtocolUDP, HostIP: "127.0.0.1", HostPort: 5353, GuestPort: 53},
+				{Protocol: PortProtocolTCP, HostPort: 9000, HostPortEnd: 9002, GuestPort: 7000, GuestPortEnd: 7002},
+			},
+		},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("ToConfig =\n%+v\nwant\n%+v", cfg, want)
+	}
+	cmd := spec.Command()
+	if cmd == nil || cmd.Path != "/bin/sh" || !reflect.DeepEqual(cmd.Args, []string{"-c", "exec httpd -f"}) || cmd.WorkingDir != "/srv" {
+		t.Errorf("Command = %+v", cmd)
+	}
+
+	// The spec survives encoding and decoding unchanged, and so does the
+	// Config it produces.
+	data, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseSpec(data)
+	if err != nil {
+		t.Fatalf("ParseSpec of the encoded spec: %v", err)
+	}
+	if !reflect.DeepEqual(again, spec) {
+		t.Errorf("spec after a round trip =\n%+v\nwant\n%+v", again, spec)
+	}
+	if cfg2, err := again.ToConfig(); err != nil || !reflect.DeepEqual(cfg2, cfg) {
+		t.Errorf("ToConfig after a round trip = %+v, %v", cfg2, err)
+	}
+}
+
+func TestSpecToConfigRejectsInvalidSpecs(t *testing.T) {
+	for _, spec := range []Spec{
+		{},
+		{Name: "x", Env: []string{"NOVALUE"}},
+		{Name: "x", Volumes: []string{"/a:relative"}},
+		{Name: "x", Volumes: []string{"/a:/b:rx"}},
+		{Name: "x", Ports: []string{"70000:80"}},
+		{Name: "x", Ports: []string{"80:8000-8001"}},
+		{Name: "x", Ports: []string{"80/sctp"}},
+		{Name: "x", Resources: SpecResources{Memory: "lots"}},
+		{Name: "x", Resources: SpecResources{CPUs: -1}},
+	} {
+		if _, err := spec.ToConfig(); !errors.Is(err, ErrInvalidSpec) {
+			t.Errorf("ToConfig(%+v) = %v, want %v", spec, err, ErrInvalidSpec)
+		}
+	}
+	if _, err := ParseSpec([]byte(`{"name": "x", "imgae": "typo"}`)); !errors.Is(err, ErrInvalidSpec) {
+		t.Errorf("ParseSpec with an unknown field = %v, want %v", err, ErrInvalidSpec)
+	}
+}
@@ -0,0 +1,200 @@
+package isolate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/oarkflow/container/pkg/isolate/agent"
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// stateRecord is the file a manager with a state directory keeps for each
+// of its containers.
+type stateRecord struct {
+	Name   string  `json:"name"`
+	VMID   string  `json:"vm_id"`
+	Config *Config `json:"config"`
+}
+
+// NewManagerWithState is NewManager for a manager that records the config
+// and VM ID of each container it creates in a JSON file in dir, creating
+// dir if needed, and removes the file when the container is deleted. A
+// manager started later on the same directory picks the containers up again
+// with Reload.
+func NewManagerWithState(rt runtimectl.Runtime, dir string) (*Manager, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("state directory is required")
+	}
+	m, err := NewManager(rt)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create state directory: %w", err)
+	}
+	m.stateDir = dir
+	return m, nil
+}
+
+// Reload adds the containers recorded in the state directory that the
+// manager does not hold yet, reconnecting each to its VM through the
+// runtime's GetVM. A container whose VM the runtime no longer has is added
+// in the failed state, so it can still be inspected and deleted. Records
+// that cannot be read are skipped and reported in the returned error.
+// Reloaded containers reserve capacity like admitted ones but are never
+// refused for lack of it.
+func (m *Manager) Reload(ctx context.Context) error {
+	if m.stateDir == "" {
+		return fmt.Errorf("manager has no state directory")
+	}
+	paths, err := filepath.Glob(filepath.Join(m.stateDir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var errs []error
+	for _, path := range paths {
+		rec, err := readStateRecord(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, exists := m.containers[rec.Name]; exists {
+			continue
+		}
+		vm, err := m.runtime.GetVM(ctx, rec.VMID)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			vm = &lostVM{id: rec.VMID, cfg: toVMConfig(rec.Config), rt: m.runtime, err: err}
+		}
+
+		c := m.newContainer(rec.Config)
+		c.vm = vm
+		c.releaseCapacity = m.admission.reserve(rec.Config)
+		m.containers[rec.Name] = c
+	}
+	return errors.Join(errs...)
+}
+
+func readStateRecord(path string) (*stateRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	var rec stateRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("parse state %s: %w", filepath.Base(path), err)
+	}
+	if rec.Name == "" || rec.VMID == "" || rec.Config == nil {
+		return nil, fmt.Errorf("state %s is incomplete", filepath.Base(path))
+	}
+	rec.Config.Name = rec.Name
+	return &rec, nil
+}
+
+// statePath names the file for the container called name; names are
+// escaped so any of them makes a single file name.
+func (m *Manager) statePath(name string) string {
+	return filepath.Join(m.stateDir, url.PathEscape(name)+".json")
+}
+
+// saveState records c in the state directory, if the manager has one.
+func (m *Manager) saveState(c *containerImpl) error {
+	if m.stateDir == "" {
+		return nil
+	}
+	c.mu.RLock()
+	rec := stateRecord{Name: c.cfg.Name, VMID: c.vm.ID(), Config: c.cfg.Clone()}
+	c.mu.RUnlock()
+
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %w", err)
+	}
+	// Write a temporary file and rename it, so a crash never leaves a
+	// truncated record behind.
+	path := m.statePath(rec.Name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// removeState deletes the record of the container called name, if the
+// manager has a state directory.
+func (m *Manager) removeState(name string) error {
+	if m.stateDir == "" {
+		return nil
+	}
+	if err := os.Remove(m.statePath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove state: %w", err)
+	}
+	return nil
+}
+
+// lostVM stands in for the VM of a reloaded container that the runtime no
+// longer has. It stays failed until the container is deleted; deleting it
+// has a runtime that implements runtimectl.VMReclaimer release what the VM
+// left behind, and otherwise succeeds without touching the runtime.
+type lostVM struct {
+	id  string
+	cfg *runtimectl.VMConfig
+	rt  runtimectl.Runtime
+	err error // why GetVM failed
+}
+
+func (v *lostVM) gone() error {
+	return fmt.Errorf("vm %s is gone: %w", v.id, v.err)
+}
+
+func (v *lostVM) ID() string                       { return v.id }
+func (v *lostVM) Config() *runtimectl.VMConfig     { return v.cfg }
+func (v *lostVM) State() runtimectl.VMState        { return runtimectl.VMStateFailed }
+func (v *lostVM) Start(context.Context) error      { return v.gone() }
+func (v *lostVM) Stop(context.Context, bool) error { return v.gone() }
+func (v *lostVM) Pause(context.Context) error      { return v.gone() }
+func (v *lostVM) Resume(context.Context) error     { return v.gone() }
+
+func (v *lostVM) Delete(ctx context.Context) error {
+	if r, ok := v.rt.(runtimectl.VMReclaimer); ok {
+		return r.ReclaimVM(ctx, v.id)
+	}
+	return nil
+}
+
+func (v *lostVM) Execute(context.Context, *agent.CommandRequest) (*runtimectl.ExecResult, error) {
+	return nil, v.gone()
+}
+
+func (v *lostVM) ExecStream(context.Context, *agent.CommandRequest) (*agent.CommandStream, error) {
+	return nil, v.gone()
+}
+
+func (v *lostVM) CopyTo(context.Context, io.Reader, string) error   { return v.gone() }
+func (v *lostVM) CopyFrom(context.Context, string, io.Writer) error { return v.gone() }
+func (v *lostVM) Snapshot(context.Context, string) error            { return v.gone() }
+
+func (v *lostVM) Status(context.Context) (*runtimectl.VMStatus, error) {
+	return &runtimectl.VMStatus{State: runtimectl.VMStateFailed}, nil
+}
+
+func (v *lostVM) Stats(context.Context) (*runtimectl.VMStats, error) {
+	return nil, v.gone()
+}
@@ -0,0 +1,74 @@
+package isolate
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+func TestContainerStatsFromInjectedProvider(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := startDevContainer(ctx, t, m, "stats")
+
+	// The provider scripts a CPU spike on a VM whose traffic keeps growing.
+	var (
+		mu    sync.Mutex
+		calls int
+		vmIDs []string
+	)
+	provider := runtimectl.StatsProviderFunc(func(ctx context.Context, vm runtimectl.VM) (*runtimectl.VMStats, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		vmIDs = append(vmIDs, vm.ID())
+		return &runtimectl.VMStats{
+			CPUPercent:     float64(calls * 30),
+			MemoryBytes:    64 << 20,
+			NetworkRxBytes: uint64(calls) * 1000,
+			NetworkTxBytes: uint64(calls) * 10,
+			Interfaces:     []runtimectl.InterfaceStats{{Name: "eth0", RXBytes: uint64(calls) * 1000}},
+		}, nil
+	})
+	if err := runtimectl.SetStatsProvider(m.runtime, provider); err != nil {
+		t.Fatalf("SetStatsProvider: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		stats, err := c.Stats(ctx)
+		if err != nil {
+			t.Fatalf("Stats: %v", err)
+		}
+		if stats.CPUPercent != float64(i*30) || stats.MemoryBytes != 64<<20 ||
+			stats.NetworkRxBytes != uint64(i)*1000 || stats.NetworkTxBytes != uint64(i)*10 {
+			t.Errorf("sample %d = %+v, want the scripted values", i, stats)
+		}
+		if len(stats.Interfaces) != 1 || stats.Interfaces[0].RXBytes != uint64(i)*1000 {
+			t.Errorf("sample %d interfaces = %+v", i, stats.Interfaces)
+		}
+	}
+	status, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range vmIDs {
+		if id != status.ID {
+			t.Errorf("provider asked about VM %q, want %q", id, status.ID)
+		}
+	}
+
+	// A nil provider restores the default stats.
+	if err := runtimectl.SetStatsProvider(m.runtime, nil); err != nil {
+		t.Fatalf("SetStatsProvider(nil): %v", err)
+	}
+	if _, err := c.Stats(ctx); err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("provider called %d times, want 3", calls)
+	}
+}
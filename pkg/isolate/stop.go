@@ -0,0 +1,127 @@
+package isolate
+
+import (
+	"context"
+	"log"
+	"syscall"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// defaultStopGracePeriod is how long Stop waits for the guest workload to
+// shut down when Config.StopGracePeriod is unset.
+const defaultStopGracePeriod = 10 * time.Second
+
+// deleteStopTimeout bounds each attempt Delete makes to stop a running VM.
+const deleteStopTimeout = 30 * time.Second
+
+// deleteTimeout bounds the runtime's delete of a stopped VM.
+const deleteTimeout = 30 * time.Second
+
+// mainWorkload tracks the detached exec started with Command.Main.
+type mainWorkload struct {
+	jobID string
+	done  chan struct{}
+}
+
+func (c *containerImpl) trackMain(jobID string) *mainWorkload {
+	if jobID == "" {
+		return nil
+	}
+	main := &mainWorkload{jobID: jobID, done: make(chan struct{})}
+	c.mu.Lock()
+	c.main = main
+	c.mu.Unlock()
+	return main
+}
+
+func (c *containerImpl) mainExited(main *mainWorkload) {
+	if main == nil {
+		return
+	}
+	close(main.done)
+	c.mu.Lock()
+	if c.main == main {
+		c.main = nil
+	}
+	c.mu.Unlock()
+}
+
+// preStop gives the guest workload a chance to shut down cleanly before the
+// VM halts: it runs the pre-stop command, signals the main workload and
+// waits for it to exit, all within the stop grace period. Failures are
+// logged and never prevent the stop.
+func (c *containerImpl) preStop(ctx context.Context, vm runtimectl.VM) {
+	c.mu.RLock()
+	cfg, main := c.cfg, c.main
+	c.mu.RUnlock()
+	if cfg == nil || (cfg.PreStopCommand == nil && main == nil) || vm.State() != runtimectl.VMStateRunning {
+		return
+	}
+
+	grace := cfg.StopGracePeriod
+	if grace <= 0 {
+		grace = defaultStopGracePeriod
+	}
+	graceCtx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	if cfg.PreStopCommand != nil {
+		res, err := c.Exec(graceCtx, cfg.PreStopCommand)
+		switch {
+		case err != nil:
+			log.Printf("isolate: pre-stop command for %s failed: %v", cfg.Name, err)
+		case res.ExitCode != 0:
+			log.Printf("isolate: pre-stop command for %s exited with code %d", cfg.Name, res.ExitCode)
+		}
+	}
+	if main == nil {
+		return
+	}
+	select {
+	case <-main.done:
+		return
+	default:
+	}
+	signaler, ok := vm.(runtimectl.JobSignaler)
+	if !ok {
+		log.Printf("isolate: runtime cannot signal the main workload of %s", cfg.Name)
+		return
+	}
+	sig := cfg.StopSignal
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	if err := signaler.SignalJob(graceCtx, main.jobID, sig); err != nil {
+		log.Printf("isolate: signal main workload of %s: %v", cfg.Name, err)
+		return
+	}
+	select {
+	case <-main.done:
+	case <-graceCtx.Done():
+	}
+}
+
+// stopForDelete halts a running VM ahead of deleting it. A graceful stop runs
+// the pre-stop hooks first and falls back to a forced stop if it fails. The
+// forced stop ignores cancellation of ctx so a VM is never deleted while it
+// is still running.
+func (c *containerImpl) stopForDelete(ctx context.Context, vm runtimectl.VM, force bool) error {
+	if !force {
+		c.preStop(ctx, vm)
+		stopCtx, cancel := context.WithTimeout(ctx, deleteStopTimeout)
+		err := vm.Stop(stopCtx, false)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		c.mu.RLock()
+		name := c.cfg.Name
+		c.mu.RUnlock()
+		log.Printf("isolate: graceful stop of %s failed, forcing: %v", name, err)
+	}
+	stopCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), deleteStopTimeout)
+	defer cancel()
+	return vm.Stop(stopCtx, true)
+}
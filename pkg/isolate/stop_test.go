@@ -0,0 +1,189 @@
+package isolate
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	runtimectl "github.com/oarkflow/container/pkg/isolate/runtime"
+)
+
+// stopRecordingRuntime wraps the VMs of a runtime so that stopping or
+// deleting one appends a line to a file, next to what the guest commands
+// record.
+type stopRecordingRuntime struct {
+	runtimectl.Runtime
+	order string
+}
+
+func (r *stopRecordingRuntime) CreateVM(ctx context.Context, cfg *runtimectl.VMConfig) (runtimectl.VM, error) {
+	vm, err := r.Runtime.CreateVM(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &stopRecordingVM{VM: vm, order: r.order}, nil
+}
+
+type stopRecordingVM struct {
+	runtimectl.VM
+	order string
+}
+
+func (v *stopRecordingVM) Stop(ctx context.Context, force bool) error {
+	if force {
+		appendLine(v.order, "vm force stop")
+	} else {
+		appendLine(v.order, "vm stop")
+	}
+	return v.VM.Stop(ctx, force)
+}
+
+func (v *stopRecordingVM) Delete(ctx context.Context) error {
+	appendLine(v.order, "vm delete "+string(v.VM.State()))
+	return v.VM.Delete(ctx)
+}
+
+func (v *stopRecordingVM) SignalJob(ctx context.Context, jobID string, sig syscall.Signal) error {
+	return v.VM.(runtimectl.JobSignaler).SignalJob(ctx, jobID, sig)
+}
+
+func appendLine(path, line string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	f.WriteString(line + "\n")
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines []string
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines = append(lines, scanner.Text())
+	}
+	return lines
+}
+
+func TestStopRunsPreStopBeforeHaltingVM(t *testing.T) {
+	dir := t.TempDir()
+	order := filepath.Join(dir, "order")
+	m := newTestManager(t)
+	m.runtime = &stopRecordingRuntime{Runtime: m.runtime, order: order}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	c, err := m.CreateContainer(ctx, &Config{
+		Name:            "prestop",
+		DevMode:         true,
+		StopSignal:      syscall.SIGUSR1,
+		StopGracePeriod: 5 * time.Second,
+		PreStopCommand:  &Command{Path: "/bin/sh", Args: []string{"-c", "echo pre-stop >>order"}, WorkingDir: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	main, err := c.ExecStream(ctx, &Command{
+		Path:       "/bin/sh",
+		Args:       []string{"-c", "trap 'echo signal >>order; exit 0' USR1; echo ready; while :; do sleep 0.02; done"},
+		WorkingDir: dir,
+		Main:       true,
+	})
+	if err != nil {
+		t.Fatalf("ExecStream: %v", err)
+	}
+	if ready := <-main.Stdout; string(ready) != "ready\n" {
+		t.Fatalf("main workload said %q", ready)
+	}
+	go func() {
+		for range main.Stdout {
+		}
+	}()
+
+	start := time.Now()
+	if err := c.Stop(ctx, 5*time.Second); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Stop took %v although the workload exited on its signal", elapsed)
+	}
+	want := []string{"pre-stop", "signal", "vm stop"}
+	if got := readLines(t, order); !reflect.DeepEqual(got, want) {
+		t.Errorf("stop order = %q, want %q", got, want)
+	}
+	select {
+	case res := <-main.Done:
+		if res == nil || res.ExitCode != 0 {
+			t.Errorf("main workload result = %+v, want a clean exit", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("the main workload did not finish")
+	}
+}
+
+func TestDeleteContainerStopsItFirst(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		pause bool
+		force bool
+		want  []string
+	}{
+		{name: "running", want: []string{"pre-stop", "vm stop", "vm delete stopped"}},
+		// A paused guest cannot run the pre-stop command.
+		{name: "paused", pause: true, want: []string{"vm stop", "vm delete stopped"}},
+		{name: "forced", force: true, want: []string{"vm force stop", "vm delete stopped"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			order := filepath.Join(dir, "order")
+			m := newTestManager(t)
+			m.runtime = &stopRecordingRuntime{Runtime: m.runtime, order: order}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			c, err := m.CreateContainer(ctx, &Config{
+				Name:           "doomed",
+				DevMode:        true,
+				PreStopCommand: &Command{Path: "/bin/sh", Args: []string{"-c", "echo pre-stop >>order"}, WorkingDir: dir},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if tc.pause {
+				if err := c.Pause(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			del := m.DeleteContainer
+			if tc.force {
+				del = m.ForceDeleteContainer
+			}
+			if err := del(ctx, "doomed"); err != nil {
+				t.Fatalf("delete: %v", err)
+			}
+			if got := readLines(t, order); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("delete order = %q, want %q", got, tc.want)
+			}
+			if _, ok := m.GetContainer("doomed"); ok {
+				t.Error("the container is still registered")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package isolate
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamSummary consolidates the end-of-command metadata of an ExecStream:
+// exit information, timing, truncation flags and the number of bytes
+// delivered on the Stdout and Stderr channels.
+type StreamSummary struct {
+	JobID           string
+	ExitCode        int
+	StdoutBytes     int64
+	StderrBytes     int64
+	StdoutTruncated bool
+	StderrTruncated bool
+	StartedAt       time.Time
+	FinishedAt      time.Time
+	Duration        time.Duration
+	// Result is the value delivered on Done; nil if the stream ended
+	// without one.
+	Result *Result
+}
+
+// streamCounter relays a stream's output channels while counting the bytes
+// handed to the caller, optionally removing escape sequences on the way.
+type streamCounter struct {
+	wg          sync.WaitGroup
+	stdoutBytes atomic.Int64
+	stderrBytes atomic.Int64
+}
+
+func (sc *streamCounter) relay(ctx context.Context, src <-chan []byte, total *atomic.Int64, stripANSI bool) <-chan []byte {
+	out := make(chan []byte, cap(src))
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		defer close(out)
+		var stripper ansiStripper
+		for chunk := range src {
+			if stripANSI {
+				if chunk = stripper.strip(chunk); len(chunk) == 0 {
+					continue
+				}
+			}
+			select {
+			case out <- chunk:
+				total.Add(int64(len(chunk)))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// summarize waits for both relays to finish and builds the summary for res.
+func (sc *streamCounter) summarize(jobID string, res *Result) *StreamSummary {
+	sc.wg.Wait()
+	summary := &StreamSummary{
+		JobID:       jobID,
+		StdoutBytes: sc.stdoutBytes.Load(),
+		StderrBytes: sc.stderrBytes.Load(),
+		Result:      res,
+	}
+	if res != nil {
+		summary.ExitCode = res.ExitCode
+		summary.StdoutTruncated = res.StdoutTruncated
+		summary.StderrTruncated = res.StderrTruncated
+		summary.StartedAt = res.StartedAt
+		summary.FinishedAt = res.FinishedAt
+		summary.Duration = res.Duration
+	}
+	return summary
+}
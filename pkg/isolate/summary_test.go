@@ -0,0 +1,86 @@
+package isolate
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// drainStream reads both output channels of s to the end and returns how
+// many bytes each delivered.
+func drainStream(s *Stream) (stdout, stderr int64) {
+	var wg sync.WaitGroup
+	count := func(ch <-chan []byte, n *int64) {
+		defer wg.Done()
+		for chunk := range ch {
+			*n += int64(len(chunk))
+		}
+	}
+	wg.Add(2)
+	go count(s.Stdout, &stdout)
+	go count(s.Stderr, &stderr)
+	wg.Wait()
+	return stdout, stderr
+}
+
+func TestStreamSummaryTotals(t *testing.T) {
+	m := newTestManager(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c := startDevContainer(ctx, t, m, "summary")
+
+	tests := []struct {
+		name       string
+		cmd        *Command
+		wantStdout int64
+		wantStderr int64
+		wantExit   int
+	}{
+		{
+			name: "plain",
+			// 200 KiB of stdout in many writes and 3 bytes of stderr.
+			cmd:        &Command{Path: "/bin/sh", Args: []string{"-c", "head -c 204800 /dev/zero; printf err >&2; exit 4"}},
+			wantStdout: 204800,
+			wantStderr: 3,
+			wantExit:   4,
+		},
+		{
+			// The totals count what the channels delivered, after the
+			// escape sequences were removed.
+			name:       "strip ansi",
+			cmd:        &Command{Path: "/bin/sh", Args: []string{"-c", `printf '\033[31mred\033[0m\n'`}, StripANSI: true},
+			wantStdout: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream, err := c.ExecStream(ctx, tt.cmd)
+			if err != nil {
+				t.Fatalf("ExecStream: %v", err)
+			}
+			stdout, stderr := drainStream(stream)
+			result := <-stream.Done
+			summary := <-stream.Summary
+
+			if stdout != tt.wantStdout || stderr != tt.wantStderr {
+				t.Fatalf("streamed %d/%d bytes, want %d/%d", stdout, stderr, tt.wantStdout, tt.wantStderr)
+			}
+			if summary.StdoutBytes != stdout || summary.StderrBytes != stderr {
+				t.Errorf("summary bytes = %d/%d, want %d/%d", summary.StdoutBytes, summary.StderrBytes, stdout, stderr)
+			}
+			if summary.Result != result {
+				t.Errorf("summary result = %p, want the Done result %p", summary.Result, result)
+			}
+			if summary.ExitCode != tt.wantExit || result.ExitCode != tt.wantExit {
+				t.Errorf("exit code = %d (summary), %d (result), want %d", summary.ExitCode, result.ExitCode, tt.wantExit)
+			}
+			if summary.StdoutTruncated != result.StdoutTruncated || summary.StderrTruncated != result.StderrTruncated {
+				t.Errorf("summary truncation = %v/%v, result %v/%v", summary.StdoutTruncated, summary.StderrTruncated, result.StdoutTruncated, result.StderrTruncated)
+			}
+			if summary.Duration != result.Duration || !summary.StartedAt.Equal(result.StartedAt) || !summary.FinishedAt.Equal(result.FinishedAt) {
+				t.Errorf("summary timing = %v %v %v, result %v %v %v", summary.StartedAt, summary.FinishedAt, summary.Duration, result.StartedAt, result.FinishedAt, result.Duration)
+			}
+		})
+	}
+}